@@ -3,11 +3,11 @@ package apidump
 import (
 	"context"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,6 +20,7 @@ import (
 	"github.com/akitasoftware/go-utils/optionals"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+	"google.golang.org/protobuf/reflect/protoregistry"
 
 	"github.com/akitasoftware/akita-libs/akid"
 	"github.com/akitasoftware/akita-libs/akiuri"
@@ -30,10 +31,14 @@ import (
 	"github.com/akitasoftware/akita-cli/ci"
 	"github.com/akitasoftware/akita-cli/deployment"
 	"github.com/akitasoftware/akita-cli/env"
+	"github.com/akitasoftware/akita-cli/learn"
 	"github.com/akitasoftware/akita-cli/location"
+	"github.com/akitasoftware/akita-cli/metrics"
 	"github.com/akitasoftware/akita-cli/pcap"
+	"github.com/akitasoftware/akita-cli/pcap/tlsdecrypt"
 	"github.com/akitasoftware/akita-cli/plugin"
 	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/redact"
 	"github.com/akitasoftware/akita-cli/rest"
 	"github.com/akitasoftware/akita-cli/tcp_conn_tracker"
 	"github.com/akitasoftware/akita-cli/telemetry"
@@ -59,6 +64,9 @@ const (
 	// Number of top ports to show in telemetry
 	topNForSummary = 10
 
+	// Name used in place of a network interface when replaying pcap files.
+	pcapReplayInterface = "pcap-replay"
+
 	// Context timeout for telemetry upload
 	telemetryTimeout = 30 * time.Second
 )
@@ -72,6 +80,10 @@ type filterState string
 const (
 	matchedFilter    filterState = "MATCHED"
 	notMatchedFilter filterState = "UNMATCHED"
+
+	// Traffic not matching the user's filters, captured only for the outbound
+	// calls in it.
+	outboundFilter filterState = "OUTBOUND"
 )
 
 type Args struct {
@@ -100,10 +112,48 @@ type Args struct {
 	PathAllowlist  []string
 	HostAllowlist  []string
 
+	// If set, packets are read from these pcap or pcapng files, in order,
+	// instead of being captured from network interfaces. apidump terminates
+	// once all files have been read.
+	PcapFiles []string
+
+	// If set, the calls our services make to other services are captured too,
+	// and reported as outbound. This includes calls excluded by Filter.
+	CaptureOutbound bool
+
+	// If set, the path of an NSS key log file, as written by programs when
+	// SSLKEYLOGFILE is set. TLS connections whose secrets are in the file are
+	// decrypted and parsed like unencrypted traffic.
+	TLSKeyLogFile string
+
+	// If set, the path of a file to which call counts, status codes and
+	// processing latency by endpoint are written as JSON when apidump stops.
+	EndpointReportFile string
+
 	// Rate-limiting parameters -- only one should be set to a non-default value.
 	SampleRate         float64
 	WitnessesPerMinute float64
 
+	// If SamplePerEndpoint is non-zero, HTTP calls are sampled by endpoint
+	// instead: in each SampleWindow, this many calls to each endpoint are
+	// kept, along with every call that fails and SampleReservoirSize other
+	// calls chosen at random.
+	SamplePerEndpoint   int
+	SampleReservoirSize int
+	SampleWindow        time.Duration
+
+	// If set, calls with a 5xx response, a response status in
+	// AlwaysCaptureStatusCodes, or a processing latency over
+	// AlwaysCaptureLatency are captured even if sampling or rate limiting
+	// would drop them. A zero AlwaysCaptureLatency disables the latency check.
+	AlwaysCaptureErrors      bool
+	AlwaysCaptureStatusCodes []int
+	AlwaysCaptureLatency     time.Duration
+
+	// The most calls captured per minute by AlwaysCaptureErrors that sampling
+	// or rate limiting would otherwise drop.
+	AlwaysCapturePerMinute int
+
 	// If set, apidump will run the command in a subshell and terminate
 	// automatically when the subcommand terminates.
 	//
@@ -116,6 +166,14 @@ type Args struct {
 
 	Plugins []plugin.AkitaPlugin
 
+	// If set, redaction rules applied to captured traffic before it is
+	// uploaded or written to a local HAR file.
+	Redactor *redact.Redactor
+
+	// If set, descriptors used to decode gRPC messages. Messages of methods
+	// that aren't described are decoded without a schema.
+	ProtobufDescriptors *protoregistry.Files
+
 	// How often to rotate learn sessions; set to zero to disable rotation.
 	LearnSessionLifetime time.Duration
 
@@ -135,13 +193,34 @@ type Args struct {
 	// Invariant: this is true if CollectTCPAndTLSReports is true
 	ParseTLSHandshakes bool
 
+	// Parsers for protocols that are off by default.
+	ProtocolParsers pcap.ProtocolParsers
+
 	// The maximum witness size to upload. Anything larger is dropped.
 	MaxWitnessSize_bytes int
 
+	// Limits on each HAR file written to a local output directory. When any
+	// limit is reached, a new file is started. Zero disables a limit.
+	HARMaxEntries    int
+	HARMaxSize_bytes int64
+	HARMaxAge        time.Duration
+
+	// If set, batches of witnesses that fail to upload because Postman can't
+	// be reached are kept in this directory and uploaded once it can be.
+	// Zero limits on the spool disable them.
+	UploadSpoolDir           string
+	UploadSpoolMaxSize_bytes int64
+	UploadSpoolMaxAge        time.Duration
+
 	// Whether to run the command with additional functionality to support the Docker Extension
 	DockerExtensionMode bool
-	// The port to be used by the Docker Extension for health checks
+	// The port on which to serve health and readiness checks, which the Docker
+	// Extension also uses. Disabled if zero.
 	HealthCheckPort int
+
+	// If non-zero, the port on which to serve Prometheus metrics about the
+	// agent at /metrics.
+	MetricsPort int
 }
 
 // TODO: either remove write-to-local-HAR-file completely,
@@ -155,6 +234,7 @@ type apidump struct {
 
 	startTime   time.Time
 	dumpSummary *Summary
+	health      *healthState
 }
 
 // Start a new apidump session based on the given arguments.
@@ -326,6 +406,36 @@ func (args *Args) lint() {
 	}
 }
 
+// Whether packets are replayed from pcap files rather than captured live.
+func (args *Args) isReplay() bool {
+	return len(args.PcapFiles) > 0
+}
+
+func (args *Args) stratifiedSamplingOptions() trace.StratifiedSamplingOptions {
+	return trace.StratifiedSamplingOptions{
+		MinPerEndpoint: args.SamplePerEndpoint,
+		ReservoirSize:  args.SampleReservoirSize,
+		Window:         args.SampleWindow,
+	}
+}
+
+func (args *Args) errorCaptureOptions(rateLimit *trace.SharedRateLimit) trace.ErrorCaptureOptions {
+	return trace.ErrorCaptureOptions{
+		StatusCodes:      args.AlwaysCaptureStatusCodes,
+		LatencyThreshold: args.AlwaysCaptureLatency,
+		MaxPerMinute:     args.AlwaysCapturePerMinute,
+		RateLimit:        rateLimit,
+	}
+}
+
+func (args *Args) harRotationOptions() trace.HARRotationOptions {
+	return trace.HARRotationOptions{
+		MaxEntries:    args.HARMaxEntries,
+		MaxSize_bytes: args.HARMaxSize_bytes,
+		MaxAge:        args.HARMaxAge,
+	}
+}
+
 // args.Tags may be initialized via the command line, but automated settings
 // are mainly performed here (for now.)
 func collectTraceTags(args *Args) map[tags.Key]string {
@@ -365,16 +475,18 @@ func collectTraceTags(args *Args) map[tags.Key]string {
 	return traceTags
 }
 
-func compileRegexps(filters []string, name string) ([]*regexp.Regexp, error) {
-	result := make([]*regexp.Regexp, len(filters))
-	for i, f := range filters {
-		r, err := regexp.Compile(f)
+// Returns the addresses of the given network interfaces on this host.
+func getHostAddrs(interfaces map[string]interfaceInfo) (*trace.HostAddrs, error) {
+	var ips []net.IP
+	for name := range interfaces {
+		addrs, err := pcap.InterfaceAddrs(name)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to compile %s %q", name, f)
+			return nil, err
 		}
-		result[i] = r
+		ips = append(ips, addrs...)
 	}
-	return result, nil
+	printer.Debugln("Host addresses:", ips)
+	return trace.NewHostAddrs(ips), nil
 }
 
 // Periodically create a new learn session with a random name.
@@ -397,6 +509,7 @@ func (a *apidump) RotateLearnSession(done <-chan struct{}, collectors []trace.Le
 				break
 			}
 			printer.Infof("Rotating to new trace on Postman Cloud: %v\n", traceName)
+			a.health.setTrace(traceName, backendLrn)
 			for _, c := range collectors {
 				c.SwitchLearnSession(backendLrn)
 			}
@@ -457,11 +570,18 @@ type interfaceError struct {
 func Run(args Args) error {
 	errChan := make(chan error)
 
-	// The Docker extension expects a health-check server to be running. Only
-	// start this server if it's needed.
-	if args.DockerExtensionMode {
+	// Serve health and readiness checks. The Docker extension expects the
+	// server to be running, so failing to start it is fatal there. Otherwise,
+	// capture continues without it.
+	health := newHealthState()
+	if args.HealthCheckPort > 0 {
 		go func() {
-			errChan <- startHealthCheckServer(args.HealthCheckPort)
+			err := startHealthCheckServer(args.HealthCheckPort, health)
+			if args.DockerExtensionMode {
+				errChan <- err
+			} else {
+				printer.Stderr.Warningf("Failed to serve health checks on port %d: %v\n", args.HealthCheckPort, err)
+			}
 		}()
 	}
 
@@ -470,6 +590,7 @@ func Run(args Args) error {
 		args.lint()
 
 		a := newSession(&args)
+		a.health = health
 		errChan <- a.Run()
 	}()
 
@@ -495,11 +616,19 @@ func (a *apidump) Run() error {
 		printer.Debugln("Capturing filtered traffic for debugging.")
 	}
 
-	// Get the interfaces to listen on.
-	interfaces, err := getEligibleInterfaces(args.Interfaces)
-	if err != nil {
-		a.SendErrorTelemetry(GetErrorTypeWithDefault(err, api_schema.ApidumpError_PCAPInterfaceOther), err)
-		return errors.Wrap(err, "No network interfaces could be used")
+	// Get the interfaces to listen on. When replaying pcap files, there is a
+	// single pseudo-interface standing in for the files.
+	var interfaces map[string]interfaceInfo
+	if args.isReplay() {
+		interfaces = map[string]interfaceInfo{
+			pcapReplayInterface: interfaceWrapper{},
+		}
+	} else {
+		interfaces, err = getEligibleInterfaces(args.Interfaces)
+		if err != nil {
+			a.SendErrorTelemetry(GetErrorTypeWithDefault(err, api_schema.ApidumpError_PCAPInterfaceOther), err)
+			return errors.Wrap(err, "No network interfaces could be used")
+		}
 	}
 
 	// Build the user-specified filter and its negation for each interface.
@@ -515,25 +644,49 @@ func (a *apidump) Run() error {
 		printer.Debugln("Negation BPF filters:", negationFilters)
 	}
 
-	traceTags := collectTraceTags(args)
-
-	// Build path filters.
-	pathExclusions, err := compileRegexps(args.PathExclusions, "path exclusion")
-	if err != nil {
-		a.SendErrorTelemetry(api_schema.ApidumpError_InvalidFilters, err)
-		return err
-	}
-	hostExclusions, err := compileRegexps(args.HostExclusions, "host exclusion")
-	if err != nil {
-		a.SendErrorTelemetry(api_schema.ApidumpError_InvalidFilters, err)
-		return err
+	// When capturing outbound calls, the addresses of this host tell them apart
+	// from the calls our services serve. Traffic excluded by the user's filters
+	// is captured too, so that outbound calls are seen even when the filters
+	// select only our services' ports.
+	var hostAddrs *trace.HostAddrs
+	var outboundFilters map[string]string
+	var dependencies *trace.DependencyCounter
+	if args.CaptureOutbound {
+		if args.isReplay() {
+			printer.Stderr.Warningf("Outbound calls can't be identified when replaying pcap files; all calls will be reported as inbound.\n")
+		} else {
+			hostAddrs, err = getHostAddrs(interfaces)
+			if err != nil {
+				a.SendErrorTelemetry(api_schema.ApidumpError_PCAPInterfaceOther, err)
+				return errors.Wrap(err, "failed to get addresses of network interfaces")
+			}
+			_, outboundFilters, err = createBPFFilters(interfaces, args.Filter, true, 0)
+			if err != nil {
+				a.SendErrorTelemetry(api_schema.ApidumpError_InvalidFilters, err)
+				return err
+			}
+			printer.Debugln("Outbound BPF filters:", outboundFilters)
+		}
+		dependencies = trace.NewDependencyCounter()
 	}
-	pathAllowlist, err := compileRegexps(args.PathAllowlist, "path filter")
-	if err != nil {
-		a.SendErrorTelemetry(api_schema.ApidumpError_InvalidFilters, err)
-		return err
+
+	var tlsKeys *tlsdecrypt.KeyLog
+	if args.TLSKeyLogFile != "" {
+		tlsKeys, err = tlsdecrypt.LoadKeyLog(args.TLSKeyLogFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load TLS key log file %q", args.TLSKeyLogFile)
+		}
 	}
-	hostAllowlist, err := compileRegexps(args.HostAllowlist, "host filter")
+
+	traceTags := collectTraceTags(args)
+
+	// Build path and host filters.
+	requestFilter, err := trace.NewHTTPRequestFilter(trace.HTTPRequestFilterOptions{
+		HostExclusions: args.HostExclusions,
+		PathExclusions: args.PathExclusions,
+		HostAllowlist:  args.HostAllowlist,
+		PathAllowlist:  args.PathAllowlist,
+	})
 	if err != nil {
 		a.SendErrorTelemetry(api_schema.ApidumpError_InvalidFilters, err)
 		return err
@@ -595,14 +748,24 @@ func (a *apidump) Run() error {
 				return errors.Wrap(err, "failed to create trace or fetch existing trace")
 			}
 		}
+		a.health.setTrace(uri.ObjectName, backendLrn)
 	}
 
 	// Initialize packet counts
 	filterSummary := trace.NewPacketCounter()
 	negationSummary := trace.NewPacketCounter()
 
-	numUserFilters := len(pathExclusions) + len(hostExclusions) + len(pathAllowlist) + len(hostAllowlist)
+	numUserFilters := len(args.PathExclusions) + len(args.HostExclusions) + len(args.PathAllowlist) + len(args.HostAllowlist)
 	prefilterSummary := trace.NewPacketCounter()
+	kafkaTopics := trace.NewKafkaTopicCounter()
+	databaseCounts := trace.NewDatabaseCounter()
+	databaseStatements := trace.NewDatabaseStatementCounter()
+	redisCommands := trace.NewRedisCommandCounter()
+	endpoints := trace.NewEndpointCounter()
+
+	// Hostnames learned from DNS, shared by all interfaces and filters, since
+	// the DNS lookup may be captured apart from the traffic that follows it.
+	hostnames := trace.NewHostnameCache()
 
 	// Initialized shared rate object, if we are configured with a rate limit
 	var rateLimit *trace.SharedRateLimit
@@ -611,6 +774,20 @@ func (a *apidump) Run() error {
 		defer rateLimit.Stop()
 	}
 
+	// Spool for batches that fail to upload, shared by all back-end
+	// collectors.
+	var uploadSpool *trace.UploadSpool
+	if args.Out.AkitaURI != nil && args.UploadSpoolDir != "" {
+		uploadSpool, err = trace.NewUploadSpool(args.UploadSpoolDir, trace.UploadSpoolOptions{
+			MaxSize_bytes: args.UploadSpoolMaxSize_bytes,
+			MaxAge:        args.UploadSpoolMaxAge,
+			RateLimit:     rateLimit,
+		}, a.learnClient)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Backend collectors that need trace rotation
 	var toRotate []trace.LearnSessionCollector
 
@@ -622,12 +799,36 @@ func (a *apidump) Run() error {
 		filterSummary,
 		prefilterSummary,
 		negationSummary,
+		kafkaTopics,
+		databaseCounts,
+		databaseStatements,
+		redisCommands,
+		dependencies,
+		endpoints,
 	)
 
+	// Serve metrics about the agent. Failing to serve them doesn't stop the
+	// capture.
+	agentMetrics := &agentMetrics{
+		interfaces:   interfaces,
+		packetCounts: filterSummary,
+		rateLimit:    rateLimit,
+		uploadSpool:  uploadSpool,
+	}
+	a.health.setMetrics(agentMetrics)
+	if args.MetricsPort > 0 {
+		go func() {
+			if err := metrics.Serve(args.MetricsPort, agentMetrics.gather); err != nil {
+				printer.Stderr.Errorf("Failed to serve metrics on port %d: %v\n", args.MetricsPort, err)
+			}
+		}()
+	}
+
 	// Synchronization for collectors + collector errors, each of which is run in a separate goroutine.
 	var doneWG sync.WaitGroup
-	doneWG.Add(len(userFilters) + len(negationFilters))
-	errChan := make(chan interfaceError, len(userFilters)+len(negationFilters)) // buffered enough so it never blocks
+	numFilters := len(userFilters) + len(negationFilters) + len(outboundFilters)
+	doneWG.Add(numFilters)
+	errChan := make(chan interfaceError, numFilters) // buffered enough so it never blocks
 	stop := make(chan struct{})
 
 	// If we're sending traffic to the cloud, then start telemetry and stop
@@ -646,31 +847,45 @@ func (a *apidump) Run() error {
 		}
 
 		go a.TelemetryWorker(stop)
+	} else if args.MetricsPort > 0 {
+		// Resource usage is also reported as metrics.
+		go usage.Poll(stop, 0, time.Duration(a.ProcFSPollingInterval)*time.Second)
 	}
 
-	// Start collecting -- set up one or two collectors per interface, depending on whether filters are in use
+	// Start collecting -- set up one to three collectors per interface, depending on whether filters are in use
 	numCollectors := 0
-	for _, filterState := range []filterState{matchedFilter, notMatchedFilter} {
+	for _, filterState := range []filterState{matchedFilter, notMatchedFilter, outboundFilter} {
 		var summary *trace.PacketCounter
 		var filters map[string]string
-		if filterState == matchedFilter {
+		switch filterState {
+		case matchedFilter:
 			filters = userFilters
 			summary = filterSummary
-		} else {
+		case notMatchedFilter:
 			filters = negationFilters
 			summary = negationSummary
+		case outboundFilter:
+			// Outbound calls are uploaded along with the traffic matching the
+			// user's filters, so they are counted together.
+			filters = outboundFilters
+			summary = filterSummary
 		}
 
 		for interfaceName, filter := range filters {
 			var collector trace.Collector
 
 			// Build collectors from the inside out (last applied to first applied).
-			//  8. Back-end collector (sink).
-			//  7. Statistics.
-			//  6. Subsampling.
-			//  5. Path and host filters.
-			//  4. Eliminate Akita CLI traffic.
-			//  3. Count packets before user filters for diagnostics.
+			// 11. Back-end collector (sink).
+			// 10. Statistics.
+			//  9. Subsampling.
+			//  8. Endpoint call counts and latency.
+			//  7. Path and host filters.
+			//  6. Record outbound calls to other services.
+			//  5. Eliminate Akita CLI traffic.
+			//  4. Count packets before user filters for diagnostics.
+			//  3. Count Kafka records by client and topic, time database statements
+			//     and Redis commands, name hosts from DNS responses, and keep only
+			//     outbound calls in traffic captured for them.
 			//  2. Process TLS traffic into TLS-connection metadata.
 			//  1. Aggregate TCP-packet metadata into TCP-connection metadata.
 
@@ -684,7 +899,13 @@ func (a *apidump) Run() error {
 			} else {
 				var localCollector trace.Collector
 				if args.Out.LocalPath != nil {
-					if lc, err := createLocalCollector(interfaceName, *args.Out.LocalPath, traceTags); err == nil {
+					// Outbound calls captured apart from the user's filters go to their
+					// own HAR files, so as not to clobber those of the interface.
+					harName := interfaceName
+					if filterState == outboundFilter {
+						harName += "_outbound"
+					}
+					if lc, err := createLocalCollector(harName, *args.Out.LocalPath, traceTags, args.harRotationOptions(), args.Redactor); err == nil {
 						localCollector = lc
 					} else {
 						return err
@@ -693,13 +914,13 @@ func (a *apidump) Run() error {
 
 				var backendCollector trace.Collector
 				if args.Out.AkitaURI != nil && args.Out.LocalPath != nil {
-					backendCollector = trace.NewBackendCollector(a.backendSvc, backendLrn, a.learnClient, optionals.Some(a.MaxWitnessSize_bytes), summary, args.Plugins)
+					backendCollector = trace.NewBackendCollector(a.backendSvc, backendLrn, a.learnClient, optionals.Some(a.MaxWitnessSize_bytes), summary, args.Plugins, args.Redactor, hostAddrs, uploadSpool, rateLimit, learn.NewGRPCDecoder(args.ProtobufDescriptors))
 					collector = trace.TeeCollector{
 						Dst1: backendCollector,
 						Dst2: localCollector,
 					}
 				} else if args.Out.AkitaURI != nil {
-					backendCollector = trace.NewBackendCollector(a.backendSvc, backendLrn, a.learnClient, optionals.Some(a.MaxWitnessSize_bytes), summary, args.Plugins)
+					backendCollector = trace.NewBackendCollector(a.backendSvc, backendLrn, a.learnClient, optionals.Some(a.MaxWitnessSize_bytes), summary, args.Plugins, args.Redactor, hostAddrs, uploadSpool, rateLimit, learn.NewGRPCDecoder(args.ProtobufDescriptors))
 					collector = backendCollector
 				} else if args.Out.LocalPath != nil {
 					collector = localCollector
@@ -707,6 +928,8 @@ func (a *apidump) Run() error {
 					return errors.Errorf("invalid output location")
 				}
 
+				agentMetrics.addCollector(backendCollector)
+
 				// If the backend collector supports rotation of learn session ID, then set that up.
 				if lsc, ok := backendCollector.(trace.LearnSessionCollector); ok && lsc != nil {
 					toRotate = append(toRotate, lsc)
@@ -718,29 +941,59 @@ func (a *apidump) Run() error {
 			// Count packets that have *passed* filtering (so that we know whether the
 			// trace is empty or not.)  In the future we could add columns for both
 			// pre- and post-filtering.
-			collector = &trace.PacketCountCollector{
+			packetCountCollector := &trace.PacketCountCollector{
 				PacketCounts: summary,
 				Collector:    collector,
 			}
+			if filterState == matchedFilter {
+				packetCountCollector.DatabaseCounts = databaseCounts
+			}
+			collector = packetCountCollector
 
 			// Subsampling.
-			collector = trace.NewSamplingCollector(args.SampleRate, collector)
-			if rateLimit != nil {
-				collector = rateLimit.NewCollector(collector)
+			sample := func(collector trace.Collector) trace.Collector {
+				if args.SamplePerEndpoint > 0 {
+					collector = trace.NewStratifiedSamplingCollector(args.stratifiedSamplingOptions(), collector)
+				} else {
+					collector = trace.NewSamplingCollector(args.SampleRate, collector)
+				}
+				if rateLimit != nil {
+					collector = rateLimit.NewCollector(collector)
+				}
+				return collector
 			}
-
-			// Path and host filters.
-			if len(hostExclusions) > 0 {
-				collector = trace.NewHTTPHostFilterCollector(hostExclusions, collector)
+			if args.AlwaysCaptureErrors {
+				// Failed calls are captured even if the sample drops them.
+				collector = trace.NewErrorCaptureCollector(args.errorCaptureOptions(rateLimit), collector, sample)
+			} else {
+				collector = sample(collector)
 			}
-			if len(pathExclusions) > 0 {
-				collector = trace.NewHTTPPathFilterCollector(pathExclusions, collector)
+
+			// Endpoint statistics. Like the packet counts, these cover only traffic
+			// that passed the user's filters, but they are taken before
+			// subsampling so that latency percentiles cover every call.
+			if filterState == matchedFilter {
+				collector = &trace.EndpointCollector{
+					Addrs:     hostAddrs,
+					Counter:   endpoints,
+					Collector: collector,
+				}
 			}
-			if len(hostAllowlist) > 0 {
-				collector = trace.NewHTTPHostAllowlistCollector(hostAllowlist, collector)
+
+			// Path and host filters.
+			if requestFilter != nil {
+				collector = requestFilter.NewCollector(collector)
 			}
-			if len(pathAllowlist) > 0 {
-				collector = trace.NewHTTPPathAllowlistCollector(pathAllowlist, collector)
+
+			// Record outbound calls. This happens before subsampling and the path and
+			// host filters, so the inventory covers all calls, but after the agent's
+			// own calls to Postman are eliminated.
+			if dependencies != nil && filterState != notMatchedFilter {
+				collector = &trace.DependencyCollector{
+					Addrs:     hostAddrs,
+					Counter:   dependencies,
+					Collector: collector,
+				}
 			}
 
 			// Eliminate Akita CLI traffic, unless --dogfood has been specified
@@ -758,6 +1011,52 @@ func (a *apidump) Run() error {
 				}
 			}
 
+			// Count Kafka records by client and topic. This happens before sampling,
+			// so the counts cover all traffic.
+			if filterState == matchedFilter {
+				collector = &trace.KafkaTopicCollector{
+					Counter:   kafkaTopics,
+					Collector: collector,
+				}
+			}
+
+			// Time database statements, pairing each query with its result. Like
+			// the Kafka counts, this covers all traffic, not just the sample.
+			if filterState == matchedFilter {
+				collector = &trace.DatabaseStatementCollector{
+					Counter:   databaseStatements,
+					Collector: collector,
+				}
+			}
+
+			// Time Redis commands and count cache misses, pairing each command
+			// with its reply. This also covers all traffic.
+			if filterState == matchedFilter {
+				collector = &trace.RedisCommandCollector{
+					Counter:   redisCommands,
+					Collector: collector,
+				}
+			}
+
+			// Of the traffic captured only for outbound calls, keep just those
+			// calls. DNS responses are still seen first, so the servers called are
+			// named.
+			if filterState == outboundFilter {
+				collector = &trace.OutboundFilterCollector{
+					Addrs:     hostAddrs,
+					Collector: collector,
+				}
+			}
+
+			// Name the servers of TLS handshakes without SNI, and of HTTP requests
+			// addressed by IP, from the DNS responses that resolved them. This
+			// happens for both filter states, so that hosts are named in the counts
+			// of unmatched traffic too.
+			collector = &trace.DNSCollector{
+				Cache:     hostnames,
+				Collector: collector,
+			}
+
 			// If this is false, we will still parse TLS client and server hello messages
 			// but not process them futher.
 			if args.CollectTCPAndTLSReports {
@@ -770,17 +1069,34 @@ func (a *apidump) Run() error {
 
 			// Compute the share of the page cache that each collection process may use.
 			// (gopacket does not currently permit a unified page cache for packet reassembly.)
-			bufferShare := 1.0 / float32(len(negationFilters)+len(userFilters))
+			bufferShare := 1.0 / float32(numFilters)
+
+			// Note when packets are captured, for health checks.
+			packetCounts := healthPacketCounts{
+				PacketCountConsumer: summary,
+				health:              a.health,
+			}
 
 			numCollectors++
+			a.health.setInterfaceStatus(interfaceName, interfaceCapturing, nil)
 			go func(interfaceName, filter string) {
 				defer doneWG.Done()
 				// Collect trace. This blocks until stop is closed or an error occurs.
-				if err := pcap.Collect(stop, interfaceName, filter, bufferShare, args.ParseTLSHandshakes, collector, summary, pool); err != nil {
+				// Replays also stop once all the files have been read.
+				var err error
+				if args.isReplay() {
+					err = pcap.CollectFromFiles(stop, args.PcapFiles, interfaceName, filter, bufferShare, args.ParseTLSHandshakes, args.ProtocolParsers, tlsKeys, collector, packetCounts, pool)
+				} else {
+					err = pcap.Collect(stop, interfaceName, filter, bufferShare, args.ParseTLSHandshakes, args.ProtocolParsers, tlsKeys, collector, packetCounts, pool)
+				}
+				if err != nil {
+					a.health.setInterfaceStatus(interfaceName, interfaceFailed, err)
 					errChan <- interfaceError{
 						interfaceName: interfaceName,
 						err:           errors.Wrapf(err, "failed to collect trace on interface %s", interfaceName),
 					}
+				} else {
+					a.health.setInterfaceStatus(interfaceName, interfaceStopped, nil)
 				}
 			}(interfaceName, filter)
 		}
@@ -791,7 +1107,9 @@ func (a *apidump) Run() error {
 		go a.RotateLearnSession(stop, toRotate, traceTags)
 	}
 
-	{
+	if args.isReplay() {
+		printer.Stderr.Infof("Replaying packets from %s\n", strings.Join(args.PcapFiles, ", "))
+	} else {
 		iNames := make([]string, 0, len(interfaces))
 		for n := range interfaces {
 			iNames = append(iNames, n)
@@ -862,6 +1180,27 @@ func (a *apidump) Run() error {
 				printer.Stderr.Infof("Subcommand finished successfully, stopping trace collection...\n")
 			}
 		}
+	} else if args.isReplay() {
+		printer.Stderr.Infof("Send SIGINT (Ctrl-C) to stop early...\n")
+
+		// The collectors exit on their own once they reach the end of the pcap
+		// files.
+		replayDone := make(chan struct{})
+		go func() {
+			doneWG.Wait()
+			close(replayDone)
+		}()
+
+		sig := make(chan os.Signal, 2)
+		signal.Notify(sig, os.Interrupt)
+		signal.Notify(sig, syscall.SIGTERM)
+
+		select {
+		case received := <-sig:
+			printer.Stderr.Infof("Received %v, stopping replay...\n", received.String())
+		case <-replayDone:
+			printer.Stderr.Infof("Finished reading pcap files, stopping trace collection...\n")
+		}
 	} else {
 		// Don't sleep pcapStartWaitTime in interactive mode since the user can send
 		// SIGINT while we're sleeping too and sleeping introduces visible lag.
@@ -898,7 +1237,11 @@ func (a *apidump) Run() error {
 		}
 	}
 
-	time.Sleep(pcapStopWaitTime)
+	// Packets from pcap files are all available immediately, so there is no
+	// need to wait for stragglers.
+	if !args.isReplay() {
+		time.Sleep(pcapStopWaitTime)
+	}
 
 	// Signal all processors to stop.
 	close(stop)
@@ -907,6 +1250,29 @@ func (a *apidump) Run() error {
 	doneWG.Wait()
 	printer.Stderr.Infof("Trace collection stopped\n")
 
+	// The collectors have flushed their last batches. Any that are still
+	// spooled are left for the next run.
+	if uploadSpool != nil {
+		uploadSpool.Close()
+		if stats := uploadSpool.Stats(); stats.Batches > 0 {
+			printer.Stderr.Warningf("%d batches of witnesses couldn't be uploaded to Postman and remain in %s, to be uploaded by the next run\n", stats.Batches, args.UploadSpoolDir)
+		}
+	}
+
+	// Replay errors are not consumed while waiting above.
+	if args.isReplay() {
+	DoneDrainingReplayErrors:
+		for {
+			select {
+			case interfaceErr := <-errChan:
+				telemetry.Error("packet capture", interfaceErr.err)
+				errorsByInterface[interfaceErr.interfaceName] = interfaceErr.err
+			default:
+				break DoneDrainingReplayErrors
+			}
+		}
+	}
+
 	// Print errors per interface.
 	reportedFilterError := false
 	if len(errorsByInterface) > 0 {
@@ -936,7 +1302,23 @@ func (a *apidump) Run() error {
 		return errors.Wrap(subcmdErr, "trace collection failed")
 	}
 
-	// Print warnings
+	// Print Kafka topic usage, database statements, Redis commands, outbound
+	// calls, endpoint statistics, and warnings
+	a.dumpSummary.PrintKafkaTopics()
+	a.dumpSummary.PrintDatabaseStatements()
+	a.dumpSummary.PrintRedisCommands()
+	a.dumpSummary.PrintDependencies()
+	a.dumpSummary.PrintEndpoints()
+	if args.EndpointReportFile != "" {
+		if err := a.dumpSummary.WriteEndpointReport(args.EndpointReportFile); err != nil {
+			printer.Stderr.Errorf("%v\n", err)
+		} else {
+			printer.Stderr.Infof("Wrote endpoint statistics to %s\n", args.EndpointReportFile)
+		}
+	}
+	if a.TargetIsRemote() {
+		a.dumpSummary.ReportRedisCommands()
+	}
 	a.dumpSummary.PrintWarnings()
 
 	if a.dumpSummary.IsEmpty() {
@@ -948,7 +1330,7 @@ func (a *apidump) Run() error {
 	return nil
 }
 
-func createLocalCollector(interfaceName, outDir string, tags map[tags.Key]string) (trace.Collector, error) {
+func createLocalCollector(interfaceName, outDir string, tags map[tags.Key]string, rotation trace.HARRotationOptions, redactor *redact.Redactor) (trace.Collector, error) {
 	if fi, err := os.Stat(outDir); err == nil {
 		// File exists, check if it's a directory.
 		if !fi.IsDir() {
@@ -969,5 +1351,5 @@ func createLocalCollector(interfaceName, outDir string, tags map[tags.Key]string
 		}
 	}
 
-	return trace.NewHARCollector(interfaceName, outDir, tags), nil
+	return trace.NewHARCollector(interfaceName, outDir, tags, rotation, redactor), nil
 }
@@ -1,22 +1,237 @@
 package apidump
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/gorilla/mux"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/client_telemetry"
+	"github.com/gorilla/mux"
+
+	"github.com/akitasoftware/akita-cli/trace"
+)
+
+const (
+	healthOK       = "ok"
+	healthStarting = "starting"
+	healthStopped  = "stopped"
+	healthFailed   = "failed"
+
+	interfaceCapturing = "capturing"
+	interfaceStopped   = "stopped"
+	interfaceFailed    = "failed"
 )
 
-// Handles health check requests for the Docker Extension.
-// Returns 200 OK by default.
-func handleHealthCheck(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(`{"status": "ok"}`))
+type interfaceHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// The state of the agent, as reported by the health server.
+type healthState struct {
+	// When the last packet was captured, in nanoseconds since the epoch, or
+	// zero if none has been. Updated atomically, and first to keep it 64-bit
+	// aligned on 32-bit platforms.
+	lastPacket int64
+
+	startTime time.Time
+
+	mutex sync.Mutex
+
+	// Capture status by interface name. Empty until capture starts.
+	interfaces map[string]*interfaceHealth
+
+	// The trace that witnesses are uploaded to, if any.
+	traceName      string
+	learnSessionID akid.LearnSessionID
+
+	// Source of upload statistics. Nil until capture starts.
+	metrics *agentMetrics
+}
+
+func newHealthState() *healthState {
+	return &healthState{
+		startTime:  time.Now(),
+		interfaces: make(map[string]*interfaceHealth),
+	}
+}
+
+func (h *healthState) packetSeen() {
+	atomic.StoreInt64(&h.lastPacket, time.Now().UnixNano())
+}
+
+// Records the status of capture on an interface. Once capture has failed on
+// an interface, the failure is kept, since there may be several captures on
+// the same interface, e.g. one for traffic matching the user's filters and
+// one for the rest.
+func (h *healthState) setInterfaceStatus(name, status string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if current, ok := h.interfaces[name]; ok && current.Status == interfaceFailed {
+		return
+	}
+	ih := &interfaceHealth{Status: status}
+	if err != nil {
+		ih.Error = err.Error()
+	}
+	h.interfaces[name] = ih
+}
+
+func (h *healthState) setTrace(name string, lrn akid.LearnSessionID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.traceName = name
+	h.learnSessionID = lrn
+}
+
+func (h *healthState) setMetrics(m *agentMetrics) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.metrics = m
+}
+
+// Passes packet counts on, noting when packets are captured.
+type healthPacketCounts struct {
+	trace.PacketCountConsumer
+	health *healthState
+}
+
+func (c healthPacketCounts) Update(delta client_telemetry.PacketCounts) {
+	if delta.TCPPackets > 0 {
+		c.health.packetSeen()
+	}
+	c.PacketCountConsumer.Update(delta)
+}
+
+type backendHealth struct {
+	// Whether the last upload succeeded, or, before any upload finishes,
+	// whether the trace could be created.
+	Reachable bool `json:"reachable"`
+
+	LastSuccessfulUpload             *time.Time `json:"last_successful_upload,omitempty"`
+	SecondsSinceLastSuccessfulUpload *float64   `json:"seconds_since_last_successful_upload,omitempty"`
+	LastFailedUpload                 *time.Time `json:"last_failed_upload,omitempty"`
+	Uploads                          uint64     `json:"uploads"`
+	FailedUploads                    uint64     `json:"failed_uploads"`
+	ThrottledUploads                 uint64     `json:"throttled_uploads"`
+}
+
+type healthReport struct {
+	Status                 string                      `json:"status"`
+	UptimeSeconds          float64                     `json:"uptime_seconds"`
+	Interfaces             map[string]*interfaceHealth `json:"interfaces"`
+	SecondsSinceLastPacket *float64                    `json:"seconds_since_last_packet,omitempty"`
+	TraceName              string                      `json:"trace_name,omitempty"`
+	LearnSessionID         string                      `json:"learn_session_id,omitempty"`
+
+	// Omitted unless witnesses are uploaded to the back end.
+	Backend *backendHealth `json:"backend,omitempty"`
+}
+
+func (h *healthState) report() healthReport {
+	now := time.Now()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	r := healthReport{
+		Status:        healthOK,
+		UptimeSeconds: now.Sub(h.startTime).Seconds(),
+		Interfaces:    make(map[string]*interfaceHealth, len(h.interfaces)),
+		TraceName:     h.traceName,
+	}
+	if h.learnSessionID != (akid.LearnSessionID{}) {
+		r.LearnSessionID = akid.String(h.learnSessionID)
+	}
+
+	// Capture has failed if it failed on any interface, and has stopped once it
+	// stops on every interface, e.g. at the end of a replay.
+	names := make([]string, 0, len(h.interfaces))
+	for name := range h.interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stopped := 0
+	for _, name := range names {
+		ih := *h.interfaces[name]
+		r.Interfaces[name] = &ih
+		switch ih.Status {
+		case interfaceFailed:
+			r.Status = healthFailed
+		case interfaceStopped:
+			stopped++
+		}
+	}
+	if r.Status != healthFailed {
+		if len(names) == 0 {
+			r.Status = healthStarting
+		} else if stopped == len(names) {
+			r.Status = healthStopped
+		}
+	}
+
+	if n := atomic.LoadInt64(&h.lastPacket); n != 0 {
+		since := now.Sub(time.Unix(0, n)).Seconds()
+		r.SecondsSinceLastPacket = &since
+	}
+
+	if h.metrics != nil {
+		if stats, ok := h.metrics.uploadStats(); ok {
+			b := &backendHealth{
+				Reachable:        !stats.LastFailedUpload.After(stats.LastUpload),
+				Uploads:          stats.Uploads,
+				FailedUploads:    stats.FailedUploads,
+				ThrottledUploads: stats.ThrottledUploads,
+			}
+			if !stats.LastUpload.IsZero() {
+				since := now.Sub(stats.LastUpload).Seconds()
+				b.LastSuccessfulUpload = &stats.LastUpload
+				b.SecondsSinceLastSuccessfulUpload = &since
+			}
+			if !stats.LastFailedUpload.IsZero() {
+				b.LastFailedUpload = &stats.LastFailedUpload
+			}
+			r.Backend = b
+		}
+	}
+	return r
+}
+
+func writeHealthReport(w http.ResponseWriter, r healthReport, healthy bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+// Handles liveness checks. Returns 503 once capture has failed.
+func (h *healthState) handleHealthCheck(w http.ResponseWriter, _ *http.Request) {
+	r := h.report()
+	writeHealthReport(w, r, r.Status != healthFailed)
+}
+
+// Handles readiness checks. Returns 200 only while packets are being captured
+// on every interface. The back end being unreachable doesn't make the agent
+// unready, since witnesses are still captured, and an unready sidecar would
+// take its pod out of service.
+func (h *healthState) handleReadinessCheck(w http.ResponseWriter, _ *http.Request) {
+	r := h.report()
+	writeHealthReport(w, r, r.Status == healthOK)
 }
 
-func startHealthCheckServer(port int) error {
+func startHealthCheckServer(port int, health *healthState) error {
 	router := mux.NewRouter()
 
-	router.HandleFunc("/health", handleHealthCheck).Methods("GET")
+	router.HandleFunc("/health", health.handleHealthCheck).Methods("GET")
+	router.HandleFunc("/ready", health.handleReadinessCheck).Methods("GET")
 
 	return http.ListenAndServe(fmt.Sprintf(":%d", port), router)
 }
@@ -0,0 +1,228 @@
+package apidump
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/akitasoftware/akita-libs/client_telemetry"
+
+	"github.com/akitasoftware/akita-cli/metrics"
+	"github.com/akitasoftware/akita-cli/pcap"
+	"github.com/akitasoftware/akita-cli/trace"
+	"github.com/akitasoftware/akita-cli/usage"
+)
+
+const (
+	metricsPrefix = "postman_insights_agent_"
+
+	// The number of ports, by traffic volume, for which packet counts are
+	// reported. Each port is a separate time series.
+	topNPortsForMetrics = 50
+)
+
+// Gathers the agent's internal counters and gauges for the metrics endpoint.
+type agentMetrics struct {
+	interfaces map[string]interfaceInfo
+
+	// Counts of traffic matching the user's filters.
+	packetCounts *trace.PacketCounter
+
+	// Nil if witnesses aren't rate-limited.
+	rateLimit *trace.SharedRateLimit
+
+	// Nil if failed uploads aren't spooled.
+	uploadSpool *trace.UploadSpool
+
+	mutex             sync.Mutex
+	backendCollectors []*trace.BackendCollector
+}
+
+// Includes the upload statistics of c, if it uploads to the back end.
+func (m *agentMetrics) addCollector(c trace.Collector) {
+	bc, ok := c.(*trace.BackendCollector)
+	if !ok {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.backendCollectors = append(m.backendCollectors, bc)
+}
+
+// The packet counts that are reported, by metric name.
+var packetCountMetrics = []struct {
+	name  string
+	help  string
+	value func(client_telemetry.PacketCounts) int
+}{
+	{"tcp_packets_total", "TCP packets captured.", func(c client_telemetry.PacketCounts) int { return c.TCPPackets }},
+	{"http_requests_total", "HTTP requests parsed.", func(c client_telemetry.PacketCounts) int { return c.HTTPRequests }},
+	{"http_responses_total", "HTTP responses parsed.", func(c client_telemetry.PacketCounts) int { return c.HTTPResponses }},
+	{"tls_hellos_total", "TLS hello messages seen.", func(c client_telemetry.PacketCounts) int { return c.TLSHello }},
+	{"unparsed_packets_total", "TCP segments that couldn't be parsed.", func(c client_telemetry.PacketCounts) int { return c.Unparsed }},
+	{"oversized_witnesses_total", "Witnesses dropped for being too large to upload.", func(c client_telemetry.PacketCounts) int { return c.OversizedWitnesses }},
+}
+
+func (m *agentMetrics) gather(w *metrics.Writer) {
+	m.gatherPacketCounts(w)
+	m.gatherUploads(w)
+	m.gatherUploadSpool(w)
+	m.gatherRateLimit(w)
+
+	w.Write(metricsPrefix+"assembler_context_nil_total", metrics.Counter,
+		"TCP segments reassembled without packet metadata.",
+		metrics.NewSample(float64(atomic.LoadUint64(&pcap.CountNilAssemblerContext))))
+	w.Write(metricsPrefix+"assembler_context_bad_type_total", metrics.Counter,
+		"TCP segments reassembled with packet metadata of the wrong type.",
+		metrics.NewSample(float64(atomic.LoadUint64(&pcap.CountBadAssemblerContextType))))
+	w.Write(metricsPrefix+"assembler_context_nil_after_parse_total", metrics.Counter,
+		"Parsed TCP segments whose packet metadata was missing.",
+		metrics.NewSample(float64(atomic.LoadUint64(&pcap.CountNilAssemblerContextAfterParse))))
+
+	if u := usage.Get(); u != nil {
+		w.Write(metricsPrefix+"cpu_cores_used", metrics.Gauge,
+			"CPU cores used by the agent, averaged over the last polling window.",
+			metrics.NewSample(u.Recent.CoresUsed))
+		w.Write(metricsPrefix+"cpu_relative", metrics.Gauge,
+			"Share of the host's CPU time used by the agent, averaged over the last polling window.",
+			metrics.NewSample(u.Recent.RelativeCPU))
+		w.Write(metricsPrefix+"memory_high_water_bytes", metrics.Gauge,
+			"Peak resident memory of the agent over the last polling window.",
+			metrics.NewSample(float64(u.Recent.VmHWM)*1024))
+	}
+}
+
+func (m *agentMetrics) gatherPacketCounts(w *metrics.Writer) {
+	interfaceNames := make([]string, 0, len(m.interfaces))
+	for name := range m.interfaces {
+		interfaceNames = append(interfaceNames, name)
+	}
+	sort.Strings(interfaceNames)
+	byInterface := make([]client_telemetry.PacketCounts, 0, len(interfaceNames))
+	for _, name := range interfaceNames {
+		byInterface = append(byInterface, m.packetCounts.TotalOnInterface(name))
+	}
+
+	top := m.packetCounts.Summary(topNPortsForMetrics)
+	ports := make([]int, 0, len(top.TopByPort))
+	for port := range top.TopByPort {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	for _, pm := range packetCountMetrics {
+		samples := make([]metrics.Sample, 0, len(byInterface))
+		for i, counts := range byInterface {
+			samples = append(samples, metrics.NewSample(float64(pm.value(counts)),
+				metrics.Label{Name: "interface", Value: interfaceNames[i]}))
+		}
+		w.Write(metricsPrefix+pm.name, metrics.Counter, pm.help, samples...)
+	}
+
+	// Ports have only the counts of captured traffic; the rest are per witness.
+	for _, pm := range packetCountMetrics[:3] {
+		samples := make([]metrics.Sample, 0, len(ports))
+		for _, port := range ports {
+			samples = append(samples, metrics.NewSample(float64(pm.value(*top.TopByPort[port])),
+				metrics.Label{Name: "port", Value: strconv.Itoa(port)}))
+		}
+		w.Write(metricsPrefix+"port_"+pm.name, metrics.Counter,
+			pm.help+" Only the busiest ports are included.", samples...)
+	}
+}
+
+// Returns the upload statistics summed over all back-end collectors, and
+// false if there are none.
+func (m *agentMetrics) uploadStats() (trace.BackendCollectorStats, bool) {
+	m.mutex.Lock()
+	collectors := m.backendCollectors
+	m.mutex.Unlock()
+
+	var total trace.BackendCollectorStats
+	for _, c := range collectors {
+		s := c.Stats()
+		total.PendingWitnesses += s.PendingWitnesses
+		total.Uploads += s.Uploads
+		total.FailedUploads += s.FailedUploads
+		total.ThrottledUploads += s.ThrottledUploads
+		total.UploadedBytes += s.UploadedBytes
+		if s.LastUpload.After(total.LastUpload) {
+			total.LastUpload = s.LastUpload
+		}
+		if s.LastFailedUpload.After(total.LastFailedUpload) {
+			total.LastFailedUpload = s.LastFailedUpload
+		}
+	}
+	return total, len(collectors) > 0
+}
+
+func (m *agentMetrics) gatherUploads(w *metrics.Writer) {
+	total, ok := m.uploadStats()
+	if !ok {
+		return
+	}
+
+	w.Write(metricsPrefix+"pending_witnesses", metrics.Gauge,
+		"Partial witnesses waiting for their request or response.",
+		metrics.NewSample(float64(total.PendingWitnesses)))
+	w.Write(metricsPrefix+"uploads_total", metrics.Counter,
+		"Batches of witnesses whose upload was attempted.",
+		metrics.NewSample(float64(total.Uploads)))
+	w.Write(metricsPrefix+"upload_failures_total", metrics.Counter,
+		"Batches of witnesses that failed to upload.",
+		metrics.NewSample(float64(total.FailedUploads)))
+	w.Write(metricsPrefix+"upload_throttled_total", metrics.Counter,
+		"Batches of witnesses whose upload was throttled by the back end.",
+		metrics.NewSample(float64(total.ThrottledUploads)))
+	w.Write(metricsPrefix+"upload_bytes_total", metrics.Counter,
+		"Total size of the batches of witnesses whose upload was attempted.",
+		metrics.NewSample(float64(total.UploadedBytes)))
+}
+
+func (m *agentMetrics) gatherUploadSpool(w *metrics.Writer) {
+	if m.uploadSpool == nil {
+		return
+	}
+	s := m.uploadSpool.Stats()
+
+	w.Write(metricsPrefix+"upload_spool_batches", metrics.Gauge,
+		"Batches of witnesses on disk, waiting to be uploaded once Postman can be reached.",
+		metrics.NewSample(float64(s.Batches)))
+	w.Write(metricsPrefix+"upload_spool_bytes", metrics.Gauge,
+		"Total size of the batches of witnesses on disk.",
+		metrics.NewSample(float64(s.Bytes)))
+	w.Write(metricsPrefix+"upload_spool_replayed_total", metrics.Counter,
+		"Spooled batches of witnesses that were uploaded.",
+		metrics.NewSample(float64(s.Replayed)))
+	w.Write(metricsPrefix+"upload_spool_dropped_total", metrics.Counter,
+		"Spooled batches of witnesses dropped for exceeding the spool's limits or being rejected by Postman.",
+		metrics.NewSample(float64(s.Dropped)))
+}
+
+func (m *agentMetrics) gatherRateLimit(w *metrics.Writer) {
+	if m.rateLimit == nil {
+		return
+	}
+	s := m.rateLimit.Stats()
+
+	sampling := 0.0
+	if s.SampleIntervalActive {
+		sampling = 1
+	}
+	w.Write(metricsPrefix+"rate_limit_configured_witnesses_per_minute", metrics.Gauge,
+		"The configured limit on witnesses captured per minute.",
+		metrics.NewSample(s.ConfiguredWitnessesPerMinute))
+	w.Write(metricsPrefix+"rate_limit_witnesses_per_minute", metrics.Gauge,
+		"The effective limit on witnesses captured per minute, which is lower than the configured limit while uploads are throttled.",
+		metrics.NewSample(s.WitnessesPerMinute))
+	w.Write(metricsPrefix+"rate_limit_estimated_sample_interval_seconds", metrics.Gauge,
+		"Estimated time to capture each epoch's quota of witnesses, or 0 before the first estimate.",
+		metrics.NewSample(s.EstimatedSampleInterval.Seconds()))
+	w.Write(metricsPrefix+"rate_limit_sampling", metrics.Gauge,
+		"Whether witnesses are being captured (1) or the epoch's quota has been reached (0).",
+		metrics.NewSample(sampling))
+	w.Write(metricsPrefix+"rate_limit_interval_witnesses", metrics.Gauge,
+		"Witnesses captured in the current sample interval.",
+		metrics.NewSample(float64(s.SampleIntervalCount)))
+}
@@ -1,16 +1,22 @@
 package apidump
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/akitasoftware/akita-libs/client_telemetry"
 	"github.com/akitasoftware/go-utils/math"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 
 	"github.com/akitasoftware/akita-cli/env"
 	"github.com/akitasoftware/akita-cli/pcap"
 	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/telemetry"
 	"github.com/akitasoftware/akita-cli/trace"
 )
 
@@ -28,6 +34,27 @@ type Summary struct {
 	FilterSummary    *trace.PacketCounter
 	PrefilterSummary *trace.PacketCounter
 	NegationSummary  *trace.PacketCounter
+
+	// Kafka records by client and topic, for traffic matching the user's
+	// filters.
+	KafkaTopics *trace.KafkaTopicCounter
+
+	// Database queries by server port, and statement latency and errors, for
+	// traffic matching the user's filters.
+	DatabaseCounts     *trace.DatabaseCounter
+	DatabaseStatements *trace.DatabaseStatementCounter
+
+	// Redis commands and their replies, for traffic matching the user's
+	// filters.
+	RedisCommands *trace.RedisCommandCounter
+
+	// Endpoints of other services that our services call. Nil unless outbound
+	// calls are captured.
+	Dependencies *trace.DependencyCounter
+
+	// Calls to our services' endpoints, with status codes and processing
+	// latency, for traffic matching the user's filters.
+	Endpoints *trace.EndpointCounter
 }
 
 func NewSummary(
@@ -38,15 +65,27 @@ func NewSummary(
 	filterSummary *trace.PacketCounter,
 	prefilterSummary *trace.PacketCounter,
 	negationSummary *trace.PacketCounter,
+	kafkaTopics *trace.KafkaTopicCounter,
+	databaseCounts *trace.DatabaseCounter,
+	databaseStatements *trace.DatabaseStatementCounter,
+	redisCommands *trace.RedisCommandCounter,
+	dependencies *trace.DependencyCounter,
+	endpoints *trace.EndpointCounter,
 ) *Summary {
 	return &Summary{
-		CapturingNegation: capturingNegation,
-		Interfaces:        interfaces,
-		NegationFilters:   negationFilters,
-		NumUserFilters:    numUserFilters,
-		FilterSummary:     filterSummary,
-		PrefilterSummary:  prefilterSummary,
-		NegationSummary:   negationSummary,
+		CapturingNegation:  capturingNegation,
+		Interfaces:         interfaces,
+		NegationFilters:    negationFilters,
+		NumUserFilters:     numUserFilters,
+		FilterSummary:      filterSummary,
+		PrefilterSummary:   prefilterSummary,
+		NegationSummary:    negationSummary,
+		KafkaTopics:        kafkaTopics,
+		DatabaseCounts:     databaseCounts,
+		DatabaseStatements: databaseStatements,
+		RedisCommands:      redisCommands,
+		Dependencies:       dependencies,
+		Endpoints:          endpoints,
 	}
 }
 
@@ -95,6 +134,265 @@ func (s *Summary) PrintPacketCountHighlights() {
 
 	printer.Stderr.Infof("Top hosts by traffic volume:\n")
 	s.printHostHighlights(top)
+
+	s.PrintKafkaTopics()
+	s.PrintDatabaseStatements()
+	s.PrintRedisCommands()
+	s.PrintDependencies()
+	s.PrintEndpoints()
+}
+
+// Lists the Kafka topics that clients produced to and consumed from, if any
+// Kafka traffic was seen.
+func (s *Summary) PrintKafkaTopics() {
+	summaryLimit := 20
+	edges := s.KafkaTopics.Top(summaryLimit)
+	if len(edges) == 0 {
+		return
+	}
+
+	printer.Stderr.Infof("Top Kafka topics by record volume:\n")
+	for _, e := range edges {
+		client := e.ClientIP
+		if e.ClientID != "" {
+			client = fmt.Sprintf("%s (%s)", e.ClientID, e.ClientIP)
+		}
+		verb := "produced to"
+		if e.Role == trace.KafkaConsumer {
+			verb = "consumed from"
+		}
+		printer.Stderr.Infof("%s %s topic %q: %d records, %d bytes in %d messages.\n",
+			client, verb, e.Topic, e.Records, e.RecordBytes, e.Messages)
+	}
+}
+
+// Lists the database statements that took the most time in total, if any
+// database traffic was seen, so that slow endpoints can be traced to the
+// statements they issue.
+func (s *Summary) PrintDatabaseStatements() {
+	summaryLimit := 20
+	total := s.DatabaseCounts.Total()
+	if total.Queries == 0 && total.Results == 0 {
+		return
+	}
+
+	printer.Stderr.Infof("Database traffic:\n")
+	for _, c := range s.DatabaseCounts.AllPorts() {
+		printer.Stderr.Infof("%s on port %d: %d queries, %d results, %d errors.\n",
+			c.Protocol, c.Port, c.Queries, c.Results, c.Errors)
+	}
+
+	statements := s.DatabaseStatements.Top(summaryLimit)
+	if len(statements) == 0 {
+		return
+	}
+	printer.Stderr.Infof("Top database statements by total time:\n")
+	for _, st := range statements {
+		text := st.Text
+		if text == "" {
+			text = "(unknown prepared statement)"
+		}
+		errorSummary := ""
+		if st.Errors > 0 {
+			errorSummary = fmt.Sprintf(", %d errors (%s)", st.Errors, formatCounts(st.ErrorCodes))
+		}
+		printer.Stderr.Infof("%s %s:%d: %q: %d executions, %v total, %v mean, %v max%s.\n",
+			st.Protocol, st.ServerIP, st.ServerPort, text, st.Count,
+			st.TotalLatency, st.MeanLatency(), st.MaxLatency, errorSummary)
+	}
+}
+
+// Lists the Redis commands that took the most time in total, with their miss
+// and error rates, if any Redis traffic was seen.
+func (s *Summary) PrintRedisCommands() {
+	summaryLimit := 20
+	commands := s.RedisCommands.Top(summaryLimit)
+	if len(commands) == 0 {
+		return
+	}
+
+	printer.Stderr.Infof("Top Redis commands by total time:\n")
+	for _, c := range commands {
+		details := ""
+		if c.Misses > 0 {
+			details += fmt.Sprintf(", %d misses (%.1f%% hit rate)", c.Misses, 100*c.HitRate())
+		}
+		if c.Errors > 0 {
+			details += fmt.Sprintf(", %d errors (%s)", c.Errors, formatCounts(c.ErrorPrefixes))
+		}
+		if len(c.KeyHashes) > 0 {
+			details += fmt.Sprintf(", %d keys (hottest used %d times) like %s",
+				len(c.KeyHashes), c.HottestKeyCount(), formatTopCounts(c.KeyPatterns, 3))
+		}
+		printer.Stderr.Infof("%s:%d %s: %d commands, %v total, %v mean, %v max%s.\n",
+			c.ServerIP, c.ServerPort, c.Name, c.Count,
+			c.TotalLatency, c.MeanLatency(), c.MaxLatency, details)
+	}
+}
+
+// Lists the endpoints of other services that our services called, if outbound
+// calls are captured and any were seen.
+func (s *Summary) PrintDependencies() {
+	if s.Dependencies == nil {
+		return
+	}
+	dependencies := s.Dependencies.All()
+	if len(dependencies) == 0 {
+		return
+	}
+
+	printer.Stderr.Infof("Outbound calls to other services:\n")
+	for _, d := range dependencies {
+		errorSummary := ""
+		if d.Errors > 0 {
+			errorSummary = fmt.Sprintf(", %d errors", d.Errors)
+		}
+		printer.Stderr.Infof("%s %s%s: %d calls%s.\n", d.Method, d.Host, d.Path, d.Calls, errorSummary)
+	}
+}
+
+// Lists the most called endpoints of our services, with their error rates and
+// processing latency, if any calls were seen.
+func (s *Summary) PrintEndpoints() {
+	summaryLimit := 20
+	endpoints := s.Endpoints.All()
+	if len(endpoints) == 0 {
+		return
+	}
+	if len(endpoints) > summaryLimit {
+		endpoints = endpoints[:summaryLimit]
+	}
+
+	printer.Stderr.Infof("Top endpoints by calls:\n")
+	for _, e := range endpoints {
+		statusCodes := make(map[string]int, len(e.StatusCodes))
+		for code, count := range e.StatusCodes {
+			statusCodes[fmt.Sprint(code)] = count
+		}
+		operation := ""
+		if e.Operation != "" {
+			operation = " (" + e.Operation + ")"
+		}
+		printer.Stderr.Infof("%s %s%s%s: %d calls, %.1f%% errors (%s), %v p50, %v p90, %v p99, %v max.\n",
+			e.Method, e.Host, e.Path, operation, e.Count, 100*e.ErrorRate(), formatCounts(statusCodes),
+			e.LatencyP50, e.LatencyP90, e.LatencyP99, e.MaxLatency)
+	}
+}
+
+type endpointReport struct {
+	Method      string      `json:"method"`
+	Host        string      `json:"host"`
+	Path        string      `json:"path"`
+	Operation   string      `json:"operation,omitempty"`
+	Count       int         `json:"count"`
+	StatusCodes map[int]int `json:"status_codes"`
+	Errors      int         `json:"errors"`
+	ErrorRate   float64     `json:"error_rate"`
+	LatencyP50  float64     `json:"latency_p50_ms"`
+	LatencyP90  float64     `json:"latency_p90_ms"`
+	LatencyP99  float64     `json:"latency_p99_ms"`
+	MaxLatency  float64     `json:"latency_max_ms"`
+}
+
+// Writes the statistics of every endpoint called to path as JSON, so that
+// they can be compared across runs.
+func (s *Summary) WriteEndpointReport(path string) error {
+	endpoints := s.Endpoints.All()
+	reports := make([]endpointReport, 0, len(endpoints))
+	for _, e := range endpoints {
+		reports = append(reports, endpointReport{
+			Method:      e.Method,
+			Host:        e.Host,
+			Path:        e.Path,
+			Operation:   e.Operation,
+			Count:       e.Count,
+			StatusCodes: e.StatusCodes,
+			Errors:      e.Errors,
+			ErrorRate:   e.ErrorRate(),
+			LatencyP50:  toMilliseconds(e.LatencyP50),
+			LatencyP90:  toMilliseconds(e.LatencyP90),
+			LatencyP99:  toMilliseconds(e.LatencyP99),
+			MaxLatency:  toMilliseconds(e.MaxLatency),
+		})
+	}
+
+	b, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal endpoint report")
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write endpoint report to %s", path)
+	}
+	return nil
+}
+
+func toMilliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
+
+// Sends the Redis command statistics as telemetry, so that cache behaviour can
+// be seen alongside the captured API traffic.
+func (s *Summary) ReportRedisCommands() {
+	summaryLimit := 20
+	commands := s.RedisCommands.Top(summaryLimit)
+	if len(commands) == 0 {
+		return
+	}
+
+	entries := make([]map[string]any, 0, len(commands))
+	for _, c := range commands {
+		replyTypes := make(map[string]int, len(c.ReplyTypes))
+		for t, count := range c.ReplyTypes {
+			replyTypes[string(t)] = count
+		}
+		entries = append(entries, map[string]any{
+			"server_port":       c.ServerPort,
+			"command":           c.Name,
+			"count":             c.Count,
+			"errors":            c.Errors,
+			"error_prefixes":    c.ErrorPrefixes,
+			"misses":            c.Misses,
+			"reply_types":       replyTypes,
+			"total_latency_ms":  c.TotalLatency.Milliseconds(),
+			"max_latency_ms":    c.MaxLatency.Milliseconds(),
+			"key_patterns":      c.KeyPatterns,
+			"distinct_keys":     len(c.KeyHashes),
+			"hottest_key_count": c.HottestKeyCount(),
+		})
+	}
+	telemetry.ServiceCommands("redis", entries)
+}
+
+// Formats counts as "key xN", ordered by key.
+func formatCounts(counts map[string]int) string {
+	parts := make([]string, 0, len(counts))
+	for k, count := range counts {
+		parts = append(parts, fmt.Sprintf("%s x%d", k, count))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// Formats up to n of the largest counts as "key xN", largest first.
+func formatTopCounts(counts map[string]int, n int) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%q x%d", k, counts[k]))
+	}
+	return strings.Join(parts, ", ")
 }
 
 func (s *Summary) printPortHighlights(top *client_telemetry.PacketCountSummary) {
@@ -136,7 +434,7 @@ func (s *Summary) printPortHighlights(top *client_telemetry.PacketCountSummary)
 				printer.Stderr.Infof("TCP Port %5d: has an unusually high amount of traffic that Postman cannot parse.\n", p)
 			}
 			if thisPort.HTTP2Prefaces > 0 {
-				printer.Stderr.Infof("TCP Port %5d: Contains HTTP/2 traffic (%d connections detected), which Postman cannot parse.\n", p, thisPort.HTTP2Prefaces)
+				printer.Stderr.Infof("TCP Port %5d: Contains HTTP/2 traffic (%d connections detected).\n", p, thisPort.HTTP2Prefaces)
 			}
 			continue
 		}
@@ -158,7 +456,7 @@ func (s *Summary) printPortHighlights(top *client_telemetry.PacketCountSummary)
 
 		// If we saw HTTP/2, report it.
 		if thisPort.HTTP2Prefaces > 0 {
-			printer.Stderr.Infof("TCP port %5d: %5d packets (%d%% of total), no HTTP/1.1 requests or responses, %d HTTP/2 connection attempts. Postman cannot currently parse HTTP/2.\n",
+			printer.Stderr.Infof("TCP port %5d: %5d packets (%d%% of total), no HTTP requests or responses, %d HTTP/2 connection attempts. Only cleartext HTTP/2 connections observed from their start can be parsed.\n",
 				p, thisPort.TCPPackets, pct, thisPort.HTTP2Prefaces)
 			continue
 		}
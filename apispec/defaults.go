@@ -16,6 +16,10 @@ const (
 	// The name of the deployment.
 	DefaultDeployment = "default"
 
+	// The port on which the Docker extension expects health checks to be
+	// served.
+	DefaultDockerExtensionHealthCheckPort = 50343
+
 	// The maximum witness size. Any witnesses larger than this are dropped.
 	DefaultMaxWitnessSize_bytes = 30_000_000 // 30 MB
 
@@ -27,6 +31,15 @@ const (
 	// How many requests to capture per minute.
 	DefaultRateLimit = 1000.0
 
+	// When sampling by endpoint, the number of other calls kept in each
+	// window, and the length of the window.
+	DefaultSampleReservoirSize = 100
+	DefaultSampleWindow        = time.Minute
+
+	// With --always-capture-errors, the most calls captured per minute that
+	// sampling or the rate limit would otherwise drop.
+	DefaultAlwaysCaptureMaxPerMinute = 100
+
 	// How long to wait after starting up before printing packet-capture statistics.
 	DefaultStatsLogDelay_seconds = 60
 
@@ -38,4 +51,24 @@ const (
 
 	// How often to rotate traces in the back end.
 	DefaultTraceRotateInterval = time.Hour
+
+	// When writing HAR files locally, the maximum number of entries in each
+	// file. Zero means no limit.
+	DefaultHARMaxEntries = 0
+
+	// When writing HAR files locally, the approximate maximum size of each
+	// file. Zero means no limit.
+	DefaultHARMaxSize_bytes = 100_000_000 // 100 MB
+
+	// When writing HAR files locally, how long to write to a file before
+	// starting a new one. Zero means no limit.
+	DefaultHARMaxAge = time.Duration(0)
+
+	// The maximum total size of the batches of witnesses kept on disk while
+	// Postman can't be reached. Zero means no limit.
+	DefaultUploadSpoolMaxSize_bytes = 500_000_000 // 500 MB
+
+	// How long to keep batches of witnesses on disk while Postman can't be
+	// reached. Zero means no limit.
+	DefaultUploadSpoolMaxAge = 24 * time.Hour
 )
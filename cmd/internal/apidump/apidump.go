@@ -5,6 +5,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/reflect/protoregistry"
 
 	"github.com/akitasoftware/akita-libs/akid"
 
@@ -12,8 +13,11 @@ import (
 	"github.com/akitasoftware/akita-cli/apispec"
 	"github.com/akitasoftware/akita-cli/cmd/internal/cmderr"
 	"github.com/akitasoftware/akita-cli/cmd/internal/pluginloader"
+	"github.com/akitasoftware/akita-cli/learn"
 	"github.com/akitasoftware/akita-cli/location"
+	"github.com/akitasoftware/akita-cli/pcap"
 	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/redact"
 	"github.com/akitasoftware/akita-cli/rest"
 	"github.com/akitasoftware/akita-cli/telemetry"
 	"github.com/akitasoftware/akita-cli/util"
@@ -25,9 +29,20 @@ var (
 	projectID               string
 	postmanCollectionID     string
 	interfacesFlag          []string
+	pcapFilesFlag           []string
+	captureOutboundFlag     bool
+	tlsKeyLogFileFlag       string
+	endpointReportFlag      string
 	filterFlag              string
 	sampleRateFlag          float64
 	rateLimitFlag           float64
+	samplePerEndpoint       int
+	sampleReservoirSize     int
+	sampleWindow            time.Duration
+	alwaysCaptureErrors     bool
+	alwaysCaptureStatus     []int
+	alwaysCaptureLatency    time.Duration
+	alwaysCaptureMax        int
 	tagsFlag                []string
 	appendByTagFlag         bool
 	pathExclusionsFlag      []string
@@ -37,15 +52,26 @@ var (
 	execCommandFlag         string
 	execCommandUserFlag     string
 	pluginsFlag             []string
+	redactionConfigFlag     string
+	protoDescriptorsFlag    []string
 	traceRotateFlag         string
 	statsLogDelay           int
 	telemetryInterval       int
 	procFSPollingInterval   int
 	collectTCPAndTLSReports bool
 	parseTLSHandshakes      bool
+	parseKafkaFlag          bool
+	parseSQLFlag            bool
 	maxWitnessSize_bytes    int
+	harMaxEntries           int
+	harMaxSize_bytes        int64
+	harMaxAge               time.Duration
+	uploadSpoolDir          string
+	uploadSpoolMaxSize      int64
+	uploadSpoolMaxAge       time.Duration
 	dockerExtensionMode     bool
 	healthCheckPort         int
+	metricsPort             int
 )
 
 var Cmd = &cobra.Command{
@@ -65,6 +91,22 @@ var Cmd = &cobra.Command{
 			return errors.Wrap(err, "failed to load plugins")
 		}
 
+		var redactor *redact.Redactor
+		if redactionConfigFlag != "" {
+			redactor, err = redact.LoadFile(redactionConfigFlag)
+			if err != nil {
+				return err
+			}
+		}
+
+		var protobufDescriptors *protoregistry.Files
+		if len(protoDescriptorsFlag) > 0 {
+			protobufDescriptors, err = learn.LoadProtobufDescriptors(protoDescriptorsFlag)
+			if err != nil {
+				return errors.Wrap(err, "failed to load protobuf descriptors")
+			}
+		}
+
 		// Check that exactly one of --project or --collection is specified.
 		if projectID == "" && postmanCollectionID == "" {
 			return errors.New("exactly one of --project or --collection must be specified")
@@ -124,6 +166,26 @@ var Cmd = &cobra.Command{
 			rateLimitFlag = 1000.0
 		}
 
+		// Sampling by endpoint replaces the other ways of limiting witnesses.
+		if samplePerEndpoint > 0 {
+			if cmd.Flags().Changed("rate-limit") || cmd.Flags().Changed("sample-rate") {
+				return errors.New("--sample-per-endpoint cannot be used with --rate-limit or --sample-rate")
+			}
+			if sampleWindow <= 0 {
+				return errors.New("--sample-window must be positive")
+			}
+			rateLimitFlag = 0
+		}
+
+		for _, code := range alwaysCaptureStatus {
+			if code < 400 || code > 499 {
+				return errors.Errorf("--always-capture-status takes 4xx status codes, got %d", code)
+			}
+		}
+		if alwaysCaptureMax <= 0 {
+			return errors.New("--always-capture-max-per-minute must be positive")
+		}
+
 		// If we collect TLS information, we have to parse it
 		if collectTCPAndTLSReports {
 			if !parseTLSHandshakes {
@@ -132,33 +194,61 @@ var Cmd = &cobra.Command{
 			}
 		}
 
+		// The Docker extension expects health checks on a fixed port. Elsewhere,
+		// the health server is only started when asked for, since it listens on
+		// all interfaces, and several agents may run on one host.
+		if dockerExtensionMode && !cmd.Flags().Changed("health-check-port") {
+			healthCheckPort = apispec.DefaultDockerExtensionHealthCheckPort
+		}
+
 		args := apidump.Args{
-			ClientID:                telemetry.GetClientID(),
-			Domain:                  rest.Domain,
-			Out:                     outFlag,
-			PostmanCollectionID:     postmanCollectionID,
-			ServiceID:               serviceID,
-			Tags:                    traceTags,
-			SampleRate:              sampleRateFlag,
-			WitnessesPerMinute:      rateLimitFlag,
-			Interfaces:              interfacesFlag,
-			Filter:                  filterFlag,
-			PathExclusions:          pathExclusionsFlag,
-			HostExclusions:          hostExclusionsFlag,
-			PathAllowlist:           pathAllowlistFlag,
-			HostAllowlist:           hostAllowlistFlag,
-			ExecCommand:             execCommandFlag,
-			ExecCommandUser:         execCommandUserFlag,
-			Plugins:                 plugins,
-			LearnSessionLifetime:    traceRotateInterval,
-			StatsLogDelay:           statsLogDelay,
-			TelemetryInterval:       telemetryInterval,
-			ProcFSPollingInterval:   procFSPollingInterval,
-			CollectTCPAndTLSReports: collectTCPAndTLSReports,
-			ParseTLSHandshakes:      parseTLSHandshakes,
-			MaxWitnessSize_bytes:    maxWitnessSize_bytes,
-			DockerExtensionMode:     dockerExtensionMode,
-			HealthCheckPort:         healthCheckPort,
+			ClientID:                 telemetry.GetClientID(),
+			Domain:                   rest.Domain,
+			Out:                      outFlag,
+			PostmanCollectionID:      postmanCollectionID,
+			ServiceID:                serviceID,
+			Tags:                     traceTags,
+			SampleRate:               sampleRateFlag,
+			WitnessesPerMinute:       rateLimitFlag,
+			SamplePerEndpoint:        samplePerEndpoint,
+			SampleReservoirSize:      sampleReservoirSize,
+			SampleWindow:             sampleWindow,
+			AlwaysCaptureErrors:      alwaysCaptureErrors,
+			AlwaysCaptureStatusCodes: alwaysCaptureStatus,
+			AlwaysCaptureLatency:     alwaysCaptureLatency,
+			AlwaysCapturePerMinute:   alwaysCaptureMax,
+			Interfaces:               interfacesFlag,
+			PcapFiles:                pcapFilesFlag,
+			CaptureOutbound:          captureOutboundFlag,
+			TLSKeyLogFile:            tlsKeyLogFileFlag,
+			EndpointReportFile:       endpointReportFlag,
+			Filter:                   filterFlag,
+			PathExclusions:           pathExclusionsFlag,
+			HostExclusions:           hostExclusionsFlag,
+			PathAllowlist:            pathAllowlistFlag,
+			HostAllowlist:            hostAllowlistFlag,
+			ExecCommand:              execCommandFlag,
+			ExecCommandUser:          execCommandUserFlag,
+			Plugins:                  plugins,
+			Redactor:                 redactor,
+			ProtobufDescriptors:      protobufDescriptors,
+			LearnSessionLifetime:     traceRotateInterval,
+			StatsLogDelay:            statsLogDelay,
+			TelemetryInterval:        telemetryInterval,
+			ProcFSPollingInterval:    procFSPollingInterval,
+			CollectTCPAndTLSReports:  collectTCPAndTLSReports,
+			ParseTLSHandshakes:       parseTLSHandshakes,
+			ProtocolParsers:          pcap.ProtocolParsers{Kafka: parseKafkaFlag, SQL: parseSQLFlag},
+			MaxWitnessSize_bytes:     maxWitnessSize_bytes,
+			HARMaxEntries:            harMaxEntries,
+			HARMaxSize_bytes:         harMaxSize_bytes,
+			HARMaxAge:                harMaxAge,
+			UploadSpoolDir:           uploadSpoolDir,
+			UploadSpoolMaxSize_bytes: uploadSpoolMaxSize,
+			UploadSpoolMaxAge:        uploadSpoolMaxAge,
+			DockerExtensionMode:      dockerExtensionMode,
+			HealthCheckPort:          healthCheckPort,
+			MetricsPort:              metricsPort,
 		}
 		if err := apidump.Run(args); err != nil {
 			return cmderr.AkitaErr{Err: err}
@@ -195,6 +285,30 @@ func init() {
 		nil,
 		"List of network interfaces to listen on. Defaults to all interfaces on host.")
 
+	Cmd.Flags().StringSliceVar(
+		&pcapFilesFlag,
+		"pcap-files",
+		nil,
+		"List of pcap or pcapng files to read packets from, in order, instead of listening on network interfaces.")
+
+	Cmd.Flags().BoolVar(
+		&captureOutboundFlag,
+		"capture-outbound",
+		false,
+		"Also capture the calls your services make to other services, including calls excluded by --filter, and report them as outbound.")
+
+	Cmd.Flags().StringVar(
+		&tlsKeyLogFileFlag,
+		"tls-keylog-file",
+		"",
+		"NSS key log file, as written by programs when SSLKEYLOGFILE is set, used to decrypt captured TLS traffic. Only connections whose handshake is captured can be decrypted.")
+
+	Cmd.Flags().StringVar(
+		&endpointReportFlag,
+		"endpoint-report",
+		"",
+		"File to write per-endpoint call counts, status codes, error rates and p50/p90/p99 latency to, as JSON, when capture stops.")
+
 	Cmd.Flags().Float64Var(
 		&sampleRateFlag,
 		"sample-rate",
@@ -207,7 +321,56 @@ func init() {
 		&rateLimitFlag,
 		"rate-limit",
 		apispec.DefaultRateLimit,
-		"Number of requests per minute to capture.",
+		"Number of requests per minute to capture. Fewer are captured while Postman throttles uploads.",
+	)
+
+	Cmd.Flags().IntVar(
+		&samplePerEndpoint,
+		"sample-per-endpoint",
+		0,
+		"Sample requests by endpoint instead of using --rate-limit: keep this many requests to each endpoint in each --sample-window, plus every request with a 4xx or 5xx response and --sample-reservoir-size others chosen at random. Disabled if 0.",
+	)
+
+	Cmd.Flags().IntVar(
+		&sampleReservoirSize,
+		"sample-reservoir-size",
+		apispec.DefaultSampleReservoirSize,
+		"When sampling by endpoint, the number of requests beyond each endpoint's quota to keep in each --sample-window.",
+	)
+
+	Cmd.Flags().DurationVar(
+		&sampleWindow,
+		"sample-window",
+		apispec.DefaultSampleWindow,
+		"When sampling by endpoint, the length of each sampling window (e.g., 1m).",
+	)
+
+	Cmd.Flags().BoolVar(
+		&alwaysCaptureErrors,
+		"always-capture-errors",
+		false,
+		"Capture every request with a 5xx response, even if sampling or --rate-limit would drop it. See also --always-capture-status, --always-capture-latency, and --always-capture-max-per-minute.",
+	)
+
+	Cmd.Flags().IntSliceVar(
+		&alwaysCaptureStatus,
+		"always-capture-status",
+		nil,
+		"With --always-capture-errors, also capture every request with one of these 4xx response statuses (e.g., 401,429).",
+	)
+
+	Cmd.Flags().DurationVar(
+		&alwaysCaptureLatency,
+		"always-capture-latency",
+		0,
+		"With --always-capture-errors, also capture every request whose processing latency exceeds this (e.g., 2s). Disabled if 0.",
+	)
+
+	Cmd.Flags().IntVar(
+		&alwaysCaptureMax,
+		"always-capture-max-per-minute",
+		apispec.DefaultAlwaysCaptureMaxPerMinute,
+		"With --always-capture-errors, the most requests to capture per minute that sampling or --rate-limit would drop. Must be positive. Fewer are captured while Postman throttles uploads.",
 	)
 
 	Cmd.Flags().StringSliceVar(
@@ -228,28 +391,28 @@ func init() {
 		&pathExclusionsFlag,
 		"path-exclusions",
 		nil,
-		"Removes HTTP paths matching regular expressions.",
+		"Removes HTTP paths matching regular expressions. Prefix a rule with \"glob:\" or \"prefix:\" to match a glob (e.g., glob:/static/**) or a literal prefix instead.",
 	)
 
 	Cmd.Flags().StringSliceVar(
 		&hostExclusionsFlag,
 		"host-exclusions",
 		nil,
-		"Removes HTTP hosts matching regular expressions.",
+		"Removes HTTP hosts matching regular expressions. Prefix a rule with \"glob:\" or \"prefix:\" to match a glob (e.g., glob:*.example.com) or a literal prefix instead.",
 	)
 
 	Cmd.Flags().StringSliceVar(
 		&pathAllowlistFlag,
 		"path-allow",
 		nil,
-		"Allows only HTTP paths matching regular expressions.",
+		"Allows only HTTP paths matching regular expressions. Prefix a rule with \"glob:\" or \"prefix:\" to match a glob (e.g., glob:/static/**) or a literal prefix instead.",
 	)
 
 	Cmd.Flags().StringSliceVar(
 		&hostAllowlistFlag,
 		"host-allow",
 		nil,
-		"Allows only HTTP hosts matching regular expressions.",
+		"Allows only HTTP hosts matching regular expressions. Prefix a rule with \"glob:\" or \"prefix:\" to match a glob (e.g., glob:*.example.com) or a literal prefix instead.",
 	)
 
 	Cmd.Flags().StringVarP(
@@ -276,6 +439,20 @@ func init() {
 	)
 	Cmd.Flags().MarkHidden("plugins")
 
+	Cmd.Flags().StringVar(
+		&redactionConfigFlag,
+		"redaction-config",
+		"",
+		"Path to a YAML file of rules for redacting headers, query parameters, cookies, body fields and values before they are uploaded or written locally.",
+	)
+
+	Cmd.Flags().StringSliceVar(
+		&protoDescriptorsFlag,
+		"proto-descriptors",
+		nil,
+		"FileDescriptorSet files, or directories of them, used to decode gRPC messages. Compile .proto files with protoc --include_imports --descriptor_set_out.",
+	)
+
 	Cmd.Flags().StringVar(
 		&traceRotateFlag,
 		"trace-rotate",
@@ -323,6 +500,20 @@ func init() {
 	)
 	Cmd.Flags().MarkHidden("parse-tls-handshakes")
 
+	Cmd.Flags().BoolVar(
+		&parseKafkaFlag,
+		"parse-kafka",
+		false,
+		"Parse Kafka requests and responses. Off by default because Kafka traffic is recognized by its shape rather than its port, and other binary traffic may be mistaken for it.",
+	)
+
+	Cmd.Flags().BoolVar(
+		&parseSQLFlag,
+		"parse-sql",
+		false,
+		"Parse PostgreSQL and MySQL queries and their results. Off by default because these protocols are recognized by their shape rather than their port, and other binary traffic may be mistaken for them.",
+	)
+
 	Cmd.Flags().IntVar(
 		&maxWitnessSize_bytes,
 		"max-witness-size-bytes",
@@ -331,6 +522,48 @@ func init() {
 	)
 	Cmd.Flags().MarkHidden("max-witness-size-bytes")
 
+	Cmd.Flags().IntVar(
+		&harMaxEntries,
+		"har-max-entries",
+		apispec.DefaultHARMaxEntries,
+		"When writing HAR files locally, start a new file after this many entries. Zero means no limit.",
+	)
+
+	Cmd.Flags().Int64Var(
+		&harMaxSize_bytes,
+		"har-max-size-bytes",
+		apispec.DefaultHARMaxSize_bytes,
+		"When writing HAR files locally, start a new file once the current one reaches this size. Zero means no limit.",
+	)
+
+	Cmd.Flags().DurationVar(
+		&harMaxAge,
+		"har-max-age",
+		apispec.DefaultHARMaxAge,
+		"When writing HAR files locally, start a new file after this much time has passed (e.g., 1h). Zero means no limit.",
+	)
+
+	Cmd.Flags().StringVar(
+		&uploadSpoolDir,
+		"upload-spool-dir",
+		"",
+		"Directory in which to keep witnesses that fail to upload because Postman can't be reached. They are uploaded, in order, once it can be, including by later runs. If not set, these witnesses are dropped.",
+	)
+
+	Cmd.Flags().Int64Var(
+		&uploadSpoolMaxSize,
+		"upload-spool-max-size-bytes",
+		apispec.DefaultUploadSpoolMaxSize_bytes,
+		"The maximum total size of the witnesses kept in --upload-spool-dir. Once reached, the oldest are dropped. Zero means no limit.",
+	)
+
+	Cmd.Flags().DurationVar(
+		&uploadSpoolMaxAge,
+		"upload-spool-max-age",
+		apispec.DefaultUploadSpoolMaxAge,
+		"How long to keep witnesses in --upload-spool-dir before dropping them (e.g., 1h). Zero means no limit.",
+	)
+
 	Cmd.Flags().BoolVar(
 		&dockerExtensionMode,
 		"docker-ext-mode",
@@ -342,8 +575,18 @@ func init() {
 	Cmd.Flags().IntVar(
 		&healthCheckPort,
 		"health-check-port",
-		50343,
-		"Port to listen on for Docker extension health checks. This is an internal flag used by the Akita Docker extension.",
+		0,
+		"Port on which to serve health and readiness checks at /health and /ready, on all interfaces. The responses name the trace being captured to. Disabled if 0.",
 	)
-	_ = Cmd.Flags().MarkHidden("health-check-port")
+
+	Cmd.Flags().IntVar(
+		&metricsPort,
+		"metrics-port",
+		0,
+		"Port on which to serve Prometheus metrics about the agent at /metrics. Disabled if 0.",
+	)
+
+	// Replaying pcap files doesn't involve live traffic.
+	Cmd.MarkFlagsMutuallyExclusive("pcap-files", "interfaces")
+	Cmd.MarkFlagsMutuallyExclusive("pcap-files", "command")
 }
@@ -0,0 +1,179 @@
+package openapi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/akitasoftware/akita-libs/buffer_pool"
+
+	"github.com/akitasoftware/akita-cli/apispec"
+	"github.com/akitasoftware/akita-cli/cmd/internal/cmderr"
+	"github.com/akitasoftware/akita-cli/openapi"
+	"github.com/akitasoftware/akita-cli/pcap"
+	"github.com/akitasoftware/akita-cli/printer"
+)
+
+const (
+	// Name used in place of a network interface when reading pcap files.
+	pcapReplayInterface = "pcap-replay"
+)
+
+var (
+	harFilesFlag  []string
+	pcapFilesFlag []string
+	filterFlag    string
+	outFlag       string
+	formatFlag    string
+	titleFlag     string
+	versionFlag   string
+)
+
+var Cmd = &cobra.Command{
+	Use:   "openapi",
+	Short: "Generate an OpenAPI 3 spec locally from captured traffic.",
+	Long: `Generate an OpenAPI 3 spec from HAR files or pcap captures, without
+contacting Postman. Endpoints, path parameters, query, header and body schemas,
+and response codes are inferred from the observed requests and responses.`,
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(0),
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		if len(harFilesFlag) == 0 && len(pcapFilesFlag) == 0 {
+			return errors.New("at least one of --har or --pcap-files must be specified")
+		}
+
+		format, err := outputFormat()
+		if err != nil {
+			return err
+		}
+
+		if err := run(format); err != nil {
+			return cmderr.AkitaErr{Err: err}
+		}
+		return nil
+	},
+}
+
+func init() {
+	Cmd.Flags().StringSliceVar(
+		&harFilesFlag,
+		"har",
+		nil,
+		"HAR files to read requests and responses from.",
+	)
+
+	Cmd.Flags().StringSliceVar(
+		&pcapFilesFlag,
+		"pcap-files",
+		nil,
+		"pcap or pcapng files to read packets from, in order.",
+	)
+
+	Cmd.Flags().StringVar(
+		&filterFlag,
+		"filter",
+		"",
+		"BPF filter used to select packets from the pcap files.",
+	)
+
+	Cmd.Flags().StringVar(
+		&outFlag,
+		"out",
+		"-",
+		`File to write the spec to. Use "-" for standard output.`,
+	)
+
+	Cmd.Flags().StringVar(
+		&formatFlag,
+		"format",
+		"",
+		`Output format, either "yaml" or "json". Defaults to JSON if --out ends in ".json", and YAML otherwise.`,
+	)
+
+	Cmd.Flags().StringVar(
+		&titleFlag,
+		"title",
+		"Generated API",
+		"Title of the generated spec.",
+	)
+
+	Cmd.Flags().StringVar(
+		&versionFlag,
+		"spec-version",
+		"1.0.0",
+		"Version of the generated spec.",
+	)
+}
+
+func outputFormat() (string, error) {
+	switch strings.ToLower(formatFlag) {
+	case "yaml", "json":
+		return strings.ToLower(formatFlag), nil
+	case "":
+		if strings.EqualFold(filepath.Ext(outFlag), ".json") {
+			return "json", nil
+		}
+		return "yaml", nil
+	}
+	return "", errors.Errorf("unsupported output format %q", formatFlag)
+}
+
+func run(format string) error {
+	builder := openapi.NewBuilder()
+	collector := openapi.NewCollector(builder)
+
+	for _, harFile := range harFilesFlag {
+		printer.Stderr.Infof("Reading %q...\n", harFile)
+		if _, err := apispec.ProcessHAR(collector, harFile); err != nil {
+			return errors.Wrapf(err, "failed to process HAR file %q", harFile)
+		}
+	}
+
+	if len(pcapFilesFlag) > 0 {
+		printer.Stderr.Infof("Reading packets from %s...\n", strings.Join(pcapFilesFlag, ", "))
+
+		pool, err := buffer_pool.MakeBufferPool(20*1024*1024, 4*1024)
+		if err != nil {
+			return errors.Wrap(err, "unable to create buffer pool")
+		}
+
+		// Returns once all files have been read.
+		stop := make(chan struct{})
+		if err := pcap.CollectFromFiles(stop, pcapFilesFlag, pcapReplayInterface, filterFlag, 1.0, false, pcap.ProtocolParsers{}, nil, collector, nil, pool); err != nil {
+			return errors.Wrap(err, "failed to read pcap files")
+		}
+	}
+
+	if err := collector.Close(); err != nil {
+		return err
+	}
+
+	doc := builder.Document(titleFlag, versionFlag)
+
+	var out []byte
+	var err error
+	if format == "json" {
+		out, err = json.MarshalIndent(doc, "", "  ")
+		out = append(out, '\n')
+	} else {
+		out, err = yaml.Marshal(doc)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal spec")
+	}
+
+	if outFlag == "-" {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	if err := os.WriteFile(outFlag, out, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write spec to %s", outFlag)
+	}
+	printer.Stderr.Infof("Wrote spec with %d paths to %s\n", len(doc.Paths), outFlag)
+	return nil
+}
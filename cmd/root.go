@@ -20,6 +20,7 @@ import (
 	"github.com/akitasoftware/akita-cli/cmd/internal/ecs"
 	"github.com/akitasoftware/akita-cli/cmd/internal/kube"
 	"github.com/akitasoftware/akita-cli/cmd/internal/legacy"
+	"github.com/akitasoftware/akita-cli/cmd/internal/openapi"
 	"github.com/akitasoftware/akita-cli/pcap"
 	"github.com/akitasoftware/akita-cli/printer"
 	"github.com/akitasoftware/akita-cli/rest"
@@ -256,6 +257,7 @@ func init() {
 	}
 
 	rootCmd.AddCommand(apidump.Cmd)
+	rootCmd.AddCommand(openapi.Cmd)
 
 	rootCmd.AddCommand(ecs.Cmd)
 	rootCmd.AddCommand(kube.Cmd)
@@ -162,6 +162,11 @@ func collectTraces(traceEventChannel <-chan *TraceEvent, learnClient rest.LearnC
 		optionals.Some(apispec.DefaultMaxWitnessSize_bytes),
 		packetCountSummary,
 		plugins,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 	collector = &trace.PacketCountCollector{
 		PacketCounts: packetCountSummary,
@@ -179,7 +179,7 @@ func NewNginxBackend(args *Args) (*NginxBackend, error) {
 
 	b.summary = trace.NewPacketCounter()
 	b.collector = trace.NewBackendCollector(b.backendSvc, backendLrn, b.learnClient,
-		optionals.Some(args.MaxWitnessSize_bytes), b.summary, args.Plugins)
+		optionals.Some(args.MaxWitnessSize_bytes), b.summary, args.Plugins, nil, nil, nil, nil, nil)
 
 	// TODO: rate-limit
 	// TODO: session rotation
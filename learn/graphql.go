@@ -0,0 +1,389 @@
+package learn
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+const (
+	// Media type recorded in HTTPBody.OtherType for GraphQL responses that carry
+	// a non-empty "errors" array, so that they are kept apart from successful
+	// responses with the same status code.
+	GraphQLErrorsMediaType = "application/graphql-response+json; outcome=errors"
+)
+
+// Top-level fields allowed in a GraphQL request body. Anything else means the
+// body isn't a GraphQL request.
+var graphQLRequestFields = map[string]struct{}{
+	"query":         {},
+	"operationName": {},
+	"variables":     {},
+	"extensions":    {},
+}
+
+// Top-level fields allowed in a GraphQL response body.
+var graphQLResponseFields = map[string]struct{}{
+	"data":       {},
+	"errors":     {},
+	"extensions": {},
+}
+
+// A GraphQL operation found in a request.
+type graphQLOperation struct {
+	// One of "query", "mutation" or "subscription".
+	Type string
+
+	// Empty for anonymous operations.
+	Name string
+}
+
+// The name recorded in the method ID for a GraphQL operation, e.g.
+// "query GetUser", or just the type for anonymous operations.
+func (op graphQLOperation) methodName() string {
+	if op.Name == "" {
+		return op.Type
+	}
+	return op.Type + " " + op.Name
+}
+
+// Detects GraphQL requests, either POSTed as a JSON body with a "query" field
+// or sent as a GET with a "query" parameter. Every operation is sent to the
+// same URL, so if the request is a GraphQL request, the operation type and
+// name are recorded as the name in the method ID, which tells the operations
+// apart. The request data is rewritten so that the operation's variables are
+// the arguments. The query document and operation name are dropped, since they
+// are the same for every call of the operation.
+//
+// Returns the datas unchanged if the request isn't a GraphQL request.
+func rewriteGraphQLRequest(req *akinet.HTTPRequest, methodID *pb.MethodID, datas []*pb.Data) []*pb.Data {
+	var op graphQLOperation
+	var ok bool
+	var result []*pb.Data
+	switch req.Method {
+	case http.MethodGet:
+		op, result, ok = graphQLFromQuery(req, datas)
+	case http.MethodPost:
+		op, result, ok = graphQLFromBody(datas)
+	}
+	if !ok {
+		return datas
+	}
+
+	methodID.Name = op.methodName()
+	return result
+}
+
+// Returns the GraphQL operation that method calls, e.g. "query GetUser", or ""
+// if the request wasn't a GraphQL request. Every operation is sent to the same
+// URL, so this tells apart methods with the same HTTP method and path.
+func GraphQLOperation(method *pb.Method) string {
+	name := method.GetId().GetName()
+	op, _, _ := strings.Cut(name, " ")
+	switch op {
+	case "query", "mutation", "subscription":
+		return name
+	}
+	return ""
+}
+
+// Returns the GraphQL operation that a request calls, in the same form as
+// GraphQLOperation, or "" if it isn't a GraphQL request. This works on the raw
+// request, for grouping calls by endpoint before they are parsed.
+func GraphQLOperationName(req akinet.HTTPRequest) string {
+	var doc, operationName string
+	switch req.Method {
+	case http.MethodGet:
+		if req.URL == nil {
+			return ""
+		}
+		params := req.URL.Query()
+		doc, operationName = params.Get("query"), params.Get("operationName")
+	case http.MethodPost:
+		if req.Body.Len() == 0 || !strings.Contains(req.Header.Get("Content-Type"), "json") {
+			return ""
+		}
+		body, err := decodeBody(req.Header, req.Body.CreateReader(), req.BodyDecompressed)
+		if err != nil {
+			return ""
+		}
+		var fields map[string]json.RawMessage
+		if err := json.NewDecoder(body).Decode(&fields); err != nil {
+			return ""
+		}
+		for k := range fields {
+			if _, allowed := graphQLRequestFields[k]; !allowed {
+				return ""
+			}
+		}
+		if err := json.Unmarshal(fields["query"], &doc); err != nil {
+			return ""
+		}
+		if raw, ok := fields["operationName"]; ok {
+			// A null operation name leaves it empty.
+			if err := json.Unmarshal(raw, &operationName); err != nil {
+				return ""
+			}
+		}
+	default:
+		return ""
+	}
+
+	op, ok := parseGraphQLDocument(doc, operationName)
+	if !ok {
+		return ""
+	}
+	return op.methodName()
+}
+
+func graphQLFromQuery(req *akinet.HTTPRequest, datas []*pb.Data) (graphQLOperation, []*pb.Data, bool) {
+	if req.URL == nil {
+		return graphQLOperation{}, nil, false
+	}
+	params := req.URL.Query()
+	op, ok := parseGraphQLDocument(params.Get("query"), params.Get("operationName"))
+	if !ok {
+		return graphQLOperation{}, nil, false
+	}
+
+	result := make([]*pb.Data, 0, len(datas))
+	for _, d := range datas {
+		query := d.GetMeta().GetHttp().GetQuery()
+		if query == nil {
+			result = append(result, d)
+			continue
+		}
+
+		switch query.Key {
+		case "query", "operationName", "extensions":
+			// Dropped.
+		case "variables":
+			// Variables are JSON-encoded. Keep the original parameter if they
+			// can't be parsed.
+			vars, err := parseHTTPBodyJSON(strings.NewReader(params.Get("variables")))
+			if err != nil {
+				result = append(result, d)
+				continue
+			}
+			vars.Meta = d.Meta
+			result = append(result, vars)
+		default:
+			result = append(result, d)
+		}
+	}
+	return op, result, true
+}
+
+func graphQLFromBody(datas []*pb.Data) (graphQLOperation, []*pb.Data, bool) {
+	for i, d := range datas {
+		if d.GetMeta().GetHttp().GetBody() == nil {
+			continue
+		}
+
+		fields := d.GetStruct().GetFields()
+		if len(fields) == 0 {
+			return graphQLOperation{}, nil, false
+		}
+		for k := range fields {
+			if _, allowed := graphQLRequestFields[k]; !allowed {
+				return graphQLOperation{}, nil, false
+			}
+		}
+
+		query := fields["query"].GetPrimitive().GetStringValue().GetValue()
+		name := fields["operationName"].GetPrimitive().GetStringValue().GetValue()
+		op, ok := parseGraphQLDocument(query, name)
+		if !ok {
+			return graphQLOperation{}, nil, false
+		}
+
+		result := make([]*pb.Data, 0, len(datas))
+		result = append(result, datas[:i]...)
+		if vars, ok := fields["variables"]; ok && vars.GetStruct() != nil {
+			// The variables take the place of the body.
+			result = append(result, &pb.Data{Value: vars.Value, Meta: d.Meta})
+		}
+		result = append(result, datas[i+1:]...)
+		return op, result, true
+	}
+	return graphQLOperation{}, nil, false
+}
+
+// Marks the successful response bodies of a GraphQL operation that carry a
+// non-empty "errors" array, by recording GraphQLErrorsMediaType as their
+// media type. GraphQL servers usually report errors with a 200 status, so the
+// status code alone doesn't tell them apart. Responses can't be recognized as
+// GraphQL on their own, so this is only done once the method is known to be a
+// GraphQL operation.
+func markGraphQLErrors(method *pb.Method) {
+	if GraphQLOperation(method) == "" {
+		return
+	}
+
+	for _, d := range method.GetResponses() {
+		meta := d.GetMeta().GetHttp()
+		body := meta.GetBody()
+		if body == nil || body.ContentType != pb.HTTPBody_JSON || meta.GetResponseCode() != http.StatusOK {
+			continue
+		}
+
+		fields := d.GetStruct().GetFields()
+		graphQL := true
+		for k := range fields {
+			if _, allowed := graphQLResponseFields[k]; !allowed {
+				graphQL = false
+				break
+			}
+		}
+		if graphQL && len(fields["errors"].GetList().GetElems()) > 0 {
+			body.OtherType = GraphQLErrorsMediaType
+		}
+	}
+}
+
+// Finds the operation with the given name in a GraphQL document, or the first
+// operation if the name is empty. Returns false if the document doesn't parse
+// as GraphQL or doesn't contain the operation.
+//
+// This only understands enough of the grammar to find the top-level operation
+// definitions; it does not validate the document.
+func parseGraphQLDocument(doc, operationName string) (graphQLOperation, bool) {
+	if strings.TrimSpace(doc) == "" {
+		return graphQLOperation{}, false
+	}
+
+	var ops []graphQLOperation
+	depth := 0
+
+	// Set after an operation keyword until the start of its selection set.
+	// The name, if any, must come before variable definitions and directives.
+	var pending *graphQLOperation
+	pendingNamed := false
+
+	// Set after "fragment" until the start of its selection set.
+	inFragmentHeader := false
+
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' && doc[i] != '\r' {
+				i++
+			}
+		case c == '"':
+			end, ok := skipGraphQLString(doc, i)
+			if !ok {
+				return graphQLOperation{}, false
+			}
+			i = end
+		case c == '{':
+			if depth == 0 {
+				if pending != nil {
+					ops = append(ops, *pending)
+					pending = nil
+				} else if !inFragmentHeader {
+					// Query shorthand: an anonymous query.
+					ops = append(ops, graphQLOperation{Type: "query"})
+				}
+				inFragmentHeader = false
+			}
+			depth++
+			i++
+		case c == '(' || c == '[':
+			pendingNamed = true
+			depth++
+			i++
+		case c == '@':
+			pendingNamed = true
+			i++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+			if depth < 0 {
+				return graphQLOperation{}, false
+			}
+			i++
+		case isGraphQLNameStart(c):
+			start := i
+			for i < len(doc) && isGraphQLNameContinue(doc[i]) {
+				i++
+			}
+			if depth > 0 || inFragmentHeader {
+				continue
+			}
+
+			name := doc[start:i]
+			if pending != nil {
+				if !pendingNamed {
+					pending.Name = name
+					pendingNamed = true
+				}
+				continue
+			}
+			switch name {
+			case "query", "mutation", "subscription":
+				pending = &graphQLOperation{Type: name}
+				pendingNamed = false
+			case "fragment":
+				inFragmentHeader = true
+			default:
+				// Type system definitions and the like aren't sent in requests.
+				return graphQLOperation{}, false
+			}
+		default:
+			// Variables, directives, and other punctuation.
+			i++
+		}
+	}
+
+	if depth != 0 || pending != nil {
+		return graphQLOperation{}, false
+	}
+
+	for _, op := range ops {
+		if operationName == "" || op.Name == operationName {
+			return op, true
+		}
+	}
+	return graphQLOperation{}, false
+}
+
+// Returns the index just past the string or block string starting at i.
+func skipGraphQLString(doc string, i int) (int, bool) {
+	if strings.HasPrefix(doc[i:], `"""`) {
+		for j := i + 3; j < len(doc); j++ {
+			if doc[j] == '\\' && strings.HasPrefix(doc[j:], `\"""`) {
+				j += 3
+				continue
+			}
+			if strings.HasPrefix(doc[j:], `"""`) {
+				return j + 3, true
+			}
+		}
+		return 0, false
+	}
+
+	for j := i + 1; j < len(doc); j++ {
+		switch doc[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1, true
+		case '\n', '\r':
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isGraphQLNameContinue(c byte) bool {
+	return isGraphQLNameStart(c) || ('0' <= c && c <= '9')
+}
@@ -0,0 +1,251 @@
+package learn
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	as "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+	"github.com/akitasoftware/akita-libs/spec_util"
+)
+
+func TestParseGraphQLDocument(t *testing.T) {
+	tests := []struct {
+		doc           string
+		operationName string
+		expected      graphQLOperation
+		ok            bool
+	}{
+		{`{ dog { name } }`, "", graphQLOperation{Type: "query"}, true},
+		{`query GetDog($id: ID!) { dog(id: $id) { name } }`, "", graphQLOperation{Type: "query", Name: "GetDog"}, true},
+		{`query ($id: ID!) @cached { dog(id: $id) { name } }`, "", graphQLOperation{Type: "query"}, true},
+		{
+			"# comment with { brace\nfragment F on Dog { name }\nquery A { dog { ...F } }\nmutation B($s: String = \"}\") { bark(s: $s) }",
+			"B",
+			graphQLOperation{Type: "mutation", Name: "B"},
+			true,
+		},
+		{`subscription OnBark { barked }`, "", graphQLOperation{Type: "subscription", Name: "OnBark"}, true},
+		{`query A { dog }`, "B", graphQLOperation{}, false},
+		{`shoes`, "", graphQLOperation{}, false},
+		{`query A { dog `, "", graphQLOperation{}, false},
+		{``, "", graphQLOperation{}, false},
+	}
+
+	for _, tc := range tests {
+		op, ok := parseGraphQLDocument(tc.doc, tc.operationName)
+		if ok != tc.ok || op != tc.expected {
+			t.Errorf("%q: expected (%v, %v), got (%v, %v)", tc.doc, tc.expected, tc.ok, op, ok)
+		}
+	}
+}
+
+func TestParseGraphQLHTTP(t *testing.T) {
+	graphQLMethodMeta := func(method string) *as.MethodMeta {
+		return &as.MethodMeta{
+			Meta: &as.MethodMeta_Http{
+				Http: &as.HTTPMethodMeta{
+					Method:       method,
+					PathTemplate: "/graphql",
+					Host:         "www.akitasoftware.com",
+				},
+			},
+		}
+	}
+
+	// The operation is recorded in the method ID, not the path.
+	named := func(m *as.Method, name string) *as.Method {
+		m.Id.Name = name
+		return m
+	}
+
+	tests := []*parseTest{
+		&parseTest{
+			name: "GraphQL POST",
+			testContent: newTestHTTPRequest(
+				"POST",
+				"https://www.akitasoftware.com/graphql",
+				[]byte(`{"query": "query GetDog($id: ID!) { dog(id: $id) { name } }", "operationName": "GetDog", "variables": {"id": 42}}`),
+				applicationJSON,
+				map[string][]string{},
+				[]*http.Cookie{},
+			),
+			expectedMethod: named(newMethod(
+				[]*as.Data{
+					newTestBodySpecFromStruct(0, as.HTTPBody_JSON, applicationJSON, map[string]*as.Data{
+						"id": dataFromPrimitive(spec_util.NewPrimitiveInt64(42)),
+					}),
+				},
+				nil,
+				graphQLMethodMeta("POST"),
+			), "query GetDog"),
+		},
+		&parseTest{
+			name: "GraphQL GET",
+			testContent: newTestHTTPRequest(
+				"GET",
+				"https://www.akitasoftware.com/graphql?query=mutation%20Bark%28%24loud%3A%20Boolean%29%20%7B%20bark%28loud%3A%20%24loud%29%20%7D&variables=%7B%22loud%22%3A%20true%7D&trace=7",
+				nil,
+				applicationJSON,
+				map[string][]string{},
+				[]*http.Cookie{},
+			),
+			expectedMethod: named(newMethod(
+				[]*as.Data{
+					newDataQuery("trace", spec_util.NewPrimitiveInt64(7)),
+					&as.Data{
+						Value: dataFromStruct(map[string]*as.Data{
+							"loud": dataFromPrimitive(spec_util.NewPrimitiveBool(true)),
+						}).Value,
+						Meta: newDataMetaQuery(&as.HTTPQuery{Key: "variables"}),
+					},
+				},
+				nil,
+				graphQLMethodMeta("GET"),
+			), "mutation Bark"),
+		},
+		&parseTest{
+			// Responses can't be told apart from other JSON on their own, so
+			// they are parsed as usual. Errors are marked once the response is
+			// paired with a GraphQL request.
+			name: "GraphQL errors response",
+			testContent: newTestHTTPResponse(
+				200,
+				[]byte(`{"data": null, "errors": [{"message": "no such dog"}]}`),
+				applicationJSON,
+				map[string][]string{},
+				[]*http.Cookie{},
+			),
+			expectedMethod: newMethod(
+				nil,
+				[]*as.Data{
+					newTestBodySpecFromStruct(200, as.HTTPBody_JSON, applicationJSON, map[string]*as.Data{
+						"data": parseElem(nil, spec_util.NO_INTERPRET_STRINGS),
+						"errors": dataFromList(
+							dataFromStruct(map[string]*as.Data{
+								"message": dataFromPrimitive(spec_util.NewPrimitiveString("no such dog")),
+							}),
+						),
+					}),
+				},
+				UnknownHTTPMethodMeta(),
+			),
+		},
+	}
+
+	for _, pt := range tests {
+		if err := runComp(pt); err != nil {
+			t.Fatalf("error in test: %s \\ %v ", pt.name, err)
+		}
+	}
+}
+
+// The operation named by the request is kept when the response is seen first.
+func TestGraphQLOperationMerge(t *testing.T) {
+	req, err := ParseHTTP(newTestHTTPRequest(
+		"POST",
+		"https://www.akitasoftware.com/graphql",
+		[]byte(`{"query": "query GetDog { dog { name } }"}`),
+		applicationJSON,
+		map[string][]string{},
+		[]*http.Cookie{},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ParseHTTP(newTestHTTPResponse(
+		200,
+		[]byte(`{"data": {"dog": {"name": "prince"}}}`),
+		applicationJSON,
+		map[string][]string{},
+		[]*http.Cookie{},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	MergeWitness(resp.Witness, req.Witness)
+	if name := resp.Witness.Method.GetId().GetName(); name != "query GetDog" {
+		t.Errorf("expected method name %q, got %q", "query GetDog", name)
+	}
+	if path := resp.Witness.Method.GetMeta().GetHttp().GetPathTemplate(); path != "/graphql" {
+		t.Errorf("expected path template %q, got %q", "/graphql", path)
+	}
+}
+
+// Responses reporting errors are kept apart from successful ones, but only for
+// GraphQL operations.
+func TestGraphQLErrorsMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		reqBody  string
+		respBody string
+		expected string
+	}{
+		{"errors", `{"query": "query GetDog { dog { name } }"}`, `{"data": null, "errors": [{"message": "no such dog"}]}`, GraphQLErrorsMediaType},
+		{"no errors", `{"query": "query GetDog { dog { name } }"}`, `{"data": {"dog": {"name": "prince"}}, "errors": []}`, applicationJSON},
+		{"not GraphQL", `{"name": "prince"}`, `{"data": null, "errors": [{"message": "no such dog"}]}`, applicationJSON},
+	}
+
+	for _, tc := range tests {
+		req, err := ParseHTTP(newTestHTTPRequest(
+			"POST",
+			"https://www.akitasoftware.com/graphql",
+			[]byte(tc.reqBody),
+			applicationJSON,
+			map[string][]string{},
+			[]*http.Cookie{},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ParseHTTP(newTestHTTPResponse(
+			200,
+			[]byte(tc.respBody),
+			applicationJSON,
+			map[string][]string{},
+			[]*http.Cookie{},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		MergeWitness(resp.Witness, req.Witness)
+		for _, d := range resp.Witness.Method.GetResponses() {
+			if body := d.GetMeta().GetHttp().GetBody(); body != nil && body.OtherType != tc.expected {
+				t.Errorf("%s: expected media type %q, got %q", tc.name, tc.expected, body.OtherType)
+			}
+		}
+	}
+}
+
+func TestGraphQLOperationName(t *testing.T) {
+	post := func(body string) akinet.HTTPRequest {
+		return akinet.HTTPRequest{
+			Method: "POST",
+			URL:    &url.URL{Path: "/graphql"},
+			Header: http.Header{"Content-Type": {applicationJSON}},
+			Body:   memview.New([]byte(body)),
+		}
+	}
+
+	tests := []struct {
+		req      akinet.HTTPRequest
+		expected string
+	}{
+		{post(`{"query": "query A { dog } mutation B { bark }", "operationName": "B"}`), "mutation B"},
+		{post(`{"query": "{ dog { name } }", "operationName": null}`), "query"},
+		{post(`{"query": "query A { dog }", "name": "prince"}`), ""},
+		{post(`{"name": "prince"}`), ""},
+		{akinet.HTTPRequest{Method: "GET", URL: &url.URL{Path: "/graphql", RawQuery: "query=query%20GetDog%20%7B%20dog%20%7D"}}, "query GetDog"},
+		{akinet.HTTPRequest{Method: "GET", URL: &url.URL{Path: "/dogs"}}, ""},
+	}
+
+	for i, tc := range tests {
+		if name := GraphQLOperationName(tc.req); name != tc.expected {
+			t.Errorf("case %d: expected %q, got %q", i, tc.expected, name)
+		}
+	}
+}
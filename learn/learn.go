@@ -21,6 +21,12 @@ func MergeWitness(dst, src *pb.Witness) {
 		dst.Method.Meta = src.Method.Meta
 	}
 
+	// The request may have named the method, e.g. with a GraphQL operation.
+	if dst.Method.GetId().GetName() == "" && src.Method.GetId().GetName() != "" {
+		dst.Method.Id = src.Method.Id
+	}
+	markGraphQLErrors(dst.Method)
+
 	// Special HTTP handling - if dst is a witness of the response, populate HTTP
 	// method meta from the src (the request witness).
 	if httpMeta := spec_util.HTTPMetaFromMethod(dst.Method); httpMeta != nil && httpMeta.Method == "" {
@@ -0,0 +1,122 @@
+package learn
+
+import (
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/spec_util"
+
+	"github.com/akitasoftware/akita-cli/printer"
+)
+
+const (
+	// Size of the prefix before each gRPC message: a compressed flag and a
+	// 4-byte big-endian length.
+	grpcMessagePrefixLen = 5
+)
+
+// A length-prefixed gRPC message.
+type grpcMessage struct {
+	Compressed bool
+	Payload    []byte
+}
+
+// Returns true for gRPC media types, e.g. application/grpc and
+// application/grpc+proto.
+func isGRPCMediaType(mediaType string) bool {
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+func isGRPCContentType(headers http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	return err == nil && isGRPCMediaType(mediaType)
+}
+
+// Splits a gRPC body into its length-prefixed messages, keeping at most
+// MaxBodyRecords of them. A truncated final message is dropped.
+func splitGRPCMessages(body []byte) ([]grpcMessage, error) {
+	messages := []grpcMessage{}
+	for len(body) >= grpcMessagePrefixLen && len(messages) < MaxBodyRecords {
+		compressed := body[0]
+		if compressed > 1 {
+			return nil, errors.Errorf("invalid gRPC compressed flag %d", compressed)
+		}
+		length := binary.BigEndian.Uint32(body[1:grpcMessagePrefixLen])
+		if uint64(len(body)-grpcMessagePrefixLen) < uint64(length) {
+			break
+		}
+		end := grpcMessagePrefixLen + int(length)
+		messages = append(messages, grpcMessage{
+			Compressed: compressed == 1,
+			Payload:    body[grpcMessagePrefixLen:end],
+		})
+		body = body[end:]
+	}
+	return messages, nil
+}
+
+// Parses a gRPC body into a list with one element per message. Messages are
+// decoded using messageType if it is non-nil, and without a schema otherwise.
+// Compressed messages, and messages that fail to decode, are kept as opaque
+// bytes, sampled like other binary bodies.
+func parseGRPCBody(mediaType string, bodyStream io.Reader, statusCode int, messageType protoreflect.MessageDescriptor) (*pb.Data, error) {
+	body, err := limitedBufferBody(bodyStream, MaxBufferedBody)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := splitGRPCMessages(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse gRPC body")
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	elems := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		elems = append(elems, decodeGRPCMessage(m, messageType))
+	}
+	bodyData := parseElem(elems, spec_util.NO_INTERPRET_STRINGS)
+
+	httpMeta := &pb.HTTPMeta{
+		Location: &pb.HTTPMeta_Body{
+			Body: &pb.HTTPBody{
+				ContentType: pb.HTTPBody_OTHER,
+				OtherType:   mediaType,
+			},
+		},
+		ResponseCode: int32(statusCode),
+	}
+	bodyData.Meta = newDataMetaHTTPMeta(httpMeta)
+
+	return bodyData, nil
+}
+
+func decodeGRPCMessage(m grpcMessage, messageType protoreflect.MessageDescriptor) interface{} {
+	if !m.Compressed {
+		if messageType != nil {
+			if decoded, err := decodeProtobufMessage(m.Payload, messageType); err == nil {
+				return decoded
+			} else {
+				printer.Debugf("Failed to decode gRPC message, decoding without a schema: %v\n", err)
+			}
+		}
+		if decoded, err := decodeSchemalessProtobuf(m.Payload, 0); err == nil {
+			return decoded
+		}
+	}
+
+	sample := m.Payload
+	if len(sample) > SmallBodySample {
+		sample = sample[:SmallBodySample]
+	}
+	return sample
+}
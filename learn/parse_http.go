@@ -22,6 +22,7 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/text/encoding/ianaindex"
 	"golang.org/x/text/transform"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"gopkg.in/yaml.v2"
 
 	pb "github.com/akitasoftware/akita-ir/go/api_spec"
@@ -90,7 +91,14 @@ func (pase ParseAPISpecError) Error() string {
 	return string(pase)
 }
 
+// Parses an HTTP request or response into a partial witness. gRPC messages
+// are decoded without a schema; use GRPCDecoder.ParseHTTP to decode them with
+// protobuf descriptors.
 func ParseHTTP(elem akinet.ParsedNetworkContent) (*PartialWitness, error) {
+	return parseHTTP(elem, nil)
+}
+
+func parseHTTP(elem akinet.ParsedNetworkContent, grpc *GRPCDecoder) (*PartialWitness, error) {
 	var isRequest bool
 	var rawBody memview.MemView
 	var bodyDecompressed bool
@@ -126,6 +134,20 @@ func ParseHTTP(elem akinet.ParsedNetworkContent) (*PartialWitness, error) {
 		return nil, ParseAPISpecError("expected http message, got something else")
 	}
 
+	// Decode gRPC messages using the method's descriptor, if we have one.
+	// Responses don't name the method, so it's remembered from the request.
+	var grpcMessageType protoreflect.MessageDescriptor
+	if isGRPCContentType(headers) {
+		if isRequest {
+			if method := grpc.lookupMethod(methodMeta.GetHttp().GetPathTemplate()); method != nil {
+				grpcMessageType = method.Input()
+				grpc.rememberCall(toWitnessID(streamID, seq), method)
+			}
+		} else if method := grpc.takeCall(toWitnessID(streamID, seq)); method != nil {
+			grpcMessageType = method.Output()
+		}
+	}
+
 	if rawBody.Len() > 0 {
 		bodyStream := rawBody.CreateReader()
 		decodeStream, err := decodeBody(headers, bodyStream, bodyDecompressed)
@@ -134,7 +156,7 @@ func ParseHTTP(elem akinet.ParsedNetworkContent) (*PartialWitness, error) {
 		}
 
 		contentType := headers.Get("Content-Type")
-		bodyData, err := parseBody(contentType, decodeStream, statusCode)
+		bodyData, err := parseBody(contentType, decodeStream, statusCode, grpcMessageType)
 		if err != nil {
 			// TODO: maybe don't do this if we *did* get a Content-Encoding header?
 			//
@@ -143,7 +165,7 @@ func ParseHTTP(elem akinet.ParsedNetworkContent) (*PartialWitness, error) {
 			printer.Debugf("Failed to parse body, attempting common decompressions: %v\n", err)
 			fallbackReader, decompressErr := attemptDecompress(rawBody)
 			if decompressErr == nil {
-				bodyData, err = parseBody(contentType, fallbackReader, statusCode)
+				bodyData, err = parseBody(contentType, fallbackReader, statusCode, grpcMessageType)
 			}
 		}
 
@@ -158,7 +180,12 @@ func ParseHTTP(elem akinet.ParsedNetworkContent) (*PartialWitness, error) {
 		}
 	}
 
-	method := &pb.Method{Id: UnassignedHTTPID(), Meta: methodMeta}
+	methodID := UnassignedHTTPID()
+	if req, ok := elem.(akinet.HTTPRequest); ok {
+		datas = rewriteGraphQLRequest(&req, methodID, datas)
+	}
+
+	method := &pb.Method{Id: methodID, Meta: methodMeta}
 
 	// Transform our array of datas into a map.
 	// We assign sequential string IDs in order to provide a consistent ordering
@@ -296,7 +323,9 @@ func limitedBufferBody(bodyStream io.Reader, limit int64) ([]byte, error) {
 
 // Possible to return nil for both the data and error values. The data will be nil
 // if the passed in body is length 0 or nil. This is not considered an error.
-func parseBody(contentType string, bodyStream io.Reader, statusCode int) (*pb.Data, error) {
+//
+// grpcMessageType describes the messages in a gRPC body, if known.
+func parseBody(contentType string, bodyStream io.Reader, statusCode int, grpcMessageType protoreflect.MessageDescriptor) (*pb.Data, error) {
 	mediaType, mediaParams, err := mime.ParseMediaType(contentType)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to parse MIME from Content-Type %q", contentType)
@@ -310,9 +339,17 @@ func parseBody(contentType string, bodyStream io.Reader, statusCode int) (*pb.Da
 		return parseMultipartBody("mixed", mediaParams["boundary"], bodyStream, statusCode)
 	}
 
+	// So are streams of records, such as NDJSON and server-sent events.
+	if format, ok := recordFormatForMediaType(mediaType); ok {
+		return parseRecordBody(format, mediaType, bodyStream, statusCode)
+	}
+
+	// And gRPC's length-prefixed messages.
+	if isGRPCMediaType(mediaType) {
+		return parseGRPCBody(mediaType, bodyStream, statusCode, grpcMessageType)
+	}
+
 	// Otherwise, use media type to decide how to parse the body.
-	// TODO: XML parsing
-	// TODO: application/json-seq (RFC 7466)?
 	// TODO: more text/* types
 	var parseBodyDataAs pb.HTTPBody_ContentType
 	switch mediaType {
@@ -332,6 +369,8 @@ func parseBody(contentType string, bodyStream io.Reader, statusCode int) (*pb.Da
 		// Handle custom JSON-encoded media types.
 		if strings.HasSuffix(mediaType, "+json") {
 			parseBodyDataAs = pb.HTTPBody_JSON
+		} else if isXMLMediaType(mediaType) {
+			parseBodyDataAs = pb.HTTPBody_XML
 		} else {
 			parseBodyDataAs = pb.HTTPBody_OTHER
 		}
@@ -405,6 +444,11 @@ func parseBody(contentType string, bodyStream io.Reader, statusCode int) (*pb.Da
 		if err != nil {
 			return nil, errors.Wrapf(err, "could not parse YAML body")
 		}
+	case pb.HTTPBody_XML:
+		bodyData, err = parseHTTPBodyXML(bodyStream)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse XML body")
+		}
 	case pb.HTTPBody_OCTET_STREAM:
 		handleAsBlob()
 	case pb.HTTPBody_TEXT_PLAIN:
@@ -465,7 +509,7 @@ func parseMultipartBody(multipartType string, boundary string, bodyStream io.Rea
 			partContentType = "text/plain"
 		}
 
-		partData, err := parseBody(partContentType, part, statusCode)
+		partData, err := parseBody(partContentType, part, statusCode, nil)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to convert multipart field %q to data", part.FormName())
 		}
@@ -549,6 +593,12 @@ func parseHeader(header http.Header, responseCodeOpt optionals.Optional[int]) []
 			continue
 		}
 
+		// Trailers, such as the gRPC status, are kept in the header under
+		// prefixed names. They describe the outcome of a call, not its shape.
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+
 		switch strings.ToLower(k) {
 		case "cookie", "set-cookie":
 			// Cookies are parsed by parseHeader.
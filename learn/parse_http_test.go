@@ -59,6 +59,42 @@ var testMultipartFormData = strings.Join([]string{
 	"--b9580db--",
 }, "")
 
+var testSOAPBody = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:m="http://www.example.org/dogs">
+  <soap:Body>
+    <m:GetDog m:kennel="burbank">
+      <m:Name>prince</m:Name>
+      <m:Teeth>42</m:Teeth>
+      <m:Home>jeuno, ak</m:Home>
+      <m:Home>versailles</m:Home>
+      <m:Note lang="en">good dog</m:Note>
+    </m:GetDog>
+  </soap:Body>
+</soap:Envelope>
+`
+
+func newTestSOAPBodySpec(statusCode int) *as.Data {
+	return newTestBodySpecFromStruct(statusCode, as.HTTPBody_XML, "application/soap+xml", map[string]*as.Data{
+		"Envelope": dataFromStruct(map[string]*as.Data{
+			"Body": dataFromStruct(map[string]*as.Data{
+				"GetDog": dataFromStruct(map[string]*as.Data{
+					"@kennel": dataFromPrimitive(spec_util.NewPrimitiveString("burbank")),
+					"Name":    dataFromPrimitive(spec_util.NewPrimitiveString("prince")),
+					"Teeth":   dataFromPrimitive(spec_util.NewPrimitiveInt64(42)),
+					"Home": dataFromList(
+						dataFromPrimitive(spec_util.NewPrimitiveString("jeuno, ak")),
+						dataFromPrimitive(spec_util.NewPrimitiveString("versailles")),
+					),
+					"Note": dataFromStruct(map[string]*as.Data{
+						"@lang": dataFromPrimitive(spec_util.NewPrimitiveString("en")),
+						"#text": dataFromPrimitive(spec_util.NewPrimitiveString("good dog")),
+					}),
+				}),
+			}),
+		}),
+	})
+}
+
 func newTestBodySpec(statusCode int) *as.Data {
 	return newTestBodySpecContentType("application/json", statusCode)
 }
@@ -262,6 +298,18 @@ func TestParseHTTPRequest(t *testing.T) {
 				UnknownHTTPMethodMeta(),
 			),
 		},
+		&parseTest{
+			name: "SOAP request body",
+			testContent: newTestHTTPRequest(
+				"POST",
+				"https://www.akitasoftware.com",
+				[]byte(testSOAPBody),
+				"application/soap+xml; charset=utf-8",
+				map[string][]string{},
+				[]*http.Cookie{},
+			),
+			expectedMethod: newMethod([]*as.Data{newTestSOAPBodySpec(0)}, nil, standardMethodPostMeta),
+		},
 		&parseTest{
 			name: "resp header test 1",
 			testContent: newTestHTTPResponse(
@@ -416,6 +464,69 @@ prince:
 				UnknownHTTPMethodMeta(),
 			),
 		},
+		&parseTest{
+			name: "NDJSON body with truncated final record",
+			testContent: newTestHTTPResponse(
+				200,
+				[]byte("{\"name\": \"prince\", \"teeth\": 42}\n\n{\"name\": \"pauper\"}\n{\"name\": \"pri"),
+				"application/x-ndjson",
+				map[string][]string{},
+				[]*http.Cookie{},
+			),
+			expectedMethod: newMethod(
+				nil,
+				[]*as.Data{
+					newTestBodySpecFromData(
+						200,
+						as.HTTPBody_JSON,
+						"application/x-ndjson",
+						dataFromList(
+							dataFromStruct(map[string]*as.Data{
+								"name":  dataFromPrimitive(spec_util.NewPrimitiveString("prince")),
+								"teeth": dataFromPrimitive(spec_util.NewPrimitiveInt64(42)),
+							}),
+							dataFromStruct(map[string]*as.Data{
+								"name": dataFromPrimitive(spec_util.NewPrimitiveString("pauper")),
+							}),
+						),
+					),
+				},
+				UnknownHTTPMethodMeta(),
+			),
+		},
+		&parseTest{
+			name: "server-sent events body",
+			testContent: newTestHTTPResponse(
+				200,
+				[]byte(": keep-alive\r\nevent: bark\r\nid: 7\r\ndata: {\"volume\": 11}\r\n\r\ndata: woof\r\ndata: woof\r\n\r\n"),
+				"text/event-stream",
+				map[string][]string{},
+				[]*http.Cookie{},
+			),
+			expectedMethod: newMethod(
+				nil,
+				[]*as.Data{
+					newTestBodySpecFromData(
+						200,
+						as.HTTPBody_OTHER,
+						"text/event-stream",
+						dataFromList(
+							dataFromStruct(map[string]*as.Data{
+								"event": dataFromPrimitive(spec_util.NewPrimitiveString("bark")),
+								"id":    dataFromPrimitive(spec_util.NewPrimitiveString("7")),
+								"data": dataFromStruct(map[string]*as.Data{
+									"volume": dataFromPrimitive(spec_util.NewPrimitiveInt64(11)),
+								}),
+							}),
+							dataFromStruct(map[string]*as.Data{
+								"data": dataFromPrimitive(spec_util.NewPrimitiveString("woof\nwoof")),
+							}),
+						),
+					),
+				},
+				UnknownHTTPMethodMeta(),
+			),
+		},
 		&parseTest{
 			name: "deflated body with content-encoding header",
 			testContent: newTestHTTPResponse(
@@ -0,0 +1,178 @@
+package learn
+
+import (
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Limits how deeply length-delimited fields are speculatively decoded as
+// nested messages when there is no schema.
+const maxSchemalessProtobufDepth = 8
+
+// Decodes a protobuf message using its descriptor into the generic tree that
+// parseElem understands, keyed by field name. Unknown fields are decoded
+// without a schema and keyed by field number.
+func decodeProtobufMessage(payload []byte, md protoreflect.MessageDescriptor) (map[string]interface{}, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, errors.Wrapf(err, "couldn't decode %s", md.FullName())
+	}
+	return protoMessageToElem(msg), nil
+}
+
+func protoMessageToElem(m protoreflect.Message) map[string]interface{} {
+	fields := map[string]interface{}{}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fields[string(fd.Name())] = protoFieldToElem(fd, v)
+		return true
+	})
+
+	if unknown := m.GetUnknown(); len(unknown) > 0 {
+		if decoded, err := decodeSchemalessProtobuf(unknown, 0); err == nil {
+			for k, v := range decoded {
+				fields[k] = v
+			}
+		}
+	}
+	return fields
+}
+
+func protoFieldToElem(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		elems := make([]interface{}, 0, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			elems = append(elems, protoValueToElem(fd, list.Get(i)))
+		}
+		return elems
+	case fd.IsMap():
+		m := map[string]interface{}{}
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			m[k.String()] = protoValueToElem(fd.MapValue(), mv)
+			return true
+		})
+		return m
+	}
+	return protoValueToElem(fd, v)
+}
+
+func protoValueToElem(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int64(v.Enum())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return v.Uint()
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return v.Bytes()
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoMessageToElem(v.Message())
+	}
+	return nil
+}
+
+// Decodes a protobuf message without a schema, keyed by field number.
+//
+// The wire format doesn't say how to interpret values, so varints and fixed-
+// width values become integers, and length-delimited values become strings if
+// they are printable text, nested messages if they decode as such, and bytes
+// otherwise. Fields that occur more than once become lists.
+func decodeSchemalessProtobuf(b []byte, depth int) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			var x uint64
+			x, n = protowire.ConsumeVarint(b)
+			v = int64(x)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(b)
+			v = int64(x)
+		case protowire.Fixed64Type:
+			var x uint64
+			x, n = protowire.ConsumeFixed64(b)
+			v = int64(x)
+		case protowire.BytesType:
+			var x []byte
+			x, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				v = decodeSchemalessBytes(x, depth)
+			}
+		case protowire.StartGroupType:
+			// Deprecated groups are skipped.
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		default:
+			return nil, errors.Errorf("unsupported wire type %d", typ)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if v == nil {
+			continue
+		}
+		key := strconv.Itoa(int(num))
+		switch existing := fields[key].(type) {
+		case nil:
+			fields[key] = v
+		case []interface{}:
+			fields[key] = append(existing, v)
+		default:
+			fields[key] = []interface{}{existing, v}
+		}
+	}
+	return fields, nil
+}
+
+func decodeSchemalessBytes(b []byte, depth int) interface{} {
+	if isPrintableText(b) {
+		return string(b)
+	}
+	if depth < maxSchemalessProtobufDepth && len(b) > 0 {
+		if nested, err := decodeSchemalessProtobuf(b, depth+1); err == nil {
+			return nested
+		}
+	}
+	return b
+}
+
+func isPrintableText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package learn
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	golangproto "github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+	"github.com/akitasoftware/akita-libs/spec_util"
+
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+// Describes dogs.v1.Kennel/GetDog(GetDogRequest{int64 id = 1}) returns
+// Dog{string name = 1; repeated string homes = 2; Breed breed = 3}.
+func newTestKennelDescriptors() *descriptorpb.FileDescriptorSet {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   typ.Enum(),
+			Label:  label.Enum(),
+		}
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	breed := field("breed", 3, descriptorpb.FieldDescriptorProto_TYPE_ENUM, optional)
+	breed.TypeName = proto.String(".dogs.v1.Breed")
+
+	return &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("dogs/v1/kennel.proto"),
+			Package: proto.String("dogs.v1"),
+			Syntax:  proto.String("proto3"),
+			EnumType: []*descriptorpb.EnumDescriptorProto{{
+				Name: proto.String("Breed"),
+				Value: []*descriptorpb.EnumValueDescriptorProto{
+					{Name: proto.String("BREED_UNKNOWN"), Number: proto.Int32(0)},
+					{Name: proto.String("BREED_CORGI"), Number: proto.Int32(1)},
+				},
+			}},
+			MessageType: []*descriptorpb.DescriptorProto{
+				{
+					Name:  proto.String("GetDogRequest"),
+					Field: []*descriptorpb.FieldDescriptorProto{field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional)},
+				},
+				{
+					Name: proto.String("Dog"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional),
+						field("homes", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated),
+						breed,
+					},
+				},
+			},
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name: proto.String("Kennel"),
+				Method: []*descriptorpb.MethodDescriptorProto{{
+					Name:       proto.String("GetDog"),
+					InputType:  proto.String(".dogs.v1.GetDogRequest"),
+					OutputType: proto.String(".dogs.v1.Dog"),
+				}},
+			}},
+		}},
+	}
+}
+
+func grpcFrame(msg []byte) []byte {
+	b := []byte{0, 0, 0, 0, byte(len(msg))}
+	return append(b, msg...)
+}
+
+func TestDecodeGRPCWithDescriptors(t *testing.T) {
+	files, err := protodesc.NewFiles(newTestKennelDescriptors())
+	require.NoError(t, err)
+	decoder := NewGRPCDecoder(files)
+
+	var reqMsg []byte
+	reqMsg = protowire.AppendTag(reqMsg, 1, protowire.VarintType)
+	reqMsg = protowire.AppendVarint(reqMsg, 42)
+
+	var respMsg []byte
+	respMsg = protowire.AppendTag(respMsg, 1, protowire.BytesType)
+	respMsg = protowire.AppendString(respMsg, "prince")
+	respMsg = protowire.AppendTag(respMsg, 2, protowire.BytesType)
+	respMsg = protowire.AppendString(respMsg, "burbank")
+	respMsg = protowire.AppendTag(respMsg, 2, protowire.BytesType)
+	respMsg = protowire.AppendString(respMsg, "versailles")
+	respMsg = protowire.AppendTag(respMsg, 3, protowire.VarintType)
+	respMsg = protowire.AppendVarint(respMsg, 1)
+	// Not in the descriptor.
+	respMsg = protowire.AppendTag(respMsg, 9, protowire.VarintType)
+	respMsg = protowire.AppendVarint(respMsg, 7)
+
+	streamID := uuid.New()
+	header := http.Header{"Content-Type": {"application/grpc"}}
+	req, err := decoder.ParseHTTP(akinet.HTTPRequest{
+		StreamID:   streamID,
+		Seq:        1,
+		Method:     "POST",
+		ProtoMajor: 2,
+		URL:        &url.URL{Path: "/dogs.v1.Kennel/GetDog"},
+		Host:       "dogs.svc",
+		Header:     header,
+		Body:       memview.New(grpcFrame(reqMsg)),
+	})
+	require.NoError(t, err)
+	resp, err := decoder.ParseHTTP(akinet.HTTPResponse{
+		StreamID:   streamID,
+		Seq:        1,
+		StatusCode: 200,
+		ProtoMajor: 2,
+		Header:     header,
+		Body:       memview.New(grpcFrame(respMsg)),
+	})
+	require.NoError(t, err)
+
+	expectedReq := parseElem(map[string]interface{}{"id": int64(42)}, spec_util.NO_INTERPRET_STRINGS)
+	expectedResp := parseElem(map[string]interface{}{
+		"name":  "prince",
+		"homes": []interface{}{"burbank", "versailles"},
+		"breed": "BREED_CORGI",
+		"9":     int64(7),
+	}, spec_util.NO_INTERPRET_STRINGS)
+
+	assertFirstGRPCMessage(t, expectedReq, req.Witness.Method.Args)
+	assertFirstGRPCMessage(t, expectedResp, resp.Witness.Method.Responses)
+	assert.Zero(t, decoder.pending.Len(), "calls are forgotten once their responses are parsed")
+}
+
+func TestGRPCDecoderForgetsOldestCall(t *testing.T) {
+	files, err := protodesc.NewFiles(newTestKennelDescriptors())
+	require.NoError(t, err)
+	decoder := NewGRPCDecoder(files)
+	method := decoder.lookupMethod("/dogs.v1.Kennel/GetDog")
+	require.NotNil(t, method)
+
+	first := toWitnessID(uuid.New(), 1)
+	decoder.rememberCall(first, method)
+	for i := 1; i < pending.MaxCalls; i++ {
+		decoder.rememberCall(toWitnessID(uuid.New(), i), method)
+	}
+	last := toWitnessID(uuid.New(), 1)
+	decoder.rememberCall(last, method)
+
+	assert.Equal(t, pending.MaxCalls, decoder.pending.Len())
+	assert.Nil(t, decoder.takeCall(first))
+	assert.Equal(t, method, decoder.takeCall(last))
+
+	// Without descriptors, messages are decoded without a schema.
+	assert.Nil(t, NewGRPCDecoder(nil).lookupMethod("/dogs.v1.Kennel/GetDog"))
+}
+
+func TestLoadProtobufDescriptors(t *testing.T) {
+	dir := t.TempDir()
+	b, err := proto.Marshal(newTestKennelDescriptors())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kennel.protoset"), b, 0644))
+
+	files, err := LoadProtobufDescriptors([]string{dir})
+	require.NoError(t, err)
+	_, err = files.FindDescriptorByName("dogs.v1.Kennel")
+	assert.NoError(t, err)
+
+	// .proto files must be compiled beforehand.
+	protoFile := filepath.Join(dir, "kennel.proto")
+	require.NoError(t, os.WriteFile(protoFile, []byte(`syntax = "proto3";`), 0644))
+	_, err = LoadProtobufDescriptors([]string{protoFile})
+	assert.ErrorContains(t, err, "FileDescriptorSet")
+}
+
+func assertFirstGRPCMessage(t *testing.T, expected *pb.Data, datas map[string]*pb.Data) {
+	for _, d := range datas {
+		if d.GetMeta().GetHttp().GetBody() == nil {
+			continue
+		}
+		elems := d.GetList().GetElems()
+		if assert.Len(t, elems, 1) {
+			assert.True(t, golangproto.Equal(expected, elems[0]), "got %v", elems[0])
+		}
+		return
+	}
+	t.Errorf("no body found")
+}
+
+func TestDecodeSchemalessProtobuf(t *testing.T) {
+	var nested []byte
+	nested = protowire.AppendTag(nested, 1, protowire.Fixed64Type)
+	nested = protowire.AppendFixed64(nested, 9000)
+
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, protowire.EncodeZigZag(-3))
+	msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, nested)
+	msg = protowire.AppendTag(msg, 3, protowire.BytesType)
+	msg = protowire.AppendString(msg, "jeuno, ak")
+	msg = protowire.AppendTag(msg, 4, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, []byte{0xff, 0xfe})
+
+	decoded, err := decodeSchemalessProtobuf(msg, 0)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"1": int64(5),
+		"2": map[string]interface{}{"1": int64(9000)},
+		"3": "jeuno, ak",
+		"4": []byte{0xff, 0xfe},
+	}, decoded)
+
+	_, err = decodeSchemalessProtobuf([]byte{0x0a, 0x05, 'a'}, 0)
+	assert.Error(t, err)
+}
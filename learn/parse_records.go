@@ -0,0 +1,219 @@
+package learn
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/spec_util"
+)
+
+const (
+	// Maximum number of records kept from a streamed body. Records beyond this
+	// are dropped; they rarely add anything to the schema.
+	MaxBodyRecords = 100
+
+	// RFC 7464 record separator.
+	jsonSeqRecordSeparator = 0x1E
+)
+
+// A body format made of a sequence of records.
+type recordFormat int
+
+const (
+	// Newline-delimited JSON: application/x-ndjson, application/jsonl, etc.
+	ndjsonRecords recordFormat = iota
+
+	// JSON text sequences (RFC 7464): application/json-seq.
+	jsonSeqRecords
+
+	// Server-sent events: text/event-stream.
+	serverSentEventRecords
+)
+
+// Returns the record format for the given media type, if it is one.
+func recordFormatForMediaType(mediaType string) (recordFormat, bool) {
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines", "application/jsonlines":
+		return ndjsonRecords, true
+	case "application/json-seq":
+		return jsonSeqRecords, true
+	case "text/event-stream":
+		return serverSentEventRecords, true
+	}
+	return 0, false
+}
+
+// Parses a body made of a sequence of records into a list with one element per
+// record, keeping at most MaxBodyRecords records.
+//
+// Streams are often cut off mid-record when the body exceeds the capture
+// limit, so an unparsable final record is dropped rather than treated as an
+// error.
+func parseRecordBody(format recordFormat, mediaType string, bodyStream io.Reader, statusCode int) (*pb.Data, error) {
+	body, err := limitedBufferBody(bodyStream, MaxBufferedBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []interface{}
+	var contentType pb.HTTPBody_ContentType
+	switch format {
+	case ndjsonRecords:
+		records, err = parseJSONRecords(bytes.Split(body, []byte{'\n'}))
+		contentType = pb.HTTPBody_JSON
+	case jsonSeqRecords:
+		records, err = parseJSONRecords(bytes.Split(body, []byte{jsonSeqRecordSeparator}))
+		contentType = pb.HTTPBody_JSON
+	case serverSentEventRecords:
+		records = parseServerSentEvents(body)
+		contentType = pb.HTTPBody_OTHER
+	default:
+		return nil, errors.Errorf("unknown record format %d", format)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s body", mediaType)
+	}
+
+	// Nothing but whitespace, or an empty event stream.
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	// Record values are already typed: JSON distinguishes strings from
+	// non-strings, and event data that isn't JSON is just text.
+	bodyData := parseElem(records, spec_util.NO_INTERPRET_STRINGS)
+
+	httpMeta := &pb.HTTPMeta{
+		Location: &pb.HTTPMeta_Body{
+			Body: &pb.HTTPBody{
+				ContentType: contentType,
+
+				// As in parseBody, OtherType holds the original media type.
+				OtherType: mediaType,
+			},
+		},
+		ResponseCode: int32(statusCode),
+	}
+	bodyData.Meta = newDataMetaHTTPMeta(httpMeta)
+
+	return bodyData, nil
+}
+
+// Decodes each chunk as a single JSON value, skipping blank chunks.
+func parseJSONRecords(chunks [][]byte) ([]interface{}, error) {
+	records := []interface{}{}
+	for i, chunk := range chunks {
+		if len(records) >= MaxBodyRecords {
+			break
+		}
+
+		chunk = bytes.TrimSpace(chunk)
+		if len(chunk) == 0 {
+			continue
+		}
+
+		record, err := decodeJSONRecord(chunk)
+		if err != nil {
+			if isLastNonEmptyChunk(chunks, i) {
+				// Probably truncated.
+				break
+			}
+			return nil, errors.Wrapf(err, "couldn't parse record %d", len(records))
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func decodeJSONRecord(record []byte) (interface{}, error) {
+	var top interface{}
+	decoder := json.NewDecoder(newStripControlCharactersReader(bytes.NewReader(record)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&top); err != nil {
+		return nil, err
+	}
+
+	// Each record must hold exactly one value.
+	if decoder.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return top, nil
+}
+
+func isLastNonEmptyChunk(chunks [][]byte, i int) bool {
+	for _, chunk := range chunks[i+1:] {
+		if len(bytes.TrimSpace(chunk)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a text/event-stream body into one struct per dispatched event, with
+// fields "event", "id", "retry", and "data". Data that is valid JSON is
+// decoded; otherwise it is kept as a string. Comments and unknown fields are
+// ignored, as is a final event that isn't terminated by a blank line.
+//
+// See https://html.spec.whatwg.org/multipage/server-sent-events.html.
+func parseServerSentEvents(body []byte) []interface{} {
+	records := []interface{}{}
+
+	event := map[string]interface{}{}
+	var data []string
+	dispatch := func() {
+		if len(data) > 0 {
+			joined := strings.Join(data, "\n")
+			if v, err := decodeJSONRecord([]byte(joined)); err == nil {
+				event["data"] = v
+			} else {
+				event["data"] = joined
+			}
+		}
+		if len(event) > 0 {
+			records = append(records, event)
+		}
+		event = map[string]interface{}{}
+		data = nil
+	}
+
+	// Lines may end in CRLF, LF, or CR.
+	text := strings.ReplaceAll(string(body), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	for _, line := range strings.Split(text, "\n") {
+		if len(records) >= MaxBodyRecords {
+			break
+		}
+
+		if line == "" {
+			dispatch()
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "data":
+			data = append(data, value)
+		case "event", "id":
+			event[field] = value
+		case "retry":
+			if retry, err := strconv.ParseInt(value, 10, 64); err == nil {
+				event[field] = retry
+			}
+		}
+	}
+
+	return records
+}
@@ -0,0 +1,146 @@
+package learn
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/spec_util"
+)
+
+const (
+	// Prefix for keys holding XML attributes.
+	xmlAttributePrefix = "@"
+
+	// Key for the text content of an XML element that also has attributes or
+	// child elements.
+	xmlTextKey = "#text"
+)
+
+// Returns true if the media type is an XML type, including SOAP.
+func isXMLMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/xml", "text/xml", "application/soap+xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+// Parses an XML document into the same struct/list tree that we use for JSON.
+//
+// The root element becomes the only field of the top-level struct. Each
+// element becomes a struct whose fields are its attributes (prefixed with
+// "@"), its child elements, and its text content (under "#text"). An element
+// with neither attributes nor children becomes a primitive. Child elements
+// that appear more than once become lists.
+//
+// Elements and attributes are keyed by their local name; namespace prefixes
+// are dropped, as are namespace declarations. So a SOAP envelope
+// <soap:Envelope><soap:Body>... becomes {"Envelope": {"Body": ...}}.
+func parseHTTPBodyXML(stream io.Reader) (*pb.Data, error) {
+	decoder := xml.NewDecoder(stream)
+	decoder.CharsetReader = xmlCharsetReader
+
+	var root interface{}
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "couldn't parse XML")
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			if root != nil {
+				return nil, errors.New("couldn't parse XML: multiple root elements")
+			}
+			value, err := parseXMLElement(decoder, start)
+			if err != nil {
+				return nil, errors.Wrap(err, "couldn't parse XML")
+			}
+			root = map[string]interface{}{start.Name.Local: value}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("couldn't parse XML: no root element")
+	}
+
+	// Everything in XML is a string, so re-interpret them as numbers and bools
+	// where possible.
+	return parseElem(root, spec_util.INTERPRET_STRINGS), nil
+}
+
+// Consumes tokens up to and including the end of the given element. Returns a
+// string if the element has only text content, and a map otherwise.
+func parseXMLElement(decoder *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	fields := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		if isXMLNamespaceDecl(attr.Name) {
+			continue
+		}
+		fields[xmlAttributePrefix+attr.Name.Local] = attr.Value
+	}
+
+	var text strings.Builder
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := parseXMLElement(decoder, t)
+			if err != nil {
+				return nil, err
+			}
+
+			// Collect repeated elements into a list.
+			name := t.Name.Local
+			switch existing := fields[name].(type) {
+			case nil:
+				fields[name] = child
+			case []interface{}:
+				fields[name] = append(existing, child)
+			default:
+				fields[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			trimmed := strings.TrimSpace(text.String())
+			if len(fields) == 0 {
+				return trimmed, nil
+			}
+			if trimmed != "" {
+				fields[xmlTextKey] = trimmed
+			}
+			return fields, nil
+		}
+	}
+}
+
+func isXMLNamespaceDecl(name xml.Name) bool {
+	return name.Space == "xmlns" || (name.Space == "" && name.Local == "xmlns")
+}
+
+// Handles non-UTF-8 encodings named in the XML declaration.
+func xmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := ianaindex.IANA.Encoding(charset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unsupported charset %q", charset)
+	}
+	if enc == nil {
+		return nil, errors.Errorf("unsupported charset %q", charset)
+	}
+	return transform.NewReader(input, enc.NewDecoder()), nil
+}
@@ -0,0 +1,158 @@
+package learn
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+// Loads protobuf descriptors from the given paths. Each path may be a
+// serialized FileDescriptorSet, as produced by
+// protoc --include_imports --descriptor_set_out, or a directory containing
+// them. .proto files must be compiled into a FileDescriptorSet beforehand.
+func LoadProtobufDescriptors(paths []string) (*protoregistry.Files, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]struct{}{}
+	addSet := func(s *descriptorpb.FileDescriptorSet) {
+		for _, f := range s.File {
+			if _, ok := seen[f.GetName()]; ok {
+				continue
+			}
+			seen[f.GetName()] = struct{}{}
+			set.File = append(set.File, f)
+		}
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read protobuf descriptors from %s", path)
+		}
+
+		if !info.IsDir() {
+			if filepath.Ext(path) == ".proto" {
+				return nil, errors.Errorf("%s is a .proto file; compile it into a FileDescriptorSet with protoc --include_imports --descriptor_set_out", path)
+			}
+			s, err := readDescriptorSet(path)
+			if err != nil {
+				return nil, err
+			}
+			addSet(s)
+			continue
+		}
+
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			switch filepath.Ext(p) {
+			case ".pb", ".protoset", ".desc", ".binpb":
+				s, err := readDescriptorSet(p)
+				if err != nil {
+					return err
+				}
+				addSet(s)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read protobuf descriptors from %s", path)
+		}
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid protobuf descriptors")
+	}
+	return files, nil
+}
+
+func readDescriptorSet(path string) (*descriptorpb.FileDescriptorSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	s := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, s); err != nil {
+		return nil, errors.Wrapf(err, "%s is not a FileDescriptorSet", path)
+	}
+	return s, nil
+}
+
+// Decodes gRPC messages using protobuf descriptors. gRPC responses don't say
+// which method they belong to, so the decoder remembers the method of each
+// request until its response is parsed. Each collector that pairs requests
+// with responses should have its own decoder.
+//
+// A nil decoder decodes messages without a schema.
+type GRPCDecoder struct {
+	files *protoregistry.Files
+
+	// Methods of requests awaiting a response.
+	pending pending.Calls[akid.WitnessID, protoreflect.MethodDescriptor]
+}
+
+// Returns a decoder that uses the given descriptors, or nil if files is nil.
+func NewGRPCDecoder(files *protoregistry.Files) *GRPCDecoder {
+	if files == nil {
+		return nil
+	}
+	return &GRPCDecoder{files: files}
+}
+
+// Like ParseHTTP, but decodes gRPC messages using d's descriptors.
+func (d *GRPCDecoder) ParseHTTP(elem akinet.ParsedNetworkContent) (*PartialWitness, error) {
+	return parseHTTP(elem, d)
+}
+
+// Returns the descriptor for a gRPC method, given its HTTP/2 path, e.g.
+// /pkg.Service/Method. Returns nil if d is nil or the method isn't described.
+func (d *GRPCDecoder) lookupMethod(path string) protoreflect.MethodDescriptor {
+	if d == nil {
+		return nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 {
+		return nil
+	}
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil
+	}
+	return service.Methods().ByName(protoreflect.Name(parts[1]))
+}
+
+func (d *GRPCDecoder) rememberCall(id akid.WitnessID, method protoreflect.MethodDescriptor) {
+	// Requests carry no capture time here, so the oldest calls are forgotten
+	// only to make room.
+	d.pending.Add(id, time.Time{}, method)
+}
+
+// Returns the method of the request with the given ID, and forgets it.
+// Returns nil if d is nil or the request wasn't remembered.
+func (d *GRPCDecoder) takeCall(id akid.WitnessID) protoreflect.MethodDescriptor {
+	if d == nil {
+		return nil
+	}
+	method, _ := d.pending.Take(id)
+	return method
+}
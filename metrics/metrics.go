@@ -0,0 +1,110 @@
+// Package metrics serves the agent's internal counters and gauges in the
+// Prometheus text exposition format, so that the agent can be monitored and
+// alerted on without the cloud.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type Type string
+
+const (
+	Counter Type = "counter"
+	Gauge   Type = "gauge"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// One value of a metric, distinguished from the metric's other values by its
+// labels.
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+func NewSample(value float64, labels ...Label) Sample {
+	return Sample{Labels: labels, Value: value}
+}
+
+// Writes metric families in the Prometheus text format.
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// Writes a metric family. Families without samples are skipped.
+func (w *Writer) Write(name string, typ Type, help string, samples ...Sample) {
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(&w.buf, "# TYPE %s %s\n", name, typ)
+	for _, s := range samples {
+		w.buf.WriteString(name)
+		if len(s.Labels) > 0 {
+			w.buf.WriteByte('{')
+			for i, l := range s.Labels {
+				if i > 0 {
+					w.buf.WriteByte(',')
+				}
+				fmt.Fprintf(&w.buf, "%s=\"%s\"", l.Name, labelEscaper.Replace(l.Value))
+			}
+			w.buf.WriteByte('}')
+		}
+		w.buf.WriteByte(' ')
+		w.buf.WriteString(formatValue(s.Value))
+		w.buf.WriteByte('\n')
+	}
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Returns a handler that writes the metrics gathered by gather on each
+// request.
+func Handler(gather func(*Writer)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		var w Writer
+		gather(&w)
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = rw.Write(w.Bytes())
+	})
+}
+
+// Serves the metrics gathered by gather at /metrics on the given port. Only
+// returns if the server fails.
+func Serve(port int, gather func(*Writer)) error {
+	router := mux.NewRouter()
+
+	router.Handle("/metrics", Handler(gather)).Methods("GET")
+
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), router)
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	var w Writer
+	w.Write("agent_tcp_packets_total", Counter, "TCP packets captured.",
+		NewSample(12, Label{"interface", "eth0"}),
+		NewSample(3, Label{"interface", `we"ird\`}),
+	)
+	w.Write("agent_pending_witnesses", Gauge, "Partial witnesses\nwaiting for their pair.", NewSample(1.5))
+	w.Write("agent_unused", Gauge, "Skipped, since it has no samples.")
+	w.Write("agent_infinite", Gauge, "Infinite.", NewSample(math.Inf(1)))
+
+	expected := `# HELP agent_tcp_packets_total TCP packets captured.
+# TYPE agent_tcp_packets_total counter
+agent_tcp_packets_total{interface="eth0"} 12
+agent_tcp_packets_total{interface="we\"ird\\"} 3
+# HELP agent_pending_witnesses Partial witnesses\nwaiting for their pair.
+# TYPE agent_pending_witnesses gauge
+agent_pending_witnesses 1.5
+# HELP agent_infinite Infinite.
+# TYPE agent_infinite gauge
+agent_infinite +Inf
+`
+	assert.Equal(t, expected, string(w.Bytes()))
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler(func(w *Writer) {
+		w.Write("agent_up", Gauge, "Whether the agent is running.", NewSample(1))
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+	assert.Contains(t, rec.Body.String(), "agent_up 1\n")
+}
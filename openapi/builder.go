@@ -0,0 +1,466 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/trace"
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/spec_util"
+)
+
+// Aggregates witnesses into an OpenAPI 3 document.
+type Builder struct {
+	endpoints map[endpointKey]*endpoint
+
+	// Server URLs, e.g. "http://example.com".
+	servers map[string]struct{}
+
+	securitySchemes map[string]*SecurityScheme
+}
+
+type endpointKey struct {
+	method       string
+	pathTemplate string
+
+	// The GraphQL operation, e.g. "query GetUser", or empty if the method
+	// isn't a GraphQL operation.
+	operation string
+}
+
+type endpoint struct {
+	// Number of requests observed.
+	count int
+
+	// Inferred path parameters, in order of appearance in the path.
+	pathParams []*Parameter
+
+	// Query, header and cookie parameters, keyed by location and name.
+	params map[paramKey]*observedParam
+
+	// Request bodies, by media type.
+	requestBodies map[string]*Schema
+
+	// Number of requests with a body.
+	requestBodyCount int
+
+	responses map[int]*observedResponse
+
+	security map[string]struct{}
+}
+
+type paramKey struct {
+	in   string
+	name string
+}
+
+type observedParam struct {
+	schema *Schema
+	count  int
+}
+
+type observedResponse struct {
+	headers map[string]*Schema
+	bodies  map[string]*Schema
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		endpoints:       make(map[endpointKey]*endpoint),
+		servers:         make(map[string]struct{}),
+		securitySchemes: make(map[string]*SecurityScheme),
+	}
+}
+
+// Adds a witness to the spec. The witness should include a request, as
+// produced by learn.ParseHTTP and learn.MergeWitness; witnesses without a
+// request are ignored. scheme is the scheme over which the request was
+// observed, e.g. "http". responseCode is the HTTP status of the response, or
+// zero if no response was observed.
+func (b *Builder) AddWitness(w *pb.Witness, scheme string, responseCode int) {
+	meta := spec_util.HTTPMetaFromMethod(w.GetMethod())
+	if meta == nil || meta.GetMethod() == "" {
+		return
+	}
+
+	if meta.GetHost() != "" {
+		b.servers[scheme+"://"+meta.GetHost()] = struct{}{}
+	}
+
+	template, pathParams := templatizePath(meta.GetPathTemplate())
+	key := endpointKey{
+		method:       strings.ToLower(meta.GetMethod()),
+		pathTemplate: template,
+		operation:    learn.GraphQLOperation(w.GetMethod()),
+	}
+	ep, ok := b.endpoints[key]
+	if !ok {
+		ep = &endpoint{
+			params:        make(map[paramKey]*observedParam),
+			requestBodies: make(map[string]*Schema),
+			responses:     make(map[int]*observedResponse),
+			security:      make(map[string]struct{}),
+		}
+		b.endpoints[key] = ep
+	}
+	ep.count += 1
+	ep.mergePathParams(pathParams)
+
+	hasBody := false
+	for _, d := range w.GetMethod().GetArgs() {
+		if b.addArg(ep, d) {
+			hasBody = true
+		}
+	}
+	if hasBody {
+		ep.requestBodyCount += 1
+	}
+
+	if responseCode != 0 {
+		ep.response(responseCode)
+	}
+	for _, d := range w.GetMethod().GetResponses() {
+		b.addResponseData(ep, d)
+	}
+}
+
+// Returns true if d is a request body.
+func (b *Builder) addArg(ep *endpoint, d *pb.Data) bool {
+	meta := d.GetMeta().GetHttp()
+
+	var key paramKey
+	switch {
+	case meta.GetQuery() != nil:
+		key = paramKey{in: "query", name: meta.GetQuery().GetKey()}
+	case meta.GetHeader() != nil:
+		key = paramKey{in: "header", name: meta.GetHeader().GetKey()}
+
+		// OpenAPI ignores these when described as header parameters.
+		switch strings.ToLower(key.name) {
+		case "accept", "content-type", "authorization":
+			return false
+		}
+	case meta.GetCookie() != nil:
+		key = paramKey{in: "cookie", name: meta.GetCookie().GetKey()}
+	case meta.GetAuth() != nil:
+		name := b.addSecurityScheme(meta.GetAuth().GetType())
+		ep.security[name] = struct{}{}
+		return false
+	case meta.GetBody() != nil || meta.GetMultipart() != nil:
+		mediaType := mediaTypeOf(meta)
+		ep.requestBodies[mediaType] = mergeSchemas(ep.requestBodies[mediaType], schemaFromData(d))
+		return true
+	default:
+		return false
+	}
+
+	p, ok := ep.params[key]
+	if !ok {
+		p = &observedParam{}
+		ep.params[key] = p
+	}
+	p.schema = mergeSchemas(p.schema, schemaFromData(d))
+	p.count += 1
+	return false
+}
+
+func (b *Builder) addResponseData(ep *endpoint, d *pb.Data) {
+	meta := d.GetMeta().GetHttp()
+	if meta.GetResponseCode() == 0 {
+		return
+	}
+	resp := ep.response(int(meta.GetResponseCode()))
+
+	switch {
+	case meta.GetHeader() != nil:
+		name := meta.GetHeader().GetKey()
+		resp.headers[name] = mergeSchemas(resp.headers[name], schemaFromData(d))
+	case meta.GetBody() != nil || meta.GetMultipart() != nil:
+		mediaType := mediaTypeOf(meta)
+		resp.bodies[mediaType] = mergeSchemas(resp.bodies[mediaType], schemaFromData(d))
+	}
+}
+
+func (b *Builder) addSecurityScheme(authType pb.HTTPAuth_HTTPAuthType) string {
+	var name string
+	var scheme *SecurityScheme
+	switch authType {
+	case pb.HTTPAuth_BASIC:
+		name, scheme = "basicAuth", &SecurityScheme{Type: "http", Scheme: "basic"}
+	case pb.HTTPAuth_BEARER:
+		name, scheme = "bearerAuth", &SecurityScheme{Type: "http", Scheme: "bearer"}
+	default:
+		name, scheme = "authorizationHeader", &SecurityScheme{Type: "apiKey", In: "header", Name: "Authorization"}
+	}
+	b.securitySchemes[name] = scheme
+	return name
+}
+
+func (ep *endpoint) response(code int) *observedResponse {
+	resp, ok := ep.responses[code]
+	if !ok {
+		resp = &observedResponse{
+			headers: make(map[string]*Schema),
+			bodies:  make(map[string]*Schema),
+		}
+		ep.responses[code] = resp
+	}
+	return resp
+}
+
+func (ep *endpoint) mergePathParams(params []*Parameter) {
+	if ep.pathParams == nil {
+		ep.pathParams = params
+		return
+	}
+	for i, p := range params {
+		if i >= len(ep.pathParams) {
+			break
+		}
+		ep.pathParams[i].Schema = mergeSchemas(ep.pathParams[i].Schema, p.Schema)
+	}
+}
+
+func mediaTypeOf(meta *pb.HTTPMeta) string {
+	if m := meta.GetMultipart(); m != nil {
+		return "multipart/" + m.GetType()
+	}
+
+	body := meta.GetBody()
+	if body.GetOtherType() != "" {
+		// The parser stores the original media type here.
+		return body.GetOtherType()
+	}
+	switch body.GetContentType() {
+	case pb.HTTPBody_JSON:
+		return "application/json"
+	case pb.HTTPBody_YAML:
+		return "application/yaml"
+	case pb.HTTPBody_FORM_URL_ENCODED:
+		return "application/x-www-form-urlencoded"
+	case pb.HTTPBody_TEXT_PLAIN:
+		return "text/plain"
+	case pb.HTTPBody_TEXT_HTML:
+		return "text/html"
+	}
+	return "application/octet-stream"
+}
+
+// Replaces path segments that look like identifiers with parameters. Returns
+// the path template and the inferred parameters.
+func templatizePath(path string) (string, []*Parameter) {
+	if path == "" {
+		return "/", nil
+	}
+
+	segments := strings.Split(path, "/")
+	var params []*Parameter
+	usedNames := map[string]struct{}{}
+	for i, seg := range segments {
+		schema, isParam := parameterSchema(seg)
+		if !isParam {
+			continue
+		}
+
+		name := paramName(segments[:i], i)
+		if _, used := usedNames[name]; used {
+			name = "arg" + strconv.Itoa(i)
+		}
+		usedNames[name] = struct{}{}
+
+		segments[i] = "{" + name + "}"
+		params = append(params, &Parameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   schema,
+		})
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// Determines whether a path segment looks like an identifier rather than a
+// fixed part of the path, using the same rules as the rest of the agent, and
+// infers its schema.
+func parameterSchema(seg string) (*Schema, bool) {
+	if !trace.LooksLikeID(seg) {
+		return nil, false
+	}
+	if _, err := strconv.ParseInt(seg, 10, 64); err == nil {
+		return &Schema{Type: "integer"}, true
+	}
+	if uuidRegexp.MatchString(seg) {
+		return &Schema{Type: "string", Format: "uuid"}, true
+	}
+	return &Schema{Type: "string"}, true
+}
+
+// Names a path parameter after the preceding literal segment, e.g. the
+// parameter in /users/123 becomes "userId". Falls back to "argN", where N is
+// the position of the segment.
+func paramName(preceding []string, position int) string {
+	if len(preceding) > 0 {
+		prev := preceding[len(preceding)-1]
+		if prev != "" && !strings.HasPrefix(prev, "{") {
+			var sb strings.Builder
+			for _, r := range singular(prev) {
+				if unicode.IsLetter(r) || unicode.IsDigit(r) {
+					sb.WriteRune(r)
+				}
+			}
+			if sb.Len() > 0 {
+				return sb.String() + "Id"
+			}
+		}
+	}
+	return "arg" + strconv.Itoa(position)
+}
+
+// Returns the singular form of a path segment naming a collection, e.g.
+// "users" or "categories". Only regular plurals are recognized; other words,
+// such as "status" or "address", are returned unchanged.
+func singular(word string) string {
+	lower := strings.ToLower(word)
+	switch {
+	case strings.HasSuffix(lower, "ies") && len(word) > 3:
+		return word[:len(word)-3] + "y"
+	case strings.HasSuffix(lower, "sses"), strings.HasSuffix(lower, "xes"),
+		strings.HasSuffix(lower, "ches"), strings.HasSuffix(lower, "shes"):
+		return word[:len(word)-2]
+	case strings.HasSuffix(lower, "ss"), strings.HasSuffix(lower, "us"),
+		strings.HasSuffix(lower, "is"):
+		return word
+	case strings.HasSuffix(lower, "s") && len(word) > 1:
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+// Produces the OpenAPI document for everything added so far.
+func (b *Builder) Document(title, version string) *Document {
+	doc := &Document{
+		OpenAPI: openAPIVersion,
+		Info: Info{
+			Title:   title,
+			Version: version,
+		},
+		Paths: make(map[string]PathItem),
+	}
+
+	var servers []string
+	for s := range b.servers {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+	for _, s := range servers {
+		doc.Servers = append(doc.Servers, Server{URL: s})
+	}
+
+	if len(b.securitySchemes) > 0 {
+		doc.Components = &Components{SecuritySchemes: b.securitySchemes}
+	}
+
+	for key, ep := range b.endpoints {
+		path := documentPath(key)
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = make(PathItem)
+			doc.Paths[path] = item
+		}
+		op := ep.operation()
+		op.Summary = key.operation
+		item[key.method] = op
+	}
+	return doc
+}
+
+// Returns the path under which an endpoint is documented. OpenAPI allows only
+// one operation per method and path, but every GraphQL operation is sent to
+// the same path, so each one is documented under a fragment naming it, e.g.
+// /graphql#query/GetUser.
+func documentPath(key endpointKey) string {
+	if key.operation == "" {
+		return key.pathTemplate
+	}
+	return key.pathTemplate + "#" + strings.ReplaceAll(key.operation, " ", "/")
+}
+
+func (ep *endpoint) operation() *Operation {
+	op := &Operation{
+		Responses: make(map[string]*Response),
+	}
+
+	op.Parameters = append(op.Parameters, ep.pathParams...)
+
+	var keys []paramKey
+	for k := range ep.params {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].in != keys[j].in {
+			return keys[i].in < keys[j].in
+		}
+		return keys[i].name < keys[j].name
+	})
+	for _, k := range keys {
+		p := ep.params[k]
+		op.Parameters = append(op.Parameters, &Parameter{
+			Name:     k.name,
+			In:       k.in,
+			Required: p.count == ep.count,
+			Schema:   p.schema,
+		})
+	}
+
+	if len(ep.requestBodies) > 0 {
+		op.RequestBody = &RequestBody{
+			Required: ep.requestBodyCount == ep.count,
+			Content:  make(map[string]*MediaType, len(ep.requestBodies)),
+		}
+		for mediaType, schema := range ep.requestBodies {
+			op.RequestBody.Content[mediaType] = &MediaType{Schema: schema}
+		}
+	}
+
+	for code, resp := range ep.responses {
+		r := &Response{
+			Description: http.StatusText(code),
+		}
+		if r.Description == "" {
+			r.Description = fmt.Sprintf("Status %d", code)
+		}
+		if len(resp.headers) > 0 {
+			r.Headers = make(map[string]*Header, len(resp.headers))
+			for name, schema := range resp.headers {
+				r.Headers[name] = &Header{Schema: schema}
+			}
+		}
+		if len(resp.bodies) > 0 {
+			r.Content = make(map[string]*MediaType, len(resp.bodies))
+			for mediaType, schema := range resp.bodies {
+				r.Content[mediaType] = &MediaType{Schema: schema}
+			}
+		}
+		op.Responses[strconv.Itoa(code)] = r
+	}
+	if len(op.Responses) == 0 {
+		// OpenAPI requires at least one response.
+		op.Responses["default"] = &Response{Description: "No response observed"}
+	}
+
+	var schemes []string
+	for name := range ep.security {
+		schemes = append(schemes, name)
+	}
+	sort.Strings(schemes)
+	for _, name := range schemes {
+		op.Security = append(op.Security, map[string][]string{name: {}})
+	}
+
+	return op
+}
@@ -0,0 +1,204 @@
+package openapi
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+
+	"github.com/akitasoftware/akita-cli/learn"
+)
+
+func TestTemplatizePath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/v1/users", "/v1/users"},
+		{"/v1/users/123", "/v1/users/{userId}"},
+		{"/v1/users/123/posts/6f1c2a4e-7b0e-4c5d-9a0e-2f3b4c5d6e7f", "/v1/users/{userId}/posts/{postId}"},
+		{"/123/123", "/{arg1}/{arg2}"},
+		{"/files/0123456789abcdef0123", "/files/{fileId}"},
+		{"/status/123", "/status/{statusId}"},
+		{"/addresses/123", "/addresses/{addressId}"},
+		{"/categories/123", "/categories/{categoryId}"},
+		{"/v1/customers/cus_NffrFeUfNV2Hib", "/v1/customers/{customerId}"},
+		{"", "/"},
+	}
+
+	for _, tc := range testCases {
+		actual, _ := templatizePath(tc.path)
+		assert.Equal(t, tc.expected, actual, tc.path)
+	}
+}
+
+func TestMergeSchemas(t *testing.T) {
+	a := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"id":   {Type: "integer", Format: "int64"},
+			"name": {Type: "string"},
+		},
+		Required: []string{"id", "name"},
+	}
+	b := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"id":   {Type: "number", Format: "double"},
+			"tags": {Type: "array", Items: &Schema{Type: "string"}},
+		},
+		Required: []string{"id", "tags"},
+	}
+
+	merged := mergeSchemas(a, b)
+	assert.Equal(t, []string{"id"}, merged.Required)
+	assert.Equal(t, &Schema{Type: "number"}, merged.Properties["id"])
+	assert.Contains(t, merged.Properties, "name")
+	assert.Contains(t, merged.Properties, "tags")
+
+	oneOf := mergeSchemas(&Schema{Type: "string"}, &Schema{Type: "boolean"})
+	assert.Len(t, oneOf.OneOf, 2)
+
+	nullable := mergeSchemas(&Schema{Type: "string"}, &Schema{Nullable: true})
+	assert.Equal(t, &Schema{Type: "string", Nullable: true}, nullable)
+}
+
+func TestCollector(t *testing.T) {
+	builder := NewBuilder()
+	c := NewCollector(builder)
+
+	for i, userID := range []string{"123", "456"} {
+		streamID := uuid.New()
+		req := akinet.HTTPRequest{
+			StreamID:   streamID,
+			Seq:        i,
+			Method:     "POST",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			URL: &url.URL{
+				Path:     "/v1/users/" + userID,
+				RawQuery: "verbose=true",
+			},
+			Host: "example.com",
+			Header: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: memview.New([]byte(`{"name": "prince"}`)),
+		}
+		resp := akinet.HTTPResponse{
+			StreamID:   streamID,
+			Seq:        i,
+			StatusCode: 201,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: memview.New([]byte(`{"id": 7}`)),
+		}
+
+		assert.NoError(t, c.Process(akinet.ParsedNetworkTraffic{Content: req}))
+		assert.NoError(t, c.Process(akinet.ParsedNetworkTraffic{Content: resp}))
+	}
+	assert.NoError(t, c.Close())
+
+	doc := builder.Document("Test", "1.0.0")
+	assert.Equal(t, []Server{{URL: "http://example.com"}}, doc.Servers)
+	if !assert.Contains(t, doc.Paths, "/v1/users/{userId}") {
+		return
+	}
+
+	op := doc.Paths["/v1/users/{userId}"]["post"]
+	if !assert.NotNil(t, op) {
+		return
+	}
+
+	if assert.Len(t, op.Parameters, 2) {
+		assert.Equal(t, &Parameter{Name: "userId", In: "path", Required: true, Schema: &Schema{Type: "integer"}}, op.Parameters[0])
+		assert.Equal(t, "verbose", op.Parameters[1].Name)
+		assert.Equal(t, "query", op.Parameters[1].In)
+		assert.True(t, op.Parameters[1].Required)
+	}
+
+	assert.Equal(t, &Schema{
+		Type:       "object",
+		Properties: map[string]*Schema{"name": {Type: "string"}},
+		Required:   []string{"name"},
+	}, op.RequestBody.Content["application/json"].Schema)
+
+	if assert.Contains(t, op.Responses, "201") {
+		assert.Equal(t, &Schema{
+			Type:       "object",
+			Properties: map[string]*Schema{"id": {Type: "integer", Format: "int64"}},
+			Required:   []string{"id"},
+		}, op.Responses["201"].Content["application/json"].Schema)
+	}
+}
+
+// GraphQL operations sent to the same path are documented separately, with
+// error responses apart from successful ones.
+func TestCollectorGraphQL(t *testing.T) {
+	builder := NewBuilder()
+	c := NewCollector(builder)
+
+	calls := []struct {
+		query    string
+		response string
+	}{
+		{"query GetDog { dog { name } }", `{"data": {"dog": {"name": "prince"}}}`},
+		{"query GetDog { dog { name } }", `{"data": null, "errors": [{"message": "no such dog"}]}`},
+		{"mutation Bark { bark }", `{"data": {"bark": true}}`},
+	}
+	for i, call := range calls {
+		streamID := uuid.New()
+		req := akinet.HTTPRequest{
+			StreamID:   streamID,
+			Seq:        i,
+			Method:     "POST",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			URL:        &url.URL{Path: "/graphql"},
+			Host:       "example.com",
+			Header: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: memview.New([]byte(`{"query": "` + call.query + `"}`)),
+		}
+		resp := akinet.HTTPResponse{
+			StreamID:   streamID,
+			Seq:        i,
+			StatusCode: 200,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: memview.New([]byte(call.response)),
+		}
+
+		assert.NoError(t, c.Process(akinet.ParsedNetworkTraffic{Content: req}))
+		assert.NoError(t, c.Process(akinet.ParsedNetworkTraffic{Content: resp}))
+	}
+	assert.NoError(t, c.Close())
+
+	doc := builder.Document("Test", "1.0.0")
+	assert.NotContains(t, doc.Paths, "/graphql")
+	if assert.Contains(t, doc.Paths, "/graphql#mutation/Bark") {
+		assert.Equal(t, "mutation Bark", doc.Paths["/graphql#mutation/Bark"]["post"].Summary)
+	}
+	if !assert.Contains(t, doc.Paths, "/graphql#query/GetDog") {
+		return
+	}
+
+	op := doc.Paths["/graphql#query/GetDog"]["post"]
+	assert.Equal(t, "query GetDog", op.Summary)
+	if assert.Contains(t, op.Responses, "200") {
+		content := op.Responses["200"].Content
+		assert.Contains(t, content, "application/json")
+		assert.Contains(t, content, learn.GraphQLErrorsMediaType)
+	}
+}
@@ -0,0 +1,106 @@
+package openapi
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/trace"
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+// Pairs up HTTP requests and responses into witnesses, as BackendCollector
+// does, and adds them to a Builder instead of uploading them.
+type Collector struct {
+	builder *Builder
+
+	mutex sync.Mutex
+
+	// Un-paired partial witnesses, by pair key.
+	pairCache map[akid.WitnessID]*partialWitness
+}
+
+type partialWitness struct {
+	witness *pb.Witness
+
+	// Empty if this is a response.
+	scheme string
+
+	// Zero if this is a request.
+	responseCode int
+}
+
+var _ trace.Collector = (*Collector)(nil)
+
+func NewCollector(builder *Builder) *Collector {
+	return &Collector{
+		builder:   builder,
+		pairCache: make(map[akid.WitnessID]*partialWitness),
+	}
+}
+
+func (c *Collector) Process(t akinet.ParsedNetworkTraffic) error {
+	var scheme string
+	var responseCode int
+	switch content := t.Content.(type) {
+	case akinet.HTTPRequest:
+		// Requests parsed from packets carry no scheme, and are cleartext HTTP.
+		// Those loaded from HAR files have absolute URLs.
+		scheme = "http"
+		if content.URL != nil && content.URL.Scheme != "" {
+			scheme = strings.ToLower(content.URL.Scheme)
+		}
+	case akinet.HTTPResponse:
+		responseCode = content.StatusCode
+	default:
+		return nil
+	}
+
+	partial, err := learn.ParseHTTP(t.Content)
+	if err != nil {
+		printer.Debugf("Failed to parse HTTP, skipping: %v\n", err)
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pair, ok := c.pairCache[partial.PairKey]
+	if !ok {
+		c.pairCache[partial.PairKey] = &partialWitness{
+			witness:      partial.Witness,
+			scheme:       scheme,
+			responseCode: responseCode,
+		}
+		return nil
+	}
+
+	delete(c.pairCache, partial.PairKey)
+	learn.MergeWitness(pair.witness, partial.Witness)
+	if responseCode == 0 {
+		responseCode = pair.responseCode
+	}
+	if scheme == "" {
+		scheme = pair.scheme
+	}
+	c.builder.AddWitness(pair.witness, scheme, responseCode)
+	return nil
+}
+
+// Adds requests that never got a response to the builder. Responses without
+// a request are dropped, since they can't be attributed to an endpoint.
+func (c *Collector) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, p := range c.pairCache {
+		if p.responseCode == 0 {
+			c.builder.AddWitness(p.witness, p.scheme, 0)
+		}
+		delete(c.pairCache, k)
+	}
+	return nil
+}
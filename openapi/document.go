@@ -0,0 +1,81 @@
+package openapi
+
+// The subset of the OpenAPI 3 document model that we generate.
+// See https://spec.openapis.org/oas/v3.0.3.
+
+const openAPIVersion = "3.0.3"
+
+type Document struct {
+	OpenAPI    string              `json:"openapi" yaml:"openapi"`
+	Info       Info                `json:"info" yaml:"info"`
+	Servers    []Server            `json:"servers,omitempty" yaml:"servers,omitempty"`
+	Paths      map[string]PathItem `json:"paths" yaml:"paths"`
+	Components *Components         `json:"components,omitempty" yaml:"components,omitempty"`
+}
+
+type Info struct {
+	Title   string `json:"title" yaml:"title"`
+	Version string `json:"version" yaml:"version"`
+}
+
+type Server struct {
+	URL string `json:"url" yaml:"url"`
+}
+
+// Operations by lower-case HTTP method.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Summary     string                `json:"summary,omitempty" yaml:"summary,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty" yaml:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses" yaml:"responses"`
+	Security    []map[string][]string `json:"security,omitempty" yaml:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name" yaml:"name"`
+	In       string  `json:"in" yaml:"in"`
+	Required bool    `json:"required,omitempty" yaml:"required,omitempty"`
+	Schema   *Schema `json:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty" yaml:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content" yaml:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+type Response struct {
+	Description string                `json:"description" yaml:"description"`
+	Headers     map[string]*Header    `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Content     map[string]*MediaType `json:"content,omitempty" yaml:"content,omitempty"`
+}
+
+type Header struct {
+	Schema *Schema `json:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+type Components struct {
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty" yaml:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type   string `json:"type" yaml:"type"`
+	Scheme string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+	In     string `json:"in,omitempty" yaml:"in,omitempty"`
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"`
+}
+
+type Schema struct {
+	Type       string             `json:"type,omitempty" yaml:"type,omitempty"`
+	Format     string             `json:"format,omitempty" yaml:"format,omitempty"`
+	Nullable   bool               `json:"nullable,omitempty" yaml:"nullable,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty" yaml:"required,omitempty"`
+	Items      *Schema            `json:"items,omitempty" yaml:"items,omitempty"`
+	OneOf      []*Schema          `json:"oneOf,omitempty" yaml:"oneOf,omitempty"`
+}
@@ -0,0 +1,201 @@
+package openapi
+
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Infers a schema from a single observed value.
+func schemaFromData(d *pb.Data) *Schema {
+	switch v := d.GetValue().(type) {
+	case *pb.Data_Primitive:
+		return schemaFromPrimitive(v.Primitive)
+	case *pb.Data_Struct:
+		s := &Schema{
+			Type:       "object",
+			Properties: make(map[string]*Schema, len(v.Struct.GetFields())),
+		}
+		for name, field := range v.Struct.GetFields() {
+			s.Properties[name] = schemaFromData(field)
+			s.Required = append(s.Required, name)
+		}
+		sort.Strings(s.Required)
+		return s
+	case *pb.Data_List:
+		s := &Schema{Type: "array"}
+		for _, elem := range v.List.GetElems() {
+			s.Items = mergeSchemas(s.Items, schemaFromData(elem))
+		}
+		if s.Items == nil {
+			s.Items = &Schema{}
+		}
+		return s
+	case *pb.Data_Optional:
+		if inner := v.Optional.GetData(); inner != nil {
+			return schemaFromData(inner)
+		}
+		return &Schema{Nullable: true}
+	case *pb.Data_Oneof:
+		var result *Schema
+		for _, option := range v.Oneof.GetOptions() {
+			result = mergeSchemas(result, schemaFromData(option))
+		}
+		if result == nil {
+			return &Schema{}
+		}
+		return result
+	}
+	return &Schema{}
+}
+
+func schemaFromPrimitive(p *pb.Primitive) *Schema {
+	switch {
+	case p.GetBoolValue() != nil:
+		return &Schema{Type: "boolean"}
+	case p.GetInt32Value() != nil:
+		return &Schema{Type: "integer", Format: "int32"}
+	case p.GetInt64Value() != nil, p.GetUint32Value() != nil, p.GetUint64Value() != nil:
+		return &Schema{Type: "integer", Format: "int64"}
+	case p.GetFloatValue() != nil:
+		return &Schema{Type: "number", Format: "float"}
+	case p.GetDoubleValue() != nil:
+		return &Schema{Type: "number", Format: "double"}
+	case p.GetBytesValue() != nil:
+		return &Schema{Type: "string", Format: "byte"}
+	case p.GetStringValue() != nil:
+		return schemaFromString(p.GetStringValue().GetValue())
+	}
+	return &Schema{}
+}
+
+func schemaFromString(s string) *Schema {
+	if uuidRegexp.MatchString(s) {
+		return &Schema{Type: "string", Format: "uuid"}
+	}
+	if _, err := time.Parse(time.RFC3339, s); err == nil {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	return &Schema{Type: "string"}
+}
+
+// Combines two schemas into one that accepts the values of both. Either
+// argument may be nil. The arguments may be modified.
+func mergeSchemas(a, b *Schema) *Schema {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	// A schema observed only as null contributes only nullability.
+	if isNullOnly(b) {
+		a.Nullable = true
+		return a
+	}
+	if isNullOnly(a) {
+		b.Nullable = true
+		return b
+	}
+
+	if len(a.OneOf) > 0 || len(b.OneOf) > 0 || !compatibleTypes(a.Type, b.Type) {
+		return mergeOneOf(a, b)
+	}
+
+	result := a
+	result.Nullable = a.Nullable || b.Nullable
+
+	// Widen integers to numbers.
+	if a.Type != b.Type {
+		result.Type = "number"
+		result.Format = ""
+	} else if a.Format != b.Format {
+		result.Format = ""
+	}
+
+	switch result.Type {
+	case "object":
+		for name, prop := range b.Properties {
+			result.Properties[name] = mergeSchemas(result.Properties[name], prop)
+		}
+		result.Required = intersectSorted(a.Required, b.Required)
+	case "array":
+		result.Items = mergeSchemas(a.Items, b.Items)
+	}
+	return result
+}
+
+func isNullOnly(s *Schema) bool {
+	return s.Nullable && s.Type == "" && len(s.OneOf) == 0
+}
+
+func compatibleTypes(a, b string) bool {
+	if a == b {
+		return true
+	}
+	isNumeric := func(t string) bool { return t == "integer" || t == "number" }
+	return isNumeric(a) && isNumeric(b)
+}
+
+// Merges two schemas of different types into a oneOf, merging options of the
+// same type together.
+func mergeOneOf(a, b *Schema) *Schema {
+	result := &Schema{Nullable: a.Nullable || b.Nullable}
+
+	var options []*Schema
+	for _, s := range []*Schema{a, b} {
+		if len(s.OneOf) > 0 {
+			options = append(options, s.OneOf...)
+		} else {
+			s.Nullable = false
+			options = append(options, s)
+		}
+	}
+
+	for _, option := range options {
+		merged := false
+		for i, existing := range result.OneOf {
+			if compatibleTypes(existing.Type, option.Type) {
+				result.OneOf[i] = mergeSchemas(existing, option)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			result.OneOf = append(result.OneOf, option)
+		}
+	}
+
+	if len(result.OneOf) == 1 {
+		only := result.OneOf[0]
+		only.Nullable = only.Nullable || result.Nullable
+		return only
+	}
+	sort.SliceStable(result.OneOf, func(i, j int) bool {
+		return result.OneOf[i].Type < result.OneOf[j].Type
+	})
+	return result
+}
+
+// Both arguments must be sorted.
+func intersectSorted(a, b []string) []string {
+	var result []string
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, a[i])
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return result
+}
@@ -21,3 +21,26 @@ type fakeClock struct {
 func (f *fakeClock) Now() time.Time {
 	return f.currTime
 }
+
+// Follows the timestamps of the packets being processed rather than the wall
+// clock. Used when replaying packet captures, so that stream timeouts are
+// measured in capture time. Not safe for concurrent use; it is only accessed
+// from the goroutine driving the reassembler.
+type packetClock struct {
+	currTime time.Time
+}
+
+func (c *packetClock) Now() time.Time {
+	if c.currTime.IsZero() {
+		return time.Now()
+	}
+	return c.currTime
+}
+
+// Advances the clock to the packet's timestamp. Out-of-order timestamps never
+// move the clock backwards.
+func (c *packetClock) observe(t time.Time) {
+	if t.After(c.currTime) {
+		c.currTime = t
+	}
+}
@@ -0,0 +1,149 @@
+// Package conntrack holds state shared by the parsers for the two directions
+// of a TCP connection, for request-response protocols whose responses don't
+// say which request they answer.
+package conntrack
+
+import (
+	"sync"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+const (
+	// Maximum number of connections whose state we track. Parsers don't learn
+	// when a connection ends, so state is evicted once this is reached.
+	maxConnections = 10000
+
+	// Maximum number of requests awaiting a response on one connection.
+	maxPendingRequests = 1000
+)
+
+// A request sent by the client that the server hasn't answered yet.
+type Pending struct {
+	// The sequence number of the reported request, or 0 if the request isn't
+	// reported, e.g. because it has no SQL text.
+	Seq int
+
+	// Protocol-specific details that the server's parser needs to interpret
+	// the answer, e.g. the MySQL command.
+	Command byte
+	Text    string
+	Extra   interface{}
+}
+
+// State shared by the parsers for the two directions of a connection. Callers
+// must hold the lock while using it.
+type Connection struct {
+	sync.Mutex
+
+	lastSeq int
+	pending []Pending
+
+	// Called with each request that is dropped without being answered. May be
+	// nil.
+	forget func(Pending)
+
+	// Protocol-specific state, created by the parsers.
+	Extra interface{}
+}
+
+// Returns the next sequence number for a request on this connection.
+func (c *Connection) NextSeq() int {
+	c.lastSeq++
+	return c.lastSeq
+}
+
+// Records a request sent by the client.
+func (c *Connection) Push(p Pending) {
+	if len(c.pending) >= maxPendingRequests {
+		c.drop(1)
+	}
+	c.pending = append(c.pending, p)
+}
+
+// Returns the oldest request awaiting an answer, without removing it.
+func (c *Connection) Peek() (Pending, bool) {
+	if len(c.pending) == 0 {
+		return Pending{}, false
+	}
+	return c.pending[0], true
+}
+
+// Removes and returns the oldest request awaiting an answer.
+func (c *Connection) Pop() (Pending, bool) {
+	p, ok := c.Peek()
+	if ok {
+		c.pending = c.pending[1:]
+	}
+	return p, ok
+}
+
+// Removes and returns the oldest request for which match returns true. The
+// requests before it were never answered, and are dropped. If none match, no
+// requests are removed.
+func (c *Connection) PopMatching(match func(Pending) bool) (Pending, bool) {
+	for i, p := range c.pending {
+		if match(p) {
+			c.drop(i)
+			c.pending = c.pending[1:]
+			return p, true
+		}
+	}
+	return Pending{}, false
+}
+
+// Drops the oldest n requests.
+func (c *Connection) drop(n int) {
+	if c.forget != nil {
+		for _, p := range c.pending[:n] {
+			c.forget(p)
+		}
+	}
+	c.pending = c.pending[n:]
+}
+
+// Hands out the state of each connection, creating it on first use.
+type Connections struct {
+	mutex  sync.Mutex
+	conns  map[akinet.TCPBidiID]*Connection
+	forget func(Pending)
+}
+
+func NewConnections() *Connections {
+	return NewConnectionsWithForget(nil)
+}
+
+// Like NewConnections, but forget is called with each request that is
+// dropped without being answered: when a connection has too many requests
+// awaiting an answer, when a request is skipped by PopMatching, and when a
+// connection is evicted. It is called with the connection's lock held.
+func NewConnectionsWithForget(forget func(Pending)) *Connections {
+	return &Connections{
+		conns:  make(map[akinet.TCPBidiID]*Connection),
+		forget: forget,
+	}
+}
+
+func (cs *Connections) Get(id akinet.TCPBidiID) *Connection {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if c, ok := cs.conns[id]; ok {
+		return c
+	}
+	if len(cs.conns) >= maxConnections {
+		for k, evicted := range cs.conns {
+			delete(cs.conns, k)
+
+			// A parser may still be using the connection, but it will find no
+			// requests to match answers with.
+			evicted.Lock()
+			evicted.drop(len(evicted.pending))
+			evicted.Unlock()
+			break
+		}
+	}
+	c := &Connection{forget: cs.forget}
+	cs.conns[id] = c
+	return c
+}
@@ -0,0 +1,51 @@
+package conntrack
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+func TestPopMatching(t *testing.T) {
+	var forgotten []int
+	conns := NewConnectionsWithForget(func(p Pending) {
+		forgotten = append(forgotten, p.Seq)
+	})
+	c := conns.Get(akinet.TCPBidiID(uuid.New()))
+	for i := 1; i <= 3; i++ {
+		c.Push(Pending{Seq: i})
+	}
+	seq := func(want int) func(Pending) bool {
+		return func(p Pending) bool { return p.Seq == want }
+	}
+
+	_, ok := c.PopMatching(seq(7))
+	assert.False(t, ok)
+	assert.Empty(t, forgotten, "nothing is dropped when nothing matches")
+
+	p, ok := c.PopMatching(seq(2))
+	assert.True(t, ok)
+	assert.Equal(t, 2, p.Seq)
+	assert.Equal(t, []int{1}, forgotten)
+
+	p, ok = c.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, 3, p.Seq)
+}
+
+func TestForgetOnOverflow(t *testing.T) {
+	forgotten := 0
+	conns := NewConnectionsWithForget(func(Pending) { forgotten++ })
+	c := conns.Get(akinet.TCPBidiID(uuid.New()))
+	for i := 0; i < maxPendingRequests+5; i++ {
+		c.Push(Pending{Seq: i + 1})
+	}
+	assert.Equal(t, 5, forgotten)
+
+	p, ok := c.Peek()
+	assert.True(t, ok)
+	assert.Equal(t, 6, p.Seq)
+}
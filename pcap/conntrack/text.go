@@ -0,0 +1,21 @@
+package conntrack
+
+// Whether b holds printable ASCII, up to the first NUL if there is one. Used by
+// parser factories to recognize statements and other text in binary messages.
+func LooksLikeText(b []byte) bool {
+	n := 0
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		if (c < 0x20 && !isSpace(c)) || c > 0x7e {
+			return false
+		}
+		n++
+	}
+	return n > 0
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
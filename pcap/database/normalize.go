@@ -0,0 +1,227 @@
+package database
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Longest normalized statement we keep. Longer statements are truncated.
+const maxNormalizedLen = 2048
+
+// Matches a list of placeholders after IN, so that statements that differ only
+// in the length of the list normalize to the same text.
+var inListRE = regexp.MustCompile(`(?i)\b(IN) ?\( ?\?(?: ?, ?\?)* ?\)`)
+
+// Returns the statement with string and numeric literals replaced by '?',
+// comments removed, and whitespace collapsed, so that statements differing
+// only in their arguments normalize to the same text. Bind parameters such as
+// $1 are kept.
+//
+// The protocol selects the dialect: MySQL treats double-quoted text as a string
+// and honors backslash escapes, while PostgreSQL treats it as an identifier.
+func Normalize(protocol Protocol, query string) string {
+	n := normalizer{
+		in:    query,
+		mysql: protocol == MySQL,
+	}
+	n.run()
+
+	result := strings.TrimSpace(n.out.String())
+	result = inListRE.ReplaceAllString(result, "$1 (?)")
+	if len(result) > maxNormalizedLen {
+		result = result[:maxNormalizedLen]
+	}
+	return result
+}
+
+type normalizer struct {
+	in    string
+	pos   int
+	mysql bool
+
+	out strings.Builder
+
+	// Whether whitespace was skipped since the last output.
+	space bool
+
+	// The last byte written, or 0 if none.
+	last byte
+}
+
+func (n *normalizer) run() {
+	for n.pos < len(n.in) && n.out.Len() <= maxNormalizedLen {
+		c := n.in[n.pos]
+		switch {
+		case isSpace(c):
+			n.space = true
+			n.pos++
+		case strings.HasPrefix(n.in[n.pos:], "--") || (n.mysql && c == '#'):
+			n.skipLineComment()
+		case strings.HasPrefix(n.in[n.pos:], "/*"):
+			n.skipBlockComment()
+		case isStringPrefix(c) && n.pos+1 < len(n.in) && n.in[n.pos+1] == '\'' && n.atTokenStart():
+			n.pos++
+			n.emit("?")
+			n.skipQuoted('\'', n.mysql || c == 'E' || c == 'e')
+		case c == '\'':
+			n.emit("?")
+			n.skipQuoted('\'', n.mysql)
+		case c == '"' && n.mysql:
+			n.skipQuoted('"', true)
+			n.emit("?")
+		case c == '"' || c == '`':
+			n.copyQuoted(c)
+		case c == '$' && !n.mysql && n.dollarQuote():
+		case isDigit(c) && n.atTokenStart():
+			n.skipNumber()
+			n.emit("?")
+		case c == '.' && n.pos+1 < len(n.in) && isDigit(n.in[n.pos+1]) && n.atTokenStart():
+			n.skipNumber()
+			n.emit("?")
+		default:
+			n.emit(n.in[n.pos : n.pos+1])
+			n.pos++
+		}
+	}
+}
+
+// Writes s, preceded by a single space if whitespace or a comment was skipped.
+func (n *normalizer) emit(s string) {
+	if n.space && n.out.Len() > 0 {
+		n.out.WriteByte(' ')
+	}
+	n.space = false
+	n.out.WriteString(s)
+	n.last = s[len(s)-1]
+}
+
+// Whether the current position can't continue an identifier or number.
+func (n *normalizer) atTokenStart() bool {
+	return n.space || !isIdentByte(n.last)
+}
+
+func (n *normalizer) skipLineComment() {
+	end := strings.IndexByte(n.in[n.pos:], '\n')
+	if end < 0 {
+		n.pos = len(n.in)
+	} else {
+		n.pos += end + 1
+	}
+	n.space = true
+}
+
+func (n *normalizer) skipBlockComment() {
+	end := strings.Index(n.in[n.pos+2:], "*/")
+	if end < 0 {
+		n.pos = len(n.in)
+	} else {
+		n.pos += 2 + end + 2
+	}
+	n.space = true
+}
+
+// Skips past a string opened by the quote at the current position. A doubled
+// quote stands for the quote itself.
+func (n *normalizer) skipQuoted(quote byte, backslashes bool) {
+	n.pos++
+	for n.pos < len(n.in) {
+		c := n.in[n.pos]
+		switch {
+		case backslashes && c == '\\':
+			n.pos += 2
+		case c == quote && n.pos+1 < len(n.in) && n.in[n.pos+1] == quote:
+			n.pos += 2
+		case c == quote:
+			n.pos++
+			return
+		default:
+			n.pos++
+		}
+	}
+	n.pos = len(n.in)
+}
+
+// Copies a quoted identifier as is.
+func (n *normalizer) copyQuoted(quote byte) {
+	start := n.pos
+	n.skipQuoted(quote, false)
+	n.emit(n.in[start:n.pos])
+}
+
+// Replaces a dollar-quoted string, e.g. $$text$$ or $tag$text$tag$, returning
+// false if the dollar sign doesn't start one.
+func (n *normalizer) dollarQuote() bool {
+	end := n.pos + 1
+	for end < len(n.in) && isIdentByte(n.in[end]) && n.in[end] != '$' {
+		end++
+	}
+	if end >= len(n.in) || n.in[end] != '$' || (end > n.pos+1 && isDigit(n.in[n.pos+1])) {
+		return false
+	}
+	tag := n.in[n.pos : end+1]
+	close := strings.Index(n.in[end+1:], tag)
+	if close < 0 {
+		n.pos = len(n.in)
+	} else {
+		n.pos = end + 1 + close + len(tag)
+	}
+	n.emit("?")
+	return true
+}
+
+// Skips a decimal, hexadecimal, or floating-point number.
+func (n *normalizer) skipNumber() {
+	if strings.HasPrefix(n.in[n.pos:], "0x") || strings.HasPrefix(n.in[n.pos:], "0X") {
+		n.pos += 2
+		for n.pos < len(n.in) && isHexDigit(n.in[n.pos]) {
+			n.pos++
+		}
+		return
+	}
+	for n.pos < len(n.in) {
+		c := n.in[n.pos]
+		switch {
+		case isDigit(c) || c == '.':
+			n.pos++
+		case (c == 'e' || c == 'E') && n.pos+1 < len(n.in):
+			next := n.in[n.pos+1]
+			if isDigit(next) {
+				n.pos++
+			} else if (next == '+' || next == '-') && n.pos+2 < len(n.in) && isDigit(n.in[n.pos+2]) {
+				n.pos += 2
+			} else {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// Whether c can be part of an identifier. Bytes of multi-byte UTF-8 characters
+// count, since those can appear in unquoted identifiers.
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c >= 0x80
+}
+
+// Whether c can prefix a string literal: E'...' for escapes, X'...' and
+// B'...' for bit strings, and N'...' for national character sets.
+func isStringPrefix(c byte) bool {
+	switch c {
+	case 'E', 'e', 'X', 'x', 'B', 'b', 'N', 'n':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		protocol Protocol
+		query    string
+		expected string
+	}{
+		{
+			name:     "literals",
+			protocol: PostgreSQL,
+			query:    "SELECT * FROM dogs WHERE name = 'Rex' AND age > 3 AND weight < 12.5e1",
+			expected: "SELECT * FROM dogs WHERE name = ? AND age > ? AND weight < ?",
+		},
+		{
+			name:     "identifiers with digits",
+			protocol: PostgreSQL,
+			query:    `SELECT t1.col2 FROM "Table 3" t1 WHERE t1.id = $1`,
+			expected: `SELECT t1.col2 FROM "Table 3" t1 WHERE t1.id = $1`,
+		},
+		{
+			name:     "escaped quotes",
+			protocol: PostgreSQL,
+			query:    `UPDATE dogs SET bio = 'it''s a dog', note = E'line\'s end' WHERE id = 7`,
+			expected: "UPDATE dogs SET bio = ?, note = ? WHERE id = ?",
+		},
+		{
+			name:     "dollar quoting",
+			protocol: PostgreSQL,
+			query:    "SELECT $$don't$$, $tag$x$tag$ FROM dogs",
+			expected: "SELECT ?, ? FROM dogs",
+		},
+		{
+			name:     "comments and whitespace",
+			protocol: PostgreSQL,
+			query:    "/* app: kennel */ SELECT\n\t  name -- the name\nFROM dogs",
+			expected: "SELECT name FROM dogs",
+		},
+		{
+			name:     "in list",
+			protocol: PostgreSQL,
+			query:    "SELECT name FROM dogs WHERE id IN (1, 2, 3) AND owner in ('a','b')",
+			expected: "SELECT name FROM dogs WHERE id IN (?) AND owner in (?)",
+		},
+		{
+			name:     "mysql strings",
+			protocol: MySQL,
+			query:    "SELECT `name` FROM dogs WHERE name = \"Rex\" OR name = 'Fi\\'do' OR tag = X'0f' OR flags = 0x1F # trailing",
+			expected: "SELECT `name` FROM dogs WHERE name = ? OR name = ? OR tag = ? OR flags = ?",
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, Normalize(tc.protocol, tc.query), tc.name)
+	}
+}
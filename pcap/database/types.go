@@ -0,0 +1,49 @@
+// Package database holds what the parsers for database wire protocols have in
+// common: the statements and results they report, and normalization of query
+// text.
+package database
+
+import (
+	"github.com/google/uuid"
+
+	"github.com/akitasoftware/akita-cli/pcap/parsed"
+)
+
+type Protocol string
+
+const (
+	PostgreSQL Protocol = "postgresql"
+	MySQL      Protocol = "mysql"
+)
+
+// A statement sent by a database client. It is answered by the Result with the
+// same StreamID and Seq.
+type Query struct {
+	parsed.Content
+
+	Protocol Protocol
+
+	// Shared by all queries and results on the same TCP connection.
+	StreamID uuid.UUID
+	Seq      int
+
+	// The normalized statement, with literals replaced by '?'. Empty if the
+	// statement isn't known, e.g. when executing a statement prepared before
+	// capture started.
+	Text string
+}
+
+// The outcome of a Query, reported once the server is ready for the next
+// statement.
+type Result struct {
+	parsed.Content
+
+	Protocol Protocol
+	StreamID uuid.UUID
+	Seq      int
+
+	// The SQLSTATE code for PostgreSQL, or the error number for MySQL. Empty if
+	// the statement succeeded. Error messages aren't kept, since they often
+	// quote the data involved.
+	ErrorCode string
+}
@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+// The port that DNS servers listen on.
+const Port = 53
+
+// Response codes by their standard mnemonics.
+var rcodeNames = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+	layers.DNSResponseCodeYXDomain: "YXDOMAIN",
+	layers.DNSResponseCodeYXRRSet:  "YXRRSET",
+	layers.DNSResponseCodeNXRRSet:  "NXRRSET",
+	layers.DNSResponseCodeNotAuth:  "NOTAUTH",
+	layers.DNSResponseCodeNotZone:  "NOTZONE",
+}
+
+// Identifies a query by the client's address and the query ID.
+type pendingKey struct {
+	client string
+	port   int
+	id     uint16
+}
+
+// Parses DNS messages, one UDP datagram at a time, and measures the latency of
+// each response by remembering when its query was seen.
+//
+// Not safe for concurrent use.
+type Parser struct {
+	// The times at which queries awaiting a response were sent.
+	queries pending.Calls[pendingKey, time.Time]
+}
+
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+// Whether a UDP datagram between the given ports may carry DNS.
+func IsDNSPort(srcPort, dstPort int) bool {
+	return srcPort == Port || dstPort == Port
+}
+
+// Parses the payload of a UDP datagram, observed at the given time, into a
+// Query or a Response.
+func (p *Parser) Parse(srcIP net.IP, srcPort int, dstIP net.IP, dstPort int, payload []byte, at time.Time) (akinet.ParsedNetworkContent, error) {
+	var msg layers.DNS
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil, errors.Wrap(err, "failed to decode DNS message")
+	}
+	if len(msg.Questions) == 0 {
+		return nil, errors.New("DNS message has no question")
+	}
+	question := msg.Questions[0]
+	name := strings.TrimSuffix(strings.ToLower(string(question.Name)), ".")
+	recordType := typeName(question.Type)
+
+	if !msg.QR {
+		p.queries.Add(pendingKey{srcIP.String(), srcPort, msg.ID}, at, at)
+		return Query{
+			ID:   msg.ID,
+			Name: name,
+			Type: recordType,
+		}, nil
+	}
+
+	response := Response{
+		ID:    msg.ID,
+		Name:  name,
+		Type:  recordType,
+		RCode: rcodeName(msg.ResponseCode),
+	}
+	for _, answer := range msg.Answers {
+		if answer.Type == layers.DNSTypeA || answer.Type == layers.DNSTypeAAAA {
+			response.Addresses = append(response.Addresses, append(net.IP(nil), answer.IP...))
+		}
+	}
+	if sent, ok := p.queries.Take(pendingKey{dstIP.String(), dstPort, msg.ID}); ok && !at.Before(sent) {
+		response.Latency = at.Sub(sent)
+	}
+	return response, nil
+}
+
+func typeName(t layers.DNSType) string {
+	if name := t.String(); name != "Unknown" {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+func rcodeName(code layers.DNSResponseCode) string {
+	if name, ok := rcodeNames[code]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(code))
+}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	clientIP = net.ParseIP("10.0.0.1")
+	serverIP = net.ParseIP("10.0.0.53")
+	apiIP    = net.ParseIP("93.184.216.34").To4()
+)
+
+func serialize(t *testing.T, msg *layers.DNS) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}))
+	return buf.Bytes()
+}
+
+func TestQueryAndResponse(t *testing.T) {
+	p := NewParser()
+	start := time.Unix(1700000000, 0)
+	question := layers.DNSQuestion{Name: []byte("API.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+
+	query := serialize(t, &layers.DNS{ID: 7, RD: true, Questions: []layers.DNSQuestion{question}})
+	content, err := p.Parse(clientIP, 40000, serverIP, Port, query, start)
+	require.NoError(t, err)
+	assert.Equal(t, Query{ID: 7, Name: "api.example.com", Type: "A"}, content)
+
+	response := serialize(t, &layers.DNS{
+		ID:        7,
+		QR:        true,
+		RD:        true,
+		RA:        true,
+		Questions: []layers.DNSQuestion{question},
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("api.example.com"), Type: layers.DNSTypeCNAME, Class: layers.DNSClassIN, TTL: 60, CNAME: []byte("edge.example.net")},
+			{Name: []byte("edge.example.net"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: apiIP},
+		},
+	})
+	content, err = p.Parse(serverIP, Port, clientIP, 40000, response, start.Add(3*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, Response{
+		ID:        7,
+		Name:      "api.example.com",
+		Type:      "A",
+		RCode:     "NOERROR",
+		Addresses: []net.IP{apiIP},
+		Latency:   3 * time.Millisecond,
+	}, content)
+
+	// A second copy of the response has no query to pair with.
+	content, err = p.Parse(serverIP, Port, clientIP, 40000, response, start.Add(4*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), content.(Response).Latency)
+}
+
+func TestErrorResponse(t *testing.T) {
+	p := NewParser()
+	response := serialize(t, &layers.DNS{
+		ID:           9,
+		QR:           true,
+		ResponseCode: layers.DNSResponseCodeNXDomain,
+		Questions:    []layers.DNSQuestion{{Name: []byte("missing.example.com"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN}},
+	})
+	content, err := p.Parse(serverIP, Port, clientIP, 40000, response, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, Response{ID: 9, Name: "missing.example.com", Type: "AAAA", RCode: "NXDOMAIN"}, content)
+
+	_, err = p.Parse(clientIP, 40000, serverIP, Port, []byte("not DNS"), time.Now())
+	assert.Error(t, err)
+}
@@ -0,0 +1,42 @@
+// Package dns parses DNS messages carried over UDP into the queries a client
+// sends and the responses it gets back.
+package dns
+
+import (
+	"net"
+	"time"
+
+	"github.com/akitasoftware/akita-cli/pcap/parsed"
+)
+
+// A DNS query. It is answered by the Response with the same ID, sent between
+// the same addresses.
+type Query struct {
+	parsed.Content
+
+	ID uint16
+
+	// The name and record type asked about, e.g. "api.example.com" and
+	// "AAAA".
+	Name string
+	Type string
+}
+
+// A DNS response.
+type Response struct {
+	parsed.Content
+
+	ID   uint16
+	Name string
+	Type string
+
+	// The response code, e.g. "NOERROR" or "NXDOMAIN".
+	RCode string
+
+	// The IPv4 and IPv6 addresses in the answer. Name resolves to them,
+	// possibly through CNAME records.
+	Addresses []net.IP
+
+	// Time from the query to this response, or 0 if the query wasn't seen.
+	Latency time.Duration
+}
@@ -0,0 +1,105 @@
+// Package http2 parses cleartext HTTP/2 (h2c) connections, including gRPC,
+// into HTTP requests and responses.
+package http2
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/google/gopacket/reassembly"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// The client connection preface. See RFC 7540, section 3.5.
+	clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	frameHeaderLen = 9
+
+	// Default SETTINGS_MAX_FRAME_SIZE.
+	defaultMaxFrameSize = 1 << 14
+)
+
+// Returns a factory for parsers that handle an entire HTTP/2 connection flow.
+//
+// A flow is accepted if it starts with the client connection preface, or with
+// the SETTINGS frame that begins the server's connection preface. Connections
+// that were already established when capture started can't be parsed, because
+// the HPACK state needed to decode their headers is unknown.
+func NewHTTP2ParserFactory() akinet.TCPParserFactory {
+	return parserFactory{}
+}
+
+type parserFactory struct{}
+
+func (parserFactory) Name() string {
+	return "HTTP/2 Parser Factory"
+}
+
+func (parserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+			discardFront = 0
+		}
+	}()
+
+	head := readPrefix(input, int64(len(clientPreface)))
+
+	// Client side.
+	if bytes.HasPrefix(head, []byte(clientPreface)) {
+		return akinet.Accept, 0
+	} else if bytes.HasPrefix([]byte(clientPreface), head) {
+		return akinet.NeedMoreData, 0
+	}
+
+	// Server side: an initial SETTINGS frame on stream 0 without the ACK flag.
+	// Its payload is a list of 6-byte settings.
+	if isInitialSettingsFrameHeader(head) {
+		if len(head) < frameHeaderLen {
+			return akinet.NeedMoreData, 0
+		}
+		return akinet.Accept, 0
+	}
+	return akinet.Reject, 0
+}
+
+func (parserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(id)
+}
+
+// Returns true if b is consistent with being a prefix of the header of the
+// SETTINGS frame that starts the server's connection preface.
+func isInitialSettingsFrameHeader(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	// The length is a 24-bit big-endian integer.
+	if len(b) >= 3 {
+		length := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		if length > defaultMaxFrameSize || length%6 != 0 {
+			return false
+		}
+	} else if b[0] != 0 {
+		return false
+	}
+
+	expected := []byte{frameTypeSettings, 0, 0, 0, 0, 0}
+	for i := 3; i < len(b) && i < frameHeaderLen; i++ {
+		if b[i] != expected[i-3] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns up to n bytes from the start of the input.
+func readPrefix(input memview.MemView, n int64) []byte {
+	if input.Len() < n {
+		n = input.Len()
+	}
+	b, _ := io.ReadAll(input.SubView(0, n).CreateReader())
+	return b
+}
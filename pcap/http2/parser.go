@@ -0,0 +1,420 @@
+package http2
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	akihttp "github.com/akitasoftware/akita-libs/akinet/http"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Frame types. See RFC 7540, section 6.
+const (
+	frameTypeData         = 0x0
+	frameTypeHeaders      = 0x1
+	frameTypePriority     = 0x2
+	frameTypeRSTStream    = 0x3
+	frameTypeSettings     = 0x4
+	frameTypePushPromise  = 0x5
+	frameTypePing         = 0x6
+	frameTypeGoAway       = 0x7
+	frameTypeWindowUpdate = 0x8
+	frameTypeContinuation = 0x9
+)
+
+// Frame flags.
+const (
+	flagEndStream  = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+const (
+	// Largest frame we are willing to buffer. This is the largest frame size a
+	// peer can negotiate.
+	maxFrameSize = 1<<24 - 1
+
+	// Maximum number of streams tracked at once. Headers for streams beyond this
+	// are still decoded, to keep the HPACK state in sync, but the streams are
+	// otherwise ignored.
+	maxOpenStreams = 1000
+
+	// Upper bound on the HPACK dynamic table size that the peer may choose.
+	maxDynamicTableSize = 1 << 20
+)
+
+// Parses one direction of an HTTP/2 connection. Each complete stream yields an
+// HTTPRequest or HTTPResponse, depending on its pseudo-headers. Requests and
+// responses share the connection's bidi ID as their stream ID and use the
+// HTTP/2 stream ID as their sequence number, so they pair up downstream.
+//
+// Unlike most parsers, this one lives for the whole flow, since the HPACK
+// decoder state must carry over from one stream to the next.
+type parser struct {
+	bidiID akinet.TCPBidiID
+
+	// Bytes of an incomplete frame, carried over from previous calls to Parse.
+	buf []byte
+
+	// Total bytes consumed over the life of the parser.
+	consumed int64
+
+	// Whether we are past the client connection preface, if any.
+	pastPreface bool
+
+	decoder *hpack.Decoder
+	streams map[uint32]*stream
+
+	// Non-nil while a header block is being continued in CONTINUATION frames.
+	pendingBlock *headerBlock
+}
+
+type stream struct {
+	id uint32
+
+	// The first complete header block, excluding interim 1xx responses.
+	headers []hpack.HeaderField
+
+	// Any later header blocks.
+	trailers []hpack.HeaderField
+
+	body []byte
+}
+
+type headerBlock struct {
+	streamID  uint32
+	fragment  []byte
+	endStream bool
+
+	// True for PUSH_PROMISE blocks, which are decoded only to keep the HPACK
+	// state in sync.
+	discard bool
+}
+
+func newParser(bidiID akinet.TCPBidiID) *parser {
+	decoder := hpack.NewDecoder(4096, nil)
+	decoder.SetAllowedMaxDynamicTableSize(maxDynamicTableSize)
+	return &parser{
+		bidiID:  bidiID,
+		decoder: decoder,
+		streams: make(map[uint32]*stream),
+	}
+}
+
+func (*parser) Name() string {
+	return "HTTP/2 Parser"
+}
+
+// Tells the TCP flow to keep this parser after it produces a result.
+func (*parser) ParsesWholeFlow() bool {
+	return true
+}
+
+func (p *parser) Parse(input memview.MemView, isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	newBytes, err := io.ReadAll(input.CreateReader())
+	if err != nil {
+		return nil, memview.MemView{}, p.consumed, errors.Wrap(err, "failed to read input")
+	}
+
+	// Offset in buf where the new input starts.
+	inputStart := len(p.buf)
+	p.buf = append(p.buf, newBytes...)
+
+	// Returns the input after the given offset in buf. The offset is always in
+	// the new input, since earlier input was fully processed.
+	unusedAfter := func(offset int) memview.MemView {
+		return input.SubView(int64(offset-inputStart), input.Len())
+	}
+
+	if !p.pastPreface {
+		if len(p.buf) < len(clientPreface) && strings.HasPrefix(clientPreface, string(p.buf)) {
+			return p.needMoreData(isEnd)
+		}
+
+		p.pastPreface = true
+		if strings.HasPrefix(string(p.buf), clientPreface) {
+			offset := len(clientPreface)
+			p.consumed += int64(offset)
+			p.buf = nil
+			return akinet.HTTP2ConnectionPreface{}, unusedAfter(offset), p.consumed, nil
+		}
+	}
+
+	offset := 0
+	for len(p.buf)-offset >= frameHeaderLen {
+		header := p.buf[offset : offset+frameHeaderLen]
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		frameType := header[3]
+		flags := header[4]
+		streamID := binary.BigEndian.Uint32(header[5:9]) & 0x7fffffff
+
+		if length > maxFrameSize {
+			return nil, memview.MemView{}, p.consumed, errors.Errorf("frame too large: %d bytes", length)
+		}
+		if len(p.buf)-offset < frameHeaderLen+length {
+			break
+		}
+
+		payload := p.buf[offset+frameHeaderLen : offset+frameHeaderLen+length]
+		offset += frameHeaderLen + length
+
+		content, err := p.handleFrame(frameType, flags, streamID, payload)
+		if err != nil {
+			p.consumed += int64(offset)
+			return nil, memview.MemView{}, p.consumed, err
+		}
+		if content != nil {
+			p.consumed += int64(offset)
+			unused := unusedAfter(offset)
+			p.buf = nil
+			return content, unused, p.consumed, nil
+		}
+	}
+
+	// Keep the incomplete frame, if any.
+	p.consumed += int64(offset)
+	p.buf = append([]byte(nil), p.buf[offset:]...)
+	return p.needMoreData(isEnd)
+}
+
+func (p *parser) needMoreData(isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	if isEnd && len(p.buf) > 0 {
+		return nil, memview.MemView{}, p.consumed + int64(len(p.buf)), errors.New("connection ended in the middle of a frame")
+	}
+	return nil, memview.MemView{}, p.consumed, nil
+}
+
+// Processes a single frame. Returns non-nil content when the frame completes a
+// stream.
+func (p *parser) handleFrame(frameType, flags uint8, streamID uint32, payload []byte) (akinet.ParsedNetworkContent, error) {
+	if p.pendingBlock != nil && frameType != frameTypeContinuation {
+		return nil, errors.Errorf("expected CONTINUATION frame, got frame type %d", frameType)
+	}
+
+	switch frameType {
+	case frameTypeData:
+		data, err := removePadding(flags, payload)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := p.streams[streamID]
+		if !ok || s.headers == nil {
+			// Headers were never seen.
+			return nil, nil
+		}
+		if room := akihttp.MaximumHTTPLength - int64(len(s.body)); room > 0 {
+			if int64(len(data)) > room {
+				data = data[:room]
+			}
+			s.body = append(s.body, data...)
+		}
+		if flags&flagEndStream != 0 {
+			return p.finishStream(s), nil
+		}
+		return nil, nil
+
+	case frameTypeHeaders:
+		fragment, err := removePadding(flags, payload)
+		if err != nil {
+			return nil, err
+		}
+		if flags&flagPriority != 0 {
+			if len(fragment) < 5 {
+				return nil, errors.New("HEADERS frame too short for priority")
+			}
+			fragment = fragment[5:]
+		}
+		p.pendingBlock = &headerBlock{
+			streamID:  streamID,
+			fragment:  append([]byte(nil), fragment...),
+			endStream: flags&flagEndStream != 0,
+		}
+		if flags&flagEndHeaders != 0 {
+			return p.finishHeaderBlock()
+		}
+		return nil, nil
+
+	case frameTypePushPromise:
+		fragment, err := removePadding(flags, payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(fragment) < 4 {
+			return nil, errors.New("PUSH_PROMISE frame too short")
+		}
+		p.pendingBlock = &headerBlock{
+			streamID: streamID,
+			fragment: append([]byte(nil), fragment[4:]...),
+			discard:  true,
+		}
+		if flags&flagEndHeaders != 0 {
+			return p.finishHeaderBlock()
+		}
+		return nil, nil
+
+	case frameTypeContinuation:
+		if p.pendingBlock == nil || p.pendingBlock.streamID != streamID {
+			return nil, errors.Errorf("unexpected CONTINUATION frame on stream %d", streamID)
+		}
+		p.pendingBlock.fragment = append(p.pendingBlock.fragment, payload...)
+		if flags&flagEndHeaders != 0 {
+			return p.finishHeaderBlock()
+		}
+		return nil, nil
+
+	case frameTypeRSTStream:
+		delete(p.streams, streamID)
+		return nil, nil
+	}
+
+	// PRIORITY, SETTINGS, PING, GOAWAY, WINDOW_UPDATE, and unknown frame types
+	// don't affect what we report.
+	return nil, nil
+}
+
+func (p *parser) finishHeaderBlock() (akinet.ParsedNetworkContent, error) {
+	block := p.pendingBlock
+	p.pendingBlock = nil
+
+	// Every block must be decoded, even for streams we ignore, to keep the HPACK
+	// dynamic table in sync with the peer's encoder.
+	fields, err := p.decoder.DecodeFull(block.fragment)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode header block")
+	}
+	if block.discard {
+		return nil, nil
+	}
+
+	s, ok := p.streams[block.streamID]
+	if !ok {
+		if len(p.streams) >= maxOpenStreams {
+			return nil, nil
+		}
+		s = &stream{id: block.streamID}
+		p.streams[block.streamID] = s
+	}
+
+	if s.headers == nil {
+		if isInterimResponse(fields) {
+			// Wait for the final response headers.
+			return nil, nil
+		}
+		s.headers = fields
+	} else {
+		s.trailers = append(s.trailers, fields...)
+	}
+
+	if block.endStream {
+		return p.finishStream(s), nil
+	}
+	return nil, nil
+}
+
+// Converts a complete stream into an HTTPRequest or HTTPResponse. Returns nil
+// if the stream has neither request nor response pseudo-headers.
+func (p *parser) finishStream(s *stream) akinet.ParsedNetworkContent {
+	delete(p.streams, s.id)
+
+	pseudo := map[string]string{}
+	header := http.Header{}
+	var cookies []string
+	for _, f := range s.headers {
+		if strings.HasPrefix(f.Name, ":") {
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		if f.Name == "cookie" {
+			// Cookies may be split across several fields. See RFC 7540, section
+			// 8.1.2.5.
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		header.Add(f.Name, f.Value)
+	}
+	if len(cookies) > 0 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	addTrailers(header, s.trailers)
+
+	streamID := uuid.UUID(p.bidiID)
+	seq := int(s.id)
+	body := memview.New(s.body)
+
+	if method, ok := pseudo[":method"]; ok {
+		u, err := url.ParseRequestURI(pseudo[":path"])
+		if err != nil {
+			u = &url.URL{Path: pseudo[":path"]}
+		}
+		host := pseudo[":authority"]
+		if host == "" {
+			host = header.Get("Host")
+		}
+		return akinet.HTTPRequest{
+			StreamID:   streamID,
+			Seq:        seq,
+			Method:     method,
+			ProtoMajor: 2,
+			ProtoMinor: 0,
+			URL:        u,
+			Host:       host,
+			Header:     header,
+			Body:       body,
+			Cookies:    (&http.Request{Header: header}).Cookies(),
+		}
+	}
+
+	if status, ok := pseudo[":status"]; ok {
+		statusCode, err := strconv.Atoi(status)
+		if err != nil {
+			return nil
+		}
+		return akinet.HTTPResponse{
+			StreamID:   streamID,
+			Seq:        seq,
+			StatusCode: statusCode,
+			ProtoMajor: 2,
+			ProtoMinor: 0,
+			Header:     header,
+			Body:       body,
+			Cookies:    (&http.Response{Header: header}).Cookies(),
+		}
+	}
+
+	return nil
+}
+
+// Returns true for 1xx response headers other than 101, which are followed by
+// the final response headers on the same stream.
+func isInterimResponse(fields []hpack.HeaderField) bool {
+	for _, f := range fields {
+		if f.Name == ":status" {
+			return len(f.Value) == 3 && f.Value[0] == '1' && f.Value != "101"
+		}
+	}
+	return false
+}
+
+func removePadding(flags uint8, payload []byte) ([]byte, error) {
+	if flags&flagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) < 1 {
+		return nil, errors.New("padded frame is empty")
+	}
+	padLen := int(payload[0])
+	if padLen >= len(payload) {
+		return nil, errors.New("padding exceeds frame length")
+	}
+	return payload[1 : len(payload)-padLen], nil
+}
@@ -0,0 +1,195 @@
+package http2
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+func encodeHeaders(t *testing.T, enc *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		require.NoError(t, enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]}))
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// Parses the input one byte at a time, to exercise reassembly of frames split
+// across packets, and returns everything that was produced.
+func parseAll(t *testing.T, input []byte) []akinet.ParsedNetworkContent {
+	decision, _ := NewHTTP2ParserFactory().Accepts(memview.New(input), false)
+	require.Equal(t, akinet.Accept, decision)
+
+	p := NewHTTP2ParserFactory().CreateParser(akinet.TCPBidiID(uuid.New()), 0, 0)
+	var results []akinet.ParsedNetworkContent
+	pending := input
+	for len(pending) > 0 {
+		chunk := pending[:1]
+		pending = pending[1:]
+		for {
+			content, unused, _, err := p.Parse(memview.New(chunk), false)
+			require.NoError(t, err)
+			if content == nil {
+				break
+			}
+			results = append(results, content)
+			if unused.Len() == 0 {
+				break
+			}
+			chunk, _ = io.ReadAll(unused.CreateReader())
+		}
+	}
+	return results
+}
+
+func TestParseClientFlow(t *testing.T) {
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	framer := http2.NewFramer(&out, nil)
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+
+	require.NoError(t, framer.WriteSettings())
+
+	// A gRPC call split into HEADERS, CONTINUATION, and DATA frames.
+	block := encodeHeaders(t, enc, &hbuf,
+		":method", "POST",
+		":scheme", "http",
+		":authority", "dogs.svc:50051",
+		":path", "/dogs.v1.Kennel/GetDog",
+		"content-type", "application/grpc",
+		"cookie", "a=1",
+		"cookie", "b=2",
+	)
+	require.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: block[:3],
+	}))
+	require.NoError(t, framer.WriteContinuation(1, true, block[3:]))
+	require.NoError(t, framer.WriteData(1, true, []byte{0, 0, 0, 0, 2, 0x08, 0x2a}))
+
+	// A second request reuses entries from the dynamic table.
+	block = encodeHeaders(t, enc, &hbuf,
+		":method", "GET",
+		":scheme", "http",
+		":authority", "dogs.svc:50051",
+		":path", "/healthz?verbose=1",
+	)
+	require.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: block,
+		EndStream:     true,
+		EndHeaders:    true,
+	}))
+
+	results := parseAll(t, out.Bytes())
+	require.Len(t, results, 3)
+	assert.IsType(t, akinet.HTTP2ConnectionPreface{}, results[0])
+
+	req, ok := results[1].(akinet.HTTPRequest)
+	require.True(t, ok)
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "/dogs.v1.Kennel/GetDog", req.URL.Path)
+	assert.Equal(t, "dogs.svc:50051", req.Host)
+	assert.Equal(t, 1, req.Seq)
+	assert.Equal(t, 2, req.ProtoMajor)
+	assert.Equal(t, "application/grpc", req.Header.Get("Content-Type"))
+	assert.Equal(t, "a=1; b=2", req.Header.Get("Cookie"))
+	assert.Len(t, req.Cookies, 2)
+	assert.Equal(t, "\x00\x00\x00\x00\x02\x08\x2a", req.Body.String())
+
+	req, ok = results[2].(akinet.HTTPRequest)
+	require.True(t, ok)
+	assert.Equal(t, "GET", req.Method)
+	assert.Equal(t, "/healthz", req.URL.Path)
+	assert.Equal(t, "verbose=1", req.URL.RawQuery)
+	assert.Equal(t, "dogs.svc:50051", req.Host)
+	assert.Equal(t, 3, req.Seq)
+}
+
+func TestParseServerFlow(t *testing.T) {
+	var out bytes.Buffer
+	framer := http2.NewFramer(&out, nil)
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+
+	require.NoError(t, framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100}))
+
+	// Interim response, then headers, data and trailers.
+	require.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: encodeHeaders(t, enc, &hbuf, ":status", "100"),
+		EndHeaders:    true,
+	}))
+	require.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: encodeHeaders(t, enc, &hbuf, ":status", "200", "content-type", "application/grpc"),
+		EndHeaders:    true,
+	}))
+	require.NoError(t, framer.WriteDataPadded(1, false, []byte{0, 0, 0, 0, 0}, []byte{0, 0, 0}))
+	require.NoError(t, framer.WriteRSTStream(5, http2.ErrCodeCancel))
+	require.NoError(t, framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: encodeHeaders(t, enc, &hbuf, "grpc-status", "14", "grpc-message", "upstream%20unavailable"),
+		EndStream:     true,
+		EndHeaders:    true,
+	}))
+
+	results := parseAll(t, out.Bytes())
+	require.Len(t, results, 1)
+
+	resp, ok := results[0].(akinet.HTTPResponse)
+	require.True(t, ok)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 1, resp.Seq)
+	assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+	assert.Equal(t, int64(5), resp.Body.Len())
+
+	// Trailers are kept apart from the headers.
+	assert.Empty(t, resp.Header.Get("Grpc-Status"))
+	assert.Equal(t, "14", Trailer(resp.Header, "grpc-status"))
+	code, message, ok := GRPCStatus(resp)
+	assert.True(t, ok)
+	assert.Equal(t, 14, code)
+	assert.Equal(t, "upstream unavailable", message)
+	assert.True(t, GRPCFailed(resp))
+}
+
+func TestGRPCStatus(t *testing.T) {
+	// Trailers-only responses carry the status in their headers.
+	resp := akinet.HTTPResponse{StatusCode: 200, Header: http.Header{"Grpc-Status": {"0"}}}
+	code, _, ok := GRPCStatus(resp)
+	assert.True(t, ok)
+	assert.Equal(t, 0, code)
+	assert.False(t, GRPCFailed(resp))
+
+	_, _, ok = GRPCStatus(akinet.HTTPResponse{StatusCode: 200, Header: http.Header{}})
+	assert.False(t, ok)
+}
+
+func TestAccepts(t *testing.T) {
+	f := NewHTTP2ParserFactory()
+
+	decision, _ := f.Accepts(memview.New([]byte("PRI * HTTP")), false)
+	assert.Equal(t, akinet.NeedMoreData, decision)
+
+	decision, _ = f.Accepts(memview.New([]byte("GET / HTTP/1.1\r\n")), false)
+	assert.Equal(t, akinet.Reject, decision)
+
+	// SETTINGS ACK isn't the start of a connection.
+	decision, _ = f.Accepts(memview.New([]byte{0, 0, 0, 4, 1, 0, 0, 0, 0}), false)
+	assert.Equal(t, akinet.Reject, decision)
+
+	decision, _ = f.Accepts(memview.New([]byte{0, 0, 6, 4, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 100}), false)
+	assert.Equal(t, akinet.Accept, decision)
+}
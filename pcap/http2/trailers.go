@@ -0,0 +1,64 @@
+package http2
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+// akinet.HTTPRequest and akinet.HTTPResponse have no field for trailers, so
+// they are kept in Header under names prefixed with http.TrailerPrefix, as
+// net/http does for handlers. The prefix keeps them apart from the headers:
+// the names aren't canonicalized, and Header.Get never finds them.
+func addTrailers(header http.Header, trailers []hpack.HeaderField) {
+	for _, f := range trailers {
+		key := http.TrailerPrefix + f.Name
+		header[key] = append(header[key], f.Value)
+	}
+}
+
+// Returns the value of the named trailer, which must be lower case, or "" if
+// there is none.
+func Trailer(header http.Header, name string) string {
+	if values := header[http.TrailerPrefix+name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Returns the gRPC status code and message of a response, and false if it
+// isn't a gRPC response. The status is normally sent in the grpc-status and
+// grpc-message trailers, but responses without a body carry it in their
+// headers instead. A non-zero code means that the call failed, whatever the
+// HTTP status.
+func GRPCStatus(resp akinet.HTTPResponse) (code int, message string, ok bool) {
+	status, rawMessage := Trailer(resp.Header, "grpc-status"), Trailer(resp.Header, "grpc-message")
+	if status == "" {
+		status, rawMessage = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status == "" {
+		return 0, "", false
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0, "", false
+	}
+
+	// The message is percent-encoded.
+	message, err = url.PathUnescape(rawMessage)
+	if err != nil {
+		message = rawMessage
+	}
+	return code, message, true
+}
+
+// Returns true if resp is a gRPC response with a non-zero status.
+func GRPCFailed(resp akinet.HTTPResponse) bool {
+	code, _, ok := GRPCStatus(resp)
+	return ok && code != 0
+}
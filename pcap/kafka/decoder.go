@@ -0,0 +1,152 @@
+package kafka
+
+import (
+	"encoding/binary"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+var errTruncated = errors.New("truncated Kafka message")
+
+// Reads the primitive types of the Kafka protocol. The first error is sticky:
+// once reading fails, every later read returns a zero value, so callers need
+// only check err at the end.
+//
+// flexible selects the compact encodings of strings, arrays and bytes, and
+// enables tagged fields, as used by newer API versions.
+type decoder struct {
+	b        []byte
+	flexible bool
+	err      error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.b = nil
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.fail(errTruncated)
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail(errors.New("invalid varint in Kafka message"))
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// Reads the length of a string, bytes, or array. Returns -1 for null.
+func (d *decoder) length(nonCompact func() int) int {
+	var n int
+	if d.flexible {
+		n = int(d.uvarint()) - 1
+	} else {
+		n = nonCompact()
+	}
+	if n < -1 {
+		d.fail(errors.Errorf("invalid length %d in Kafka message", n))
+		return -1
+	}
+	return n
+}
+
+// Reads a string or nullable string. Null is returned as the empty string.
+func (d *decoder) string() string {
+	n := d.length(func() int { return int(d.int16()) })
+	if n <= 0 {
+		return ""
+	}
+	return string(d.take(n))
+}
+
+// Reads bytes or nullable bytes. Null is returned as nil.
+func (d *decoder) bytes() []byte {
+	n := d.length(func() int { return int(d.int32()) })
+	if n < 0 {
+		return nil
+	}
+	return d.take(n)
+}
+
+// Reads the length of an array or nullable array. Returns -1 for null.
+func (d *decoder) arrayLen() int {
+	n := d.length(func() int { return int(d.int32()) })
+	// Every element takes at least a byte, which limits what we allocate for
+	// corrupt lengths.
+	if n > len(d.b) {
+		d.fail(errTruncated)
+		return -1
+	}
+	return n
+}
+
+func (d *decoder) uuid() uuid.UUID {
+	var id uuid.UUID
+	copy(id[:], d.take(len(id)))
+	return id
+}
+
+// Skips the tagged fields that end each structure in flexible versions.
+func (d *decoder) taggedFields() {
+	if !d.flexible {
+		return
+	}
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		d.uvarint()
+		d.take(int(d.uvarint()))
+	}
+}
+
+// Skips an array of fixed-size elements.
+func (d *decoder) skipArray(elemSize int) {
+	if n := d.arrayLen(); n > 0 {
+		d.take(n * elemSize)
+	}
+}
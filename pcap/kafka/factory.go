@@ -0,0 +1,185 @@
+// Package kafka parses the Kafka wire protocol into requests and responses,
+// reporting which topics and partitions they refer to.
+package kafka
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"unicode"
+
+	"github.com/google/gopacket/reassembly"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Length of the size prefix on each request and response.
+	sizeLen = 4
+
+	// Length of a request header up to the length of the client ID: API key,
+	// API version, and correlation ID.
+	requestHeaderFixedLen = 8
+
+	// Largest message we accept. Brokers default to about 100 MiB.
+	maxMessageSize = 100 * 1024 * 1024
+
+	// Limits what we consider a plausible request header. Kafka defines fewer
+	// API keys and versions than these.
+	maxAPIKey     = 128
+	maxAPIVersion = 32
+)
+
+// A request whose response hasn't been parsed yet, kept in the Extra field
+// of the connection's pending requests.
+type pendingRequest struct {
+	correlationID int32
+	apiKey        APIKey
+	apiVersion    int16
+	clientID      string
+}
+
+// Counts requests awaiting a response by correlation ID, across connections.
+// The response factory doesn't know which connection it is looking at, so it
+// uses this to judge whether data looks like a response.
+type correlationIDs struct {
+	mutex  sync.Mutex
+	counts map[int32]int
+}
+
+func newCorrelationIDs() *correlationIDs {
+	return &correlationIDs{
+		counts: make(map[int32]int),
+	}
+}
+
+func (c *correlationIDs) add(id int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[id]++
+}
+
+func (c *correlationIDs) remove(id int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.counts[id]--; c.counts[id] <= 0 {
+		delete(c.counts, id)
+	}
+}
+
+func (c *correlationIDs) contains(id int32) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[id] > 0
+}
+
+// Returns factories for parsers of Kafka requests and responses. They must be
+// used together, since responses are matched with the requests before them.
+func NewParserFactories() (requests, responses akinet.TCPParserFactory) {
+	ids := newCorrelationIDs()
+	conns := conntrack.NewConnectionsWithForget(func(p conntrack.Pending) {
+		ids.remove(p.Extra.(pendingRequest).correlationID)
+	})
+	return requestParserFactory{conns: conns, ids: ids}, responseParserFactory{conns: conns, ids: ids}
+}
+
+type requestParserFactory struct {
+	conns *conntrack.Connections
+	ids   *correlationIDs
+}
+
+func (requestParserFactory) Name() string {
+	return "Kafka Request Parser Factory"
+}
+
+// Kafka has no magic bytes, so a request is recognized by a plausible size,
+// API key and version, and a printable client ID.
+func (requestParserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	prefixLen := int64(sizeLen + requestHeaderFixedLen + 2)
+	if input.Len() < prefixLen {
+		return akinet.NeedMoreData, 0
+	}
+	head := readPrefix(input, prefixLen)
+
+	size := int32(binary.BigEndian.Uint32(head))
+	apiKey := int16(binary.BigEndian.Uint16(head[4:]))
+	apiVersion := int16(binary.BigEndian.Uint16(head[6:]))
+	correlationID := int32(binary.BigEndian.Uint32(head[8:]))
+	clientIDLen := int16(binary.BigEndian.Uint16(head[12:]))
+
+	if size < requestHeaderFixedLen+2 || size > maxMessageSize ||
+		apiKey < 0 || apiKey > maxAPIKey ||
+		apiVersion < 0 || apiVersion > maxAPIVersion ||
+		correlationID < 0 ||
+		clientIDLen < -1 || int32(clientIDLen) > size-requestHeaderFixedLen-2 {
+		return akinet.Reject, 0
+	}
+	if clientIDLen <= 0 {
+		return akinet.Accept, 0
+	}
+
+	if input.Len() < prefixLen+int64(clientIDLen) {
+		return akinet.NeedMoreData, 0
+	}
+	clientID := readPrefix(input, prefixLen+int64(clientIDLen))[prefixLen:]
+	for _, r := range string(clientID) {
+		if !unicode.IsPrint(r) {
+			return akinet.Reject, 0
+		}
+	}
+	return akinet.Accept, 0
+}
+
+func (f requestParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), f.ids, id, true)
+}
+
+type responseParserFactory struct {
+	conns *conntrack.Connections
+	ids   *correlationIDs
+}
+
+func (responseParserFactory) Name() string {
+	return "Kafka Response Parser Factory"
+}
+
+// A response is recognized by a plausible size and the correlation ID of a
+// request that is awaiting its response.
+func (f responseParserFactory) Accepts(input memview.MemView, isEnd bool) (akinet.AcceptDecision, int64) {
+	prefixLen := int64(sizeLen + 4)
+	if input.Len() < prefixLen {
+		if isEnd {
+			return akinet.Reject, 0
+		}
+		return akinet.NeedMoreData, 0
+	}
+	head := readPrefix(input, prefixLen)
+
+	size := int32(binary.BigEndian.Uint32(head))
+	correlationID := int32(binary.BigEndian.Uint32(head[4:]))
+	if size < 4 || size > maxMessageSize || !f.ids.contains(correlationID) {
+		return akinet.Reject, 0
+	}
+	return akinet.Accept, 0
+}
+
+func (f responseParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), f.ids, id, false)
+}
+
+// Returns up to n bytes from the start of the input.
+func readPrefix(input memview.MemView, n int64) []byte {
+	if input.Len() < n {
+		n = input.Len()
+	}
+	b, _ := io.ReadAll(input.SubView(0, n).CreateReader())
+	return b
+}
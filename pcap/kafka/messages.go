@@ -0,0 +1,337 @@
+package kafka
+
+import (
+	"encoding/binary"
+)
+
+// Returns true if the given version of an API uses the flexible encoding, with
+// compact types and tagged fields. Only meaningful for the APIs whose bodies
+// we decode.
+func isFlexible(key APIKey, version int16) bool {
+	switch key {
+	case Produce, Metadata:
+		return version >= 9
+	case Fetch:
+		return version >= 12
+	}
+	return false
+}
+
+// Reads a topic name or, in versions that identify topics by ID, a topic ID.
+func (d *decoder) topic(byID bool) string {
+	if byID {
+		return d.uuid().String()
+	}
+	return d.string()
+}
+
+// Decodes the body of a request, returning the partitions it refers to. The
+// result is partial if the body can't be fully decoded.
+func decodeRequestBody(d *decoder, key APIKey, version int16) []PartitionStats {
+	switch key {
+	case Produce:
+		return decodeProduceRequest(d, version)
+	case Fetch:
+		return decodeFetchRequest(d, version)
+	case Metadata:
+		return decodeMetadataRequest(d, version)
+	}
+	return nil
+}
+
+// Decodes the body of a response, returning the partitions it refers to. The
+// result is partial if the body can't be fully decoded.
+func decodeResponseBody(d *decoder, key APIKey, version int16) []PartitionStats {
+	switch key {
+	case Produce:
+		return decodeProduceResponse(d, version)
+	case Fetch:
+		return decodeFetchResponse(d, version)
+	case Metadata:
+		return decodeMetadataResponse(d, version)
+	}
+	return nil
+}
+
+func decodeProduceRequest(d *decoder, version int16) []PartitionStats {
+	if version >= 3 {
+		d.string() // transactional_id
+	}
+	d.int16() // acks
+	d.int32() // timeout_ms
+
+	var stats []PartitionStats
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.topic(version >= 13)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			records := d.bytes()
+			d.taggedFields()
+			stats = append(stats, PartitionStats{
+				Topic:       topic,
+				Partition:   partition,
+				RecordCount: countRecords(records),
+				RecordBytes: len(records),
+			})
+		}
+		d.taggedFields()
+	}
+	return stats
+}
+
+func decodeProduceResponse(d *decoder, version int16) []PartitionStats {
+	var stats []PartitionStats
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.topic(version >= 13)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			errorCode := d.int16()
+			d.int64() // base_offset
+			if version >= 2 {
+				d.int64() // log_append_time_ms
+			}
+			if version >= 5 {
+				d.int64() // log_start_offset
+			}
+			if version >= 8 {
+				for k, l := 0, d.arrayLen(); k < l && d.err == nil; k++ {
+					d.int32()  // batch_index
+					d.string() // batch_index_error_message
+					d.taggedFields()
+				}
+				d.string() // error_message
+			}
+			d.taggedFields()
+			stats = append(stats, PartitionStats{
+				Topic:     topic,
+				Partition: partition,
+				ErrorCode: errorCode,
+			})
+		}
+		d.taggedFields()
+	}
+	return stats
+}
+
+func decodeFetchRequest(d *decoder, version int16) []PartitionStats {
+	if version <= 14 {
+		d.int32() // replica_id
+	}
+	d.int32() // max_wait_ms
+	d.int32() // min_bytes
+	if version >= 3 {
+		d.int32() // max_bytes
+	}
+	if version >= 4 {
+		d.int8() // isolation_level
+	}
+	if version >= 7 {
+		d.int32() // session_id
+		d.int32() // session_epoch
+	}
+
+	var stats []PartitionStats
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.topic(version >= 13)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			if version >= 9 {
+				d.int32() // current_leader_epoch
+			}
+			d.int64() // fetch_offset
+			if version >= 12 {
+				d.int32() // last_fetched_epoch
+			}
+			if version >= 5 {
+				d.int64() // log_start_offset
+			}
+			d.int32() // partition_max_bytes
+			d.taggedFields()
+			stats = append(stats, PartitionStats{
+				Topic:     topic,
+				Partition: partition,
+			})
+		}
+		d.taggedFields()
+	}
+	return stats
+}
+
+func decodeFetchResponse(d *decoder, version int16) []PartitionStats {
+	if version >= 1 {
+		d.int32() // throttle_time_ms
+	}
+	if version >= 7 {
+		d.int16() // error_code
+		d.int32() // session_id
+	}
+
+	var stats []PartitionStats
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.topic(version >= 13)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			errorCode := d.int16()
+			d.int64() // high_watermark
+			if version >= 4 {
+				d.int64() // last_stable_offset
+			}
+			if version >= 5 {
+				d.int64() // log_start_offset
+			}
+			if version >= 4 {
+				for k, l := 0, d.arrayLen(); k < l && d.err == nil; k++ {
+					d.int64() // producer_id
+					d.int64() // first_offset
+					d.taggedFields()
+				}
+			}
+			if version >= 11 {
+				d.int32() // preferred_read_replica
+			}
+			records := d.bytes()
+			d.taggedFields()
+			stats = append(stats, PartitionStats{
+				Topic:       topic,
+				Partition:   partition,
+				ErrorCode:   errorCode,
+				RecordCount: countRecords(records),
+				RecordBytes: len(records),
+			})
+		}
+		d.taggedFields()
+	}
+	return stats
+}
+
+func decodeMetadataRequest(d *decoder, version int16) []PartitionStats {
+	var stats []PartitionStats
+	// A null array requests all topics.
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		var topic string
+		if version >= 10 {
+			id := d.uuid()
+			topic = d.string()
+			if topic == "" {
+				topic = id.String()
+			}
+		} else {
+			topic = d.string()
+		}
+		d.taggedFields()
+		stats = append(stats, PartitionStats{
+			Topic:     topic,
+			Partition: -1,
+		})
+	}
+	return stats
+}
+
+func decodeMetadataResponse(d *decoder, version int16) []PartitionStats {
+	if version >= 3 {
+		d.int32() // throttle_time_ms
+	}
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		d.int32()  // node_id
+		d.string() // host
+		d.int32()  // port
+		if version >= 1 {
+			d.string() // rack
+		}
+		d.taggedFields()
+	}
+	if version >= 2 {
+		d.string() // cluster_id
+	}
+	if version >= 1 {
+		d.int32() // controller_id
+	}
+
+	var stats []PartitionStats
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topicError := d.int16()
+		topic := d.string()
+		if version >= 10 {
+			if id := d.uuid(); topic == "" {
+				topic = id.String()
+			}
+		}
+		if version >= 1 {
+			d.int8() // is_internal
+		}
+
+		numPartitions := d.arrayLen()
+		if numPartitions <= 0 {
+			// Report the topic even when it has no partitions, which is where
+			// errors such as UNKNOWN_TOPIC_OR_PARTITION show up.
+			stats = append(stats, PartitionStats{
+				Topic:     topic,
+				Partition: -1,
+				ErrorCode: topicError,
+			})
+		}
+		for j := 0; j < numPartitions && d.err == nil; j++ {
+			errorCode := d.int16()
+			partition := d.int32()
+			d.int32() // leader_id
+			if version >= 7 {
+				d.int32() // leader_epoch
+			}
+			d.skipArray(4) // replica_nodes
+			d.skipArray(4) // isr_nodes
+			if version >= 5 {
+				d.skipArray(4) // offline_replicas
+			}
+			d.taggedFields()
+			stats = append(stats, PartitionStats{
+				Topic:     topic,
+				Partition: partition,
+				ErrorCode: errorCode,
+			})
+		}
+		if version >= 8 {
+			d.int32() // topic_authorized_operations
+		}
+		d.taggedFields()
+	}
+	return stats
+}
+
+const (
+	// Offsets into a record batch (magic 2) or a legacy message (magic 0 and 1).
+	// Both start with an offset and a length, and have the magic byte at the
+	// same place.
+	recordSetLengthOffset = 8
+	recordSetHeaderLen    = 12
+	recordSetMagicOffset  = 16
+
+	// Offset of the record count in a record batch.
+	recordBatchCountOffset = 57
+)
+
+// Counts the records in a record set: a sequence of record batches or, in
+// older versions, legacy messages. A legacy message that wraps a compressed
+// set of messages counts as one. A truncated final batch isn't counted, since
+// brokers may send one at the end of a fetch.
+func countRecords(b []byte) int {
+	count := 0
+	for len(b) > recordSetMagicOffset {
+		length := int32(binary.BigEndian.Uint32(b[recordSetLengthOffset:]))
+		if length < 0 || int64(length) > int64(len(b)-recordSetHeaderLen) {
+			break
+		}
+
+		if b[recordSetMagicOffset] >= 2 {
+			if len(b) < recordBatchCountOffset+4 {
+				break
+			}
+			if n := int32(binary.BigEndian.Uint32(b[recordBatchCountOffset:])); n > 0 {
+				count += int(n)
+			}
+		} else {
+			count++
+		}
+		b = b[recordSetHeaderLen+int(length):]
+	}
+	return count
+}
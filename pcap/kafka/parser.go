@@ -0,0 +1,187 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Largest part of a message that we buffer for decoding. The rest of a larger
+// message is skipped, so only the partitions described within this prefix are
+// reported.
+const maxBufferedMessage = 10 * 1024 * 1024
+
+// Parses a single Kafka request or response.
+type parser struct {
+	conn      *conntrack.Connection
+	ids       *correlationIDs
+	bidiID    akinet.TCPBidiID
+	isRequest bool
+
+	// The start of the message, including the size prefix.
+	buf []byte
+
+	// Total length of the message, including the size prefix. Zero until the
+	// size prefix has been read.
+	size int
+
+	// Bytes of the message that were skipped rather than buffered.
+	skipped int
+}
+
+func newParser(conn *conntrack.Connection, ids *correlationIDs, bidiID akinet.TCPBidiID, isRequest bool) *parser {
+	return &parser{
+		conn:      conn,
+		ids:       ids,
+		bidiID:    bidiID,
+		isRequest: isRequest,
+	}
+}
+
+func (p *parser) Name() string {
+	if p.isRequest {
+		return "Kafka Request Parser"
+	}
+	return "Kafka Response Parser"
+}
+
+func (p *parser) Parse(input memview.MemView, isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	data, err := io.ReadAll(input.CreateReader())
+	if err != nil {
+		return nil, memview.MemView{}, int64(p.read()), errors.Wrap(err, "failed to read input")
+	}
+
+	offset := 0
+	if p.size == 0 {
+		n := sizeLen - len(p.buf)
+		if n > len(data) {
+			n = len(data)
+		}
+		p.buf = append(p.buf, data[:n]...)
+		offset = n
+		if len(p.buf) == sizeLen {
+			size := int32(binary.BigEndian.Uint32(p.buf))
+			if size < 0 || size > maxMessageSize {
+				return nil, memview.MemView{}, int64(p.read()), errors.Errorf("invalid Kafka message size %d", size)
+			}
+			p.size = sizeLen + int(size)
+		}
+	}
+
+	if p.size > 0 {
+		n := p.size - p.read()
+		if n > len(data)-offset {
+			n = len(data) - offset
+		}
+		keep := n
+		if room := maxBufferedMessage - len(p.buf); keep > room {
+			keep = room
+		}
+		p.buf = append(p.buf, data[offset:offset+keep]...)
+		p.skipped += n - keep
+		offset += n
+
+		if p.read() == p.size {
+			content, err := p.decode()
+			if err != nil {
+				return nil, memview.MemView{}, int64(p.size), err
+			}
+			return content, input.SubView(int64(offset), input.Len()), int64(p.size), nil
+		}
+	}
+
+	if isEnd {
+		return nil, memview.MemView{}, int64(p.read()), errors.New("connection ended in the middle of a Kafka message")
+	}
+	return nil, memview.MemView{}, int64(p.read()), nil
+}
+
+// Returns the number of bytes of the message read so far.
+func (p *parser) read() int {
+	return len(p.buf) + p.skipped
+}
+
+func (p *parser) decode() (akinet.ParsedNetworkContent, error) {
+	if p.isRequest {
+		return p.decodeRequest()
+	}
+	return p.decodeResponse()
+}
+
+func (p *parser) decodeRequest() (akinet.ParsedNetworkContent, error) {
+	d := &decoder{b: p.buf[sizeLen:]}
+	key := APIKey(d.int16())
+	version := d.int16()
+	correlationID := d.int32()
+	clientID := d.string()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "failed to decode Kafka request header")
+	}
+	if isFlexible(key, version) {
+		d.flexible = true
+		d.taggedFields()
+	}
+
+	p.conn.Lock()
+	p.ids.add(correlationID)
+	p.conn.Push(conntrack.Pending{Extra: pendingRequest{
+		correlationID: correlationID,
+		apiKey:        key,
+		apiVersion:    version,
+		clientID:      clientID,
+	}})
+	p.conn.Unlock()
+
+	return Request{
+		StreamID:      uuid.UUID(p.bidiID),
+		CorrelationID: correlationID,
+		APIKey:        key,
+		APIVersion:    version,
+		ClientID:      clientID,
+		Partitions:    decodeRequestBody(d, key, version),
+		Size:          p.size,
+	}, nil
+}
+
+func (p *parser) decodeResponse() (akinet.ParsedNetworkContent, error) {
+	d := &decoder{b: p.buf[sizeLen:]}
+	correlationID := d.int32()
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "failed to decode Kafka response header")
+	}
+
+	// Brokers answer requests in order, so the requests before the matching
+	// one were never answered, or their responses were missed.
+	p.conn.Lock()
+	pending, ok := p.conn.PopMatching(func(p conntrack.Pending) bool {
+		return p.Extra.(pendingRequest).correlationID == correlationID
+	})
+	if ok {
+		p.ids.remove(correlationID)
+	}
+	p.conn.Unlock()
+	if !ok {
+		return nil, errors.Errorf("Kafka response with unknown correlation ID %d", correlationID)
+	}
+	req := pending.Extra.(pendingRequest)
+	if isFlexible(req.apiKey, req.apiVersion) {
+		d.flexible = true
+		d.taggedFields()
+	}
+
+	return Response{
+		StreamID:      uuid.UUID(p.bidiID),
+		CorrelationID: correlationID,
+		APIKey:        req.apiKey,
+		APIVersion:    req.apiVersion,
+		ClientID:      req.clientID,
+		Partitions:    decodeResponseBody(d, req.apiKey, req.apiVersion),
+		Size:          p.size,
+	}, nil
+}
@@ -0,0 +1,232 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Builds Kafka messages in the non-flexible encoding, unless flexible is set.
+type encoder struct {
+	b        []byte
+	flexible bool
+}
+
+func (e *encoder) int8(v int8) *encoder {
+	e.b = append(e.b, byte(v))
+	return e
+}
+
+func (e *encoder) put(n int, put func([]byte)) *encoder {
+	b := make([]byte, n)
+	put(b)
+	e.b = append(e.b, b...)
+	return e
+}
+
+func (e *encoder) int16(v int16) *encoder {
+	return e.put(2, func(b []byte) { binary.BigEndian.PutUint16(b, uint16(v)) })
+}
+
+func (e *encoder) int32(v int32) *encoder {
+	return e.put(4, func(b []byte) { binary.BigEndian.PutUint32(b, uint32(v)) })
+}
+
+func (e *encoder) int64(v int64) *encoder {
+	return e.put(8, func(b []byte) { binary.BigEndian.PutUint64(b, uint64(v)) })
+}
+
+func (e *encoder) length(n int, nonCompact func(int)) *encoder {
+	if e.flexible {
+		buf := make([]byte, binary.MaxVarintLen64)
+		e.b = append(e.b, buf[:binary.PutUvarint(buf, uint64(n+1))]...)
+	} else {
+		nonCompact(n)
+	}
+	return e
+}
+
+func (e *encoder) string(s string) *encoder {
+	e.length(len(s), func(n int) { e.int16(int16(n)) })
+	e.b = append(e.b, s...)
+	return e
+}
+
+func (e *encoder) bytes(b []byte) *encoder {
+	e.length(len(b), func(n int) { e.int32(int32(n)) })
+	e.b = append(e.b, b...)
+	return e
+}
+
+func (e *encoder) array(n int) *encoder {
+	return e.length(n, func(n int) { e.int32(int32(n)) })
+}
+
+func (e *encoder) tags() *encoder {
+	if e.flexible {
+		e.b = append(e.b, 0)
+	}
+	return e
+}
+
+// Prepends the size prefix.
+func (e *encoder) message() []byte {
+	return append((&encoder{}).int32(int32(len(e.b))).b, e.b...)
+}
+
+// Returns a record batch header claiming to hold n records, with a body of
+// the given length.
+func recordBatch(n int32, bodyLen int) []byte {
+	b := make([]byte, recordBatchCountOffset+4+bodyLen)
+	binary.BigEndian.PutUint32(b[recordSetLengthOffset:], uint32(len(b)-recordSetHeaderLen))
+	b[recordSetMagicOffset] = 2
+	binary.BigEndian.PutUint32(b[recordBatchCountOffset:], uint32(n))
+	return b
+}
+
+func parseOne(t *testing.T, f akinet.TCPParserFactory, bidiID akinet.TCPBidiID, msg []byte) akinet.ParsedNetworkContent {
+	decision, _ := f.Accepts(memview.New(msg), false)
+	require.Equal(t, akinet.Accept, decision)
+
+	p := f.CreateParser(bidiID, 0, 0)
+	// Split the message to exercise reassembly.
+	content, _, _, err := p.Parse(memview.New(msg[:3]), false)
+	require.NoError(t, err)
+	require.Nil(t, content)
+	content, unused, consumed, err := p.Parse(memview.New(msg[3:]), false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), unused.Len())
+	assert.Equal(t, int64(len(msg)), consumed)
+	return content
+}
+
+func TestProduce(t *testing.T) {
+	requests, responses := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+
+	records := append(recordBatch(3, 20), recordBatch(2, 10)...)
+	req := (&encoder{}).
+		int16(int16(Produce)).int16(7).int32(42).string("billing-service").
+		string("").int16(-1).int32(30000).
+		array(1).string("invoices").
+		array(1).int32(4).bytes(records).
+		message()
+
+	content := parseOne(t, requests, bidiID, req)
+	assert.Equal(t, Request{
+		StreamID:      uuid.UUID(bidiID),
+		CorrelationID: 42,
+		APIKey:        Produce,
+		APIVersion:    7,
+		ClientID:      "billing-service",
+		Partitions: []PartitionStats{
+			{Topic: "invoices", Partition: 4, RecordCount: 5, RecordBytes: len(records)},
+		},
+		Size: len(req),
+	}, content)
+
+	resp := (&encoder{}).
+		int32(42).
+		array(1).string("invoices").
+		array(1).int32(4).int16(0).int64(100).int64(-1).int64(0).
+		int32(0).
+		message()
+
+	content = parseOne(t, responses, bidiID, resp)
+	assert.Equal(t, Response{
+		StreamID:      uuid.UUID(bidiID),
+		CorrelationID: 42,
+		APIKey:        Produce,
+		APIVersion:    7,
+		ClientID:      "billing-service",
+		Partitions: []PartitionStats{
+			{Topic: "invoices", Partition: 4},
+		},
+		Size: len(resp),
+	}, content)
+
+	// The response was matched, so a repeat doesn't look like a response.
+	decision, _ := responses.Accepts(memview.New(resp), false)
+	assert.Equal(t, akinet.Reject, decision)
+}
+
+func TestFlexibleMetadata(t *testing.T) {
+	requests, responses := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+
+	req := &encoder{}
+	req.int16(int16(Metadata)).int16(9).int32(7).string("orders")
+	req.flexible = true
+	req.tags().
+		array(2).string("invoices").tags().string("payments").tags().
+		int8(1).int8(0).int8(0).
+		tags()
+
+	content := parseOne(t, requests, bidiID, req.message())
+	require.IsType(t, Request{}, content)
+	assert.Equal(t, []PartitionStats{
+		{Topic: "invoices", Partition: -1},
+		{Topic: "payments", Partition: -1},
+	}, content.(Request).Partitions)
+
+	resp := &encoder{flexible: true}
+	resp.int32(7).tags().
+		int32(0).
+		array(1).int32(1).string("broker-1").int32(9092).string("").tags().
+		string("cluster").int32(1).
+		array(2).
+		// A topic with one partition.
+		int16(0).string("invoices").int8(0).
+		array(1).int16(0).int32(0).int32(1).int32(5).array(1).int32(1).array(1).int32(1).array(0).tags().
+		int32(0).tags().
+		// A topic that doesn't exist.
+		int16(3).string("payments").int8(0).array(0).int32(0).tags().
+		int32(0).tags()
+
+	content = parseOne(t, responses, bidiID, resp.message())
+	require.IsType(t, Response{}, content)
+	assert.Equal(t, "orders", content.(Response).ClientID)
+	assert.Equal(t, []PartitionStats{
+		{Topic: "invoices", Partition: 0},
+		{Topic: "payments", Partition: -1, ErrorCode: 3},
+	}, content.(Response).Partitions)
+}
+
+func TestFetchResponseRecords(t *testing.T) {
+	// A trailing partial batch isn't counted.
+	records := append(recordBatch(10, 100), recordBatch(4, 50)[:40]...)
+	body := (&encoder{}).
+		int32(0).int16(0).int32(0).
+		array(1).string("invoices").
+		array(1).int32(0).int16(0).int64(500).int64(500).int64(0).array(-1).int32(-1).bytes(records).
+		b
+
+	stats := decodeFetchResponse(&decoder{b: body}, 11)
+	assert.Equal(t, []PartitionStats{
+		{Topic: "invoices", Partition: 0, RecordCount: 10, RecordBytes: len(records)},
+	}, stats)
+}
+
+func TestAcceptsRequest(t *testing.T) {
+	requests, _ := NewParserFactories()
+
+	decision, _ := requests.Accepts(memview.New([]byte("GET / HTTP/1.1\r\n")), false)
+	assert.Equal(t, akinet.Reject, decision)
+
+	// A PostgreSQL startup message resembles a Metadata request, but doesn't
+	// have a plausible client ID.
+	startup := (&encoder{}).int32(196608).b
+	startup = append(startup, "user\x00dog\x00database\x00kennel\x00\x00"...)
+	startup = (&encoder{b: startup}).message()
+	decision, _ = requests.Accepts(memview.New(startup), false)
+	assert.Equal(t, akinet.Reject, decision)
+
+	decision, _ = requests.Accepts(memview.New([]byte{0, 0, 0, 20, 0, 18}), false)
+	assert.Equal(t, akinet.NeedMoreData, decision)
+}
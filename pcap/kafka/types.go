@@ -0,0 +1,86 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/akitasoftware/akita-cli/pcap/parsed"
+)
+
+// Identifies the type of a Kafka request.
+type APIKey int16
+
+// The API keys whose bodies are decoded. Requests and responses for other APIs
+// are reported with their headers only.
+const (
+	Produce  APIKey = 0
+	Fetch    APIKey = 1
+	Metadata APIKey = 3
+)
+
+func (k APIKey) String() string {
+	switch k {
+	case Produce:
+		return "Produce"
+	case Fetch:
+		return "Fetch"
+	case Metadata:
+		return "Metadata"
+	}
+	return fmt.Sprintf("ApiKey(%d)", int16(k))
+}
+
+// What a request or response says about one partition of a topic.
+type PartitionStats struct {
+	Topic string
+
+	// -1 if the message names the topic without any partitions, as Metadata
+	// requests do.
+	Partition int32
+
+	// Error code for the partition. Always 0 in requests.
+	ErrorCode int16
+
+	// The number of records and their total size in bytes. Only set for
+	// messages that carry records: Produce requests and Fetch responses.
+	RecordCount int
+	RecordBytes int
+}
+
+// A Kafka request, sent by a client to a broker.
+type Request struct {
+	parsed.Content
+
+	// Shared by all requests and responses on the same TCP connection.
+	StreamID uuid.UUID
+
+	// Matches the request with its response.
+	CorrelationID int32
+
+	APIKey     APIKey
+	APIVersion int16
+	ClientID   string
+
+	Partitions []PartitionStats
+
+	// Size of the request in bytes, including its length prefix.
+	Size int
+}
+
+// A Kafka response, sent by a broker to a client. The API key, version, and
+// client ID are taken from the matching request.
+type Response struct {
+	parsed.Content
+
+	StreamID      uuid.UUID
+	CorrelationID int32
+
+	APIKey     APIKey
+	APIVersion int16
+	ClientID   string
+
+	Partitions []PartitionStats
+
+	Size int
+}
@@ -0,0 +1,65 @@
+package mysql
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+var errShortPacket = errors.New("packet too short")
+
+// Reads MySQL's little-endian integers from a packet payload. Once a read runs
+// past the end, all further reads return zero, and err is set.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errShortPacket
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+// Reads a length-encoded integer: one byte for values below 251, or a marker
+// byte followed by 2, 3 or 8 bytes.
+func (d *decoder) lengthEncodedInt() uint64 {
+	first := d.take(1)
+	if first == nil {
+		return 0
+	}
+
+	var n int
+	switch first[0] {
+	case 0xfc:
+		n = 2
+	case 0xfd:
+		n = 3
+	case 0xfe:
+		n = 8
+	case 0xfb, 0xff:
+		// NULL, or an error packet's header.
+		d.err = errors.Errorf("invalid length-encoded integer prefix 0x%x", first[0])
+		return 0
+	default:
+		return uint64(first[0])
+	}
+
+	b := d.take(n)
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
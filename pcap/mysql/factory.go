@@ -0,0 +1,226 @@
+// Package mysql parses the MySQL client/server protocol into the statements a
+// client sends and the results the server returns for them.
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/google/gopacket/reassembly"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Length of a packet header: a 3-byte little-endian payload length and a
+	// sequence number.
+	headerLen = 4
+
+	// Payload length of a packet that is continued by the next packet.
+	maxPayloadLen = 1<<24 - 1
+
+	// Protocol version sent in the server's initial handshake.
+	protocolVersion = 10
+
+	// Length of the fixed part of a client's handshake response: capability
+	// flags, maximum packet size, character set, and 23 bytes of filler.
+	handshakeResponseFixedLen = 32
+)
+
+// Commands sent by the client.
+const (
+	comQuit             = 0x01
+	comQuery            = 0x03
+	comStatistics       = 0x09
+	comStmtPrepare      = 0x16
+	comStmtExecute      = 0x17
+	comStmtSendLongData = 0x18
+	comStmtClose        = 0x19
+)
+
+// The first byte of some packets sent by the server.
+const (
+	okHeader          = 0x00
+	localInfileHeader = 0xfb
+	eofHeader         = 0xfe
+	errHeader         = 0xff
+)
+
+// Capability flags, and the server status flag for further result sets.
+const (
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientQueryAttributes  = 0x08000000
+	serverMoreResultsExist = 0x0008
+)
+
+// Returns factories for parsers of the packets sent by MySQL clients and
+// servers. They must be used together, since results are matched with the
+// statements before them.
+func NewParserFactories() (clients, servers akinet.TCPParserFactory) {
+	conns := conntrack.NewConnections()
+	return clientParserFactory{conns: conns}, serverParserFactory{conns: conns}
+}
+
+type clientParserFactory struct {
+	conns *conntrack.Connections
+}
+
+func (clientParserFactory) Name() string {
+	return "MySQL Client Parser Factory"
+}
+
+// Recognizes the client's handshake response on a new connection, or a query
+// or prepared statement on a connection that was already open when capture
+// started. Requests to switch to TLS are rejected, since what follows them
+// can't be parsed.
+func (clientParserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	if input.Len() < headerLen+1 {
+		return akinet.NeedMoreData, 0
+	}
+	head := readPrefix(input, headerLen+handshakeResponseFixedLen)
+	length, seq := packetHeader(head)
+	payload := head[headerLen:]
+	if length == 0 {
+		return akinet.Reject, 0
+	}
+
+	switch seq {
+	case 0:
+		if length < 2 || (payload[0] != comQuery && payload[0] != comStmtPrepare) {
+			return akinet.Reject, 0
+		}
+		if len(payload) < length && len(payload) < 16 {
+			return akinet.NeedMoreData, 0
+		}
+		text := payload[1:]
+		if bytes.HasPrefix(text, []byte{0, 1}) {
+			// No query attributes, in a single parameter set.
+			text = text[2:]
+		}
+		if !conntrack.LooksLikeText(text) {
+			return akinet.Reject, 0
+		}
+		return akinet.Accept, 0
+
+	case 1:
+		if length < handshakeResponseFixedLen {
+			return akinet.Reject, 0
+		}
+		if len(payload) < handshakeResponseFixedLen {
+			return akinet.NeedMoreData, 0
+		}
+		caps := binary.LittleEndian.Uint32(payload)
+		filler := payload[9:handshakeResponseFixedLen]
+		if caps&clientProtocol41 == 0 || !bytes.Equal(filler, make([]byte, len(filler))) {
+			return akinet.Reject, 0
+		}
+		if caps&clientSSL != 0 && length == handshakeResponseFixedLen {
+			return akinet.Reject, 0
+		}
+		return akinet.Accept, 0
+	}
+	return akinet.Reject, 0
+}
+
+func (f clientParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), id, true)
+}
+
+type serverParserFactory struct {
+	conns *conntrack.Connections
+}
+
+func (serverParserFactory) Name() string {
+	return "MySQL Server Parser Factory"
+}
+
+// Recognizes the server's initial handshake on a new connection. On a
+// connection that was already open when capture started, recognizes the OK
+// and error packets and result sets that reply to a statement.
+func (serverParserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	if input.Len() < headerLen+1 {
+		return akinet.NeedMoreData, 0
+	}
+	head := readPrefix(input, 2*headerLen+16)
+	length, seq := packetHeader(head)
+	payload := head[headerLen:]
+	if length == 0 {
+		return akinet.Reject, 0
+	}
+
+	switch {
+	case seq == 0 && payload[0] == protocolVersion:
+		// The initial handshake, which continues with the server version.
+		if len(payload) < length && len(payload) < 8 {
+			return akinet.NeedMoreData, 0
+		}
+		if !conntrack.LooksLikeText(payload[1:]) {
+			return akinet.Reject, 0
+		}
+		return akinet.Accept, 0
+
+	case seq == 1 && payload[0] == errHeader:
+		// An error packet, with the error number and the SQLSTATE marker.
+		if len(payload) < 4 {
+			return akinet.NeedMoreData, 0
+		}
+		if length < 9 || payload[3] != '#' {
+			return akinet.Reject, 0
+		}
+		return akinet.Accept, 0
+
+	case seq == 1 && payload[0] == okHeader:
+		// An OK packet, holding little more than counts and flags.
+		if length < 7 || length > 256 {
+			return akinet.Reject, 0
+		}
+		return akinet.Accept, 0
+
+	case seq == 1 && length == 1 && payload[0] < localInfileHeader:
+		// The column count of a result set, followed by the first column
+		// definition, which starts with the catalog name "def".
+		next := payload[1:]
+		if len(next) < headerLen+4 {
+			return akinet.NeedMoreData, 0
+		}
+		if _, nextSeq := packetHeader(next); nextSeq != 2 || !bytes.Equal(next[headerLen:headerLen+4], []byte("\x03def")) {
+			return akinet.Reject, 0
+		}
+		return akinet.Accept, 0
+	}
+	return akinet.Reject, 0
+}
+
+func (f serverParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), id, false)
+}
+
+// Returns the payload length and sequence number from a packet header.
+func packetHeader(b []byte) (length int, seq byte) {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16, b[3]
+}
+
+// Returns up to n bytes from the start of the input.
+func readPrefix(input memview.MemView, n int64) []byte {
+	if input.Len() < n {
+		n = input.Len()
+	}
+	b, _ := io.ReadAll(input.SubView(0, n).CreateReader())
+	return b
+}
@@ -0,0 +1,478 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-cli/pcap/database"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Largest part of a client's command that we buffer for decoding.
+	maxBufferedCommand = 1024 * 1024
+
+	// Largest part of other packets that we buffer. Enough for the counts and
+	// flags at the start of OK, error and EOF packets.
+	maxBufferedPacket = 64
+
+	// Maximum number of prepared statements remembered per connection.
+	maxPreparedStatements = 1000
+)
+
+// Where the server's parser is in a reply to a command.
+type replyPhase int
+
+const (
+	// Waiting for the first packet of a reply.
+	awaitingReply replyPhase = iota
+
+	// Waiting for the next result set of a reply that has several, e.g. from a
+	// stored procedure.
+	awaitingNextResult
+
+	// Reading the column definitions of a result set.
+	readingColumns
+
+	// Reading the rows of a result set.
+	readingRows
+
+	// Reading the parameter and column definitions that follow the reply to
+	// COM_STMT_PREPARE.
+	readingPreparedDefs
+)
+
+// Connection state that both directions need.
+type connState struct {
+	// The normalized text of prepared statements, by statement ID. The server
+	// assigns the IDs, and the client refers to them.
+	statements map[uint32]string
+
+	// Whether the client sends query attributes ahead of each query.
+	queryAttributes bool
+}
+
+func getConnState(conn *conntrack.Connection) *connState {
+	if s, ok := conn.Extra.(*connState); ok {
+		return s
+	}
+	s := &connState{statements: make(map[uint32]string)}
+	conn.Extra = s
+	return s
+}
+
+// Parses one direction of a MySQL connection.
+//
+// On the client side, each COM_QUERY and COM_STMT_EXECUTE yields a Query. On
+// the server side, the end of each reply to one of those yields a Result: an
+// OK or error packet, or the end of the last result set. Everything else is
+// consumed without being reported.
+type parser struct {
+	conn       *conntrack.Connection
+	streamID   uuid.UUID
+	fromClient bool
+
+	// Total bytes consumed over the life of the parser.
+	consumed int64
+
+	// Bytes of an incomplete packet header.
+	header []byte
+
+	// The packet whose payload is being read, if inPacket is set.
+	inPacket   bool
+	seq        byte
+	payloadLen int
+	remaining  int
+	payload    []byte
+
+	// Whether the current packet continues the payload of the previous one,
+	// which was as long as a packet can be.
+	continuation bool
+
+	// Server side: progress through the current reply.
+	phase       replyPhase
+	columnsLeft int
+	sawEOF      bool
+	defsLeft    int
+
+	// Server side: whether the next packet may be an EOF packet that ends the
+	// definitions that follow the reply to COM_STMT_PREPARE.
+	skipEOF bool
+}
+
+func newParser(conn *conntrack.Connection, bidiID akinet.TCPBidiID, fromClient bool) *parser {
+	return &parser{
+		conn:       conn,
+		streamID:   uuid.UUID(bidiID),
+		fromClient: fromClient,
+	}
+}
+
+func (p *parser) Name() string {
+	if p.fromClient {
+		return "MySQL Client Parser"
+	}
+	return "MySQL Server Parser"
+}
+
+// Tells the TCP flow to keep this parser after it produces a result.
+func (*parser) ParsesWholeFlow() bool {
+	return true
+}
+
+func (p *parser) Parse(input memview.MemView, isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	data, err := io.ReadAll(input.CreateReader())
+	if err != nil {
+		return nil, memview.MemView{}, p.consumed, errors.Wrap(err, "failed to read input")
+	}
+
+	offset := 0
+	for offset < len(data) {
+		if !p.inPacket {
+			offset += p.readHeader(data[offset:])
+			if !p.inPacket {
+				// Need more of the header.
+				break
+			}
+		}
+
+		offset += p.readPayload(data[offset:])
+
+		if p.remaining == 0 {
+			p.inPacket = false
+			continuation := p.continuation
+			p.continuation = p.payloadLen == maxPayloadLen
+			if continuation {
+				continue
+			}
+
+			var content akinet.ParsedNetworkContent
+			if p.fromClient {
+				content = p.finishClientPacket()
+			} else {
+				content = p.finishServerPacket()
+			}
+			if content != nil {
+				p.consumed += int64(offset)
+				return content, input.SubView(int64(offset), input.Len()), p.consumed, nil
+			}
+		}
+	}
+
+	p.consumed += int64(offset)
+	if isEnd && (p.inPacket || len(p.header) > 0) {
+		return nil, memview.MemView{}, p.consumed, errors.New("connection ended in the middle of a MySQL packet")
+	}
+	return nil, memview.MemView{}, p.consumed, nil
+}
+
+// Accumulates the packet header from b, and returns the number of bytes used.
+// Sets inPacket once the header is complete.
+func (p *parser) readHeader(b []byte) int {
+	n := headerLen - len(p.header)
+	if n > len(b) {
+		n = len(b)
+	}
+	p.header = append(p.header, b[:n]...)
+	if len(p.header) < headerLen {
+		return n
+	}
+
+	p.payloadLen, p.seq = packetHeader(p.header)
+	p.header = p.header[:0]
+	p.inPacket = true
+	p.remaining = p.payloadLen
+	p.payload = p.payload[:0]
+	return n
+}
+
+// Reads the packet payload from b, buffering its start, and returns the number
+// of bytes used.
+func (p *parser) readPayload(b []byte) int {
+	n := p.remaining
+	if n > len(b) {
+		n = len(b)
+	}
+
+	limit := maxBufferedPacket
+	if p.fromClient && p.seq == 0 {
+		limit = maxBufferedCommand
+	}
+	keep := n
+	if room := limit - len(p.payload); keep > room {
+		keep = room
+	}
+	if keep > 0 {
+		p.payload = append(p.payload, b[:keep]...)
+	}
+
+	p.remaining -= n
+	return n
+}
+
+func (p *parser) finishClientPacket() akinet.ParsedNetworkContent {
+	if len(p.payload) == 0 {
+		return nil
+	}
+
+	p.conn.Lock()
+	defer p.conn.Unlock()
+	state := getConnState(p.conn)
+
+	if p.seq == 1 && len(p.payload) >= handshakeResponseFixedLen {
+		// The handshake response, assuming this isn't the continuation of some
+		// other exchange.
+		caps := binary.LittleEndian.Uint32(p.payload)
+		if caps&clientProtocol41 != 0 {
+			state.queryAttributes = caps&clientQueryAttributes != 0
+		}
+		return nil
+	}
+	if p.seq != 0 {
+		return nil
+	}
+
+	command := p.payload[0]
+	body := p.payload[1:]
+	switch command {
+	case comQuery:
+		text := body
+		// Queries can't start with a zero byte, so one means query attributes,
+		// even if the handshake wasn't captured.
+		if state.queryAttributes || (len(text) > 0 && text[0] == 0) {
+			text = skipQueryAttributes(text)
+		}
+		return p.statement(command, true, database.Normalize(database.MySQL, string(text)))
+
+	case comStmtPrepare:
+		// Remembered until the server replies with the statement ID.
+		return p.statement(command, false, database.Normalize(database.MySQL, string(body)))
+
+	case comStmtExecute:
+		if len(body) < 4 {
+			return nil
+		}
+		return p.statement(command, true, state.statements[binary.LittleEndian.Uint32(body)])
+
+	case comStmtClose:
+		if len(body) >= 4 {
+			delete(state.statements, binary.LittleEndian.Uint32(body))
+		}
+
+	case comQuit, comStmtSendLongData:
+		// No reply.
+
+	default:
+		p.statement(command, false, "")
+	}
+	return nil
+}
+
+// Returns the query that follows the query attributes in a COM_QUERY, or nil
+// if there are attributes, since those are too involved to skip.
+func skipQueryAttributes(b []byte) []byte {
+	d := &decoder{b: b}
+	count := d.lengthEncodedInt()
+	d.lengthEncodedInt()
+	if d.err != nil || count != 0 {
+		return nil
+	}
+	return d.b
+}
+
+// Records a command that the server will reply to, and returns the Query to
+// report, if any. The caller must hold the connection lock.
+func (p *parser) statement(command byte, report bool, text string) akinet.ParsedNetworkContent {
+	if !report {
+		p.conn.Push(conntrack.Pending{Command: command, Text: text})
+		return nil
+	}
+	seq := p.conn.NextSeq()
+	p.conn.Push(conntrack.Pending{Seq: seq, Command: command})
+	return database.Query{
+		Protocol: database.MySQL,
+		StreamID: p.streamID,
+		Seq:      seq,
+		Text:     text,
+	}
+}
+
+func (p *parser) finishServerPacket() akinet.ParsedNetworkContent {
+	if len(p.payload) == 0 {
+		return nil
+	}
+	header := p.payload[0]
+
+	if p.skipEOF {
+		p.skipEOF = false
+		if p.isEOF() {
+			return nil
+		}
+	}
+
+	switch p.phase {
+	case awaitingReply:
+		// Replies start with sequence number 1. Packets that don't are part of
+		// the handshake, or of a reply whose start wasn't captured.
+		if p.seq != 1 {
+			return nil
+		}
+		return p.firstPacket(header)
+
+	case awaitingNextResult:
+		return p.firstPacket(header)
+
+	case readingColumns:
+		if p.columnsLeft--; p.columnsLeft <= 0 {
+			p.phase = readingRows
+		}
+
+	case readingRows:
+		switch {
+		case header == errHeader:
+			return p.finish(errorNumber(p.payload))
+		case header == eofHeader && p.payloadLen < maxPayloadLen:
+			// An EOF packet, or an OK packet in its place if the client asked
+			// for EOF packets to be left out. Without that, an EOF packet also
+			// separates the column definitions from the rows.
+			if p.payloadLen == 5 && !p.sawEOF {
+				p.sawEOF = true
+				return nil
+			}
+			return p.endResult(p.eofStatus())
+		}
+
+	case readingPreparedDefs:
+		if p.isEOF() {
+			return nil
+		}
+		if p.defsLeft--; p.defsLeft <= 0 {
+			p.skipEOF = true
+			return p.finish("")
+		}
+	}
+	return nil
+}
+
+// Handles the first packet of a reply, or of a further result set in it.
+func (p *parser) firstPacket(header byte) akinet.ParsedNetworkContent {
+	p.conn.Lock()
+	pending, ok := p.conn.Peek()
+	var state *connState
+	if ok {
+		state = getConnState(p.conn)
+	}
+	p.conn.Unlock()
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case header == errHeader:
+		return p.finish(errorNumber(p.payload))
+
+	case header == okHeader && pending.Command == comStmtPrepare && len(p.payload) >= 9:
+		// Statement ID, and the number of columns and parameters, whose
+		// definitions follow.
+		id := binary.LittleEndian.Uint32(p.payload[1:])
+		columns := int(binary.LittleEndian.Uint16(p.payload[5:]))
+		params := int(binary.LittleEndian.Uint16(p.payload[7:]))
+
+		p.conn.Lock()
+		if _, exists := state.statements[id]; exists || len(state.statements) < maxPreparedStatements {
+			state.statements[id] = pending.Text
+		}
+		p.conn.Unlock()
+
+		if p.defsLeft = columns + params; p.defsLeft > 0 {
+			p.phase = readingPreparedDefs
+			return nil
+		}
+		return p.finish("")
+
+	case header == okHeader:
+		d := &decoder{b: p.payload[1:]}
+		d.lengthEncodedInt()
+		d.lengthEncodedInt()
+		return p.endResult(d.uint16())
+
+	case header == localInfileHeader:
+		// The server asks for a file, and replies once the client has sent it.
+		p.phase = awaitingNextResult
+		return nil
+
+	case header == eofHeader || pending.Command == comStatistics:
+		// A request to switch authentication methods, or the statistics string.
+		return p.finish("")
+	}
+
+	// The column count of a result set.
+	d := &decoder{b: p.payload}
+	p.columnsLeft = int(d.lengthEncodedInt())
+	p.sawEOF = false
+	p.phase = readingColumns
+	if p.columnsLeft <= 0 {
+		p.phase = readingRows
+	}
+	return nil
+}
+
+// Ends a result set, given the status flags that follow it.
+func (p *parser) endResult(status uint16) akinet.ParsedNetworkContent {
+	if status&serverMoreResultsExist != 0 {
+		p.phase = awaitingNextResult
+		return nil
+	}
+	return p.finish("")
+}
+
+// Ends the reply to the oldest pending command, and returns the Result to
+// report, if any.
+func (p *parser) finish(errorCode string) akinet.ParsedNetworkContent {
+	p.phase = awaitingReply
+
+	p.conn.Lock()
+	pending, ok := p.conn.Pop()
+	p.conn.Unlock()
+	if !ok || pending.Seq == 0 {
+		return nil
+	}
+	return database.Result{
+		Protocol:  database.MySQL,
+		StreamID:  p.streamID,
+		Seq:       pending.Seq,
+		ErrorCode: errorCode,
+	}
+}
+
+// Whether the current packet is an EOF packet, as opposed to an OK packet
+// with the same header.
+func (p *parser) isEOF() bool {
+	return p.payload[0] == eofHeader && p.payloadLen == 5
+}
+
+// Returns the status flags of the EOF or OK packet that ends a result set.
+func (p *parser) eofStatus() uint16 {
+	if p.isEOF() {
+		d := &decoder{b: p.payload[3:]}
+		return d.uint16()
+	}
+	d := &decoder{b: p.payload[1:]}
+	d.lengthEncodedInt()
+	d.lengthEncodedInt()
+	return d.uint16()
+}
+
+// Returns the error number from an error packet.
+func errorNumber(payload []byte) string {
+	if len(payload) < 3 {
+		return "unknown"
+	}
+	return strconv.Itoa(int(binary.LittleEndian.Uint16(payload[1:])))
+}
@@ -0,0 +1,186 @@
+package mysql
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-cli/pcap/database"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+func packet(seq byte, payload ...string) []byte {
+	length := 0
+	for _, s := range payload {
+		length += len(s)
+	}
+	b := []byte{byte(length), byte(length >> 8), byte(length >> 16), seq}
+	for _, s := range payload {
+		b = append(b, s...)
+	}
+	return b
+}
+
+func concat(packets ...[]byte) []byte {
+	var b []byte
+	for _, p := range packets {
+		b = append(b, p...)
+	}
+	return b
+}
+
+const (
+	columnDef = "\x03def\x06kennel\x04dogs\x04dogs\x04name\x04name\x0c\x21\x00\xfd\x03\x00\x00\xfd\x00\x00\x00\x00\x00"
+
+	// EOF packet with SERVER_STATUS_AUTOCOMMIT.
+	eof = "\xfe\x00\x00\x02\x00"
+
+	// OK packet with SERVER_STATUS_AUTOCOMMIT, in place of an EOF packet.
+	okEOF = "\xfe\x00\x00\x02\x00\x00\x00"
+)
+
+// One direction of a connection, parsed by a parser that lives as long as the
+// flow, as in a TCP flow.
+type flow struct {
+	t       *testing.T
+	factory akinet.TCPParserFactory
+	bidiID  akinet.TCPBidiID
+	parser  akinet.TCPParser
+}
+
+// Feeds data to the flow's parser, creating it on first use, and returns
+// everything it reports.
+func (f *flow) feed(data []byte) []akinet.ParsedNetworkContent {
+	if f.parser == nil {
+		decision, _ := f.factory.Accepts(memview.New(data), false)
+		require.Equal(f.t, akinet.Accept, decision)
+		f.parser = f.factory.CreateParser(f.bidiID, 0, 0)
+	}
+
+	var results []akinet.ParsedNetworkContent
+	input := memview.New(data)
+	for {
+		content, unused, _, err := f.parser.Parse(input, false)
+		require.NoError(f.t, err)
+		if content == nil {
+			return results
+		}
+		results = append(results, content)
+		input = unused
+	}
+}
+
+func TestQueries(t *testing.T) {
+	clients, servers := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+	streamID := uuid.UUID(bidiID)
+	client := &flow{t: t, factory: clients, bidiID: bidiID}
+	server := &flow{t: t, factory: servers, bidiID: bidiID}
+
+	handshake := packet(0, "\x0a8.0.36\x00", "\x08\x00\x00\x00abcdefgh\x00\xff\xff\xff\x02\x00\xff\xdf\x15")
+	assert.Empty(t, server.feed(handshake))
+
+	handshakeResponse := packet(1, "\x8d\xa6\x0f\x00", "\x00\x00\x00\x01", "\xff", string(make([]byte, 23)), "dog\x00", "\x00")
+	authOK := packet(2, "\x00\x00\x00\x02\x00\x00\x00")
+	assert.Empty(t, client.feed(handshakeResponse))
+	assert.Empty(t, server.feed(authOK))
+
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Query{Protocol: database.MySQL, StreamID: streamID, Seq: 1, Text: "SELECT name FROM dogs WHERE id = ?"},
+	}, client.feed(packet(0, "\x03", "SELECT name FROM dogs WHERE id = 7")))
+
+	// Split the result set to exercise reassembly.
+	resultSet := concat(
+		packet(1, "\x01"),
+		packet(2, columnDef),
+		packet(3, eof),
+		packet(4, "\x03Rex"),
+		packet(5, eof),
+	)
+	assert.Empty(t, server.feed(resultSet[:10]))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Result{Protocol: database.MySQL, StreamID: streamID, Seq: 1},
+	}, server.feed(resultSet[10:]))
+
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Query{Protocol: database.MySQL, StreamID: streamID, Seq: 2, Text: "UPDATE dogs SET name = ? WHERE id IN (?)"},
+	}, client.feed(packet(0, "\x03", "UPDATE dogs SET name = \"Fido\" WHERE id IN (1, 2)")))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Result{Protocol: database.MySQL, StreamID: streamID, Seq: 2},
+	}, server.feed(packet(1, "\x00\x02\x00\x02\x00\x00\x00")))
+
+	// COM_PING isn't reported, but its reply must be consumed.
+	assert.Empty(t, client.feed(packet(0, "\x0e")))
+	assert.Empty(t, server.feed(packet(1, "\x00\x00\x00\x02\x00\x00\x00")))
+
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Query{Protocol: database.MySQL, StreamID: streamID, Seq: 3, Text: "SELECT * FROM cats"},
+	}, client.feed(packet(0, "\x03", "SELECT * FROM cats")))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Result{Protocol: database.MySQL, StreamID: streamID, Seq: 3, ErrorCode: "1146"},
+	}, server.feed(packet(1, "\xff\x7a\x04#42S02", "Table 'kennel.cats' doesn't exist")))
+}
+
+func TestPreparedStatements(t *testing.T) {
+	clients, servers := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+	streamID := uuid.UUID(bidiID)
+	client := &flow{t: t, factory: clients, bidiID: bidiID}
+	server := &flow{t: t, factory: servers, bidiID: bidiID}
+
+	// Captured mid-connection, with EOF packets left out.
+	assert.Empty(t, client.feed(packet(0, "\x16", "SELECT name FROM dogs WHERE id = ? AND age > 3")))
+	assert.Empty(t, server.feed(concat(
+		// Statement 5, with one column and one parameter.
+		packet(1, "\x00\x05\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00"),
+		packet(2, columnDef),
+		packet(3, columnDef),
+	)))
+
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Query{Protocol: database.MySQL, StreamID: streamID, Seq: 1, Text: "SELECT name FROM dogs WHERE id = ? AND age > ?"},
+	}, client.feed(packet(0, "\x17\x05\x00\x00\x00\x00\x01\x00\x00\x00\x00\x01\x08\x00\x07\x00\x00\x00\x00\x00\x00\x00")))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Result{Protocol: database.MySQL, StreamID: streamID, Seq: 1},
+	}, server.feed(concat(
+		packet(1, "\x01"),
+		packet(2, columnDef),
+		packet(3, "\x00\x00\x03Rex"),
+		packet(4, okEOF),
+	)))
+
+	// Closing the statement gets no reply.
+	assert.Empty(t, client.feed(packet(0, "\x19\x05\x00\x00\x00")))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Query{Protocol: database.MySQL, StreamID: streamID, Seq: 2, Text: ""},
+	}, client.feed(packet(0, "\x17\x05\x00\x00\x00\x00\x01\x00\x00\x00")))
+}
+
+func TestAccepts(t *testing.T) {
+	clients, servers := NewParserFactories()
+
+	sslRequest := packet(1, "\x8d\xae\x0f\x00", "\x00\x00\x00\x01", "\xff", string(make([]byte, 23)))
+
+	testCases := []struct {
+		name     string
+		factory  akinet.TCPParserFactory
+		data     []byte
+		expected akinet.AcceptDecision
+	}{
+		{"SSL request", clients, sslRequest, akinet.Reject},
+		{"PostgreSQL startup", clients, []byte("\x00\x00\x00\x10\x00\x03\x00\x00user\x00dog\x00"), akinet.Reject},
+		{"HTTP request", clients, []byte("GET / HTTP/1.1\r\n\r\n"), akinet.Reject},
+		{"query with attributes", clients, packet(0, "\x03\x00\x01SELECT 1"), akinet.Accept},
+		{"result set", servers, concat(packet(1, "\x01"), packet(2, columnDef)), akinet.Accept},
+		{"partial result set", servers, packet(1, "\x01"), akinet.NeedMoreData},
+		{"error", servers, packet(1, "\xff\x7a\x04#42S02", "no such table"), akinet.Accept},
+		{"PostgreSQL authentication", servers, []byte("R\x00\x00\x00\x08\x00\x00\x00\x00"), akinet.Reject},
+	}
+	for _, tc := range testCases {
+		decision, _ := tc.factory.Accepts(memview.New(tc.data), false)
+		assert.Equal(t, tc.expected, decision, tc.name)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/google/gopacket/reassembly"
 	"github.com/pkg/errors"
 
+	"github.com/akitasoftware/akita-cli/pcap/dns"
 	"github.com/akitasoftware/akita-cli/printer"
 	"github.com/akitasoftware/akita-cli/telemetry"
 	"github.com/akitasoftware/akita-libs/akinet"
@@ -83,6 +84,7 @@ type NetworkTrafficParser struct {
 	clock       clockWrapper
 	observer    NetworkTrafficObserver // This function is called for every packet.
 	bufferShare float32
+	dns         *dns.Parser
 }
 
 func NewNetworkTrafficParser(bufferShare float32) *NetworkTrafficParser {
@@ -91,6 +93,20 @@ func NewNetworkTrafficParser(bufferShare float32) *NetworkTrafficParser {
 		clock:       &realClock{},
 		observer:    func(gopacket.Packet) {},
 		bufferShare: bufferShare,
+		dns:         dns.NewParser(),
+	}
+}
+
+// Creates a parser that reads packets from the given pcap or pcapng files, in
+// order, instead of from a live interface. Packet timestamps are preserved,
+// and stream timeouts are measured against them rather than the wall clock.
+func NewPcapFileTrafficParser(files []string, bufferShare float32) *NetworkTrafficParser {
+	return &NetworkTrafficParser{
+		pcap:        &pcapFilesImpl{files: files},
+		clock:       &packetClock{},
+		observer:    func(gopacket.Packet) {},
+		bufferShare: bufferShare,
+		dns:         dns.NewParser(),
 	}
 }
 
@@ -153,6 +169,9 @@ func (p *NetworkTrafficParser) ParseFromInterface(interfaceName, bpfFilter strin
 
 					return
 				}
+				if pc, ok := p.clock.(*packetClock); ok && packet.Metadata() != nil {
+					pc.observe(packet.Metadata().Timestamp)
+				}
 				p.observer(packet)
 				p.packetToParsedNetworkTraffic(out, assembler, packet)
 			case <-ticker.C:
@@ -245,12 +264,22 @@ func (p *NetworkTrafficParser) packetToParsedNetworkTraffic(out chan<- akinet.Pa
 		// Let TCP reassembler do extra magic to parse out higher layer protocols.
 		assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), t, contextFromTCPPacket(packet, t))
 	case *layers.UDP:
+		// UDP isn't parsed, except for DNS.
+		var content akinet.ParsedNetworkContent = akinet.DroppedBytes(len(t.LayerPayload()))
+		if dns.IsDNSPort(int(t.SrcPort), int(t.DstPort)) {
+			c, err := p.dns.Parse(srcIP, int(t.SrcPort), dstIP, int(t.DstPort), t.LayerPayload(), observationTime)
+			if err == nil {
+				content = c
+			} else {
+				printer.V(6).Debugf("unparseable DNS message: %v\n", err)
+			}
+		}
 		out <- akinet.ParsedNetworkTraffic{
 			SrcIP:           srcIP,
 			SrcPort:         int(t.SrcPort),
 			DstIP:           dstIP,
 			DstPort:         int(t.DstPort),
-			Content:         akinet.DroppedBytes(len(t.LayerPayload())),
+			Content:         content,
 			ObservationTime: observationTime,
 		}
 	default:
@@ -10,10 +10,13 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 
 	"github.com/akitasoftware/akita-libs/akinet"
 	"github.com/akitasoftware/akita-libs/akinet/http"
 	"github.com/akitasoftware/akita-libs/buffer_pool"
+
+	"github.com/akitasoftware/akita-cli/pcap/dns"
 )
 
 var (
@@ -479,6 +482,71 @@ func TestUDP(t *testing.T) {
 	}
 }
 
+func TestDNS(t *testing.T) {
+	question := layers.DNSQuestion{Name: []byte("api.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+	serialize := func(msg *layers.DNS) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			t.Fatalf("failed to serialize DNS message: %v", err)
+		}
+		return buf.Bytes()
+	}
+	query := serialize(&layers.DNS{ID: 7, RD: true, Questions: []layers.DNSQuestion{question}})
+	response := serialize(&layers.DNS{
+		ID:        7,
+		QR:        true,
+		Questions: []layers.DNSQuestion{question},
+		Answers: []layers.DNSResourceRecord{
+			{Name: question.Name, Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 60, IP: ip2},
+		},
+	})
+
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+	pcap := fakePcap(makeUDPPackets(1,
+		&testMessage{testEndpoint1, testEndpoint2, query},
+		&testMessage{testEndpoint2, testEndpoint1, response},
+	))
+	out, err := setupParseFromInterface(pcap, closeChan)
+	if err != nil {
+		t.Fatalf("unexpected error setting up listener: %v", err)
+	}
+
+	var actual []akinet.ParsedNetworkTraffic
+	for nt := range out {
+		actual = append(actual, nt)
+	}
+
+	expected := []akinet.ParsedNetworkTraffic{
+		{
+			SrcIP:           ip1,
+			SrcPort:         port1,
+			DstIP:           ip2,
+			DstPort:         port2,
+			Content:         dns.Query{ID: 7, Name: "api.example.com", Type: "A"},
+			ObservationTime: testTime,
+		},
+		{
+			SrcIP:   ip2,
+			SrcPort: port2,
+			DstIP:   ip1,
+			DstPort: port1,
+			Content: dns.Response{
+				ID:        7,
+				Name:      "api.example.com",
+				Type:      "A",
+				RCode:     "NOERROR",
+				Addresses: []net.IP{ip2},
+			},
+			ObservationTime: testTime,
+		},
+	}
+
+	if diff := netParseCmp(expected, actual); diff != "" {
+		t.Errorf("mismatch: %s", diff)
+	}
+}
+
 // This test triggers a nil assembly context in tcpFlow.reassembledWithIgnore.
 // Currently we have an error counter, but maybe we should come up with a better long-term solution.
 func XXX_TestHTTPResponseInJumboframe(t *testing.T) {
@@ -0,0 +1,18 @@
+// Package parsed lets parsers in this repository define their own kinds of
+// akinet.ParsedNetworkContent, for protocols that akita-libs doesn't know
+// about.
+package parsed
+
+import (
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+// Embedding Content in a struct makes it an akinet.ParsedNetworkContent.
+//
+// akinet.ParsedNetworkContent has an unexported method, so only types in akinet
+// can implement it directly; other types get the method by embedding one of
+// them. Content embeds an empty one, so it carries no data and has nothing to
+// release. Types that hold pooled buffers should override ReleaseBuffers.
+type Content struct {
+	akinet.HTTP2ConnectionPreface
+}
@@ -76,6 +76,66 @@ func (p *pcapImpl) capturePackets(done <-chan struct{}, interfaceName, bpfFilter
 	return wrappedChan, nil
 }
 
+// pcapWrapper backed by one or more pcap or pcapng files, which are read in
+// order as if they were a single capture.
+type pcapFilesImpl struct {
+	files []string
+}
+
+func (p *pcapFilesImpl) capturePackets(done <-chan struct{}, _, bpfFilter string) (<-chan gopacket.Packet, error) {
+	// Open all the files up front, so that a missing file or a bad filter is
+	// reported before we start replaying anything.
+	handles := make([]*pcap.Handle, 0, len(p.files))
+	closeHandles := func() {
+		for _, h := range handles {
+			h.Close()
+		}
+	}
+	for _, f := range p.files {
+		handle, err := pcap.OpenOffline(f)
+		if err != nil {
+			closeHandles()
+			return nil, errors.Wrapf(err, "failed to open pcap file %s", f)
+		}
+		handles = append(handles, handle)
+
+		if bpfFilter != "" {
+			if err := handle.SetBPFFilter(bpfFilter); err != nil {
+				closeHandles()
+				return nil, errors.Wrap(err, "failed to set BPF filter")
+			}
+		}
+	}
+
+	wrappedChan := make(chan gopacket.Packet, 10)
+	go func() {
+		defer func() {
+			close(wrappedChan)
+			closeHandles()
+		}()
+
+		for i, handle := range handles {
+			count := 0
+			packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+			for pkt := range packetSource.Packets() {
+				select {
+				case <-done:
+					return
+				case wrappedChan <- pkt:
+					count += 1
+				}
+			}
+			printer.Debugf("Replayed %d packets from %s\n", count, p.files[i])
+		}
+	}()
+	return wrappedChan, nil
+}
+
+// Packet captures are not tied to any interface on this host.
+func (p *pcapFilesImpl) getInterfaceAddrs(_ string) ([]net.IP, error) {
+	return nil, nil
+}
+
 func (p *pcapImpl) getInterfaceAddrs(interfaceName string) ([]net.IP, error) {
 	iface, err := net.InterfaceByName(interfaceName)
 	if err != nil {
@@ -113,3 +173,26 @@ func nextIP(ip net.IP) {
 		}
 	}
 }
+
+// Returns the addresses assigned to the named network interface on this host.
+// Unlike the addresses used for the capture filter, these are the interface's
+// own addresses rather than guesses from its networks.
+func InterfaceAddrs(interfaceName string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "no network interface with name %s", interfaceName)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get addresses on interface %s", iface.Name)
+	}
+
+	var hostIPs []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			hostIPs = append(hostIPs, ipNet.IP)
+		}
+	}
+	return hostIPs, nil
+}
@@ -178,10 +178,19 @@ func (filePcapWrapper) getInterfaceAddrs(interfaceName string) ([]net.IP, error)
 func readFromPcapFile(file string, pool buffer_pool.BufferPool) ([]akinet.ParsedNetworkTraffic, error) {
 	p := NewNetworkTrafficParser(1.0)
 	p.pcap = filePcapWrapper(file)
+	return collectParsed(p, "", pool)
+}
+
+// Reads from a pcap file through the replay parser, which takes its clock
+// from packet timestamps.
+func replayPcapFile(file string, bpfFilter string, pool buffer_pool.BufferPool) ([]akinet.ParsedNetworkTraffic, error) {
+	return collectParsed(NewPcapFileTrafficParser([]string{file}, 1.0), bpfFilter, pool)
+}
 
+func collectParsed(p *NetworkTrafficParser, bpfFilter string, pool buffer_pool.BufferPool) ([]akinet.ParsedNetworkTraffic, error) {
 	done := make(chan struct{})
 	defer close(done)
-	out, err := p.ParseFromInterface("fake", "", done, akihttp.NewHTTPRequestParserFactory(pool), akihttp.NewHTTPResponseParserFactory(pool))
+	out, err := p.ParseFromInterface("fake", bpfFilter, done, akihttp.NewHTTPRequestParserFactory(pool), akihttp.NewHTTPResponseParserFactory(pool))
 	if err != nil {
 		return nil, errors.Wrap(err, "ParseFromInterface failed")
 	}
@@ -252,3 +261,53 @@ func TestPcapHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestPcapReplayFilter(t *testing.T) {
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		t.Error(err)
+	}
+
+	testCases := []struct {
+		name     string
+		filter   string
+		expected []akinet.ParsedNetworkTraffic
+	}{
+		{
+			name:   "filter matching the HTTP port",
+			filter: "tcp port 80",
+			expected: []akinet.ParsedNetworkTraffic{
+				simpleHTTPReq1(),
+				simpleHTTPResp1(),
+			},
+		},
+		{
+			name:     "filter excluding everything",
+			filter:   "tcp port 8081",
+			expected: []akinet.ParsedNetworkTraffic{},
+		},
+	}
+
+	for _, c := range testCases {
+		collected, err := replayPcapFile("testdata/simple_http.pcap", c.filter, pool)
+		if err != nil {
+			t.Errorf("[%s] got unexpected error: %v", c.name, err)
+		} else if diff := cmp.Diff(c.expected, collected, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(akinet.HTTPRequest{}, akinet.HTTPResponse{})); diff != "" {
+			t.Errorf("[%s] found diff: %s", c.name, diff)
+		}
+
+		for _, pnt := range collected {
+			pnt.Content.ReleaseBuffers()
+		}
+	}
+}
+
+func TestPcapReplayMissingFile(t *testing.T) {
+	p := NewPcapFileTrafficParser([]string{"testdata/simple_http.pcap", "testdata/does_not_exist.pcap"}, 1.0)
+
+	done := make(chan struct{})
+	defer close(done)
+	if _, err := p.ParseFromInterface("fake", "", done); err == nil {
+		t.Errorf("expected an error when replaying a missing file")
+	}
+}
@@ -0,0 +1,177 @@
+// Package postgres parses the PostgreSQL wire protocol into the statements a
+// client sends and the results the server returns for them.
+package postgres
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/google/gopacket/reassembly"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Length of a message header: the type byte and the length, which counts
+	// itself but not the type byte. Startup messages have no type byte.
+	headerLen        = 5
+	startupHeaderLen = 4
+
+	// Protocol version 3.0, sent in startup messages.
+	protocolVersion = 196608
+
+	// Largest startup message we consider plausible.
+	maxStartupLen = 10000
+
+	// Largest message we accept. The server limits most messages to 1 GiB.
+	maxMessageLen = 1 << 30
+
+	// Highest authentication request code defined by the protocol.
+	maxAuthCode = 12
+)
+
+// Returns factories for parsers of the messages sent by PostgreSQL clients
+// (the frontend) and servers (the backend). They must be used together, since
+// results are matched with the statements before them.
+func NewParserFactories() (frontend, backend akinet.TCPParserFactory) {
+	conns := conntrack.NewConnections()
+	return frontendParserFactory{conns: conns}, backendParserFactory{conns: conns}
+}
+
+type frontendParserFactory struct {
+	conns *conntrack.Connections
+}
+
+func (frontendParserFactory) Name() string {
+	return "PostgreSQL Frontend Parser Factory"
+}
+
+// Recognizes the startup message of a new connection, or a simple query or
+// Parse message on a connection that was already open when capture started.
+// Requests to switch to TLS or GSSAPI encryption are rejected, since what
+// follows them can't be parsed.
+func (frontendParserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	if input.Len() < 8 {
+		return akinet.NeedMoreData, 0
+	}
+	head := readPrefix(input, headerLen+16)
+
+	if head[0] == 0 {
+		length := binary.BigEndian.Uint32(head)
+		version := binary.BigEndian.Uint32(head[4:])
+		if version == protocolVersion && length >= 8 && length <= maxStartupLen {
+			return akinet.Accept, 0
+		}
+		return akinet.Reject, 0
+	}
+
+	if head[0] != 'Q' && head[0] != 'P' {
+		return akinet.Reject, 0
+	}
+	length := binary.BigEndian.Uint32(head[1:])
+	if length < startupHeaderLen+2 || length > maxMessageLen {
+		return akinet.Reject, 0
+	}
+
+	// Look for text at the start of the body: the query, or the name of the
+	// statement being prepared.
+	body := head[headerLen:]
+	if int64(len(body)) < int64(length)-startupHeaderLen && len(body) < 16 {
+		return akinet.NeedMoreData, 0
+	}
+	if head[0] == 'P' && len(body) > 0 && body[0] == 0 {
+		// The unnamed statement.
+		body = body[1:]
+	}
+	if !conntrack.LooksLikeText(body) {
+		return akinet.Reject, 0
+	}
+	return akinet.Accept, 0
+}
+
+func (f frontendParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), id, true)
+}
+
+type backendParserFactory struct {
+	conns *conntrack.Connections
+}
+
+func (backendParserFactory) Name() string {
+	return "PostgreSQL Backend Parser Factory"
+}
+
+// Recognizes the authentication request that starts the server's side of a
+// connection. On a connection that was already open when capture started,
+// recognizes the messages that usually start a reply to a statement.
+func (backendParserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	if input.Len() < headerLen {
+		return akinet.NeedMoreData, 0
+	}
+	head := readPrefix(input, headerLen+16)
+	length := binary.BigEndian.Uint32(head[1:])
+	if length < startupHeaderLen || length > maxMessageLen {
+		return akinet.Reject, 0
+	}
+	bodyLen := int(length) - startupHeaderLen
+	body := head[headerLen:]
+	if len(body) < bodyLen && len(body) < 16 {
+		return akinet.NeedMoreData, 0
+	}
+
+	plausible := false
+	switch head[0] {
+	case 'R':
+		// Authentication request.
+		plausible = length >= 8 && length <= maxStartupLen &&
+			binary.BigEndian.Uint32(body) <= maxAuthCode
+	case 'Z':
+		// ReadyForQuery, with the transaction status.
+		plausible = bodyLen == 1 && (body[0] == 'I' || body[0] == 'T' || body[0] == 'E')
+	case '1', '2':
+		// ParseComplete and BindComplete.
+		plausible = bodyLen == 0
+	case 'C':
+		// CommandComplete, with a tag such as "INSERT 0 1".
+		plausible = bodyLen > 1 && conntrack.LooksLikeText(body) &&
+			(bodyLen > len(body) || body[bodyLen-1] == 0)
+	case 'T':
+		// RowDescription, with the number of fields and the first field, which is
+		// a name and 18 bytes of type information.
+		plausible = bodyLen >= 2+2+18 && binary.BigEndian.Uint16(body) > 0 && conntrack.LooksLikeText(body[2:])
+	case 'E':
+		// ErrorResponse, which starts with the severity.
+		plausible = bodyLen > 2 && (body[0] == 'S' || body[0] == 'V') && conntrack.LooksLikeText(body[1:])
+	}
+	if !plausible {
+		return akinet.Reject, 0
+	}
+	return akinet.Accept, 0
+}
+
+func (f backendParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), id, false)
+}
+
+// Returns up to n bytes from the start of the input.
+func readPrefix(input memview.MemView, n int64) []byte {
+	if input.Len() < n {
+		n = input.Len()
+	}
+	b, _ := io.ReadAll(input.SubView(0, n).CreateReader())
+	return b
+}
@@ -0,0 +1,318 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-cli/pcap/database"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Largest part of a message body that we buffer for decoding. Only the
+	// messages we decode are buffered at all; the rest are skipped.
+	maxBufferedBody = 1024 * 1024
+
+	// Maximum number of prepared statements remembered per connection.
+	maxPreparedStatements = 1000
+)
+
+// Parses one direction of a PostgreSQL connection.
+//
+// On the client side, each simple query, and each batch of extended-protocol
+// messages ending in Sync that executes a statement, yields a Query. On the
+// server side, each ReadyForQuery that answers a reported statement yields a
+// Result, carrying the code of any error reported since the previous
+// ReadyForQuery. Everything else is consumed without being reported.
+type parser struct {
+	conn       *conntrack.Connection
+	streamID   uuid.UUID
+	fromClient bool
+
+	// Total bytes consumed over the life of the parser.
+	consumed int64
+
+	// Bytes of an incomplete message header.
+	header []byte
+
+	// The message whose body is being read, if inMessage is set. The type is 0
+	// for startup messages.
+	inMessage bool
+	msgType   byte
+	remaining int
+	decode    bool
+	body      []byte
+
+	// Client side: the normalized text of prepared statements by name, and the
+	// statement bound since the last Sync.
+	prepared      map[string]string
+	batchText     string
+	batchExecuted bool
+
+	// Server side: the SQLSTATE of the last error since the last ReadyForQuery,
+	// and whether the connection is starting up, having seen an authentication
+	// request but not yet the first ReadyForQuery.
+	errorCode string
+	starting  bool
+}
+
+func newParser(conn *conntrack.Connection, bidiID akinet.TCPBidiID, fromClient bool) *parser {
+	return &parser{
+		conn:       conn,
+		streamID:   uuid.UUID(bidiID),
+		fromClient: fromClient,
+		prepared:   make(map[string]string),
+	}
+}
+
+func (p *parser) Name() string {
+	if p.fromClient {
+		return "PostgreSQL Frontend Parser"
+	}
+	return "PostgreSQL Backend Parser"
+}
+
+// Tells the TCP flow to keep this parser after it produces a result.
+func (*parser) ParsesWholeFlow() bool {
+	return true
+}
+
+func (p *parser) Parse(input memview.MemView, isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	data, err := io.ReadAll(input.CreateReader())
+	if err != nil {
+		return nil, memview.MemView{}, p.consumed, errors.Wrap(err, "failed to read input")
+	}
+
+	offset := 0
+	for offset < len(data) {
+		if !p.inMessage {
+			n, err := p.readHeader(data[offset:])
+			offset += n
+			if err != nil {
+				p.consumed += int64(offset)
+				return nil, memview.MemView{}, p.consumed, err
+			}
+			if !p.inMessage {
+				// Need more of the header.
+				break
+			}
+		}
+
+		offset += p.readBody(data[offset:])
+
+		if p.remaining == 0 {
+			p.inMessage = false
+			if content := p.finishMessage(); content != nil {
+				p.consumed += int64(offset)
+				return content, input.SubView(int64(offset), input.Len()), p.consumed, nil
+			}
+		}
+	}
+
+	p.consumed += int64(offset)
+	if isEnd && (p.inMessage || len(p.header) > 0) {
+		return nil, memview.MemView{}, p.consumed, errors.New("connection ended in the middle of a PostgreSQL message")
+	}
+	return nil, memview.MemView{}, p.consumed, nil
+}
+
+// Accumulates the message header from b, and returns the number of bytes used.
+// Sets inMessage once the header is complete.
+func (p *parser) readHeader(b []byte) (int, error) {
+	used := 0
+	for used < len(b) {
+		p.header = append(p.header, b[used])
+		used++
+
+		// Only clients send startup messages, which have no type byte. Message
+		// types are letters, so a leading zero byte marks a startup message.
+		n := headerLen
+		if p.fromClient && p.header[0] == 0 {
+			n = startupHeaderLen
+		}
+		if len(p.header) < n {
+			continue
+		}
+
+		msgType := byte(0)
+		if n == headerLen {
+			msgType = p.header[0]
+		}
+		length := binary.BigEndian.Uint32(p.header[n-startupHeaderLen:])
+		p.header = p.header[:0]
+		if length < startupHeaderLen || length > maxMessageLen {
+			return used, errors.Errorf("invalid PostgreSQL message length %d", length)
+		}
+
+		p.inMessage = true
+		p.msgType = msgType
+		p.remaining = int(length) - startupHeaderLen
+		p.decode = p.decodes(msgType)
+		p.body = p.body[:0]
+		return used, nil
+	}
+	return used, nil
+}
+
+// Whether the body of messages of the given type is needed.
+func (p *parser) decodes(msgType byte) bool {
+	if p.fromClient {
+		switch msgType {
+		case 'Q', 'P', 'B', 'E', 'S', 'C':
+			return true
+		}
+		return false
+	}
+	return msgType == 'E' || msgType == 'Z' || msgType == 'R'
+}
+
+// Reads the message body from b, buffering it if it will be decoded, and
+// returns the number of bytes used.
+func (p *parser) readBody(b []byte) int {
+	n := p.remaining
+	if n > len(b) {
+		n = len(b)
+	}
+	if p.decode {
+		keep := n
+		if room := maxBufferedBody - len(p.body); keep > room {
+			keep = room
+		}
+		p.body = append(p.body, b[:keep]...)
+	}
+	p.remaining -= n
+	return n
+}
+
+func (p *parser) finishMessage() akinet.ParsedNetworkContent {
+	if !p.decode {
+		return nil
+	}
+	if p.fromClient {
+		return p.finishClientMessage()
+	}
+	return p.finishServerMessage()
+}
+
+func (p *parser) finishClientMessage() akinet.ParsedNetworkContent {
+	switch p.msgType {
+	case 'Q':
+		// Simple query.
+		text, _ := cString(p.body)
+		return p.statement(true, database.Normalize(database.PostgreSQL, text))
+
+	case 'P':
+		// Parse: statement name and query.
+		name, rest := cString(p.body)
+		text, _ := cString(rest)
+		if _, exists := p.prepared[name]; exists || name == "" || len(p.prepared) < maxPreparedStatements {
+			p.prepared[name] = database.Normalize(database.PostgreSQL, text)
+		}
+
+	case 'B':
+		// Bind: portal name and statement name.
+		_, rest := cString(p.body)
+		name, _ := cString(rest)
+		p.batchText = p.prepared[name]
+
+	case 'E':
+		// Execute.
+		p.batchExecuted = true
+
+	case 'C':
+		// Close, of a statement or a portal.
+		if len(p.body) > 0 && p.body[0] == 'S' {
+			name, _ := cString(p.body[1:])
+			delete(p.prepared, name)
+		}
+
+	case 'S':
+		// Sync, which ends a batch. The server answers each with ReadyForQuery.
+		content := p.statement(p.batchExecuted, p.batchText)
+		p.batchText = ""
+		p.batchExecuted = false
+		return content
+	}
+	return nil
+}
+
+// Records a statement that the server will answer with ReadyForQuery, and
+// returns the Query to report, if any.
+func (p *parser) statement(report bool, text string) akinet.ParsedNetworkContent {
+	p.conn.Lock()
+	defer p.conn.Unlock()
+
+	if !report {
+		p.conn.Push(conntrack.Pending{})
+		return nil
+	}
+	seq := p.conn.NextSeq()
+	p.conn.Push(conntrack.Pending{Seq: seq})
+	return database.Query{
+		Protocol: database.PostgreSQL,
+		StreamID: p.streamID,
+		Seq:      seq,
+		Text:     text,
+	}
+}
+
+func (p *parser) finishServerMessage() akinet.ParsedNetworkContent {
+	switch p.msgType {
+	case 'R':
+		// Authentication request.
+		p.starting = true
+
+	case 'E':
+		// ErrorResponse: fields, each a type byte and a string, ending with a
+		// zero byte.
+		fields := p.body
+		for len(fields) > 0 && fields[0] != 0 {
+			fieldType := fields[0]
+			var value string
+			value, fields = cString(fields[1:])
+			if fieldType == 'C' {
+				p.errorCode = value
+			}
+		}
+
+	case 'Z':
+		// ReadyForQuery. The one that ends the startup of a connection answers
+		// no statement.
+		if p.starting {
+			p.starting = false
+			p.errorCode = ""
+			return nil
+		}
+		p.conn.Lock()
+		pending, ok := p.conn.Pop()
+		p.conn.Unlock()
+
+		errorCode := p.errorCode
+		p.errorCode = ""
+		if ok && pending.Seq > 0 {
+			return database.Result{
+				Protocol:  database.PostgreSQL,
+				StreamID:  p.streamID,
+				Seq:       pending.Seq,
+				ErrorCode: errorCode,
+			}
+		}
+	}
+	return nil
+}
+
+// Splits b after the first NUL, returning the string before it and the rest.
+// If there is no NUL, all of b is returned as the string.
+func cString(b []byte) (string, []byte) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return string(b), nil
+	}
+	return string(b[:i]), b[i+1:]
+}
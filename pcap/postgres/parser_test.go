@@ -0,0 +1,159 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-cli/pcap/database"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Builds a message of the given type. A type of 0 builds a startup message.
+func message(msgType byte, body ...string) []byte {
+	var b []byte
+	if msgType != 0 {
+		b = append(b, msgType)
+	}
+	length := 4
+	for _, s := range body {
+		length += len(s)
+	}
+	lengthBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBytes, uint32(length))
+	b = append(b, lengthBytes...)
+	for _, s := range body {
+		b = append(b, s...)
+	}
+	return b
+}
+
+func concat(msgs ...[]byte) []byte {
+	var b []byte
+	for _, m := range msgs {
+		b = append(b, m...)
+	}
+	return b
+}
+
+// Feeds data to a new parser from the factory, one byte at a time for the first
+// few bytes to exercise reassembly, and returns everything it reports.
+func parseAll(t *testing.T, f akinet.TCPParserFactory, bidiID akinet.TCPBidiID, data []byte) []akinet.ParsedNetworkContent {
+	decision, _ := f.Accepts(memview.New(data), false)
+	require.Equal(t, akinet.Accept, decision)
+
+	p := f.CreateParser(bidiID, 0, 0)
+	var results []akinet.ParsedNetworkContent
+	for _, b := range data[:3] {
+		content, _, _, err := p.Parse(memview.New([]byte{b}), false)
+		require.NoError(t, err)
+		require.Nil(t, content)
+	}
+	input := memview.New(data[3:])
+	for {
+		content, unused, _, err := p.Parse(input, false)
+		require.NoError(t, err)
+		if content == nil {
+			break
+		}
+		results = append(results, content)
+		input = unused
+	}
+	return results
+}
+
+func TestSimpleQuery(t *testing.T) {
+	frontend, backend := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+	streamID := uuid.UUID(bidiID)
+
+	startup := message(0, "\x00\x03\x00\x00", "user\x00dog\x00\x00")
+	fromClient := concat(
+		startup,
+		message('Q', "SELECT name FROM dogs WHERE id = 42\x00"),
+		message('Q', "INSERT INTO dogs (name) VALUES ('Rex')\x00"),
+		message('X'),
+	)
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Query{Protocol: database.PostgreSQL, StreamID: streamID, Seq: 1, Text: "SELECT name FROM dogs WHERE id = ?"},
+		database.Query{Protocol: database.PostgreSQL, StreamID: streamID, Seq: 2, Text: "INSERT INTO dogs (name) VALUES (?)"},
+	}, parseAll(t, frontend, bidiID, fromClient))
+
+	fromServer := concat(
+		message('R', "\x00\x00\x00\x00"),
+		message('S', "server_version\x0016.1\x00"),
+		// Ends startup, so doesn't answer a statement.
+		message('Z', "I"),
+		message('T', "\x00\x01", "name\x00", string(make([]byte, 18))),
+		message('D', "\x00\x01", "\x00\x00\x00\x03Rex"),
+		message('C', "SELECT 1\x00"),
+		message('Z', "I"),
+		message('E', "SERROR\x00", "C23505\x00", "Mduplicate key value\x00", "\x00"),
+		message('Z', "I"),
+	)
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Result{Protocol: database.PostgreSQL, StreamID: streamID, Seq: 1},
+		database.Result{Protocol: database.PostgreSQL, StreamID: streamID, Seq: 2, ErrorCode: "23505"},
+	}, parseAll(t, backend, bidiID, fromServer))
+}
+
+func TestExtendedQuery(t *testing.T) {
+	frontend, backend := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+	streamID := uuid.UUID(bidiID)
+
+	// Captured mid-connection: the first message is a Parse.
+	fromClient := concat(
+		message('P', "find_dog\x00", "SELECT * FROM dogs WHERE id = $1 AND age > 3\x00", "\x00\x00"),
+		message('S'),
+		message('B', "\x00", "find_dog\x00", "\x00\x00\x00\x01\x00\x00\x00\x01", "7", "\x00\x00"),
+		message('E', "\x00", "\x00\x00\x00\x00"),
+		message('S'),
+	)
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Query{Protocol: database.PostgreSQL, StreamID: streamID, Seq: 1, Text: "SELECT * FROM dogs WHERE id = $1 AND age > ?"},
+	}, parseAll(t, frontend, bidiID, fromClient))
+
+	fromServer := concat(
+		// Answers the Sync after Parse, which isn't reported.
+		message('1'),
+		message('Z', "I"),
+		message('2'),
+		message('D', "\x00\x01", "\x00\x00\x00\x03Rex"),
+		message('C', "SELECT 1\x00"),
+		message('Z', "I"),
+	)
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		database.Result{Protocol: database.PostgreSQL, StreamID: streamID, Seq: 1},
+	}, parseAll(t, backend, bidiID, fromServer))
+}
+
+func TestAccepts(t *testing.T) {
+	frontend, backend := NewParserFactories()
+
+	testCases := []struct {
+		name     string
+		factory  akinet.TCPParserFactory
+		data     []byte
+		expected akinet.AcceptDecision
+	}{
+		{"SSL request", frontend, message(0, "\x04\xd2\x16\x2f"), akinet.Reject},
+		{"HTTP request", frontend, []byte("GET / HTTP/1.1\r\n\r\n"), akinet.Reject},
+		{"unnamed Parse", frontend, message('P', "\x00", "SELECT 1\x00", "\x00\x00"), akinet.Accept},
+		{"partial query", frontend, message('Q', "SELECT 1\x00")[:7], akinet.NeedMoreData},
+		{"SSL refusal", backend, []byte("N"), akinet.NeedMoreData},
+		{"MySQL handshake", backend, []byte("J\x00\x00\x00\x0a8.0.36\x00"), akinet.Reject},
+		{"MySQL handshake like CommandComplete", backend, []byte("C\x00\x00\x00\x0a8.0.36\x00abcdefgh"), akinet.Reject},
+		{"MySQL handshake like RowDescription", backend, []byte("T\x00\x00\x00\x0a5.7.44-log\x00"), akinet.Reject},
+		{"ReadyForQuery", backend, message('Z', "T"), akinet.Accept},
+		{"CommandComplete", backend, message('C', "UPDATE 3\x00"), akinet.Accept},
+	}
+	for _, tc := range testCases {
+		decision, _ := tc.factory.Accepts(memview.New(tc.data), false)
+		assert.Equal(t, tc.expected, decision, tc.name)
+	}
+}
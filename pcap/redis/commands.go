@@ -0,0 +1,233 @@
+package redis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Longest command name we report. Longer names are truncated.
+	maxNameLen = 64
+
+	// Longest key pattern we report. Longer patterns are truncated.
+	maxKeyPatternLen = 256
+)
+
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+// Commands that are recognized at the start of a connection that was already
+// open when capture started. Module commands, whose names contain a dot, are
+// recognized too.
+var knownCommands = wordSet(`
+	ACL APPEND ASKING AUTH BGREWRITEAOF BGSAVE BITCOUNT BITFIELD BITFIELD_RO
+	BITOP BITPOS BLMOVE BLMPOP BLPOP BRPOP BRPOPLPUSH BZMPOP BZPOPMAX BZPOPMIN
+	CLIENT CLUSTER COMMAND CONFIG COPY DBSIZE DEBUG DECR DECRBY DEL DISCARD
+	DUMP ECHO EVAL EVAL_RO EVALSHA EVALSHA_RO EXEC EXISTS EXPIRE EXPIREAT
+	EXPIRETIME FAILOVER FCALL FCALL_RO FLUSHALL FLUSHDB FUNCTION GEOADD
+	GEODIST GEOHASH GEOPOS GEORADIUS GEORADIUSBYMEMBER GEOSEARCH
+	GEOSEARCHSTORE GET GETBIT GETDEL GETEX GETRANGE GETSET HDEL HELLO HEXISTS
+	HEXPIRE HGET HGETALL HINCRBY HINCRBYFLOAT HKEYS HLEN HMGET HMSET HRANDFIELD
+	HSCAN HSET HSETNX HSTRLEN HVALS INCR INCRBY INCRBYFLOAT INFO KEYS LASTSAVE
+	LATENCY LCS LINDEX LINSERT LLEN LMOVE LMPOP LOLWUT LPOP LPOS LPUSH LPUSHX
+	LRANGE LREM LSET LTRIM MEMORY MGET MIGRATE MODULE MONITOR MOVE MSET MSETNX
+	MULTI OBJECT PERSIST PEXPIRE PEXPIREAT PEXPIRETIME PFADD PFCOUNT PFMERGE
+	PING PSETEX PSUBSCRIBE PSYNC PTTL PUBLISH PUBSUB PUNSUBSCRIBE QUIT
+	RANDOMKEY READONLY READWRITE RENAME RENAMENX REPLICAOF RESET RESTORE ROLE
+	RPOP RPOPLPUSH RPUSH RPUSHX SADD SAVE SCAN SCARD SCRIPT SDIFF SDIFFSTORE
+	SELECT SET SETBIT SETEX SETNX SETRANGE SHUTDOWN SINTER SINTERCARD
+	SINTERSTORE SISMEMBER SLAVEOF SLOWLOG SMEMBERS SMISMEMBER SMOVE SORT
+	SORT_RO SPOP SPUBLISH SRANDMEMBER SREM SSCAN SSUBSCRIBE STRLEN SUBSCRIBE
+	SUBSTR SUNION SUNIONSTORE SUNSUBSCRIBE SWAPDB SYNC TIME TOUCH TTL TYPE
+	UNLINK UNSUBSCRIBE UNWATCH WAIT WAITAOF WATCH XACK XADD XAUTOCLAIM XCLAIM
+	XDEL XGROUP XINFO XLEN XPENDING XRANGE XREAD XREADGROUP XREVRANGE XSETID
+	XTRIM ZADD ZCARD ZCOUNT ZDIFF ZDIFFSTORE ZINCRBY ZINTER ZINTERCARD
+	ZINTERSTORE ZLEXCOUNT ZMPOP ZMSCORE ZPOPMAX ZPOPMIN ZRANDMEMBER ZRANGE
+	ZRANGEBYLEX ZRANGEBYSCORE ZRANGESTORE ZRANK ZREM ZREMRANGEBYLEX
+	ZREMRANGEBYRANK ZREMRANGEBYSCORE ZREVRANGE ZREVRANGEBYLEX
+	ZREVRANGEBYSCORE ZREVRANK ZSCAN ZSCORE ZUNION ZUNIONSTORE
+`)
+
+// Commands whose first argument is a subcommand, which is reported as part of
+// the command name.
+var containerCommands = wordSet(`
+	ACL CLIENT CLUSTER COMMAND CONFIG FUNCTION LATENCY MEMORY MODULE OBJECT
+	PUBSUB SCRIPT SLOWLOG XGROUP XINFO
+`)
+
+// Subcommands that take a key right after the subcommand.
+var keyedSubcommands = wordSet(`
+	MEMORY_USAGE OBJECT_ENCODING OBJECT_FREQ OBJECT_IDLETIME OBJECT_REFCOUNT
+	XGROUP_CREATE XGROUP_CREATECONSUMER XGROUP_DELCONSUMER XGROUP_DESTROY
+	XGROUP_SETID XINFO_CONSUMERS XINFO_GROUPS XINFO_STREAM
+`)
+
+// Commands that don't take a key as their first argument, or take none at
+// all.
+var keylessCommands = wordSet(`
+	ASKING AUTH BGREWRITEAOF BGSAVE DBSIZE DEBUG DISCARD ECHO EXEC FAILOVER
+	FLUSHALL FLUSHDB HELLO INFO KEYS LASTSAVE LOLWUT MONITOR MULTI PING
+	PSUBSCRIBE PSYNC PUBLISH PUNSUBSCRIBE QUIT RANDOMKEY READONLY READWRITE
+	REPLICAOF RESET ROLE SAVE SCAN SELECT SHUTDOWN SLAVEOF SPUBLISH SSUBSCRIBE
+	SUBSCRIBE SUNSUBSCRIBE SWAPDB SYNC TIME UNSUBSCRIBE UNWATCH WAIT WAITAOF
+	XREAD XREADGROUP
+`)
+
+// For commands that give the number of keys before the keys themselves, the
+// position of that number. The first key follows it.
+var numKeysPosition = map[string]int{
+	"EVAL":       2,
+	"EVAL_RO":    2,
+	"EVALSHA":    2,
+	"EVALSHA_RO": 2,
+	"FCALL":      2,
+	"FCALL_RO":   2,
+	"BLMPOP":     2,
+	"BZMPOP":     2,
+	"LMPOP":      1,
+	"ZMPOP":      1,
+	"SINTERCARD": 1,
+	"ZDIFF":      1,
+	"ZINTER":     1,
+	"ZINTERCARD": 1,
+	"ZUNION":     1,
+}
+
+// Commands whose first key isn't their first argument, and its position.
+var keyPosition = map[string]int{
+	"BITOP": 2,
+}
+
+// Whether the first bulk string of a command looks like a command name.
+func isCommandName(name []byte) bool {
+	if len(name) == 0 || len(name) > maxNameLen {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c == '_', c == '.', c == '-':
+		default:
+			return false
+		}
+	}
+	upper := strings.ToUpper(string(name))
+	return knownCommands[upper] || strings.Contains(upper, ".")
+}
+
+// Returns the name to report for a command, given its first arguments.
+func commandName(args []string) string {
+	name := strings.ToUpper(args[0])
+	if containerCommands[name] && len(args) > 1 {
+		name += " " + strings.ToUpper(args[1])
+	}
+	if len(name) > maxNameLen {
+		name = name[:maxNameLen]
+	}
+	return name
+}
+
+// Returns the first key of a command, given its first arguments, if the key is
+// among them.
+func commandKey(args []string) (string, bool) {
+	base := strings.ToUpper(args[0])
+	i := 1
+	if pos, ok := keyPosition[base]; ok {
+		i = pos
+	}
+	if containerCommands[base] {
+		if len(args) < 2 || !keyedSubcommands[base+"_"+strings.ToUpper(args[1])] {
+			return "", false
+		}
+		i = 2
+	} else if keylessCommands[base] {
+		return "", false
+	}
+	if pos, ok := numKeysPosition[base]; ok {
+		if len(args) <= pos {
+			return "", false
+		}
+		if n, err := strconv.Atoi(args[pos]); err != nil || n <= 0 {
+			return "", false
+		}
+		i = pos + 1
+	}
+	if i >= len(args) {
+		return "", false
+	}
+	return args[i], true
+}
+
+// Returns the key with each part that looks like an ID replaced by '*'. Parts
+// are separated by ':', '/', '.' or '|'. The braces of cluster hash tags are
+// kept.
+func keyPattern(key string) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(key); i++ {
+		if i < len(key) && !strings.ContainsRune(":/.|", rune(key[i])) {
+			continue
+		}
+		b.WriteString(partPattern(key[start:i]))
+		if i < len(key) {
+			b.WriteByte(key[i])
+		}
+		start = i + 1
+	}
+	pattern := b.String()
+	if len(pattern) > maxKeyPatternLen {
+		pattern = pattern[:maxKeyPatternLen]
+	}
+	return pattern
+}
+
+func partPattern(part string) string {
+	inner := strings.TrimPrefix(part, "{")
+	opening := part[:len(part)-len(inner)]
+	id := strings.TrimSuffix(inner, "}")
+	closing := inner[len(id):]
+	if looksLikeID(id) {
+		return opening + "*" + closing
+	}
+	return part
+}
+
+// Whether a part of a key looks like an ID: a number, a UUID or long hex
+// string, or a long token that mixes letters and digits.
+func looksLikeID(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits, hexOnly, token := true, true, true
+	hasDigit := false
+	for _, c := range s {
+		isDigit := '0' <= c && c <= '9'
+		isHex := isDigit || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F') || c == '-'
+		isToken := isDigit || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '-' || c == '_'
+		digits = digits && isDigit
+		hexOnly = hexOnly && isHex
+		token = token && isToken
+		hasDigit = hasDigit || isDigit
+	}
+	switch {
+	case digits:
+		return true
+	case hexOnly && hasDigit && len(s) >= 16:
+		return true
+	case token && hasDigit && len(s) >= 20:
+		return true
+	}
+	return false
+}
+
+// Returns a short hash of a key.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,219 @@
+package redis
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/google/gopacket/reassembly"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Longest header line, e.g. "*3" or "$11", that we wait for when deciding
+	// whether to accept a connection.
+	maxHeaderLineLen = 16
+
+	// Longest first line of a reply that we wait for when deciding whether to
+	// accept a connection.
+	maxFirstReplyLineLen = 256
+)
+
+// Returns factories for parsers of the data sent by Redis clients and
+// servers. They must be used together, since replies are matched with the
+// commands before them.
+func NewParserFactories() (clients, servers akinet.TCPParserFactory) {
+	conns := conntrack.NewConnections()
+	return clientParserFactory{conns: conns}, serverParserFactory{conns: conns}
+}
+
+type clientParserFactory struct {
+	conns *conntrack.Connections
+}
+
+func (clientParserFactory) Name() string {
+	return "Redis Client Parser Factory"
+}
+
+// Recognizes a command sent as an array of bulk strings, which is how clients
+// send commands, whose name is a known command. Inline commands aren't
+// recognized, since they can't be told apart from other text protocols.
+func (clientParserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	head := readPrefix(input, 2*(maxHeaderLineLen+2)+maxNameLen+2)
+	count, rest, decision := acceptHeaderLine(head, '*')
+	if decision != akinet.Accept {
+		return decision, 0
+	}
+	if count == 0 || count > 1024*1024 {
+		return akinet.Reject, 0
+	}
+	nameLen, rest, decision := acceptHeaderLine(rest, '$')
+	if decision != akinet.Accept {
+		return decision, 0
+	}
+	if len(rest) < nameLen+2 {
+		return akinet.NeedMoreData, 0
+	}
+	if !isCommandName(rest[:nameLen]) || !bytes.Equal(rest[nameLen:nameLen+2], []byte("\r\n")) {
+		return akinet.Reject, 0
+	}
+	return akinet.Accept, 0
+}
+
+func (f clientParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), id, true)
+}
+
+type serverParserFactory struct {
+	conns *conntrack.Connections
+}
+
+func (serverParserFactory) Name() string {
+	return "Redis Server Parser Factory"
+}
+
+// Recognizes a reply whose first line is well formed.
+func (serverParserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	head := readPrefix(input, maxFirstReplyLineLen)
+	end := bytes.Index(head, []byte("\r\n"))
+	if end < 0 {
+		if len(head) < maxFirstReplyLineLen && bytes.IndexByte(head, '\n') < 0 {
+			return akinet.NeedMoreData, 0
+		}
+		return akinet.Reject, 0
+	}
+	if !isReplyLine(head[:end]) {
+		return akinet.Reject, 0
+	}
+	return akinet.Accept, 0
+}
+
+func (f serverParserFactory) CreateParser(id akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.conns.Get(id), id, false)
+}
+
+// Reads a line with the given type and a non-negative length from the start of
+// b, and returns the length and what follows the line.
+func acceptHeaderLine(b []byte, typ byte) (int, []byte, akinet.AcceptDecision) {
+	if len(b) == 0 {
+		return 0, nil, akinet.NeedMoreData
+	}
+	if b[0] != typ {
+		return 0, nil, akinet.Reject
+	}
+	end := bytes.Index(b, []byte("\r\n"))
+	if end < 0 {
+		if len(b) < maxHeaderLineLen {
+			return 0, nil, akinet.NeedMoreData
+		}
+		return 0, nil, akinet.Reject
+	}
+	n, ok := parseLength(b[1:end])
+	if !ok || n < 0 {
+		return 0, nil, akinet.Reject
+	}
+	return n, b[end+2:], akinet.Accept
+}
+
+// Whether a line, without its CRLF, could be the first line of a reply.
+func isReplyLine(line []byte) bool {
+	if len(line) == 0 {
+		return false
+	}
+	body := line[1:]
+	switch line[0] {
+	case '+':
+		return conntrack.LooksLikeText(body)
+	case '-':
+		return errorPrefix(body) != ""
+	case ':':
+		_, err := strconv.ParseInt(string(body), 10, 64)
+		return err == nil
+	case '(':
+		return isDigits(bytes.TrimPrefix(body, []byte("-")))
+	case ',':
+		_, err := strconv.ParseFloat(string(body), 64)
+		return err == nil
+	case '#':
+		return string(body) == "t" || string(body) == "f"
+	case '_':
+		return len(body) == 0
+	case '$', '*':
+		_, ok := parseLength(body)
+		return ok
+	case '=', '!', '%', '~', '>', '|':
+		n, ok := parseLength(body)
+		return ok && n >= 0
+	}
+	return false
+}
+
+// Parses the length of a bulk string or aggregate. A length of -1 is the
+// RESP2 null.
+func parseLength(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 10 {
+		return 0, false
+	}
+	if string(b) == "-1" {
+		return -1, true
+	}
+	if !isDigits(b) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(b))
+	return n, err == nil
+}
+
+func isDigits(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the first word of an error message if it's an upper-case error code,
+// as Redis errors start with, or the empty string otherwise.
+func errorPrefix(message []byte) string {
+	word := message
+	if i := bytes.IndexByte(word, ' '); i >= 0 {
+		word = word[:i]
+	}
+	if len(word) == 0 || len(word) > 32 {
+		return ""
+	}
+	for _, c := range word {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return ""
+		}
+	}
+	return string(word)
+}
+
+// Returns up to n bytes from the start of the input.
+func readPrefix(input memview.MemView, n int64) []byte {
+	if input.Len() < n {
+		n = input.Len()
+	}
+	b, _ := io.ReadAll(input.SubView(0, n).CreateReader())
+	return b
+}
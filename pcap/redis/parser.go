@@ -0,0 +1,426 @@
+package redis
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-cli/pcap/conntrack"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Longest line that we buffer. The rest of a longer line is dropped, which
+	// only matters for inline commands and simple strings.
+	maxLineLen = 64 * 1024
+
+	// Number of arguments of a command, counting the name, that we keep. Enough
+	// to find the first key of any command we know.
+	maxArgs = 4
+
+	// Longest part of an argument that we keep.
+	maxArgLen = 1024
+
+	// Deepest nesting of aggregates that we accept.
+	maxDepth = 64
+)
+
+// Commands after which the server only sends push messages, which aren't
+// matched with commands.
+var pushOnlyCommands = wordSet(`MONITOR PSUBSCRIBE SSUBSCRIBE SUBSCRIBE`)
+
+// Connection state that both directions need.
+type connState struct {
+	// Whether the client subscribed to messages or started monitoring. Replies
+	// can't be matched with commands after that, so the connection is no
+	// longer reported.
+	pushOnly bool
+}
+
+func getConnState(conn *conntrack.Connection) *connState {
+	if s, ok := conn.Extra.(*connState); ok {
+		return s
+	}
+	s := &connState{}
+	conn.Extra = s
+	return s
+}
+
+// An aggregate whose elements are being read.
+type frame struct {
+	// Elements left, counting the keys and values of maps separately.
+	left int
+
+	// Whether the aggregate is an attribute, which annotates the value after
+	// it rather than being a value itself.
+	attribute bool
+}
+
+// Parses one direction of a Redis connection.
+//
+// On the client side, each command yields a Command. On the server side, each
+// reply yields a Reply, matched with the oldest command that hasn't been
+// answered. RESP3 push messages aren't replies, and are consumed without being
+// reported. Commands that turn replies off with CLIENT REPLY aren't handled,
+// and throw the matching off.
+type parser struct {
+	conn       *conntrack.Connection
+	streamID   uuid.UUID
+	fromClient bool
+
+	// Total bytes consumed over the life of the parser.
+	consumed int64
+
+	// An incomplete line.
+	line []byte
+
+	// The bulk string whose content is being read, if inBulk is set. Its
+	// start is kept in bulk if collect is set.
+	inBulk   bool
+	bulkLen  int
+	bulkLeft int
+	collect  bool
+	bulk     []byte
+
+	// Aggregates that the current value is nested in.
+	stack []frame
+
+	// The type of the value at the top level, and whether it is null.
+	top  byte
+	null bool
+
+	// Client side: the first arguments of the command.
+	args []string
+
+	// Server side: the first word of an error reply.
+	errorPrefix string
+}
+
+func newParser(conn *conntrack.Connection, bidiID akinet.TCPBidiID, fromClient bool) *parser {
+	return &parser{
+		conn:       conn,
+		streamID:   uuid.UUID(bidiID),
+		fromClient: fromClient,
+	}
+}
+
+func (p *parser) Name() string {
+	if p.fromClient {
+		return "Redis Client Parser"
+	}
+	return "Redis Server Parser"
+}
+
+// Tells the TCP flow to keep this parser after it produces a result.
+func (*parser) ParsesWholeFlow() bool {
+	return true
+}
+
+func (p *parser) Parse(input memview.MemView, isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	data, err := io.ReadAll(input.CreateReader())
+	if err != nil {
+		return nil, memview.MemView{}, p.consumed, errors.Wrap(err, "failed to read input")
+	}
+
+	offset := 0
+	for offset < len(data) {
+		done := false
+		if p.inBulk {
+			var n int
+			n, done = p.readBulk(data[offset:])
+			offset += n
+		} else {
+			end := bytes.IndexByte(data[offset:], '\n')
+			if end < 0 {
+				p.appendLine(data[offset:])
+				offset = len(data)
+				break
+			}
+			p.appendLine(data[offset : offset+end])
+			offset += end + 1
+
+			done, err = p.readLine(bytes.TrimSuffix(p.line, []byte("\r")))
+			p.line = p.line[:0]
+			if err != nil {
+				p.consumed += int64(offset)
+				return nil, memview.MemView{}, p.consumed, err
+			}
+		}
+
+		if done {
+			content := p.finishValue()
+			p.reset()
+			if content != nil {
+				p.consumed += int64(offset)
+				return content, input.SubView(int64(offset), input.Len()), p.consumed, nil
+			}
+		}
+	}
+
+	p.consumed += int64(offset)
+	if isEnd && (p.inBulk || len(p.stack) > 0 || len(p.line) > 0) {
+		return nil, memview.MemView{}, p.consumed, errors.New("connection ended in the middle of a Redis message")
+	}
+	return nil, memview.MemView{}, p.consumed, nil
+}
+
+func (p *parser) appendLine(b []byte) {
+	if room := maxLineLen - len(p.line); len(b) > room {
+		b = b[:room]
+	}
+	p.line = append(p.line, b...)
+}
+
+// Handles a line, without its line ending, and returns whether it completes a
+// value at the top level.
+func (p *parser) readLine(line []byte) (bool, error) {
+	if len(line) == 0 {
+		if len(p.stack) == 0 {
+			// Blank lines between inline commands are ignored.
+			return false, nil
+		}
+		return false, errors.New("empty line in a Redis message")
+	}
+
+	if p.fromClient && len(p.stack) == 0 && line[0] != '*' {
+		// An inline command, with space-separated arguments.
+		fields := strings.Fields(string(line))
+		if len(fields) > maxArgs {
+			fields = fields[:maxArgs]
+		}
+		p.args = fields
+		return true, nil
+	}
+
+	typ, body := line[0], line[1:]
+	if len(p.stack) == 0 && typ != '|' {
+		p.top = typ
+	}
+
+	switch typ {
+	case '+', ':', ',', '(', '#':
+		return p.valueDone(), nil
+
+	case '-':
+		if len(p.stack) == 0 {
+			p.errorPrefix = errorPrefix(body)
+		}
+		return p.valueDone(), nil
+
+	case '_':
+		if len(p.stack) == 0 {
+			p.null = true
+		}
+		return p.valueDone(), nil
+
+	case '$', '=', '!':
+		n, ok := parseLength(body)
+		if !ok {
+			return false, errors.Errorf("invalid Redis bulk string length %q", body)
+		}
+		if n < 0 {
+			if len(p.stack) == 0 {
+				p.null = true
+			}
+			return p.valueDone(), nil
+		}
+		p.inBulk = true
+		p.bulkLen = n
+		p.bulkLeft = n + 2
+		p.collect = (p.fromClient && len(p.stack) == 1 && len(p.args) < maxArgs) ||
+			(typ == '!' && len(p.stack) == 0)
+		p.bulk = p.bulk[:0]
+		return false, nil
+
+	case '*', '~', '>', '%', '|':
+		n, ok := parseLength(body)
+		if !ok {
+			return false, errors.Errorf("invalid Redis aggregate length %q", body)
+		}
+		if n < 0 {
+			if len(p.stack) == 0 {
+				p.null = true
+			}
+			return p.valueDone(), nil
+		}
+		if typ == '%' || typ == '|' {
+			// Maps and attributes hold a key and a value for each entry.
+			n *= 2
+		}
+		if n == 0 {
+			if typ == '|' {
+				return false, nil
+			}
+			return p.valueDone(), nil
+		}
+		if len(p.stack) >= maxDepth {
+			return false, errors.New("aggregates nested too deeply in a Redis message")
+		}
+		p.stack = append(p.stack, frame{left: n, attribute: typ == '|'})
+		return false, nil
+	}
+	return false, errors.Errorf("unexpected Redis type %q", typ)
+}
+
+// Reads the content of a bulk string from b, and returns the number of bytes
+// used and whether the string completes a value at the top level.
+func (p *parser) readBulk(b []byte) (int, bool) {
+	n := p.bulkLeft
+	if n > len(b) {
+		n = len(b)
+	}
+
+	if p.collect {
+		read := p.bulkLen + 2 - p.bulkLeft
+		keep := p.bulkLen
+		if keep > maxArgLen {
+			keep = maxArgLen
+		}
+		keep -= read
+		if keep > n {
+			keep = n
+		}
+		if keep > 0 {
+			p.bulk = append(p.bulk, b[:keep]...)
+		}
+	}
+
+	p.bulkLeft -= n
+	if p.bulkLeft > 0 {
+		return n, false
+	}
+
+	p.inBulk = false
+	if p.collect {
+		if p.fromClient {
+			p.args = append(p.args, string(p.bulk))
+		} else {
+			p.errorPrefix = errorPrefix(p.bulk)
+		}
+	}
+	return n, p.valueDone()
+}
+
+// Counts a complete value against the aggregates it is nested in, and returns
+// whether that completes a value at the top level.
+func (p *parser) valueDone() bool {
+	for len(p.stack) > 0 {
+		f := &p.stack[len(p.stack)-1]
+		if f.left--; f.left > 0 {
+			return false
+		}
+		p.stack = p.stack[:len(p.stack)-1]
+		if f.attribute {
+			// The value that the attribute annotates is still to come.
+			return false
+		}
+	}
+	return true
+}
+
+func (p *parser) reset() {
+	p.top = 0
+	p.null = false
+	p.args = nil
+	p.errorPrefix = ""
+}
+
+func (p *parser) finishValue() akinet.ParsedNetworkContent {
+	if p.fromClient {
+		return p.finishCommand()
+	}
+	return p.finishReply()
+}
+
+func (p *parser) finishCommand() akinet.ParsedNetworkContent {
+	if len(p.args) == 0 || p.args[0] == "" {
+		return nil
+	}
+	name := commandName(p.args)
+
+	p.conn.Lock()
+	defer p.conn.Unlock()
+	state := getConnState(p.conn)
+
+	if state.pushOnly {
+		return nil
+	}
+	if pushOnlyCommands[name] {
+		state.pushOnly = true
+		return nil
+	}
+
+	seq := p.conn.NextSeq()
+	p.conn.Push(conntrack.Pending{Seq: seq})
+	command := Command{
+		StreamID: p.streamID,
+		Seq:      seq,
+		Name:     name,
+	}
+	if key, ok := commandKey(p.args); ok {
+		command.KeyPattern = keyPattern(key)
+		command.KeyHash = hashKey(key)
+	}
+	return command
+}
+
+func (p *parser) finishReply() akinet.ParsedNetworkContent {
+	if p.top == '>' {
+		// A push message, which doesn't answer a command.
+		return nil
+	}
+
+	p.conn.Lock()
+	pushOnly := getConnState(p.conn).pushOnly
+	var pending conntrack.Pending
+	ok := false
+	if !pushOnly {
+		pending, ok = p.conn.Pop()
+	}
+	p.conn.Unlock()
+	if !ok || pending.Seq == 0 {
+		return nil
+	}
+
+	return Reply{
+		StreamID:    p.streamID,
+		Seq:         pending.Seq,
+		Type:        p.replyType(),
+		ErrorPrefix: p.errorPrefix,
+	}
+}
+
+func (p *parser) replyType() ReplyType {
+	if p.null {
+		return Null
+	}
+	switch p.top {
+	case '+':
+		return SimpleString
+	case '$':
+		return BulkString
+	case '=':
+		return VerbatimString
+	case '-', '!':
+		return Error
+	case ':':
+		return Integer
+	case ',':
+		return Double
+	case '#':
+		return Boolean
+	case '(':
+		return BigNumber
+	case '*':
+		return Array
+	case '%':
+		return Map
+	case '~':
+		return Set
+	}
+	return ""
+}
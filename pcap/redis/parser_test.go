@@ -0,0 +1,156 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// One direction of a connection, parsed by a parser that lives as long as the
+// flow, as in a TCP flow.
+type flow struct {
+	t       *testing.T
+	factory akinet.TCPParserFactory
+	bidiID  akinet.TCPBidiID
+	parser  akinet.TCPParser
+}
+
+// Feeds data to the flow's parser, creating it on first use, and returns
+// everything it reports.
+func (f *flow) feed(data string) []akinet.ParsedNetworkContent {
+	if f.parser == nil {
+		decision, _ := f.factory.Accepts(memview.New([]byte(data)), false)
+		require.Equal(f.t, akinet.Accept, decision)
+		f.parser = f.factory.CreateParser(f.bidiID, 0, 0)
+	}
+
+	var results []akinet.ParsedNetworkContent
+	input := memview.New([]byte(data))
+	for {
+		content, unused, _, err := f.parser.Parse(input, false)
+		require.NoError(f.t, err)
+		if content == nil {
+			return results
+		}
+		results = append(results, content)
+		input = unused
+	}
+}
+
+func TestCommands(t *testing.T) {
+	clients, servers := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+	streamID := uuid.UUID(bidiID)
+	client := &flow{t: t, factory: clients, bidiID: bidiID}
+	server := &flow{t: t, factory: servers, bidiID: bidiID}
+
+	// Pipelined commands, split to exercise reassembly.
+	commands := "*2\r\n$3\r\nGET\r\n$16\r\nuser:1234:avatar\r\n" +
+		"*3\r\n$4\r\nHGET\r\n$13\r\nsession:a1b2c\r\n$2\r\nid\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$6\r\nvisits\r\n"
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Command{StreamID: streamID, Seq: 1, Name: "GET", KeyPattern: "user:*:avatar", KeyHash: hashKey("user:1234:avatar")},
+	}, client.feed(commands[:40]))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Command{StreamID: streamID, Seq: 2, Name: "HGET", KeyPattern: "session:a1b2c", KeyHash: hashKey("session:a1b2c")},
+		Command{StreamID: streamID, Seq: 3, Name: "INCR", KeyPattern: "visits", KeyHash: hashKey("visits")},
+	}, client.feed(commands[40:]))
+
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Reply{StreamID: streamID, Seq: 1, Type: Null},
+		Reply{StreamID: streamID, Seq: 2, Type: BulkString},
+		Reply{StreamID: streamID, Seq: 3, Type: Integer},
+	}, server.feed("$-1\r\n$5\r\nhello\r\n:42\r\n"))
+
+	// RESP3, with an attribute and a push message ahead of the reply.
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Command{StreamID: streamID, Seq: 4, Name: "CLIENT TRACKING"},
+		Command{StreamID: streamID, Seq: 5, Name: "EVALSHA", KeyPattern: "lock:*", KeyHash: hashKey("lock:550e8400-e29b-41d4-a716-446655440000")},
+	}, client.feed("*3\r\n$6\r\nclient\r\n$8\r\ntracking\r\n$2\r\non\r\n"+
+		"*4\r\n$7\r\nevalsha\r\n$3\r\nabc\r\n$1\r\n1\r\n$41\r\nlock:550e8400-e29b-41d4-a716-446655440000\r\n"))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Reply{StreamID: streamID, Seq: 4, Type: SimpleString},
+		Reply{StreamID: streamID, Seq: 5, Type: Map},
+	}, server.feed("+OK\r\n"+
+		">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nvisits\r\n"+
+		"|1\r\n+ttl\r\n:3600\r\n%1\r\n+a\r\n*2\r\n:1\r\n_\r\n"))
+
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Command{StreamID: streamID, Seq: 6, Name: "LPUSH", KeyPattern: "visits", KeyHash: hashKey("visits")},
+	}, client.feed("*3\r\n$5\r\nLPUSH\r\n$6\r\nvisits\r\n$1\r\nx\r\n"))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Reply{StreamID: streamID, Seq: 6, Type: Error, ErrorPrefix: "WRONGTYPE"},
+	}, server.feed("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"))
+
+	// Nothing is reported once the client subscribes.
+	assert.Empty(t, client.feed("*2\r\n$9\r\nSUBSCRIBE\r\n$4\r\nnews\r\n"))
+	assert.Empty(t, server.feed("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"))
+	assert.Empty(t, client.feed("PING\r\n"))
+}
+
+func TestInlineCommands(t *testing.T) {
+	clients, servers := NewParserFactories()
+	bidiID := akinet.TCPBidiID(uuid.New())
+	streamID := uuid.UUID(bidiID)
+	client := &flow{t: t, factory: clients, bidiID: bidiID}
+	server := &flow{t: t, factory: servers, bidiID: bidiID}
+
+	// The parser is created by a command sent as an array.
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Command{StreamID: streamID, Seq: 1, Name: "PING"},
+		Command{StreamID: streamID, Seq: 2, Name: "EXISTS", KeyPattern: "cart:*", KeyHash: hashKey("cart:99")},
+	}, client.feed("*1\r\n$4\r\nPING\r\nexists cart:99\r\n"))
+	assert.Equal(t, []akinet.ParsedNetworkContent{
+		Reply{StreamID: streamID, Seq: 1, Type: SimpleString},
+		Reply{StreamID: streamID, Seq: 2, Type: Integer},
+	}, server.feed("+PONG\r\n:0\r\n"))
+}
+
+func TestKeyPattern(t *testing.T) {
+	testCases := map[string]string{
+		"user:1234:avatar":                         "user:*:avatar",
+		"{user:42}.cart":                           "{user:*}.cart",
+		"session:9f86d081884c7d659a2feaa0c55ad015": "session:*",
+		"feed/2024/latest":                         "feed/*/latest",
+		"token:abcdefghijklmnopqrst1":              "token:*",
+		"rate-limit:api":                           "rate-limit:api",
+		"cache:v2:home":                            "cache:v2:home",
+		"{42}":                                     "{*}",
+	}
+	for key, expected := range testCases {
+		assert.Equal(t, expected, keyPattern(key), key)
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	clients, servers := NewParserFactories()
+
+	testCases := []struct {
+		name     string
+		factory  akinet.TCPParserFactory
+		data     string
+		expected akinet.AcceptDecision
+	}{
+		{"command", clients, "*2\r\n$3\r\nget\r\n$3\r\nfoo\r\n", akinet.Accept},
+		{"module command", clients, "*2\r\n$8\r\nJSON.GET\r\n$3\r\nfoo\r\n", akinet.Accept},
+		{"partial command", clients, "*2\r\n$3\r\nGE", akinet.NeedMoreData},
+		{"unknown command", clients, "*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", akinet.Reject},
+		{"inline command", clients, "PING\r\n", akinet.Reject},
+		{"HTTP request", clients, "GET / HTTP/1.1\r\n\r\n", akinet.Reject},
+		{"OK", servers, "+OK\r\n", akinet.Accept},
+		{"error", servers, "-ERR unknown command 'FOO'\r\n", akinet.Accept},
+		{"null", servers, "$-1\r\n", akinet.Accept},
+		{"partial reply", servers, "$1", akinet.NeedMoreData},
+		{"HTTP response", servers, "HTTP/1.1 200 OK\r\n\r\n", akinet.Reject},
+		{"lower-case error", servers, "-oops\r\n", akinet.Reject},
+	}
+	for _, tc := range testCases {
+		decision, _ := tc.factory.Accepts(memview.New([]byte(tc.data)), false)
+		assert.Equal(t, tc.expected, decision, tc.name)
+	}
+}
@@ -0,0 +1,65 @@
+// Package redis parses the Redis serialization protocol, RESP2 and RESP3, into
+// the commands a client sends and the replies the server returns for them.
+package redis
+
+import (
+	"github.com/google/uuid"
+
+	"github.com/akitasoftware/akita-cli/pcap/parsed"
+)
+
+// The kind of value at the top level of a reply.
+type ReplyType string
+
+const (
+	SimpleString   ReplyType = "simple-string"
+	BulkString     ReplyType = "bulk-string"
+	VerbatimString ReplyType = "verbatim-string"
+	Error          ReplyType = "error"
+	Integer        ReplyType = "integer"
+	Double         ReplyType = "double"
+	Boolean        ReplyType = "boolean"
+	BigNumber      ReplyType = "big-number"
+	Null           ReplyType = "null"
+	Array          ReplyType = "array"
+	Map            ReplyType = "map"
+	Set            ReplyType = "set"
+)
+
+// A command sent by a Redis client. It is answered by the Reply with the same
+// StreamID and Seq.
+type Command struct {
+	parsed.Content
+
+	// Shared by all commands and replies on the same TCP connection.
+	StreamID uuid.UUID
+	Seq      int
+
+	// The command name in upper case, followed by the subcommand for commands
+	// that have them, e.g. "GET" or "CLIENT SETNAME".
+	Name string
+
+	// The first key the command operates on, with the parts that look like
+	// IDs replaced by '*', e.g. "user:*:profile". Empty if the command takes
+	// no key.
+	KeyPattern string
+
+	// A hash of the whole key, so that accesses to the same key can be
+	// counted without keeping the key itself. Empty if the command takes no
+	// key.
+	KeyHash string
+}
+
+// The reply to a Command.
+type Reply struct {
+	parsed.Content
+
+	StreamID uuid.UUID
+	Seq      int
+
+	Type ReplyType
+
+	// For errors, the first word of the error message, e.g. "WRONGTYPE" or
+	// "MOVED". The rest of the message is dropped, since it may quote data.
+	ErrorPrefix string
+}
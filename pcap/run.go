@@ -5,40 +5,103 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/pkg/errors"
 
+	"github.com/akitasoftware/akita-cli/pcap/http2"
+	"github.com/akitasoftware/akita-cli/pcap/kafka"
+	"github.com/akitasoftware/akita-cli/pcap/mysql"
+	"github.com/akitasoftware/akita-cli/pcap/postgres"
+	"github.com/akitasoftware/akita-cli/pcap/redis"
+	"github.com/akitasoftware/akita-cli/pcap/tlsdecrypt"
 	"github.com/akitasoftware/akita-cli/trace"
 	"github.com/akitasoftware/akita-libs/akinet"
 	akihttp "github.com/akitasoftware/akita-libs/akinet/http"
-	akihttp2 "github.com/akitasoftware/akita-libs/akinet/http2"
 	"github.com/akitasoftware/akita-libs/akinet/tls"
 	"github.com/akitasoftware/akita-libs/buffer_pool"
 	. "github.com/akitasoftware/akita-libs/client_telemetry"
 )
 
+// Selects parsers for protocols that are off by default. These parsers
+// recognize a connection by the shape of its first bytes rather than by its
+// port, so they could claim binary traffic of other protocols.
+type ProtocolParsers struct {
+	// Parse Kafka requests and responses.
+	Kafka bool
+
+	// Parse PostgreSQL and MySQL queries and their results.
+	SQL bool
+}
+
 func Collect(
 	stop <-chan struct{},
 	intf string,
 	bpfFilter string,
 	bufferShare float32,
 	parseTCPAndTLS bool,
+	protocols ProtocolParsers,
+	keys *tlsdecrypt.KeyLog,
+	proc trace.Collector,
+	packetCount trace.PacketCountConsumer,
+	pool buffer_pool.BufferPool,
+) error {
+	parser := NewNetworkTrafficParser(bufferShare)
+	return collect(parser, stop, intf, bpfFilter, parseTCPAndTLS, protocols, keys, proc, packetCount, pool)
+}
+
+// Like Collect, but replays packets from pcap or pcapng files instead of
+// capturing them live. The files are read in order, as a single capture, and
+// the resulting traffic is attributed to the interface name intf. Returns
+// once all files have been read or stop is closed.
+func CollectFromFiles(
+	stop <-chan struct{},
+	files []string,
+	intf string,
+	bpfFilter string,
+	bufferShare float32,
+	parseTCPAndTLS bool,
+	protocols ProtocolParsers,
+	keys *tlsdecrypt.KeyLog,
+	proc trace.Collector,
+	packetCount trace.PacketCountConsumer,
+	pool buffer_pool.BufferPool,
+) error {
+	parser := NewPcapFileTrafficParser(files, bufferShare)
+	return collect(parser, stop, intf, bpfFilter, parseTCPAndTLS, protocols, keys, proc, packetCount, pool)
+}
+
+func collect(
+	parser *NetworkTrafficParser,
+	stop <-chan struct{},
+	intf string,
+	bpfFilter string,
+	parseTCPAndTLS bool,
+	protocols ProtocolParsers,
+	keys *tlsdecrypt.KeyLog,
 	proc trace.Collector,
 	packetCount trace.PacketCountConsumer,
 	pool buffer_pool.BufferPool,
 ) error {
 	defer proc.Close()
 
-	facts := []akinet.TCPParserFactory{
-		akihttp.NewHTTPRequestParserFactory(pool),
-		akihttp.NewHTTPResponseParserFactory(pool),
-		akihttp2.NewHTTP2PrefaceParserFactory(),
-	}
+	facts := tcpParserFactories(protocols, pool)
+
+	var tlsClients, tlsServers akinet.TCPParserFactory
 	if parseTCPAndTLS {
-		facts = append(facts,
-			tls.NewTLSClientParserFactory(),
-			tls.NewTLSServerParserFactory(),
-		)
+		tlsClients = tls.NewTLSClientParserFactory()
+		tlsServers = tls.NewTLSServerParserFactory()
 	}
 
-	parser := NewNetworkTrafficParser(bufferShare)
+	// Connections are decrypted when a key log is given. Otherwise, or if a
+	// connection's ClientHello is missed, only the handshake is parsed.
+	if keys != nil {
+		decryptingClients, decryptingServers := tlsdecrypt.NewParserFactories(keys, tlsClients, tlsServers,
+			akihttp.NewHTTPRequestParserFactory(pool),
+			akihttp.NewHTTPResponseParserFactory(pool),
+			http2.NewHTTP2ParserFactory(),
+		)
+		facts = append(facts, decryptingClients, decryptingServers)
+	}
+	if parseTCPAndTLS {
+		facts = append(facts, tlsClients, tlsServers)
+	}
 
 	if packetCount != nil {
 		parser.InstallObserver(CountTcpPackets(intf, packetCount))
@@ -61,6 +124,31 @@ func Collect(
 	return nil
 }
 
+// Returns the factories for parsers of cleartext TCP traffic.
+func tcpParserFactories(protocols ProtocolParsers, pool buffer_pool.BufferPool) []akinet.TCPParserFactory {
+	redisClients, redisServers := redis.NewParserFactories()
+	facts := []akinet.TCPParserFactory{
+		akihttp.NewHTTPRequestParserFactory(pool),
+		akihttp.NewHTTPResponseParserFactory(pool),
+		http2.NewHTTP2ParserFactory(),
+		redisClients,
+		redisServers,
+	}
+
+	if protocols.Kafka {
+		kafkaRequests, kafkaResponses := kafka.NewParserFactories()
+		facts = append(facts, kafkaRequests, kafkaResponses)
+	}
+
+	if protocols.SQL {
+		postgresFrontend, postgresBackend := postgres.NewParserFactories()
+		mysqlClients, mysqlServers := mysql.NewParserFactories()
+		facts = append(facts, postgresFrontend, postgresBackend, mysqlClients, mysqlServers)
+	}
+
+	return facts
+}
+
 // Observe every captured TCP segment here
 func CountTcpPackets(ifc string, packetCount trace.PacketCountConsumer) NetworkTrafficObserver {
 	observer := func(p gopacket.Packet) {
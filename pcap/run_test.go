@@ -0,0 +1,43 @@
+package pcap
+
+import (
+	"testing"
+
+	"github.com/akitasoftware/akita-libs/buffer_pool"
+)
+
+func TestOptionalProtocolParsers(t *testing.T) {
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasFactory := func(protocols ProtocolParsers, name string) bool {
+		for _, f := range tcpParserFactories(protocols, pool) {
+			if f.Name() == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	testCases := []struct {
+		name      string
+		protocols ProtocolParsers
+		factory   string
+		expected  bool
+	}{
+		{"Kafka off by default", ProtocolParsers{}, "Kafka Request Parser Factory", false},
+		{"Kafka enabled", ProtocolParsers{Kafka: true}, "Kafka Request Parser Factory", true},
+		{"PostgreSQL off by default", ProtocolParsers{}, "PostgreSQL Frontend Parser Factory", false},
+		{"MySQL off by default", ProtocolParsers{Kafka: true}, "MySQL Client Parser Factory", false},
+		{"PostgreSQL enabled", ProtocolParsers{SQL: true}, "PostgreSQL Backend Parser Factory", true},
+		{"MySQL enabled", ProtocolParsers{SQL: true}, "MySQL Server Parser Factory", true},
+		{"HTTP/2 always on", ProtocolParsers{}, "HTTP/2 Parser Factory", true},
+	}
+	for _, c := range testCases {
+		if got := hasFactory(c.protocols, c.factory); got != c.expected {
+			t.Errorf("[%s] expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/google/gopacket/reassembly"
 	"github.com/google/uuid"
 
+	"github.com/akitasoftware/akita-cli/pcap/websocket"
 	"github.com/akitasoftware/akita-cli/printer"
 	"github.com/akitasoftware/akita-cli/telemetry"
 	"github.com/akitasoftware/akita-libs/akid"
@@ -32,6 +33,26 @@ var CountNilAssemblerContextAfterParse uint64
 // happen at all.
 var CountBadAssemblerContextType uint64
 
+// Implemented by parsers that handle an entire TCP flow rather than a single
+// message, because they keep per-connection state (such as HTTP/2's HPACK
+// tables) between messages. The flow keeps using such a parser after it
+// produces a result, instead of selecting a new one.
+type wholeFlowParser interface {
+	ParsesWholeFlow() bool
+}
+
+func parsesWholeFlow(p akinet.TCPParser) bool {
+	wfp, ok := p.(wholeFlowParser)
+	return ok && wfp.ParsesWholeFlow()
+}
+
+// Implemented by parsers whose results are only one half of an HTTP exchange,
+// such as WebSocket messages. The flow emits the other half right after each
+// result, so that the two pair up into a complete witness downstream.
+type companionParser interface {
+	Companion(akinet.ParsedNetworkContent) akinet.ParsedNetworkContent
+}
+
 // tcpFlow represents a uni-directional flow of TCP segments along with a
 // bidirectional ID that identifies the tcpFlow in the opposite direction.
 // Writes come from TCP assembler via tcpStream, while reads come from users
@@ -49,12 +70,23 @@ type tcpFlow struct {
 
 	factorySelector akinet.TCPParserFactorySelector
 
+	// Set once the connection has switched protocols, e.g. to WebSocket. Used
+	// instead of factorySelector from then on.
+	upgradedFactory akinet.TCPParserFactory
+
+	// The stream this flow belongs to. Nil in tests that use a lone flow.
+	stream *tcpStream
+
 	// Non-nil if there is an active parser for this flow.
 	currentParser akinet.TCPParser
 
 	// Context for the FIRST packet that currentParser is processing.
 	currentParserCtx *assemblerCtxWithSeq
 
+	// Set when currentParser parses the whole flow and has just produced a
+	// result, so currentParserCtx should be reset from the next data it sees.
+	resetParserCtx bool
+
 	// Data that was left unused when determining parser, awaiting for more data.
 	// This is a hack to flush data when the flow terminates before a parser has
 	// been selected since reassembled does not get invoked on stream end even if
@@ -96,7 +128,11 @@ func (f *tcpFlow) reassembledWithIgnore(ignoreCount int, sg reassembly.ScatterGa
 
 	if f.currentParser == nil {
 		// Try to create a new parser.
-		fact, decision, discardFront := f.factorySelector.Select(pktData, isEnd)
+		fs := f.factorySelector
+		if f.upgradedFactory != nil {
+			fs = akinet.TCPParserFactorySelector{f.upgradedFactory}
+		}
+		fact, decision, discardFront := fs.Select(pktData, isEnd)
 		if discardFront > 0 {
 			printer.V(6).Infof("discarding %d bytes discarded by all parsers\n", discardFront)
 			f.handleUnparseable(sg.CaptureInfo(ignoreCount).Timestamp, discardFront)
@@ -142,6 +178,13 @@ func (f *tcpFlow) reassembledWithIgnore(ignoreCount int, sg reassembly.ScatterGa
 			f.handleUnparseable(sg.CaptureInfo(ignoreCount).Timestamp, pktData.Len())
 			return
 		}
+	} else if f.resetParserCtx {
+		// Time the next message from the first packet that carries it. If the
+		// context has no TCP seq info, keep using the previous one.
+		if ctx, ok := sg.AssemblerContext(ignoreCount).(*assemblerCtxWithSeq); ok {
+			f.currentParserCtx = ctx
+		}
+		f.resetParserCtx = false
 	}
 
 	pnc, unused, numBytesConsumed, err := f.currentParser.Parse(pktData, isEnd)
@@ -153,6 +196,7 @@ func (f *tcpFlow) reassembledWithIgnore(ignoreCount int, sg reassembly.ScatterGa
 
 		f.currentParser = nil
 		f.currentParserCtx = nil
+		f.resetParserCtx = false
 
 		telemetry.RateLimitError("parser", err)
 	} else if pnc != nil {
@@ -171,9 +215,21 @@ func (f *tcpFlow) reassembledWithIgnore(ignoreCount int, sg reassembly.ScatterGa
 			parseEnd = parseStart
 		}
 		f.outChan <- f.toPNT(parseStart, parseEnd, pnc)
+		if cp, ok := f.currentParser.(companionParser); ok {
+			if companion := cp.Companion(pnc); companion != nil {
+				f.outChan <- f.toPNT(parseStart, parseEnd, companion)
+			}
+		}
+		if f.stream != nil {
+			f.stream.observe(f, pnc)
+		}
 
-		f.currentParser = nil
-		f.currentParserCtx = nil
+		if parsesWholeFlow(f.currentParser) {
+			f.resetParserCtx = true
+		} else {
+			f.currentParser = nil
+			f.currentParserCtx = nil
+		}
 
 		if unused.Len() > 0 {
 			// Any unused bytes must be from the latest call to Parse, or else Parse
@@ -258,6 +314,11 @@ type tcpStream struct {
 
 	factorySelector akinet.TCPParserFactorySelector
 	outChan         chan<- akinet.ParsedNetworkTraffic
+
+	// The last request seen on this connection that asked to upgrade it to
+	// WebSocket, along with the flow that carried it.
+	websocketUpgrade    *websocket.Upgrade
+	websocketClientFlow *tcpFlow
 }
 
 func newTCPStream(clock clockWrapper, netFlow gopacket.Flow, outChan chan<- akinet.ParsedNetworkTraffic, fs akinet.TCPParserFactorySelector) *tcpStream {
@@ -288,6 +349,8 @@ func (c *tcpStream) Accept(tcp *layers.TCP, _ gopacket.CaptureInfo, dir reassemb
 		tf, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(tcp.SrcPort), layers.NewTCPPortEndpoint(tcp.DstPort))
 		s1 := newTCPFlow(c.clock, c.bidiID, c.netFlow, tf, c.outChan, c.factorySelector)
 		s2 := newTCPFlow(c.clock, c.bidiID, c.netFlow.Reverse(), tf.Reverse(), c.outChan, c.factorySelector)
+		s1.stream = c
+		s2.stream = c
 		c.flows = map[reassembly.TCPFlowDirection]*tcpFlow{
 			dir:           s1,
 			dir.Reverse(): s2,
@@ -323,6 +386,28 @@ func (c *tcpStream) Accept(tcp *layers.TCP, _ gopacket.CaptureInfo, dir reassemb
 	return true
 }
 
+// Called with each result parsed from one of the stream's flows. Watches for
+// the connection being upgraded to WebSocket, after which the HTTP parsers no
+// longer apply, and switches both flows to parsing WebSocket frames.
+func (c *tcpStream) observe(f *tcpFlow, pnc akinet.ParsedNetworkContent) {
+	switch pnc := pnc.(type) {
+	case akinet.HTTPRequest:
+		if websocket.IsUpgradeRequest(pnc) {
+			c.websocketUpgrade = websocket.NewUpgrade(pnc)
+			c.websocketClientFlow = f
+		}
+	case akinet.HTTPResponse:
+		if c.websocketUpgrade == nil || f == c.websocketClientFlow || !websocket.IsUpgradeResponse(pnc) {
+			return
+		}
+		for _, flow := range c.flows {
+			fromClient := flow == c.websocketClientFlow
+			flow.upgradedFactory = websocket.NewParserFactory(c.websocketUpgrade, fromClient)
+		}
+		printer.V(6).Infof("connection upgraded to WebSocket\n")
+	}
+}
+
 // Handles reassmbled TCP stream data.
 func (c *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
 	if c.flows == nil {
@@ -0,0 +1,198 @@
+package tlsdecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
+
+	// Length of the client and server randoms.
+	randomLen = 32
+
+	// Length of the fixed part of the nonce in TLS 1.2 AES-GCM suites, and of
+	// the whole IV in TLS 1.3.
+	tls12FixedIVLen = 4
+	tls13IVLen      = 12
+
+	// Length of the explicit nonce that precedes each TLS 1.2 AES-GCM record.
+	tls12ExplicitNonceLen = 8
+)
+
+type cipherSuite struct {
+	keyLen int
+	hash   func() hash.Hash
+}
+
+// The cipher suites that can be decrypted: those using AES-GCM. ChaCha20-
+// Poly1305 and CBC suites aren't supported.
+var cipherSuites = map[uint16]cipherSuite{
+	// TLS 1.3.
+	0x1301: {keyLen: 16, hash: sha256.New},    // TLS_AES_128_GCM_SHA256
+	0x1302: {keyLen: 32, hash: sha512.New384}, // TLS_AES_256_GCM_SHA384
+
+	// TLS 1.2.
+	0x009c: {keyLen: 16, hash: sha256.New},    // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {keyLen: 32, hash: sha512.New384}, // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x009e: {keyLen: 16, hash: sha256.New},    // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: {keyLen: 32, hash: sha512.New384}, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0xc02b: {keyLen: 16, hash: sha256.New},    // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {keyLen: 32, hash: sha512.New384}, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {keyLen: 16, hash: sha256.New},    // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {keyLen: 32, hash: sha512.New384}, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+}
+
+func lookupCipherSuite(id uint16) (cipherSuite, error) {
+	suite, ok := cipherSuites[id]
+	if !ok {
+		return cipherSuite{}, errors.Errorf("unsupported TLS cipher suite 0x%04x", id)
+	}
+	return suite, nil
+}
+
+// Decrypts the records sent in one direction of a connection.
+type recordCipher struct {
+	aead  cipher.AEAD
+	iv    []byte
+	seq   uint64
+	tls13 bool
+}
+
+func newRecordCipher(key, iv []byte, tls13 bool) (*recordCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AES cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GCM cipher")
+	}
+	return &recordCipher{aead: aead, iv: iv, tls13: tls13}, nil
+}
+
+// Derives the record cipher for one direction of a TLS 1.2 connection from
+// the master secret. The key block is laid out as the client's key, the
+// server's key, then the client's and server's fixed IVs; AEAD suites have no
+// MAC keys.
+func newTLS12Cipher(suite cipherSuite, masterSecret, clientRandom, serverRandom []byte, fromClient bool) (*recordCipher, error) {
+	seed := append(append([]byte{}, serverRandom...), clientRandom...)
+	keyBlock := prf12(suite.hash, masterSecret, "key expansion", seed, 2*suite.keyLen+2*tls12FixedIVLen)
+
+	clientKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	serverKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	clientIV, serverIV := keyBlock[:tls12FixedIVLen], keyBlock[tls12FixedIVLen:]
+	if fromClient {
+		return newRecordCipher(clientKey, clientIV, false)
+	}
+	return newRecordCipher(serverKey, serverIV, false)
+}
+
+// Derives a TLS 1.3 record cipher from a traffic secret.
+func newTLS13Cipher(suite cipherSuite, secret []byte) (*recordCipher, error) {
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	iv := hkdfExpandLabel(suite.hash, secret, "iv", tls13IVLen)
+	return newRecordCipher(key, iv, true)
+}
+
+// Returns the traffic secret that follows secret after a KeyUpdate.
+func nextTrafficSecret(suite cipherSuite, secret []byte) []byte {
+	return hkdfExpandLabel(suite.hash, secret, "traffic upd", suite.hash().Size())
+}
+
+// Decrypts the fragment of a record with the given header. In TLS 1.3, also
+// returns the real content type, which is hidden inside the encryption.
+func (c *recordCipher) decrypt(header, fragment []byte) (byte, []byte, error) {
+	var nonce, ciphertext, additional []byte
+	if c.tls13 {
+		nonce = make([]byte, tls13IVLen)
+		copy(nonce, c.iv)
+		for i := 0; i < 8; i++ {
+			nonce[tls13IVLen-1-i] ^= byte(c.seq >> (8 * i))
+		}
+		ciphertext = fragment
+		additional = header
+	} else {
+		if len(fragment) < tls12ExplicitNonceLen+c.aead.Overhead() {
+			return 0, nil, errors.New("TLS record too short to decrypt")
+		}
+		nonce = append(append([]byte{}, c.iv...), fragment[:tls12ExplicitNonceLen]...)
+		ciphertext = fragment[tls12ExplicitNonceLen:]
+		additional = make([]byte, 13)
+		binary.BigEndian.PutUint64(additional, c.seq)
+		copy(additional[8:], header[:3])
+		binary.BigEndian.PutUint16(additional[11:], uint16(len(ciphertext)-c.aead.Overhead()))
+	}
+
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to decrypt TLS record")
+	}
+	c.seq++
+
+	contentType := header[0]
+	if c.tls13 {
+		// The plaintext is followed by its content type, then zero padding.
+		end := len(plaintext) - 1
+		for end >= 0 && plaintext[end] == 0 {
+			end--
+		}
+		if end < 0 {
+			return 0, nil, errors.New("TLS record has no content type")
+		}
+		contentType, plaintext = plaintext[end], plaintext[:end]
+	}
+	return contentType, plaintext, nil
+}
+
+// The TLS 1.2 pseudorandom function (RFC 5246, section 5).
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelAndSeed := append([]byte(label), seed...)
+	result := make([]byte, 0, length)
+
+	mac := hmac.New(h, secret)
+	a := labelAndSeed
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelAndSeed)
+		result = mac.Sum(result)
+	}
+	return result[:length]
+}
+
+// HKDF-Expand-Label from TLS 1.3 (RFC 8446, section 7.1), with an empty
+// context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = append(info, byte(length>>8), byte(length), byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+
+	// HKDF-Expand (RFC 5869, section 2.3).
+	result := make([]byte, 0, length)
+	mac := hmac.New(h, secret)
+	var t []byte
+	for counter := byte(1); len(result) < length; counter++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		t = mac.Sum(nil)
+		result = append(result, t...)
+	}
+	return result[:length]
+}
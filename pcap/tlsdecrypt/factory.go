@@ -0,0 +1,103 @@
+package tlsdecrypt
+
+import (
+	"io"
+
+	"github.com/google/gopacket/reassembly"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+	recordTypeApplicationData  = 23
+
+	handshakeTypeClientHello = 1
+	handshakeTypeServerHello = 2
+	handshakeTypeFinished    = 20
+	handshakeTypeKeyUpdate   = 24
+
+	// Length of a record header.
+	recordHeaderLen = 5
+
+	// Length of a handshake message header.
+	handshakeHeaderLen = 4
+)
+
+// Returns factories for parsers that decrypt the data sent by TLS clients and
+// servers with the secrets in keys, and parse the plaintext with the inner
+// factories. They must be used together, since each direction is decrypted
+// with the randoms that both sides sent.
+//
+// The hello factories may be nil. If given, they are handed the unencrypted
+// handshake, so that the TLS handshake metadata is reported as it would be for
+// connections that aren't decrypted.
+func NewParserFactories(keys *KeyLog, clientHellos, serverHellos akinet.TCPParserFactory, inner ...akinet.TCPParserFactory) (clients, servers akinet.TCPParserFactory) {
+	sessions := newSessions()
+	selector := akinet.TCPParserFactorySelector(inner)
+	clients = parserFactory{keys: keys, sessions: sessions, hellos: clientHellos, inner: selector, fromClient: true}
+	servers = parserFactory{keys: keys, sessions: sessions, hellos: serverHellos, inner: selector, fromClient: false}
+	return clients, servers
+}
+
+type parserFactory struct {
+	keys       *KeyLog
+	sessions   *sessions
+	hellos     akinet.TCPParserFactory
+	inner      akinet.TCPParserFactorySelector
+	fromClient bool
+}
+
+func (f parserFactory) Name() string {
+	if f.fromClient {
+		return "TLS Decrypting Client Parser Factory"
+	}
+	return "TLS Decrypting Server Parser Factory"
+}
+
+// Recognizes a handshake record that starts with a ClientHello, on the client
+// side, or a ServerHello, on the server side.
+func (f parserFactory) Accepts(input memview.MemView, isEnd bool) (decision akinet.AcceptDecision, discardFront int64) {
+	defer func() {
+		if decision == akinet.NeedMoreData && isEnd {
+			decision = akinet.Reject
+		}
+	}()
+
+	head := make([]byte, recordHeaderLen+1)
+	n, _ := io.ReadFull(input.CreateReader(), head)
+	head = head[:n]
+
+	if len(head) > 0 && head[0] != recordTypeHandshake {
+		return akinet.Reject, 0
+	}
+	if len(head) > 1 && head[1] != 3 {
+		return akinet.Reject, 0
+	}
+	if len(head) > 2 && head[2] > 4 {
+		return akinet.Reject, 0
+	}
+	if len(head) < recordHeaderLen+1 {
+		return akinet.NeedMoreData, 0
+	}
+
+	wantType := byte(handshakeTypeServerHello)
+	if f.fromClient {
+		wantType = handshakeTypeClientHello
+	}
+	if head[recordHeaderLen] != wantType {
+		return akinet.Reject, 0
+	}
+	return akinet.Accept, 0
+}
+
+func (f parserFactory) CreateParser(id akinet.TCPBidiID, seq, ack reassembly.Sequence) akinet.TCPParser {
+	var hellos akinet.TCPParser
+	if f.hellos != nil {
+		hellos = f.hellos.CreateParser(id, seq, ack)
+	}
+	return newParser(f.keys, f.sessions.get(id), id, hellos, f.inner, f.fromClient)
+}
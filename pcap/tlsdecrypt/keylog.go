@@ -0,0 +1,117 @@
+// Package tlsdecrypt decrypts captured TLS connections using the secrets in
+// an NSS key log file, the format written by Go, OpenSSL, curl and browsers
+// when SSLKEYLOGFILE is set, and parses the plaintext with other parsers.
+package tlsdecrypt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Labels of the key log lines that are used.
+const (
+	// TLS 1.2: the master secret.
+	labelClientRandom = "CLIENT_RANDOM"
+
+	// TLS 1.3: the traffic secrets for the handshake and for application data.
+	labelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	labelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	labelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	labelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+type keyLogEntry struct {
+	label string
+
+	// The client random of the connection, hex-encoded.
+	clientRandom string
+}
+
+// The secrets in an NSS key log file.
+//
+// Programs append to the file as they make connections, so when a secret
+// isn't found, the file is read again if it has grown since it was last read.
+// This lets live captures decrypt connections made after the file was loaded.
+type KeyLog struct {
+	path string
+
+	mutex   sync.Mutex
+	size    int64
+	secrets map[keyLogEntry][]byte
+}
+
+// Reads the key log file at path.
+func LoadKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{
+		path:    path,
+		secrets: make(map[keyLogEntry][]byte),
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Should be called with k.mutex held, or before k is shared.
+func (k *KeyLog) load() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open TLS key log file")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to read TLS key log file")
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line is "<label> <client random> <secret>", in hex. Comments and
+		// lines with other labels are skipped.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		clientRandom, err := hex.DecodeString(fields[1])
+		if err != nil || len(clientRandom) != randomLen {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			continue
+		}
+		k.secrets[keyLogEntry{label: fields[0], clientRandom: hex.EncodeToString(clientRandom)}] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "failed to read TLS key log file")
+	}
+	k.size = info.Size()
+	return nil
+}
+
+// Returns the secret with the given label for the connection with the given
+// client random.
+func (k *KeyLog) secret(label string, clientRandom []byte) ([]byte, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	entry := keyLogEntry{label: label, clientRandom: hex.EncodeToString(clientRandom)}
+	if secret, ok := k.secrets[entry]; ok {
+		return secret, true
+	}
+
+	if info, err := os.Stat(k.path); err != nil || info.Size() == k.size {
+		return nil, false
+	}
+	if err := k.load(); err != nil {
+		return nil, false
+	}
+	secret, ok := k.secrets[entry]
+	return secret, ok
+}
@@ -0,0 +1,537 @@
+package tlsdecrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+const (
+	// Largest record allowed: 2^14 bytes of plaintext plus the most expansion
+	// that TLS 1.2 permits.
+	maxRecordLen = 1<<14 + 2048
+
+	// Largest TLS 1.3 handshake message that we reassemble, e.g. a certificate
+	// chain.
+	maxHandshakeLen = 256 * 1024
+
+	// The ServerHello extension that carries the negotiated version in TLS 1.3.
+	extensionSupportedVersions = 43
+)
+
+// The random of a ServerHello that is really a HelloRetryRequest (RFC 8446,
+// section 4.1.3).
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// What the two directions of a connection learn from each other's hellos.
+// Callers must hold the lock while using it.
+type session struct {
+	sync.Mutex
+
+	clientRandom []byte
+	serverRandom []byte
+	version      uint16
+	cipherSuite  uint16
+}
+
+// Maximum number of connections whose session we track. Parsers don't learn
+// when a connection ends, so sessions are evicted once this is reached.
+const maxSessions = 10000
+
+// Hands out the session of each connection, creating it on first use.
+type sessions struct {
+	mutex sync.Mutex
+	byID  map[akinet.TCPBidiID]*session
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		byID: make(map[akinet.TCPBidiID]*session),
+	}
+}
+
+func (ss *sessions) get(id akinet.TCPBidiID) *session {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if s, ok := ss.byID[id]; ok {
+		return s
+	}
+	if len(ss.byID) >= maxSessions {
+		for k := range ss.byID {
+			delete(ss.byID, k)
+			break
+		}
+	}
+	s := &session{}
+	ss.byID[id] = s
+	return s
+}
+
+// Same as the interface in the pcap package, which this package can't import.
+type wholeFlowParser interface {
+	ParsesWholeFlow() bool
+}
+
+// Decrypts one direction of a TLS connection and parses the plaintext.
+//
+// The hellos are read to learn the randoms, version and cipher suite. Once
+// this direction is encrypted, its records are decrypted with keys derived
+// from the key log, and application data is handed to the inner parsers.
+// Each parsed message is reported as if it had been sent unencrypted.
+type parser struct {
+	keys       *KeyLog
+	shared     *session
+	fromClient bool
+
+	// Total bytes consumed over the life of the parser.
+	consumed int64
+
+	// The start of a record that was cut off at the end of the last input.
+	partial []byte
+
+	// Parses the unencrypted handshake to report TLS metadata, until it
+	// produces a result or the handshake is encrypted. May be nil.
+	hellos akinet.TCPParser
+
+	// Set once this direction is encrypted.
+	cipher *recordCipher
+
+	// TLS 1.3: the cipher suite and current traffic secret, needed to change
+	// keys; whether the handshake keys are still in use; and handshake messages
+	// being reassembled.
+	suite       cipherSuite
+	secret      []byte
+	inHandshake bool
+	handshake   []byte
+
+	plaintext *plaintextParser
+
+	// Results not yet returned.
+	results []akinet.ParsedNetworkContent
+}
+
+func newParser(keys *KeyLog, shared *session, bidiID akinet.TCPBidiID, hellos akinet.TCPParser, inner akinet.TCPParserFactorySelector, fromClient bool) *parser {
+	return &parser{
+		keys:       keys,
+		shared:     shared,
+		fromClient: fromClient,
+		hellos:     hellos,
+		plaintext: &plaintextParser{
+			bidiID:   bidiID,
+			selector: inner,
+		},
+	}
+}
+
+func (p *parser) Name() string {
+	if p.fromClient {
+		return "TLS Decrypting Client Parser"
+	}
+	return "TLS Decrypting Server Parser"
+}
+
+// Tells the TCP flow to keep this parser after it produces a result.
+func (*parser) ParsesWholeFlow() bool {
+	return true
+}
+
+func (p *parser) Parse(input memview.MemView, isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	// Return results held over from the last input before reading more.
+	if len(p.results) > 0 {
+		return p.nextResult(), input, p.consumed, nil
+	}
+
+	data, err := io.ReadAll(input.CreateReader())
+	if err != nil {
+		return nil, memview.MemView{}, p.consumed, errors.Wrap(err, "failed to read input")
+	}
+	p.consumed += int64(len(data))
+
+	// Records are read from the cut-off record, if any, followed by the input.
+	buf := data
+	base := len(p.partial)
+	if base > 0 {
+		buf = append(p.partial, data...)
+		p.partial = nil
+	}
+
+	pos := 0
+	for len(buf)-pos >= recordHeaderLen {
+		length := int(binary.BigEndian.Uint16(buf[pos+3:]))
+		if length > maxRecordLen {
+			return nil, memview.MemView{}, p.consumed, errors.Errorf("TLS record of %d bytes is too long", length)
+		}
+		end := pos + recordHeaderLen + length
+		if end > len(buf) {
+			break
+		}
+		if err := p.handleRecord(buf[pos:end]); err != nil {
+			return nil, memview.MemView{}, p.consumed, err
+		}
+		pos = end
+
+		if len(p.results) > 0 {
+			// A cut-off record is always completed by the input, so the rest of
+			// the input is unused.
+			unused := input.SubView(int64(pos-base), input.Len())
+			p.consumed -= unused.Len()
+			return p.nextResult(), unused, p.consumed, nil
+		}
+	}
+	p.partial = append([]byte{}, buf[pos:]...)
+
+	if isEnd {
+		p.parsePlaintext(nil, true)
+		if len(p.results) > 0 {
+			return p.nextResult(), memview.MemView{}, p.consumed, nil
+		}
+	}
+	return nil, memview.MemView{}, p.consumed, nil
+}
+
+func (p *parser) nextResult() akinet.ParsedNetworkContent {
+	pnc := p.results[0]
+	p.results = p.results[1:]
+	return pnc
+}
+
+func (p *parser) handleRecord(record []byte) error {
+	header, fragment := record[:recordHeaderLen], record[recordHeaderLen:]
+
+	if p.cipher == nil {
+		switch header[0] {
+		case recordTypeHandshake:
+			p.parseHellos(record)
+			p.readHello(fragment)
+			return nil
+		case recordTypeChangeCipherSpec:
+			// In TLS 1.2, the records that follow are encrypted. TLS 1.3 only sends
+			// this for compatibility with middleboxes.
+			if p.version() != versionTLS12 {
+				return nil
+			}
+			return p.startTLS12()
+		case recordTypeApplicationData:
+			// In TLS 1.3, records after the hellos are encrypted and sent as
+			// application data. Records before the ServerHello is seen are early
+			// data, which isn't decrypted.
+			if p.version() != versionTLS13 {
+				return nil
+			}
+			if err := p.startTLS13(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+
+	contentType, plaintext, err := p.cipher.decrypt(header, fragment)
+	if err != nil {
+		// Early data is encrypted with keys that aren't tracked, and the client
+		// may send it after switching to the handshake keys. Like a server that
+		// rejects early data, skip records that don't decrypt until the client's
+		// handshake is done.
+		if p.fromClient && p.inHandshake {
+			return nil
+		}
+		return err
+	}
+
+	switch contentType {
+	case recordTypeHandshake:
+		if p.cipher.tls13 {
+			return p.readEncryptedHandshake(plaintext)
+		}
+	case recordTypeApplicationData:
+		p.parsePlaintext(plaintext, false)
+	}
+	return nil
+}
+
+// Hands an unencrypted handshake record to the hello parser.
+func (p *parser) parseHellos(record []byte) {
+	if p.hellos == nil {
+		return
+	}
+	pnc, _, _, err := p.hellos.Parse(memview.New(append([]byte{}, record...)), false)
+	if err != nil {
+		p.hellos = nil
+	} else if pnc != nil {
+		p.results = append(p.results, pnc)
+		p.hellos = nil
+	}
+}
+
+// Lets the hello parser finish once the handshake is encrypted.
+func (p *parser) finishHellos() {
+	if p.hellos == nil {
+		return
+	}
+	pnc, _, _, err := p.hellos.Parse(memview.New(nil), true)
+	if err == nil && pnc != nil {
+		p.results = append(p.results, pnc)
+	}
+	p.hellos = nil
+}
+
+// Records what the session needs from a ClientHello or ServerHello at the
+// start of an unencrypted handshake record. Hellos are never fragmented in
+// practice, so messages spanning records aren't reassembled.
+func (p *parser) readHello(fragment []byte) {
+	if len(fragment) < handshakeHeaderLen {
+		return
+	}
+	msgType := fragment[0]
+	body := fragment[handshakeHeaderLen:]
+	if length := int(fragment[1])<<16 | int(fragment[2])<<8 | int(fragment[3]); length < len(body) {
+		body = body[:length]
+	}
+
+	s := p.shared
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case p.fromClient && msgType == handshakeTypeClientHello:
+		// The random follows the legacy version.
+		if len(body) >= 2+randomLen {
+			s.clientRandom = append([]byte{}, body[2:2+randomLen]...)
+		}
+	case !p.fromClient && msgType == handshakeTypeServerHello:
+		if len(body) < 2+randomLen+1 {
+			return
+		}
+		version := binary.BigEndian.Uint16(body)
+		random := body[2 : 2+randomLen]
+		if bytes.Equal(random, helloRetryRequestRandom) {
+			// The real ServerHello follows the client's second ClientHello.
+			return
+		}
+		rest := body[2+randomLen:]
+		sessionIDLen := int(rest[0])
+		if len(rest) < 1+sessionIDLen+3 {
+			return
+		}
+		rest = rest[1+sessionIDLen:]
+		cipherSuite := binary.BigEndian.Uint16(rest)
+		rest = rest[3:]
+
+		// TLS 1.3 is negotiated in an extension, since the legacy version says
+		// TLS 1.2.
+		if len(rest) >= 2 {
+			extensions := rest[2:]
+			if extLen := int(binary.BigEndian.Uint16(rest)); extLen < len(extensions) {
+				extensions = extensions[:extLen]
+			}
+			for len(extensions) >= 4 {
+				extType := binary.BigEndian.Uint16(extensions)
+				extLen := int(binary.BigEndian.Uint16(extensions[2:]))
+				if len(extensions) < 4+extLen {
+					break
+				}
+				if extType == extensionSupportedVersions && extLen == 2 {
+					version = binary.BigEndian.Uint16(extensions[4:])
+				}
+				extensions = extensions[4+extLen:]
+			}
+		}
+
+		s.serverRandom = append([]byte{}, random...)
+		s.version = version
+		s.cipherSuite = cipherSuite
+	}
+}
+
+// Returns a copy of the session.
+func (p *parser) session() session {
+	p.shared.Lock()
+	defer p.shared.Unlock()
+	return session{
+		clientRandom: p.shared.clientRandom,
+		serverRandom: p.shared.serverRandom,
+		version:      p.shared.version,
+		cipherSuite:  p.shared.cipherSuite,
+	}
+}
+
+// Returns the negotiated version, or 0 if the ServerHello hasn't been seen.
+func (p *parser) version() uint16 {
+	return p.session().version
+}
+
+// Switches to the TLS 1.2 keys for this direction.
+func (p *parser) startTLS12() error {
+	p.finishHellos()
+
+	s := p.session()
+	suite, err := lookupCipherSuite(s.cipherSuite)
+	if err != nil {
+		return err
+	}
+	masterSecret, ok := p.keys.secret(labelClientRandom, s.clientRandom)
+	if !ok {
+		return errors.New("TLS key log has no master secret for connection")
+	}
+	p.cipher, err = newTLS12Cipher(suite, masterSecret, s.clientRandom, s.serverRandom, p.fromClient)
+	return err
+}
+
+// Switches to the TLS 1.3 handshake keys for this direction.
+func (p *parser) startTLS13() error {
+	p.finishHellos()
+
+	s := p.session()
+	suite, err := lookupCipherSuite(s.cipherSuite)
+	if err != nil {
+		return err
+	}
+	label := labelServerHandshake
+	if p.fromClient {
+		label = labelClientHandshake
+	}
+	secret, ok := p.keys.secret(label, s.clientRandom)
+	if !ok {
+		return errors.New("TLS key log has no handshake secret for connection")
+	}
+	p.suite = suite
+	p.inHandshake = true
+	return p.useSecret(secret)
+}
+
+func (p *parser) useSecret(secret []byte) error {
+	cipher, err := newTLS13Cipher(p.suite, secret)
+	if err != nil {
+		return err
+	}
+	p.secret = secret
+	p.cipher = cipher
+	return nil
+}
+
+// Watches the encrypted TLS 1.3 handshake for the messages that change keys:
+// Finished, after which application keys are used, and KeyUpdate.
+func (p *parser) readEncryptedHandshake(plaintext []byte) error {
+	p.handshake = append(p.handshake, plaintext...)
+	for len(p.handshake) >= handshakeHeaderLen {
+		length := int(p.handshake[1])<<16 | int(p.handshake[2])<<8 | int(p.handshake[3])
+		if length > maxHandshakeLen {
+			return errors.Errorf("TLS handshake message of %d bytes is too long", length)
+		}
+		if len(p.handshake) < handshakeHeaderLen+length {
+			return nil
+		}
+		msgType := p.handshake[0]
+		p.handshake = p.handshake[handshakeHeaderLen+length:]
+
+		switch {
+		case msgType == handshakeTypeFinished && p.inHandshake:
+			label := labelServerTraffic
+			if p.fromClient {
+				label = labelClientTraffic
+			}
+			secret, ok := p.keys.secret(label, p.session().clientRandom)
+			if !ok {
+				return errors.New("TLS key log has no traffic secret for connection")
+			}
+			p.inHandshake = false
+			if err := p.useSecret(secret); err != nil {
+				return err
+			}
+		case msgType == handshakeTypeKeyUpdate && !p.inHandshake:
+			if err := p.useSecret(nextTrafficSecret(p.suite, p.secret)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(p.handshake) == 0 {
+		p.handshake = nil
+	}
+	return nil
+}
+
+// Parses decrypted application data, collecting every result.
+func (p *parser) parsePlaintext(plaintext []byte, isEnd bool) {
+	for pnc := p.plaintext.parse(plaintext, false); pnc != nil; pnc = p.plaintext.parse(nil, false) {
+		p.results = append(p.results, pnc)
+	}
+	if isEnd {
+		if pnc := p.plaintext.parse(nil, true); pnc != nil {
+			p.results = append(p.results, pnc)
+		}
+	}
+}
+
+// Parses the plaintext of one direction of a connection with the inner
+// parsers, the way a TCP flow parses the data of an unencrypted connection.
+type plaintextParser struct {
+	bidiID   akinet.TCPBidiID
+	selector akinet.TCPParserFactorySelector
+
+	// The parser of the current message, if one has been chosen.
+	current akinet.TCPParser
+
+	// Plaintext not yet handed to a parser.
+	buf []byte
+
+	// The number of messages started. TCP sequence numbers don't line up with
+	// the plaintext, so this is used in their place. Each direction counts
+	// separately, so that the nth request is paired with the nth response.
+	messages int
+}
+
+// Adds data to the plaintext and returns the next result, if any.
+func (pp *plaintextParser) parse(data []byte, isEnd bool) akinet.ParsedNetworkContent {
+	pp.buf = append(pp.buf, data...)
+	for len(pp.buf) > 0 || (isEnd && pp.current != nil) {
+		input := memview.New(pp.buf)
+		if pp.current == nil {
+			fact, decision, discardFront := pp.selector.Select(input, isEnd)
+			input = input.SubView(discardFront, input.Len())
+			switch decision {
+			case akinet.Accept:
+				pp.messages++
+				seq := reassembly.Sequence(pp.messages)
+				pp.current = fact.CreateParser(pp.bidiID, seq, seq)
+			case akinet.NeedMoreData:
+				pp.buf = pp.buf[discardFront:]
+				return nil
+			default:
+				pp.buf = nil
+				return nil
+			}
+		}
+
+		// The parser holds on to the input until it produces a result.
+		pp.buf = nil
+		pnc, unused, _, err := pp.current.Parse(input, isEnd)
+		if err != nil {
+			printer.V(6).Debugf("failed to parse decrypted TLS data: %v\n", err)
+			pp.current = nil
+			return nil
+		}
+		if pnc == nil {
+			return nil
+		}
+		if wfp, ok := pp.current.(wholeFlowParser); !ok || !wfp.ParsesWholeFlow() {
+			pp.current = nil
+		}
+		if unused.Len() > 0 {
+			pp.buf, _ = io.ReadAll(unused.CreateReader())
+		}
+		return pnc
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package tlsdecrypt
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	akihttp "github.com/akitasoftware/akita-libs/akinet/http"
+	"github.com/akitasoftware/akita-libs/buffer_pool"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Data written by one side of a connection.
+type segment struct {
+	fromClient bool
+	data       []byte
+}
+
+// Records what is written to a connection, in the order written by both
+// sides.
+type recordingConn struct {
+	net.Conn
+	fromClient bool
+
+	mutex    *sync.Mutex
+	segments *[]segment
+}
+
+func (c recordingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	*c.segments = append(*c.segments, segment{fromClient: c.fromClient, data: append([]byte{}, b...)})
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Makes an HTTP request over a TLS connection with the given version, and
+// returns the bytes sent by both sides, the key log, and the negotiated cipher
+// suite.
+func captureTLSExchange(t *testing.T, version uint16) ([]segment, string, uint16) {
+	keyLogPath := filepath.Join(t.TempDir(), "keylog.txt")
+	keyLog, err := os.Create(keyLogPath)
+	require.NoError(t, err)
+	defer keyLog.Close()
+
+	var mutex sync.Mutex
+	var segments []segment
+	clientConn, serverConn := net.Pipe()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		server := tls.Server(recordingConn{Conn: serverConn, mutex: &mutex, segments: &segments}, &tls.Config{
+			Certificates: []tls.Certificate{selfSignedCertificate(t)},
+			MinVersion:   version,
+			MaxVersion:   version,
+		})
+		// Closing the TLS connection would wait for its close_notify alert to be
+		// read.
+		defer serverConn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		req.Body.Close()
+		_, err = io.WriteString(server, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello")
+		serverDone <- err
+	}()
+
+	client := tls.Client(recordingConn{Conn: clientConn, fromClient: true, mutex: &mutex, segments: &segments}, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+		// Only AES-GCM suites can be decrypted. TLS 1.3 suites can't be chosen.
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		KeyLogWriter: keyLog,
+	})
+	_, err = io.WriteString(client, "GET /hello HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	require.NoError(t, <-serverDone)
+	cipherSuite := client.ConnectionState().CipherSuite
+	clientConn.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return segments, keyLogPath, cipherSuite
+}
+
+// One direction of a connection, parsed by a parser that lives as long as the
+// flow, as in a TCP flow.
+type flow struct {
+	t       *testing.T
+	factory akinet.TCPParserFactory
+	bidiID  akinet.TCPBidiID
+	parser  akinet.TCPParser
+	results []akinet.ParsedNetworkContent
+}
+
+func (f *flow) feed(data []byte) {
+	if f.parser == nil {
+		decision, _ := f.factory.Accepts(memview.New(data), false)
+		require.Equal(f.t, akinet.Accept, decision)
+		f.parser = f.factory.CreateParser(f.bidiID, 0, 0)
+	}
+
+	input := memview.New(data)
+	for {
+		content, unused, _, err := f.parser.Parse(input, false)
+		require.NoError(f.t, err)
+		if content == nil {
+			return
+		}
+		f.results = append(f.results, content)
+		input = unused
+	}
+}
+
+func testDecryption(t *testing.T, version uint16) {
+	segments, keyLogPath, cipherSuite := captureTLSExchange(t, version)
+	if _, ok := cipherSuites[cipherSuite]; !ok {
+		t.Skipf("negotiated cipher suite %s can't be decrypted", tls.CipherSuiteName(cipherSuite))
+	}
+
+	keys, err := LoadKeyLog(keyLogPath)
+	require.NoError(t, err)
+	pool, err := buffer_pool.MakeBufferPool(1024*1024, 4*1024)
+	require.NoError(t, err)
+	clients, servers := NewParserFactories(keys, nil, nil,
+		akihttp.NewHTTPRequestParserFactory(pool),
+		akihttp.NewHTTPResponseParserFactory(pool),
+	)
+
+	bidiID := akinet.TCPBidiID(uuid.New())
+	client := &flow{t: t, factory: clients, bidiID: bidiID}
+	server := &flow{t: t, factory: servers, bidiID: bidiID}
+	for _, s := range segments {
+		if s.fromClient {
+			client.feed(s.data)
+		} else {
+			server.feed(s.data)
+		}
+	}
+
+	require.Len(t, client.results, 1)
+	require.Len(t, server.results, 1)
+	req, ok := client.results[0].(akinet.HTTPRequest)
+	require.True(t, ok, "expected an HTTP request, got %T", client.results[0])
+	resp, ok := server.results[0].(akinet.HTTPResponse)
+	require.True(t, ok, "expected an HTTP response, got %T", server.results[0])
+
+	assert.Equal(t, "GET", req.Method)
+	assert.Equal(t, "/hello", req.URL.Path)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// The request and response are paired as they would be without TLS.
+	assert.Equal(t, req.StreamID, resp.StreamID)
+	assert.Equal(t, req.Seq, resp.Seq)
+
+	req.ReleaseBuffers()
+	resp.ReleaseBuffers()
+}
+
+func TestDecryptTLS12(t *testing.T) {
+	testDecryption(t, tls.VersionTLS12)
+}
+
+func TestDecryptTLS13(t *testing.T) {
+	testDecryption(t, tls.VersionTLS13)
+}
+
+func TestMissingKeys(t *testing.T) {
+	segments, _, cipherSuite := captureTLSExchange(t, tls.VersionTLS12)
+	require.Contains(t, cipherSuites, cipherSuite)
+
+	emptyKeyLog := filepath.Join(t.TempDir(), "keylog.txt")
+	require.NoError(t, os.WriteFile(emptyKeyLog, nil, 0600))
+	keys, err := LoadKeyLog(emptyKeyLog)
+	require.NoError(t, err)
+	clients, servers := NewParserFactories(keys, nil, nil)
+
+	// Decryption starts once the client has read the ServerHello, and fails
+	// without a master secret.
+	bidiID := akinet.TCPBidiID(uuid.New())
+	client := clients.CreateParser(bidiID, 0, 0)
+	server := servers.CreateParser(bidiID, 0, 0)
+	var clientErr error
+	for _, s := range segments {
+		if !s.fromClient {
+			server.Parse(memview.New(s.data), false)
+		} else if clientErr == nil {
+			_, _, _, clientErr = client.Parse(memview.New(s.data), false)
+		}
+	}
+	assert.Error(t, clientErr)
+}
@@ -0,0 +1,99 @@
+// Package websocket parses the frames exchanged on a TCP connection after it
+// has been upgraded to the WebSocket protocol (RFC 6455).
+package websocket
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/gopacket/reassembly"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// An HTTP request that upgraded a connection to WebSocket. Messages on the
+// connection are reported as traffic to the request's endpoint.
+type Upgrade struct {
+	request akinet.HTTPRequest
+
+	// Sequence number given to the last message. Shared by both directions, so
+	// that every message on the connection gets a distinct pair key.
+	lastSeq int64
+}
+
+func NewUpgrade(req akinet.HTTPRequest) *Upgrade {
+	return &Upgrade{
+		request: req,
+		lastSeq: int64(req.Seq),
+	}
+}
+
+func (u *Upgrade) nextSeq() int {
+	return int(atomic.AddInt64(&u.lastSeq, 1))
+}
+
+// Returns true if the request asks to upgrade its connection to WebSocket.
+func IsUpgradeRequest(req akinet.HTTPRequest) bool {
+	return hasToken(req.Header, "Upgrade", "websocket")
+}
+
+// Returns true if the response accepts an upgrade to WebSocket.
+func IsUpgradeResponse(resp akinet.HTTPResponse) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols && hasToken(resp.Header, "Upgrade", "websocket")
+}
+
+// Returns true if the comma-separated header contains the given token,
+// ignoring case.
+func hasToken(header http.Header, key, token string) bool {
+	for _, v := range header.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a factory for parsers that handle one direction of a connection
+// that was upgraded by u. fromClient is true for the direction from the
+// client that sent the upgrade request.
+//
+// Frames carry no distinguishing marks, so the factory should only be used on
+// flows known to be past an upgrade.
+func NewParserFactory(u *Upgrade, fromClient bool) akinet.TCPParserFactory {
+	return parserFactory{
+		upgrade:    u,
+		fromClient: fromClient,
+	}
+}
+
+type parserFactory struct {
+	upgrade    *Upgrade
+	fromClient bool
+}
+
+func (parserFactory) Name() string {
+	return "WebSocket Parser Factory"
+}
+
+func (parserFactory) Accepts(input memview.MemView, isEnd bool) (akinet.AcceptDecision, int64) {
+	if input.Len() == 0 {
+		if isEnd {
+			return akinet.Reject, 0
+		}
+		return akinet.NeedMoreData, 0
+	}
+
+	b := input.GetByte(0)
+	if b&(rsv2|rsv3) != 0 || !isKnownOpcode(b&opcodeMask) {
+		return akinet.Reject, 0
+	}
+	return akinet.Accept, 0
+}
+
+func (f parserFactory) CreateParser(_ akinet.TCPBidiID, _, _ reassembly.Sequence) akinet.TCPParser {
+	return newParser(f.upgrade, f.fromClient)
+}
@@ -0,0 +1,361 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	akihttp "github.com/akitasoftware/akita-libs/akinet/http"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+// Bits of the first byte of a frame header. See RFC 6455, section 5.2.
+const (
+	finBit     = 0x80
+	rsv1       = 0x40
+	rsv2       = 0x20
+	rsv3       = 0x10
+	opcodeMask = 0x0f
+)
+
+// Bits of the second byte of a frame header.
+const (
+	maskBit        = 0x80
+	payloadLenMask = 0x7f
+)
+
+const (
+	opcodeContinuation = 0x0
+	opcodeText         = 0x1
+	opcodeBinary       = 0x2
+	opcodeClose        = 0x8
+	opcodePing         = 0x9
+	opcodePong         = 0xa
+)
+
+// Largest payload allowed in a control frame.
+const maxControlPayloadLen = 125
+
+func isKnownOpcode(opcode byte) bool {
+	switch opcode {
+	case opcodeContinuation, opcodeText, opcodeBinary, opcodeClose, opcodePing, opcodePong:
+		return true
+	}
+	return false
+}
+
+func isControlOpcode(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+// A data message, possibly fragmented across several frames.
+type message struct {
+	text bool
+
+	// Set by the permessage-deflate extension. We don't track the compression
+	// context across messages, so compressed messages can't be decoded.
+	compressed bool
+
+	// Whether the payload exceeded akihttp.MaximumHTTPLength and was cut short.
+	truncated bool
+
+	payload []byte
+}
+
+// Parses one direction of a WebSocket connection. Each complete text message
+// yields an HTTPRequest, if it was sent by the client, or an HTTPResponse, if
+// it was sent by the server. Both are attributed to the upgrade request's
+// endpoint. Binary and compressed messages are consumed but not reported, as
+// are control frames.
+//
+// Payloads are unmasked as they arrive, so frames of any size can be parsed
+// without buffering them whole.
+type parser struct {
+	upgrade    *Upgrade
+	fromClient bool
+
+	// Total bytes consumed over the life of the parser.
+	consumed int64
+
+	// Bytes of an incomplete frame header.
+	header []byte
+
+	// The frame whose payload is being read, if inFrame is set.
+	frame       frameHeader
+	inFrame     bool
+	payloadRead uint64
+
+	// The data message being assembled, if any.
+	msg *message
+}
+
+func newParser(u *Upgrade, fromClient bool) *parser {
+	return &parser{
+		upgrade:    u,
+		fromClient: fromClient,
+	}
+}
+
+func (*parser) Name() string {
+	return "WebSocket Parser"
+}
+
+// Tells the TCP flow to keep this parser after it produces a result.
+func (*parser) ParsesWholeFlow() bool {
+	return true
+}
+
+func (p *parser) Parse(input memview.MemView, isEnd bool) (akinet.ParsedNetworkContent, memview.MemView, int64, error) {
+	data, err := io.ReadAll(input.CreateReader())
+	if err != nil {
+		return nil, memview.MemView{}, p.consumed, errors.Wrap(err, "failed to read input")
+	}
+
+	offset := 0
+	for offset < len(data) {
+		if !p.inFrame {
+			n, err := p.readHeader(data[offset:])
+			offset += n
+			if err != nil {
+				p.consumed += int64(offset)
+				return nil, memview.MemView{}, p.consumed, err
+			}
+			if !p.inFrame {
+				// Need more of the header.
+				break
+			}
+		}
+
+		n := p.readPayload(data[offset:])
+		offset += n
+
+		if p.payloadRead == p.frame.length {
+			p.inFrame = false
+			if content := p.finishFrame(); content != nil {
+				p.consumed += int64(offset)
+				return content, input.SubView(int64(offset), input.Len()), p.consumed, nil
+			}
+		}
+	}
+
+	p.consumed += int64(offset)
+	if isEnd && (p.inFrame || len(p.header) > 0) {
+		return nil, memview.MemView{}, p.consumed, errors.New("connection ended in the middle of a frame")
+	}
+	return nil, memview.MemView{}, p.consumed, nil
+}
+
+// Accumulates the frame header from b, and returns the number of bytes used.
+// Sets inFrame once the header is complete.
+func (p *parser) readHeader(b []byte) (int, error) {
+	used := 0
+	for used < len(b) {
+		p.header = append(p.header, b[used])
+		used++
+
+		if n := headerLen(p.header); n == 0 || len(p.header) < n {
+			continue
+		}
+
+		frame, err := parseHeader(p.header)
+		p.header = p.header[:0]
+		if err != nil {
+			return used, err
+		}
+		p.startFrame(frame)
+		return used, nil
+	}
+	return used, nil
+}
+
+// Returns the length of the frame header that starts with b, or 0 if b is too
+// short to tell.
+func headerLen(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	n := 2
+	switch b[1] & payloadLenMask {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b[1]&maskBit != 0 {
+		n += 4
+	}
+	return n
+}
+
+func parseHeader(b []byte) (frameHeader, error) {
+	h := frameHeader{
+		fin:    b[0]&finBit != 0,
+		rsv1:   b[0]&rsv1 != 0,
+		opcode: b[0] & opcodeMask,
+		masked: b[1]&maskBit != 0,
+	}
+	if b[0]&(rsv2|rsv3) != 0 {
+		return h, errors.New("reserved bits set in WebSocket frame")
+	}
+	if !isKnownOpcode(h.opcode) {
+		return h, errors.Errorf("unknown WebSocket opcode %d", h.opcode)
+	}
+
+	rest := b[2:]
+	switch l := b[1] & payloadLenMask; l {
+	case 126:
+		h.length = uint64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		h.length = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+	default:
+		h.length = uint64(l)
+	}
+	if h.masked {
+		copy(h.mask[:], rest)
+	}
+
+	if isControlOpcode(h.opcode) && (!h.fin || h.length > maxControlPayloadLen) {
+		return h, errors.Errorf("invalid WebSocket control frame with opcode %d", h.opcode)
+	}
+	return h, nil
+}
+
+func (p *parser) startFrame(h frameHeader) {
+	p.frame = h
+	p.inFrame = true
+	p.payloadRead = 0
+
+	switch h.opcode {
+	case opcodeText, opcodeBinary:
+		// Starts a new message. Any unfinished message was missing its final
+		// fragment, so it's dropped.
+		p.msg = &message{
+			text:       h.opcode == opcodeText,
+			compressed: h.rsv1,
+		}
+	}
+}
+
+// Reads the current frame's payload from b, and returns the number of bytes
+// used.
+func (p *parser) readPayload(b []byte) int {
+	n := p.frame.length - p.payloadRead
+	if uint64(len(b)) < n {
+		n = uint64(len(b))
+	}
+	chunk := b[:n]
+
+	// Control frames may arrive between the fragments of a data message, and
+	// their payload isn't part of the message. Continuation frames without a
+	// message started before capture began.
+	if !isControlOpcode(p.frame.opcode) && p.msg != nil && !p.msg.truncated {
+		if room := akihttp.MaximumHTTPLength - int64(len(p.msg.payload)); int64(len(chunk)) > room {
+			chunk = chunk[:room]
+			p.msg.truncated = true
+		}
+		start := len(p.msg.payload)
+		p.msg.payload = append(p.msg.payload, chunk...)
+		if p.frame.masked {
+			for i := range p.msg.payload[start:] {
+				p.msg.payload[start+i] ^= p.frame.mask[(p.payloadRead+uint64(i))%4]
+			}
+		}
+	}
+
+	p.payloadRead += n
+	return int(n)
+}
+
+// Called once the current frame has been read. Returns non-nil content when the
+// frame completes a message that should be reported.
+func (p *parser) finishFrame() akinet.ParsedNetworkContent {
+	if isControlOpcode(p.frame.opcode) || !p.frame.fin || p.msg == nil {
+		return nil
+	}
+
+	m := p.msg
+	p.msg = nil
+	if !m.text || m.compressed || m.truncated {
+		return nil
+	}
+	return p.toContent(m)
+}
+
+func (p *parser) toContent(m *message) akinet.ParsedNetworkContent {
+	contentType := "text/plain; charset=utf-8"
+	if json.Valid(m.payload) {
+		contentType = "application/json"
+	}
+	header := http.Header{"Content-Type": {contentType}}
+
+	upgradeReq := p.upgrade.request
+	seq := p.upgrade.nextSeq()
+	if p.fromClient {
+		return akinet.HTTPRequest{
+			StreamID:   upgradeReq.StreamID,
+			Seq:        seq,
+			Method:     upgradeReq.Method,
+			ProtoMajor: upgradeReq.ProtoMajor,
+			ProtoMinor: upgradeReq.ProtoMinor,
+			URL:        upgradeReq.URL,
+			Host:       upgradeReq.Host,
+			Header:     header,
+			Body:       memview.New(m.payload),
+		}
+	}
+	return akinet.HTTPResponse{
+		StreamID:   upgradeReq.StreamID,
+		Seq:        seq,
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: upgradeReq.ProtoMajor,
+		ProtoMinor: upgradeReq.ProtoMinor,
+		Header:     header,
+		Body:       memview.New(m.payload),
+	}
+}
+
+// WebSocket messages have no reply, so each message is paired with a
+// synthesized, bodiless counterpart: messages from the client with the 101
+// response, and messages from the server with the upgrade request. This gives
+// complete witnesses on the upgrade endpoint for messages in either direction.
+func (p *parser) Companion(c akinet.ParsedNetworkContent) akinet.ParsedNetworkContent {
+	upgradeReq := p.upgrade.request
+	switch c := c.(type) {
+	case akinet.HTTPRequest:
+		return akinet.HTTPResponse{
+			StreamID:   c.StreamID,
+			Seq:        c.Seq,
+			StatusCode: http.StatusSwitchingProtocols,
+			ProtoMajor: c.ProtoMajor,
+			ProtoMinor: c.ProtoMinor,
+			Header:     http.Header{},
+		}
+	case akinet.HTTPResponse:
+		return akinet.HTTPRequest{
+			StreamID:   c.StreamID,
+			Seq:        c.Seq,
+			Method:     upgradeReq.Method,
+			ProtoMajor: upgradeReq.ProtoMajor,
+			ProtoMinor: upgradeReq.ProtoMinor,
+			URL:        upgradeReq.URL,
+			Host:       upgradeReq.Host,
+			Header:     http.Header{},
+		}
+	}
+	return nil
+}
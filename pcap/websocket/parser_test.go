@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+func newTestUpgrade() *Upgrade {
+	return NewUpgrade(akinet.HTTPRequest{
+		StreamID:   uuid.New(),
+		Seq:        1000,
+		Method:     "GET",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		URL:        &url.URL{Path: "/v1/kennel/live"},
+		Host:       "dogs.svc",
+		Header: http.Header{
+			"Upgrade":    {"websocket"},
+			"Connection": {"Upgrade"},
+		},
+	})
+}
+
+func frame(fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= finBit
+	}
+	out := []byte{b0}
+
+	var maskFlag byte
+	if mask != nil {
+		maskFlag = maskBit
+	}
+	switch {
+	case len(payload) < 126:
+		out = append(out, maskFlag|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		out = append(out, maskFlag|126)
+		out = append(out, 0, 0)
+		binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(payload)))
+	default:
+		out = append(out, maskFlag|127)
+		out = append(out, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(out[len(out)-8:], uint64(len(payload)))
+	}
+
+	if mask == nil {
+		return append(out, payload...)
+	}
+	out = append(out, mask...)
+	for i, c := range payload {
+		out = append(out, c^mask[i%4])
+	}
+	return out
+}
+
+// Parses the input one byte at a time, to exercise frames split across
+// packets, and returns everything that was produced.
+func parseAll(t *testing.T, p *parser, input []byte) []akinet.ParsedNetworkContent {
+	var results []akinet.ParsedNetworkContent
+	pending := input
+	for len(pending) > 0 {
+		chunk := pending[:1]
+		pending = pending[1:]
+		for {
+			content, unused, _, err := p.Parse(memview.New(chunk), false)
+			require.NoError(t, err)
+			if content == nil {
+				break
+			}
+			results = append(results, content)
+			if unused.Len() == 0 {
+				break
+			}
+			chunk, _ = io.ReadAll(unused.CreateReader())
+		}
+	}
+	return results
+}
+
+func TestParseClientMessages(t *testing.T) {
+	u := newTestUpgrade()
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+
+	var input []byte
+	// A JSON message fragmented around a ping.
+	input = append(input, frame(false, opcodeText, mask, []byte(`{"name":`))...)
+	input = append(input, frame(true, opcodePing, mask, []byte("hi"))...)
+	input = append(input, frame(true, opcodeContinuation, mask, []byte(`"prince"}`))...)
+	// Binary messages aren't reported.
+	input = append(input, frame(true, opcodeBinary, mask, []byte{0xde, 0xad})...)
+	// A plain text message with an extended length.
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'a'
+	}
+	input = append(input, frame(true, opcodeText, mask, long)...)
+
+	results := parseAll(t, newParser(u, true), input)
+	require.Len(t, results, 2)
+
+	req, ok := results[0].(akinet.HTTPRequest)
+	require.True(t, ok)
+	assert.Equal(t, u.request.StreamID, req.StreamID)
+	assert.Equal(t, 1001, req.Seq)
+	assert.Equal(t, "GET", req.Method)
+	assert.Equal(t, "/v1/kennel/live", req.URL.Path)
+	assert.Equal(t, "dogs.svc", req.Host)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, `{"name":"prince"}`, req.Body.String())
+
+	req, ok = results[1].(akinet.HTTPRequest)
+	require.True(t, ok)
+	assert.Equal(t, 1002, req.Seq)
+	assert.Equal(t, "text/plain; charset=utf-8", req.Header.Get("Content-Type"))
+	assert.Equal(t, string(long), req.Body.String())
+}
+
+func TestParseServerMessages(t *testing.T) {
+	u := newTestUpgrade()
+	p := newParser(u, false)
+
+	var input []byte
+	input = append(input, frame(true, opcodeText, nil, []byte(`[1, 2]`))...)
+	// Compressed messages can't be decoded.
+	input = append(input, frame(true, opcodeText|rsv1, nil, []byte{0xf2, 0x48})...)
+	input = append(input, frame(true, opcodeClose, nil, []byte{0x03, 0xe8})...)
+
+	results := parseAll(t, p, input)
+	require.Len(t, results, 1)
+
+	resp, ok := results[0].(akinet.HTTPResponse)
+	require.True(t, ok)
+	assert.Equal(t, u.request.StreamID, resp.StreamID)
+	assert.Equal(t, 1001, resp.Seq)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, `[1, 2]`, resp.Body.String())
+
+	companion, ok := p.Companion(resp).(akinet.HTTPRequest)
+	require.True(t, ok)
+	assert.Equal(t, resp.StreamID, companion.StreamID)
+	assert.Equal(t, resp.Seq, companion.Seq)
+	assert.Equal(t, "/v1/kennel/live", companion.URL.Path)
+	assert.Equal(t, int64(0), companion.Body.Len())
+}
+
+func TestParseInvalidFrame(t *testing.T) {
+	p := newParser(newTestUpgrade(), false)
+	_, _, _, err := p.Parse(memview.New([]byte{finBit | 0x3, 0}), false)
+	assert.Error(t, err)
+
+	p = newParser(newTestUpgrade(), false)
+	_, _, _, err = p.Parse(memview.New([]byte{finBit | opcodeText, 5, 'a'}), true)
+	assert.Error(t, err)
+}
+
+func TestUpgradeDetection(t *testing.T) {
+	assert.True(t, IsUpgradeRequest(newTestUpgrade().request))
+	assert.True(t, IsUpgradeResponse(akinet.HTTPResponse{
+		StatusCode: 101,
+		Header:     http.Header{"Upgrade": {"WebSocket"}},
+	}))
+	assert.False(t, IsUpgradeResponse(akinet.HTTPResponse{
+		StatusCode: 101,
+		Header:     http.Header{"Upgrade": {"h2c"}},
+	}))
+}
@@ -0,0 +1,114 @@
+// Package pending pairs the requests of calls with their responses.
+package pending
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of calls awaiting a response that are remembered.
+	MaxCalls = 10000
+
+	// How long a call awaits its response before it is forgotten.
+	Expiration = time.Minute
+)
+
+// Remembers the requests of calls, by key, until their responses are seen.
+// Requests whose responses are never seen would otherwise accumulate, so a
+// request is forgotten once it is older than Expiration, and the oldest
+// request is forgotten to make room once MaxCalls are remembered.
+//
+// Age is judged by the capture times of the requests rather than by the wall
+// clock, so that replayed traffic expires as it would have when it was
+// captured. Requests added without a time only expire to make room.
+//
+// The zero value is ready to use. Safe for concurrent use.
+type Calls[K comparable, V any] struct {
+	mutex sync.Mutex
+
+	// The latest capture time seen.
+	latest time.Time
+
+	// The calls, by key, and in the order they were added.
+	byKey map[K]*list.Element
+	order list.List
+}
+
+type call[K comparable, V any] struct {
+	key   K
+	seen  time.Time
+	value V
+}
+
+// Remembers the request with the given key, captured at the given time.
+// Replaces any request already remembered with that key.
+func (c *Calls[K, V]) Add(key K, seen time.Time, value V) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.byKey == nil {
+		c.byKey = make(map[K]*list.Element)
+	}
+	if e, ok := c.byKey[key]; ok {
+		c.removeLocked(e)
+	}
+
+	if seen.After(c.latest) {
+		c.latest = seen
+	}
+	c.expireLocked()
+	for len(c.byKey) >= MaxCalls {
+		c.removeLocked(c.order.Front())
+	}
+
+	c.byKey[key] = c.order.PushBack(&call[K, V]{key: key, seen: seen, value: value})
+}
+
+// Returns the request remembered with the given key, and forgets it.
+func (c *Calls[K, V]) Take(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.byKey[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.removeLocked(e)
+	return e.Value.(*call[K, V]).value, true
+}
+
+// Returns whether a request is remembered with the given key.
+func (c *Calls[K, V]) Has(key K) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.byKey[key]
+	return ok
+}
+
+// Returns the number of requests remembered.
+func (c *Calls[K, V]) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.byKey)
+}
+
+// Forgets the requests that are older than Expiration. Requests are added
+// roughly in capture order, so only the oldest are checked.
+func (c *Calls[K, V]) expireLocked() {
+	cutoff := c.latest.Add(-Expiration)
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		seen := e.Value.(*call[K, V]).seen
+		if seen.IsZero() || !seen.Before(cutoff) {
+			return
+		}
+		c.removeLocked(e)
+	}
+}
+
+func (c *Calls[K, V]) removeLocked(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.byKey, e.Value.(*call[K, V]).key)
+}
@@ -0,0 +1,43 @@
+package pending
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalls(t *testing.T) {
+	var calls Calls[int, string]
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	calls.Add(1, start, "a")
+	calls.Add(2, start.Add(time.Second), "b")
+	assert.True(t, calls.Has(1))
+	assert.False(t, calls.Has(3))
+	v, ok := calls.Take(1)
+	assert.True(t, ok)
+	assert.Equal(t, "a", v)
+	_, ok = calls.Take(1)
+	assert.False(t, ok, "calls are forgotten once taken")
+
+	// Calls expire by capture time, however long ago that was.
+	calls.Add(3, start.Add(Expiration+2*time.Second), "c")
+	_, ok = calls.Take(2)
+	assert.False(t, ok)
+	assert.Equal(t, 1, calls.Len())
+}
+
+func TestCallsForgetsOldestWhenFull(t *testing.T) {
+	var calls Calls[int, int]
+	for i := 0; i < MaxCalls+1; i++ {
+		calls.Add(i, time.Time{}, i)
+	}
+	assert.Equal(t, MaxCalls, calls.Len())
+
+	_, ok := calls.Take(0)
+	assert.False(t, ok)
+	v, ok := calls.Take(MaxCalls)
+	assert.True(t, ok)
+	assert.Equal(t, MaxCalls, v)
+}
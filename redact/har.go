@@ -0,0 +1,261 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/url"
+	"strings"
+
+	"github.com/google/martian/v3/har"
+)
+
+// Redacts the given HAR request in place.
+func (r *Redactor) RedactHARRequest(req *har.Request) {
+	if r.isEmpty() || req == nil {
+		return
+	}
+
+	req.Headers = r.redactHARHeaders(req.Headers, "Cookie")
+	req.Cookies = r.redactHARCookies(req.Cookies)
+
+	if qs, changed := r.redactHARQueryString(req.QueryString); changed {
+		req.QueryString = qs
+		if u, err := url.Parse(req.URL); err == nil {
+			q := url.Values{}
+			for _, kv := range qs {
+				q.Add(kv.Name, kv.Value)
+			}
+			u.RawQuery = q.Encode()
+			req.URL = u.String()
+		}
+	}
+
+	if pd := req.PostData; pd != nil {
+		if text, changed := r.redactBodyText(pd.MimeType, []byte(pd.Text)); changed {
+			pd.Text = string(text)
+		}
+
+		// Form parameters are treated like query parameters.
+		params := pd.Params[:0]
+		for _, p := range pd.Params {
+			if v, drop := r.redactNamedValue(r.queryKeyAction, p.Name, p.Value); !drop {
+				p.Value = v
+				params = append(params, p)
+			}
+		}
+		pd.Params = params
+	}
+}
+
+// Redacts the given HAR response in place.
+func (r *Redactor) RedactHARResponse(resp *har.Response) {
+	if r.isEmpty() || resp == nil {
+		return
+	}
+
+	resp.Headers = r.redactHARHeaders(resp.Headers, "Set-Cookie")
+	resp.Cookies = r.redactHARCookies(resp.Cookies)
+
+	if c := resp.Content; c != nil {
+		if text, changed := r.redactBodyText(c.MimeType, c.Text); changed {
+			c.Text = text
+			c.Size = int64(len(text))
+		}
+	}
+}
+
+func (r *Redactor) redactHARHeaders(headers []har.Header, cookieHeader string) []har.Header {
+	result := headers[:0]
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, cookieHeader) {
+			// Cookie values also appear in the raw header.
+			v, drop := r.redactCookieHeader(h.Value, cookieHeader == "Set-Cookie")
+			if drop {
+				continue
+			}
+			h.Value = v
+		}
+
+		v, drop := r.redactNamedValue(r.headerAction, h.Name, h.Value)
+		if drop {
+			continue
+		}
+		h.Value = v
+		result = append(result, h)
+	}
+	return result
+}
+
+// Redacts cookies in the value of a Cookie or Set-Cookie header. Returns true
+// if the entire header should be dropped.
+func (r *Redactor) redactCookieHeader(value string, isSetCookie bool) (string, bool) {
+	sep := ";"
+	pairs := strings.Split(value, sep)
+
+	// Set-Cookie has a single cookie, followed by attributes.
+	numCookies := len(pairs)
+	if isSetCookie {
+		numCookies = 1
+	}
+
+	result := make([]string, 0, len(pairs))
+	for i, pair := range pairs {
+		if i >= numCookies {
+			result = append(result, pair)
+			continue
+		}
+
+		name, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			result = append(result, pair)
+			continue
+		}
+
+		action, ok := r.cookieAction(name)
+		if !ok {
+			result = append(result, pair)
+			continue
+		}
+		if action == Drop {
+			if isSetCookie {
+				return "", true
+			}
+			continue
+		}
+		v, _ = applyAction(action, v)
+		result = append(result, " "+name+"="+v)
+	}
+
+	if len(result) == 0 {
+		return "", true
+	}
+	return strings.TrimSpace(strings.Join(result, sep)), false
+}
+
+func (r *Redactor) redactHARCookies(cookies []har.Cookie) []har.Cookie {
+	result := cookies[:0]
+	for _, c := range cookies {
+		v, drop := r.redactNamedValue(r.cookieAction, c.Name, c.Value)
+		if drop {
+			continue
+		}
+		c.Value = v
+		result = append(result, c)
+	}
+	return result
+}
+
+func (r *Redactor) redactHARQueryString(qs []har.QueryString) ([]har.QueryString, bool) {
+	changed := false
+	result := make([]har.QueryString, 0, len(qs))
+	for _, kv := range qs {
+		v, drop := r.redactNamedValue(r.queryKeyAction, kv.Name, kv.Value)
+		if drop {
+			changed = true
+			continue
+		}
+		if v != kv.Value {
+			changed = true
+			kv.Value = v
+		}
+		result = append(result, kv)
+	}
+	return result, changed
+}
+
+// Redacts a value that is identified by name, such as a header. Name-based
+// rules take precedence over value patterns.
+func (r *Redactor) redactNamedValue(lookup func(string) (Action, bool), name, value string) (string, bool) {
+	if action, ok := lookup(name); ok {
+		return applyAction(action, value)
+	}
+	return r.redactString(value)
+}
+
+// Redacts a message body. JSON bodies are redacted structurally; other text
+// bodies only have value patterns applied, and only the matching parts of the
+// text are dropped, hashed or masked. Returns the new body and whether it was
+// changed. The body is returned as is if nothing was redacted.
+func (r *Redactor) redactBodyText(mimeType string, body []byte) ([]byte, bool) {
+	if len(body) == 0 {
+		return body, false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+
+		var top interface{}
+		if err := decoder.Decode(&top); err == nil {
+			redacted, drop, changed := r.redactJSONValue(top, []string{})
+			if !changed {
+				// Re-encoding would reorder keys and reformat the body.
+				return body, false
+			}
+			if drop {
+				redacted = nil
+			}
+			if bs, err := json.Marshal(redacted); err == nil {
+				return bs, true
+			}
+		}
+	}
+
+	s, changed := r.redactText(string(body))
+	return []byte(s), changed
+}
+
+// Returns the redacted value, whether it should be dropped, and whether
+// anything in it was redacted.
+func (r *Redactor) redactJSONValue(v interface{}, path []string) (interface{}, bool, bool) {
+	if len(path) > 0 {
+		if action, ok := r.jsonPathAction(path); ok {
+			if action == Drop {
+				return nil, true, true
+			}
+			s, _ := applyAction(action, jsonValueToString(v))
+			return s, false, true
+		}
+	}
+
+	switch tv := v.(type) {
+	case string:
+		s, drop := r.redactString(tv)
+		return s, drop, drop || s != tv
+	case map[string]interface{}:
+		changed := false
+		for k, field := range tv {
+			newField, drop, fieldChanged := r.redactJSONValue(field, append(append([]string{}, path...), k))
+			if drop {
+				delete(tv, k)
+			} else {
+				tv[k] = newField
+			}
+			changed = changed || fieldChanged
+		}
+		return tv, false, changed
+	case []interface{}:
+		// Arrays are transparent in JSON paths.
+		changed := false
+		result := tv[:0]
+		for _, elem := range tv {
+			newElem, drop, elemChanged := r.redactJSONValue(elem, path)
+			if !drop {
+				result = append(result, newElem)
+			}
+			changed = changed || elemChanged
+		}
+		return result, false, changed
+	}
+	return v, false, false
+}
+
+func jsonValueToString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	bs, _ := json.Marshal(v)
+	return string(bs)
+}
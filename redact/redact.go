@@ -0,0 +1,300 @@
+// Package redact implements declarative redaction of captured HTTP traffic.
+//
+// Rules are loaded from a YAML file of the following form:
+//
+//	rules:
+//	  - name: credentials
+//	    headers: [Authorization, X-Api-Key]
+//	    cookies: [session_id]
+//	    query_keys: [access_token]
+//	    action: drop
+//	  - name: pii
+//	    json_paths: [user.email, payment.card.number]
+//	    value_patterns: ['\b\d{3}-\d{2}-\d{4}\b']
+//	    action: mask
+//
+// The matchers within a rule are OR'ed together. When several rules match the
+// same value, the first one wins.
+package redact
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// What to do with a value that matches a rule.
+type Action string
+
+const (
+	// Remove the value, along with its name, entirely.
+	Drop Action = "drop"
+
+	// Replace the value with a truncated SHA-256 hash, so that equal values can
+	// still be correlated.
+	Hash Action = "hash"
+
+	// Replace the value with a fixed placeholder. For value_patterns, only the
+	// matching parts of the value are replaced.
+	Mask Action = "mask"
+)
+
+const (
+	// Placeholder used by the Mask action.
+	maskString = "****"
+)
+
+type Config struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	// Optional; used in error messages.
+	Name string `yaml:"name"`
+
+	// Header names, matched case-insensitively.
+	Headers []string `yaml:"headers"`
+
+	// Query parameter names, matched exactly.
+	QueryKeys []string `yaml:"query_keys"`
+
+	// Dot-separated paths into structured bodies, e.g. "user.email". A leading
+	// "$." is ignored, and "*" matches any single field name. Arrays are
+	// transparent: a path applies to every element of an array, so "items.id"
+	// matches the "id" field of each object in "items". "items[*].id" is
+	// accepted as an equivalent spelling.
+	JSONPaths []string `yaml:"json_paths"`
+
+	// Cookie names, matched exactly.
+	Cookies []string `yaml:"cookies"`
+
+	// Regular expressions matched against string values anywhere in the
+	// request or response.
+	ValuePatterns []string `yaml:"value_patterns"`
+
+	Action Action `yaml:"action"`
+}
+
+// A compiled set of redaction rules. A nil *Redactor is valid and redacts
+// nothing.
+type Redactor struct {
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	name          string
+	headers       map[string]struct{}
+	queryKeys     map[string]struct{}
+	jsonPaths     [][]string
+	cookies       map[string]struct{}
+	valuePatterns []*regexp.Regexp
+	action        Action
+}
+
+// Loads a Redactor from the YAML file at the given path.
+func LoadFile(path string) (*Redactor, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read redaction config %s", path)
+	}
+
+	var cfg Config
+	if err := yaml.UnmarshalStrict(bs, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse redaction config %s", path)
+	}
+
+	r, err := New(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid redaction config %s", path)
+	}
+	return r, nil
+}
+
+func New(cfg Config) (*Redactor, error) {
+	r := &Redactor{}
+	for i, rule := range cfg.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch rule.Action {
+		case Drop, Hash, Mask:
+		default:
+			return nil, errors.Errorf("rule %s: unknown action %q, expected one of drop, hash, mask", name, rule.Action)
+		}
+
+		cr := &compiledRule{
+			name:      name,
+			headers:   make(map[string]struct{}, len(rule.Headers)),
+			queryKeys: toSet(rule.QueryKeys),
+			cookies:   toSet(rule.Cookies),
+			action:    rule.Action,
+		}
+		for _, h := range rule.Headers {
+			cr.headers[strings.ToLower(h)] = struct{}{}
+		}
+		for _, p := range rule.JSONPaths {
+			cr.jsonPaths = append(cr.jsonPaths, parseJSONPath(p))
+		}
+		for _, p := range rule.ValuePatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "rule %s: bad value pattern", name)
+			}
+			cr.valuePatterns = append(cr.valuePatterns, re)
+		}
+		r.rules = append(r.rules, cr)
+	}
+	return r, nil
+}
+
+func toSet(ss []string) map[string]struct{} {
+	result := make(map[string]struct{}, len(ss))
+	for _, s := range ss {
+		result[s] = struct{}{}
+	}
+	return result
+}
+
+func parseJSONPath(p string) []string {
+	p = strings.TrimPrefix(p, "$.")
+	p = strings.ReplaceAll(p, "[*]", "")
+	p = strings.ReplaceAll(p, "[]", "")
+
+	var result []string
+	for _, seg := range strings.Split(p, ".") {
+		if seg != "" {
+			result = append(result, seg)
+		}
+	}
+	return result
+}
+
+func (r *Redactor) isEmpty() bool {
+	return r == nil || len(r.rules) == 0
+}
+
+// Returns the action of the first rule matching the given header name, if any.
+func (r *Redactor) headerAction(name string) (Action, bool) {
+	name = strings.ToLower(name)
+	for _, rule := range r.rules {
+		if _, ok := rule.headers[name]; ok {
+			return rule.action, true
+		}
+	}
+	return "", false
+}
+
+func (r *Redactor) queryKeyAction(key string) (Action, bool) {
+	for _, rule := range r.rules {
+		if _, ok := rule.queryKeys[key]; ok {
+			return rule.action, true
+		}
+	}
+	return "", false
+}
+
+func (r *Redactor) cookieAction(name string) (Action, bool) {
+	for _, rule := range r.rules {
+		if _, ok := rule.cookies[name]; ok {
+			return rule.action, true
+		}
+	}
+	return "", false
+}
+
+func (r *Redactor) jsonPathAction(path []string) (Action, bool) {
+	for _, rule := range r.rules {
+		for _, p := range rule.jsonPaths {
+			if pathMatches(p, path) {
+				return rule.action, true
+			}
+		}
+	}
+	return "", false
+}
+
+func pathMatches(pattern, path []string) bool {
+	if len(pattern) != len(path) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Applies value patterns to the given string. Returns the new value and
+// whether it should be dropped.
+func (r *Redactor) redactString(v string) (string, bool) {
+	for _, rule := range r.rules {
+		for _, re := range rule.valuePatterns {
+			if !re.MatchString(v) {
+				continue
+			}
+
+			switch rule.action {
+			case Drop:
+				return "", true
+			case Hash:
+				return hashString(v), false
+			case Mask:
+				v = re.ReplaceAllString(v, maskString)
+			}
+		}
+	}
+	return v, false
+}
+
+// Applies value patterns to free text, such as a message body that isn't JSON.
+// Unlike redactString, only the matching parts of the text are changed: Drop
+// removes them and Hash replaces each with its hash. Returns the new text and
+// whether it was changed.
+func (r *Redactor) redactText(v string) (string, bool) {
+	changed := false
+	for _, rule := range r.rules {
+		for _, re := range rule.valuePatterns {
+			if !re.MatchString(v) {
+				continue
+			}
+
+			changed = true
+			switch rule.action {
+			case Drop:
+				v = re.ReplaceAllString(v, "")
+			case Hash:
+				v = re.ReplaceAllStringFunc(v, hashString)
+			case Mask:
+				v = re.ReplaceAllString(v, maskString)
+			}
+		}
+	}
+	return v, changed
+}
+
+// Applies an action that matched a value by name or path. Returns the new
+// value and whether it should be dropped.
+func applyAction(action Action, v string) (string, bool) {
+	switch action {
+	case Drop:
+		return "", true
+	case Hash:
+		return hashString(v), false
+	case Mask:
+		return maskString, false
+	}
+	return v, false
+}
+
+func hashString(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return fmt.Sprintf("sha256:%x", sum[:8])
+}
@@ -0,0 +1,145 @@
+package redact
+
+import (
+	"testing"
+
+	"github.com/google/martian/v3/har"
+	"github.com/stretchr/testify/assert"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/spec_util"
+)
+
+func newTestRedactor(t *testing.T) *Redactor {
+	r, err := New(Config{
+		Rules: []Rule{
+			{
+				Headers:   []string{"x-api-key"},
+				Cookies:   []string{"session"},
+				QueryKeys: []string{"token"},
+				Action:    Drop,
+			},
+			{
+				JSONPaths: []string{"user.email", "$.cards[*].number"},
+				Action:    Hash,
+			},
+			{
+				ValuePatterns: []string{`\d{3}-\d{2}-\d{4}`},
+				Action:        Mask,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestBadConfig(t *testing.T) {
+	_, err := New(Config{Rules: []Rule{{Headers: []string{"a"}, Action: "erase"}}})
+	assert.Error(t, err)
+
+	_, err = New(Config{Rules: []Rule{{ValuePatterns: []string{"("}, Action: Mask}}})
+	assert.Error(t, err)
+}
+
+func TestRedactHARRequest(t *testing.T) {
+	r := newTestRedactor(t)
+
+	req := &har.Request{
+		URL: "http://example.com/v1?token=abc&page=2",
+		Headers: []har.Header{
+			{Name: "X-API-Key", Value: "secret"},
+			{Name: "Cookie", Value: "session=s3cr3t; theme=dark"},
+			{Name: "X-SSN", Value: "ssn 123-45-6789"},
+		},
+		Cookies: []har.Cookie{
+			{Name: "session", Value: "s3cr3t"},
+			{Name: "theme", Value: "dark"},
+		},
+		QueryString: []har.QueryString{
+			{Name: "token", Value: "abc"},
+			{Name: "page", Value: "2"},
+		},
+		PostData: &har.PostData{
+			MimeType: "application/json",
+			Text:     `{"user": {"email": "a@example.com", "name": "prince"}, "cards": [{"number": "4111"}]}`,
+		},
+	}
+	r.RedactHARRequest(req)
+
+	assert.Equal(t, []har.Header{
+		{Name: "Cookie", Value: "theme=dark"},
+		{Name: "X-SSN", Value: "ssn ****"},
+	}, req.Headers)
+	assert.Equal(t, []har.Cookie{{Name: "theme", Value: "dark"}}, req.Cookies)
+	assert.Equal(t, []har.QueryString{{Name: "page", Value: "2"}}, req.QueryString)
+	assert.Equal(t, "http://example.com/v1?page=2", req.URL)
+	assert.JSONEq(t,
+		`{"user": {"email": "`+hashString("a@example.com")+`", "name": "prince"}, "cards": [{"number": "`+hashString("4111")+`"}]}`,
+		req.PostData.Text)
+}
+
+func TestRedactBodyText(t *testing.T) {
+	r := newTestRedactor(t)
+
+	// Bodies that nothing matched are left exactly as they were.
+	body := []byte(`{"zip": "94107", "amount": 1.50, "html": "<b>"}`)
+	text, changed := r.redactBodyText("application/json", body)
+	assert.False(t, changed)
+	assert.Equal(t, body, text)
+
+	text, changed = r.redactBodyText("application/json", []byte(`{"user": {"email": "a@example.com"}}`))
+	assert.True(t, changed)
+	assert.JSONEq(t, `{"user": {"email": "`+hashString("a@example.com")+`"}}`, string(text))
+
+	// Value patterns only change the matching parts of other text.
+	drop, err := New(Config{Rules: []Rule{{ValuePatterns: []string{`\d{3}-\d{2}-\d{4}`}, Action: Drop}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, changed = drop.redactBodyText("text/plain", []byte("name=prince ssn=123-45-6789 id=7"))
+	assert.True(t, changed)
+	assert.Equal(t, "name=prince ssn= id=7", string(text))
+
+	text, changed = r.redactBodyText("text/plain", []byte("ssn 123-45-6789"))
+	assert.True(t, changed)
+	assert.Equal(t, "ssn ****", string(text))
+}
+
+func TestRedactMethod(t *testing.T) {
+	r := newTestRedactor(t)
+
+	header := &pb.Data{
+		Value: &pb.Data_Primitive{Primitive: spec_util.NewPrimitiveString("secret")},
+		Meta: &pb.DataMeta{Meta: &pb.DataMeta_Http{Http: &pb.HTTPMeta{
+			Location: &pb.HTTPMeta_Header{Header: &pb.HTTPHeader{Key: "X-Api-Key"}},
+		}}},
+	}
+	body := &pb.Data{
+		Value: &pb.Data_Struct{Struct: &pb.Struct{Fields: map[string]*pb.Data{
+			"user": {Value: &pb.Data_Struct{Struct: &pb.Struct{Fields: map[string]*pb.Data{
+				"email": {Value: &pb.Data_Primitive{Primitive: spec_util.NewPrimitiveString("a@example.com")}},
+			}}}},
+			"ssn": {Value: &pb.Data_Primitive{Primitive: spec_util.NewPrimitiveString("123-45-6789")}},
+		}}},
+		Meta: &pb.DataMeta{Meta: &pb.DataMeta_Http{Http: &pb.HTTPMeta{
+			Location: &pb.HTTPMeta_Body{Body: &pb.HTTPBody{ContentType: pb.HTTPBody_JSON}},
+		}}},
+	}
+	m := &pb.Method{Args: map[string]*pb.Data{"header": header, "body": body}}
+
+	r.RedactMethod(m)
+
+	assert.NotContains(t, m.Args, "header")
+	fields := m.Args["body"].GetStruct().GetFields()
+	assert.Equal(t, hashString("a@example.com"), fields["user"].GetStruct().GetFields()["email"].GetPrimitive().GetStringValue().GetValue())
+	assert.Equal(t, "****", fields["ssn"].GetPrimitive().GetStringValue().GetValue())
+}
+
+func TestNilRedactor(t *testing.T) {
+	var r *Redactor
+	req := &har.Request{Headers: []har.Header{{Name: "X-Api-Key", Value: "secret"}}}
+	r.RedactHARRequest(req)
+	assert.Len(t, req.Headers, 1)
+}
@@ -0,0 +1,133 @@
+package redact
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/akitasoftware/akita-ir/go/api_spec"
+	"github.com/akitasoftware/akita-libs/spec_util"
+)
+
+// Redacts the arguments and responses of the given method in place.
+func (r *Redactor) RedactMethod(m *pb.Method) {
+	if r.isEmpty() || m == nil {
+		return
+	}
+
+	r.redactDataMap(m.Args)
+	r.redactDataMap(m.Responses)
+}
+
+func (r *Redactor) redactDataMap(datas map[string]*pb.Data) {
+	for k, d := range datas {
+		if drop := r.redactTopLevelData(d); drop {
+			delete(datas, k)
+		}
+	}
+}
+
+// Returns true if the data should be dropped.
+func (r *Redactor) redactTopLevelData(d *pb.Data) bool {
+	meta := d.GetMeta().GetHttp()
+
+	var action Action
+	var matched bool
+	switch {
+	case meta.GetHeader() != nil:
+		action, matched = r.headerAction(meta.GetHeader().GetKey())
+	case meta.GetAuth() != nil:
+		// Authorization headers are turned into HTTPAuth data by the parser.
+		action, matched = r.headerAction("Authorization")
+	case meta.GetQuery() != nil:
+		action, matched = r.queryKeyAction(meta.GetQuery().GetKey())
+	case meta.GetCookie() != nil:
+		action, matched = r.cookieAction(meta.GetCookie().GetKey())
+	case meta.GetBody() != nil:
+		return r.redactData(d, []string{})
+	}
+
+	if matched {
+		return applyActionToData(action, d)
+	}
+	return r.redactData(d, nil)
+}
+
+// Recursively redacts d. If path is non-nil, d is part of a body at that
+// path, and JSON path rules apply. Returns true if d should be dropped.
+func (r *Redactor) redactData(d *pb.Data, path []string) bool {
+	if len(path) > 0 {
+		if action, ok := r.jsonPathAction(path); ok {
+			return applyActionToData(action, d)
+		}
+	}
+
+	switch v := d.GetValue().(type) {
+	case *pb.Data_Primitive:
+		s := v.Primitive.GetStringValue()
+		if s == nil {
+			return false
+		}
+		newValue, drop := r.redactString(s.GetValue())
+		if drop {
+			return true
+		}
+		if newValue != s.GetValue() {
+			v.Primitive = spec_util.NewPrimitiveString(newValue)
+		}
+	case *pb.Data_Struct:
+		for name, field := range v.Struct.GetFields() {
+			var fieldPath []string
+			if path != nil {
+				fieldPath = append(append([]string{}, path...), name)
+			}
+			if r.redactData(field, fieldPath) {
+				delete(v.Struct.Fields, name)
+			}
+		}
+	case *pb.Data_List:
+		// Arrays are transparent in JSON paths.
+		elems := v.List.GetElems()[:0]
+		for _, elem := range v.List.GetElems() {
+			if !r.redactData(elem, path) {
+				elems = append(elems, elem)
+			}
+		}
+		v.List.Elems = elems
+	case *pb.Data_Optional:
+		if inner := v.Optional.GetData(); inner != nil && r.redactData(inner, path) {
+			v.Optional.Value = &pb.Optional_None{None: &pb.None{}}
+		}
+	case *pb.Data_Oneof:
+		for k, option := range v.Oneof.GetOptions() {
+			if r.redactData(option, path) {
+				delete(v.Oneof.Options, k)
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if d should be dropped.
+func applyActionToData(action Action, d *pb.Data) bool {
+	if action == Drop {
+		return true
+	}
+
+	newValue, _ := applyAction(action, dataToString(d))
+	d.Value = &pb.Data_Primitive{Primitive: spec_util.NewPrimitiveString(newValue)}
+	return false
+}
+
+// Produces a string representation of d for hashing.
+func dataToString(d *pb.Data) string {
+	if p := d.GetPrimitive(); p != nil {
+		if s := p.GetStringValue(); s != nil {
+			return s.GetValue()
+		}
+		if pv, err := spec_util.PrimitiveValueFromProto(p); err == nil {
+			return fmt.Sprint(pv.GoValue())
+		}
+	}
+	return proto.CompactTextString(d)
+}
@@ -322,6 +322,31 @@ func InstallIntegrationVersion(integration, arch, platform, version string) {
 		})
 }
 
+// Report aggregate statistics about the commands sent to a service that the
+// captured APIs depend on, such as a cache. Each entry describes one command.
+func ServiceCommands(service string, commands []map[string]any) {
+	tryTrackingEvent(
+		"Service Commands - Summarized",
+		map[string]any{
+			"service":  service,
+			"commands": commands,
+		},
+	)
+}
+
+// Report a change to the effective witness rate limit, made in response to
+// the back end throttling uploads or to uploads succeeding again.
+func RateLimitAdjusted(reason string, configuredWitnessesPerMinute, effectiveWitnessesPerMinute float64) {
+	tryTrackingEvent(
+		"Rate Limit - Adjusted",
+		map[string]any{
+			"reason":                          reason,
+			"configured_witnesses_per_minute": configuredWitnessesPerMinute,
+			"effective_witnesses_per_minute":  effectiveWitnessesPerMinute,
+		},
+	)
+}
+
 // Flush the telemetry to its endpoint
 // (even buffer size of 1 is not enough if the CLi exits right away.)
 func Shutdown() {
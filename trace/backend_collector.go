@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -12,6 +13,7 @@ import (
 	"github.com/akitasoftware/akita-cli/learn"
 	"github.com/akitasoftware/akita-cli/plugin"
 	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/redact"
 	"github.com/akitasoftware/akita-cli/rest"
 	"github.com/akitasoftware/akita-cli/telemetry"
 	pb "github.com/akitasoftware/akita-ir/go/api_spec"
@@ -51,6 +53,10 @@ type witnessWithInfo struct {
 	requestEnd      time.Time
 	responseStart   time.Time
 
+	// Whether this is a call from one of our services to another service,
+	// rather than a call to one of our services.
+	outbound bool
+
 	witness *pb.Witness
 }
 
@@ -64,8 +70,13 @@ func (r witnessWithInfo) toReport() (*kgxapi.WitnessReport, error) {
 		return nil, errors.Wrap(err, "failed to marshal witness proto")
 	}
 
+	direction := kgxapi.Inbound
+	if r.outbound {
+		direction = kgxapi.Outbound
+	}
+
 	return &kgxapi.WitnessReport{
-		Direction:       kgxapi.Inbound,
+		Direction:       direction,
 		OriginAddr:      r.srcIP,
 		OriginPort:      r.srcPort,
 		DestinationAddr: r.dstIP,
@@ -100,17 +111,26 @@ func (w witnessWithInfo) computeProcessingLatency(isRequest bool, t akinet.Parse
 	}
 
 	// Missing data, leave as default value in protobuf
-	if requestEnd.IsZero() || responseStart.IsZero() {
+	latency, ok := processingLatency(requestEnd, responseStart)
+	if !ok {
 		return
 	}
 
 	// HTTPMethodMetadata only for now
 	if meta := spec_util.HTTPMetaFromMethod(w.witness.Method); meta != nil {
-		latency := responseStart.Sub(requestEnd)
 		meta.ProcessingLatency = float32(latency.Microseconds()) / 1000.0
 	}
 }
 
+// Processing latency is the time from the last packet of the request to the
+// first packet of the response. Returns false if either time is missing.
+func processingLatency(requestEnd, responseStart time.Time) (time.Duration, bool) {
+	if requestEnd.IsZero() || responseStart.IsZero() {
+		return 0, false
+	}
+	return responseStart.Sub(requestEnd), true
+}
+
 // An additional method supported by the backend collector to switch learn
 // sessions.
 type LearnSessionCollector interface {
@@ -121,6 +141,18 @@ type LearnSessionCollector interface {
 
 // Sends witnesses up to akita cloud.
 type BackendCollector struct {
+	// Upload statistics, updated atomically. These come first to keep them
+	// 64-bit aligned on 32-bit platforms.
+	uploads          uint64
+	failedUploads    uint64
+	throttledUploads uint64
+	uploadedBytes    uint64
+
+	// Times of the last successful and failed uploads, in nanoseconds since
+	// the epoch, or zero if there have been none. Updated atomically.
+	lastUpload       int64
+	lastFailedUpload int64
+
 	serviceID      akid.ServiceID
 	learnSessionID akid.LearnSessionID
 	learnClient    rest.LearnClient
@@ -129,6 +161,10 @@ type BackendCollector struct {
 	// akid.WitnessID -> *witnessWithInfo
 	pairCache sync.Map
 
+	// Partial witnesses expire by capture time, which differs from the wall
+	// clock when replaying pcap files.
+	clock captureClock
+
 	// Batch of reports (witnesses, TCP-connection reports, etc.) pending upload.
 	uploadReportBatch *batcher.InMemory[rawReport]
 
@@ -139,6 +175,44 @@ type BackendCollector struct {
 	learnSessionMutex sync.Mutex
 
 	plugins []plugin.AkitaPlugin
+
+	// Applied to witnesses before obfuscation. May be nil.
+	redactor *redact.Redactor
+
+	// Used to tag witnesses of calls from this host to other hosts as
+	// outbound. If nil, all witnesses are inbound.
+	hostAddrs *HostAddrs
+
+	// Holds batches that failed to upload because the back end was
+	// unreachable. If nil, those batches are dropped.
+	spool *UploadSpool
+
+	// Told when uploads are throttled or succeed, so that fewer witnesses are
+	// captured while the back end is overloaded. May be nil.
+	rateLimit *SharedRateLimit
+
+	// Decodes gRPC messages. If nil, they are decoded without a schema.
+	grpc *learn.GRPCDecoder
+}
+
+// Statistics about the witnesses a BackendCollector is pairing and uploading.
+type BackendCollectorStats struct {
+	// Partial witnesses waiting for their pair.
+	PendingWitnesses int
+
+	// Batches whose upload was attempted, and how many of those failed. Of the
+	// failures, ThrottledUploads were rejected by the back end with a 429.
+	Uploads          uint64
+	FailedUploads    uint64
+	ThrottledUploads uint64
+
+	// The total size of the batches whose upload was attempted.
+	UploadedBytes uint64
+
+	// When the last successful and failed uploads finished. Zero if there have
+	// been none.
+	LastUpload       time.Time
+	LastFailedUpload time.Time
 }
 
 var _ LearnSessionCollector = (*BackendCollector)(nil)
@@ -150,6 +224,11 @@ func NewBackendCollector(
 	maxWitnessSize_bytes optionals.Optional[int],
 	packetCounts PacketCountConsumer,
 	plugins []plugin.AkitaPlugin,
+	redactor *redact.Redactor,
+	hostAddrs *HostAddrs,
+	spool *UploadSpool,
+	rateLimit *SharedRateLimit,
+	grpc *learn.GRPCDecoder,
 ) Collector {
 	col := &BackendCollector{
 		serviceID:      svc,
@@ -157,6 +236,11 @@ func NewBackendCollector(
 		learnClient:    lc,
 		flushDone:      make(chan struct{}),
 		plugins:        plugins,
+		redactor:       redactor,
+		hostAddrs:      hostAddrs,
+		spool:          spool,
+		rateLimit:      rateLimit,
+		grpc:           grpc,
 	}
 
 	col.uploadReportBatch = batcher.NewInMemory[rawReport](
@@ -176,9 +260,9 @@ func (c *BackendCollector) Process(t akinet.ParsedNetworkTraffic) error {
 	switch content := t.Content.(type) {
 	case akinet.HTTPRequest:
 		isRequest = true
-		partial, parseHTTPErr = learn.ParseHTTP(content)
+		partial, parseHTTPErr = c.grpc.ParseHTTP(content)
 	case akinet.HTTPResponse:
-		partial, parseHTTPErr = learn.ParseHTTP(content)
+		partial, parseHTTPErr = c.grpc.ParseHTTP(content)
 	case akinet.TCPConnectionMetadata:
 		return c.processTCPConnection(t, content)
 	case akinet.TLSHandshakeMetadata:
@@ -188,6 +272,8 @@ func (c *BackendCollector) Process(t akinet.ParsedNetworkTraffic) error {
 		return nil
 	}
 
+	c.clock.observe(t.ObservationTime)
+
 	if parseHTTPErr != nil {
 		telemetry.RateLimitError("parse HTTP", parseHTTPErr)
 		printer.Debugf("Failed to parse HTTP, skipping: %v\n", parseHTTPErr)
@@ -215,7 +301,12 @@ func (c *BackendCollector) Process(t akinet.ParsedNetworkTraffic) error {
 
 	} else {
 		// Store the partial witness for now, waiting for its pair or a
-		// flush timeout.
+		// flush timeout. The direction is decided here, since the partial may be
+		// uploaded without its pair.
+		client, server := t.SrcIP, t.DstIP
+		if !isRequest {
+			client, server = server, client
+		}
 		w := &witnessWithInfo{
 			netInterface:    t.Interface,
 			srcIP:           t.SrcIP,
@@ -225,6 +316,7 @@ func (c *BackendCollector) Process(t akinet.ParsedNetworkTraffic) error {
 			witness:         partial.Witness,
 			observationTime: t.ObservationTime,
 			id:              partial.PairKey,
+			outbound:        c.hostAddrs.IsOutbound(client, server),
 		}
 		// Store whichever timestamp brackets the processing interval.
 		w.recordTimestamp(isRequest, t)
@@ -281,6 +373,10 @@ func (c *BackendCollector) queueUpload(w *witnessWithInfo) {
 		}
 	}
 
+	// Apply user-configured redaction rules. This has to happen before
+	// obfuscation, since rules can match on values.
+	c.redactor.RedactMethod(w.witness.GetMethod())
+
 	// Obfuscate the original value so type inference engine can use it on the
 	// backend without revealing the actual value.
 	obfuscate(w.witness.GetMethod())
@@ -289,6 +385,30 @@ func (c *BackendCollector) queueUpload(w *witnessWithInfo) {
 	})
 }
 
+func (c *BackendCollector) Stats() BackendCollectorStats {
+	pending := 0
+	c.pairCache.Range(func(_, _ interface{}) bool {
+		pending++
+		return true
+	})
+	return BackendCollectorStats{
+		PendingWitnesses: pending,
+		Uploads:          atomic.LoadUint64(&c.uploads),
+		FailedUploads:    atomic.LoadUint64(&c.failedUploads),
+		ThrottledUploads: atomic.LoadUint64(&c.throttledUploads),
+		UploadedBytes:    atomic.LoadUint64(&c.uploadedBytes),
+		LastUpload:       loadTime(&c.lastUpload),
+		LastFailedUpload: loadTime(&c.lastFailedUpload),
+	}
+}
+
+func loadTime(nanos *int64) time.Time {
+	if n := atomic.LoadInt64(nanos); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
 func (c *BackendCollector) Close() error {
 	close(c.flushDone)
 	c.flushPairCache(time.Now())
@@ -314,7 +434,7 @@ func (c *BackendCollector) periodicFlush() {
 	for {
 		select {
 		case <-ticker.C:
-			c.flushPairCache(time.Now().Add(-1 * pairCacheExpiration))
+			c.flushPairCache(c.clock.now().Add(-1 * pairCacheExpiration))
 		case <-c.flushDone:
 			ticker.Stop()
 			return
@@ -92,7 +92,7 @@ func TestObfuscate(t *testing.T) {
 		},
 	}
 
-	col := NewBackendCollector(fakeSvc, fakeLrn, mockClient, optionals.None[int](), NewPacketCounter(), nil)
+	col := NewBackendCollector(fakeSvc, fakeLrn, mockClient, optionals.None[int](), NewPacketCounter(), nil, nil, nil, nil, nil, nil)
 	assert.NoError(t, col.Process(req))
 	assert.NoError(t, col.Process(resp))
 	assert.NoError(t, col.Close())
@@ -220,7 +220,7 @@ func TestTiming(t *testing.T) {
 		FinalPacketTime: startTime.Add(13 * time.Millisecond),
 	}
 
-	col := NewBackendCollector(fakeSvc, fakeLrn, mockClient, optionals.None[int](), NewPacketCounter(), nil)
+	col := NewBackendCollector(fakeSvc, fakeLrn, mockClient, optionals.None[int](), NewPacketCounter(), nil, nil, nil, nil, nil, nil)
 	assert.NoError(t, col.Process(req))
 	assert.NoError(t, col.Process(resp))
 	assert.NoError(t, col.Close())
@@ -242,7 +242,7 @@ func TestMultipleInterfaces(t *testing.T) {
 		AnyTimes().
 		Return(nil)
 
-	bc := NewBackendCollector(fakeSvc, fakeLrn, mockClient, optionals.None[int](), NewPacketCounter(), nil)
+	bc := NewBackendCollector(fakeSvc, fakeLrn, mockClient, optionals.None[int](), NewPacketCounter(), nil, nil, nil, nil, nil, nil)
 
 	var wg sync.WaitGroup
 	fakeTrace := func(count int, start_seq int) {
@@ -300,3 +300,46 @@ func TestFlushExit(t *testing.T) {
 	b.periodicFlush()
 	// Test should exit immediately
 }
+
+// Partial witnesses from a replayed capture expire by capture time, not by the
+// wall clock.
+func TestPairCacheExpiresByCaptureTime(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockClient := mockrest.NewMockLearnClient(ctrl)
+	defer ctrl.Finish()
+
+	var rec witnessRecorder
+	mockClient.
+		EXPECT().
+		AsyncReportsUpload(gomock.Any(), gomock.Any(), gomock.Any()).
+		Do(rec.recordAsyncReportsUpload).
+		AnyTimes().
+		Return(nil)
+
+	col := NewBackendCollector(fakeSvc, fakeLrn, mockClient, optionals.None[int](), NewPacketCounter(), nil, nil, nil, nil, nil, nil).(*BackendCollector)
+	captured := time.Date(2020, 4, 17, 3, 45, 6, 0, time.UTC)
+	request := func(seq int, at time.Time) akinet.ParsedNetworkTraffic {
+		return akinet.ParsedNetworkTraffic{
+			Content: akinet.HTTPRequest{
+				StreamID: uuid.New(),
+				Seq:      seq,
+				Method:   "GET",
+				URL:      &url.URL{Path: "/v1/doggos"},
+				Host:     "example.com",
+			},
+			ObservationTime: at,
+			FinalPacketTime: at,
+		}
+	}
+
+	assert.NoError(t, col.Process(request(1, captured)))
+	col.flushPairCache(col.clock.now().Add(-1 * pairCacheExpiration))
+	assert.Equal(t, 1, col.Stats().PendingWitnesses, "a request captured years ago is still awaiting its response")
+
+	assert.NoError(t, col.Process(request(2, captured.Add(2*pairCacheExpiration))))
+	col.flushPairCache(col.clock.now().Add(-1 * pairCacheExpiration))
+	assert.Equal(t, 1, col.Stats().PendingWitnesses, "only the request from more than a minute earlier in the capture expires")
+
+	assert.NoError(t, col.Close())
+	assert.Len(t, rec.witnesses, 2)
+}
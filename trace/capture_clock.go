@@ -0,0 +1,45 @@
+package trace
+
+import (
+	"sync"
+	"time"
+)
+
+// Tells the time by the traffic being processed, so that caches of partial
+// calls expire by capture time rather than by the wall clock. This matters
+// when replaying pcap files: packet timestamps can be far in the past, and
+// packets arrive much faster than they were captured.
+//
+// The time is the latest observation time seen, advanced by the wall-clock
+// time since it was seen, so that caches still expire while traffic is quiet.
+// During live capture, this is close to the wall clock. Before any traffic is
+// seen, it is the wall clock.
+type captureClock struct {
+	mutex sync.Mutex
+
+	// The latest observation time seen, and when it was seen.
+	latest     time.Time
+	observedAt time.Time
+}
+
+func (c *captureClock) observe(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if t.After(c.latest) {
+		c.latest = t
+		c.observedAt = time.Now()
+	}
+}
+
+func (c *captureClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.latest.IsZero() {
+		return time.Now()
+	}
+	return c.latest.Add(time.Since(c.observedAt))
+}
@@ -12,6 +12,11 @@ import (
 	"github.com/akitasoftware/akita-libs/akid"
 	"github.com/akitasoftware/akita-libs/akinet"
 
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pcap/database"
+	"github.com/akitasoftware/akita-cli/pcap/dns"
+	"github.com/akitasoftware/akita-cli/pcap/kafka"
+	"github.com/akitasoftware/akita-cli/pcap/redis"
 	"github.com/akitasoftware/akita-cli/rest"
 	"github.com/akitasoftware/akita-cli/util"
 )
@@ -62,13 +67,29 @@ func (sc *SamplingCollector) Process(t akinet.ParsedNetworkTraffic) error {
 	var key string
 	switch c := t.Content.(type) {
 	case akinet.HTTPRequest:
-		key = c.StreamID.String() + strconv.Itoa(c.Seq)
+		key = akid.String(learn.ToWitnessID(c.StreamID, c.Seq))
 	case akinet.HTTPResponse:
-		key = c.StreamID.String() + strconv.Itoa(c.Seq)
+		key = akid.String(learn.ToWitnessID(c.StreamID, c.Seq))
 	case akinet.TCPConnectionMetadata:
 		key = akid.String(c.ConnectionID)
 	case akinet.TLSHandshakeMetadata:
 		key = akid.String(c.ConnectionID)
+	case kafka.Request:
+		key = akid.String(learn.ToWitnessID(c.StreamID, int(c.CorrelationID)))
+	case kafka.Response:
+		key = akid.String(learn.ToWitnessID(c.StreamID, int(c.CorrelationID)))
+	case database.Query:
+		key = akid.String(learn.ToWitnessID(c.StreamID, c.Seq))
+	case database.Result:
+		key = akid.String(learn.ToWitnessID(c.StreamID, c.Seq))
+	case redis.Command:
+		key = akid.String(learn.ToWitnessID(c.StreamID, c.Seq))
+	case redis.Reply:
+		key = akid.String(learn.ToWitnessID(c.StreamID, c.Seq))
+	case dns.Query:
+		key = t.SrcIP.String() + strconv.Itoa(t.SrcPort) + strconv.Itoa(int(c.ID))
+	case dns.Response:
+		key = t.DstIP.String() + strconv.Itoa(t.DstPort) + strconv.Itoa(int(c.ID))
 	default:
 		key = ""
 	}
@@ -101,7 +122,12 @@ func (sc *UserTrafficCollector) Close() error {
 // This is a shim to add packet counts based on payload type.
 type PacketCountCollector struct {
 	PacketCounts PacketCountConsumer
-	Collector    Collector
+
+	// Optional. Counts database queries and results, which PacketCounts has no
+	// fields for.
+	DatabaseCounts *DatabaseCounter
+
+	Collector Collector
 }
 
 // Don't record self-generated traffic in the breakdown by hostname,
@@ -172,6 +198,33 @@ func (pc *PacketCountCollector) Process(t akinet.ParsedNetworkTraffic) error {
 		// Don't count TCP metadata.
 	case akinet.TLSHandshakeMetadata:
 		// Don't count TLS metadata.
+	case kafka.Request, kafka.Response:
+		// Kafka traffic is counted by KafkaTopicCollector.
+	case database.Query:
+		if pc.DatabaseCounts != nil {
+			pc.DatabaseCounts.Update(DatabaseCounts{
+				Protocol: c.Protocol,
+				Port:     t.DstPort,
+				Queries:  1,
+			})
+		}
+	case database.Result:
+		if pc.DatabaseCounts != nil {
+			errorCount := 0
+			if c.ErrorCode != "" {
+				errorCount = 1
+			}
+			pc.DatabaseCounts.Update(DatabaseCounts{
+				Protocol: c.Protocol,
+				Port:     t.SrcPort,
+				Results:  1,
+				Errors:   errorCount,
+			})
+		}
+	case redis.Command, redis.Reply:
+		// Redis traffic is counted by RedisCommandCollector.
+	case dns.Query, dns.Response:
+		// DNS traffic is only used to name hosts, by DNSCollector.
 	case akinet.HTTP2ConnectionPreface:
 		pc.PacketCounts.Update(client_telemetry.PacketCounts{
 			Interface:     t.Interface,
@@ -0,0 +1,247 @@
+package trace
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pcap/database"
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+// Counts of database queries and results seen on a server port.
+type DatabaseCounts struct {
+	Protocol database.Protocol
+	Port     int
+
+	Queries int
+	Results int
+	Errors  int
+}
+
+func (c *DatabaseCounts) Add(other DatabaseCounts) {
+	c.Queries += other.Queries
+	c.Results += other.Results
+	c.Errors += other.Errors
+}
+
+type databasePortKey struct {
+	protocol database.Protocol
+	port     int
+}
+
+// Counts database queries and results by protocol and server port. These get
+// their own counter because client_telemetry.PacketCounts has no fields for
+// them.
+//
+// Imposes a hard limit on the number of ports that are individually tracked;
+// traffic on further ports is still included in the total.
+type DatabaseCounter struct {
+	mutex  sync.Mutex
+	total  DatabaseCounts
+	byPort map[databasePortKey]*DatabaseCounts
+}
+
+func NewDatabaseCounter() *DatabaseCounter {
+	return &DatabaseCounter{
+		byPort: make(map[databasePortKey]*DatabaseCounts),
+	}
+}
+
+func (c *DatabaseCounter) Update(delta DatabaseCounts) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.total.Add(delta)
+
+	key := databasePortKey{delta.Protocol, delta.Port}
+	counts, ok := c.byPort[key]
+	if !ok {
+		if len(c.byPort) >= maxKeys {
+			return
+		}
+		counts = &DatabaseCounts{Protocol: delta.Protocol, Port: delta.Port}
+		c.byPort[key] = counts
+	}
+	counts.Add(delta)
+}
+
+// Returns the counts across all protocols and ports.
+func (c *DatabaseCounter) Total() DatabaseCounts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.total
+}
+
+// Returns the counts for each protocol and port, busiest first.
+func (c *DatabaseCounter) AllPorts() []DatabaseCounts {
+	c.mutex.Lock()
+	result := make([]DatabaseCounts, 0, len(c.byPort))
+	for _, counts := range c.byPort {
+		result = append(result, *counts)
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Queries != result[j].Queries {
+			return result[i].Queries > result[j].Queries
+		}
+		return result[i].Port < result[j].Port
+	})
+	return result
+}
+
+// A normalized statement, as issued to a database server.
+type DatabaseStatement struct {
+	Protocol database.Protocol
+
+	// The server's address, so that the same statement sent to different
+	// databases is kept apart.
+	ServerIP   string
+	ServerPort int
+
+	Text string
+}
+
+type DatabaseStatementStats struct {
+	// The number of executions whose result was seen.
+	Count int
+
+	// The number of executions that failed, in total and by error code.
+	Errors     int
+	ErrorCodes map[string]int
+
+	// Time from the last packet of the statement to the last packet of its
+	// result.
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+func (s DatabaseStatementStats) MeanLatency() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Count)
+}
+
+type DatabaseStatementWithStats struct {
+	DatabaseStatement
+	DatabaseStatementStats
+}
+
+// Aggregates the executions of database statements.
+//
+// Imposes a hard limit on the number of statements that are individually
+// tracked; executions of further statements are dropped.
+type DatabaseStatementCounter struct {
+	mutex      sync.Mutex
+	statements map[DatabaseStatement]*DatabaseStatementStats
+}
+
+func NewDatabaseStatementCounter() *DatabaseStatementCounter {
+	return &DatabaseStatementCounter{
+		statements: make(map[DatabaseStatement]*DatabaseStatementStats),
+	}
+}
+
+// Records one execution of a statement.
+func (c *DatabaseStatementCounter) Add(statement DatabaseStatement, latency time.Duration, errorCode string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats, ok := c.statements[statement]
+	if !ok {
+		if len(c.statements) >= maxKeys {
+			return
+		}
+		stats = &DatabaseStatementStats{}
+		c.statements[statement] = stats
+	}
+
+	stats.Count++
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+	if errorCode != "" {
+		stats.Errors++
+		if stats.ErrorCodes == nil {
+			stats.ErrorCodes = make(map[string]int)
+		}
+		stats.ErrorCodes[errorCode]++
+	}
+}
+
+// Returns up to n statements that took the most time in total, slowest first.
+func (c *DatabaseStatementCounter) Top(n int) []DatabaseStatementWithStats {
+	c.mutex.Lock()
+	result := make([]DatabaseStatementWithStats, 0, len(c.statements))
+	for statement, stats := range c.statements {
+		s := *stats
+		if stats.ErrorCodes != nil {
+			s.ErrorCodes = make(map[string]int, len(stats.ErrorCodes))
+			for code, count := range stats.ErrorCodes {
+				s.ErrorCodes[code] = count
+			}
+		}
+		result = append(result, DatabaseStatementWithStats{statement, s})
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalLatency != result[j].TotalLatency {
+			return result[i].TotalLatency > result[j].TotalLatency
+		}
+		return result[i].Count > result[j].Count
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+type pendingDatabaseQuery struct {
+	statement DatabaseStatement
+	sent      time.Time
+}
+
+// Pairs database queries with their results to measure statement latency and
+// count errors by statement. All traffic is passed on to the wrapped collector.
+type DatabaseStatementCollector struct {
+	Counter   *DatabaseStatementCounter
+	Collector Collector
+
+	queries pending.Calls[akid.WitnessID, pendingDatabaseQuery]
+}
+
+func (dc *DatabaseStatementCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	switch c := t.Content.(type) {
+	case database.Query:
+		dc.queries.Add(learn.ToWitnessID(c.StreamID, c.Seq), t.ObservationTime, pendingDatabaseQuery{
+			statement: DatabaseStatement{
+				Protocol:   c.Protocol,
+				ServerIP:   t.DstIP.String(),
+				ServerPort: t.DstPort,
+				Text:       c.Text,
+			},
+			sent: t.FinalPacketTime,
+		})
+	case database.Result:
+		if q, ok := dc.queries.Take(learn.ToWitnessID(c.StreamID, c.Seq)); ok {
+			latency := t.FinalPacketTime.Sub(q.sent)
+			if q.sent.IsZero() || latency < 0 {
+				latency = 0
+			}
+			dc.Counter.Add(q.statement, latency, c.ErrorCode)
+		}
+	}
+	return dc.Collector.Process(t)
+}
+
+func (dc *DatabaseStatementCollector) Close() error {
+	return dc.Collector.Close()
+}
@@ -0,0 +1,103 @@
+package trace
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pcap/database"
+)
+
+func TestDatabaseStatementCollector(t *testing.T) {
+	statements := NewDatabaseStatementCounter()
+	counts := NewDatabaseCounter()
+	col := &DatabaseStatementCollector{
+		Counter: statements,
+		Collector: &PacketCountCollector{
+			PacketCounts:   NewPacketCounter(),
+			DatabaseCounts: counts,
+			Collector:      NewDummyCollector(),
+		},
+	}
+
+	client := net.ParseIP("10.0.0.1")
+	server := net.ParseIP("10.0.0.9")
+	streamID := uuid.New()
+	start := time.Unix(1700000000, 0)
+	selectDog := "SELECT name FROM dogs WHERE id = ?"
+
+	query := func(seq int, text string, at time.Duration) akinet.ParsedNetworkTraffic {
+		return akinet.ParsedNetworkTraffic{
+			SrcIP:           client,
+			SrcPort:         40000,
+			DstIP:           server,
+			DstPort:         5432,
+			FinalPacketTime: start.Add(at),
+			Content: database.Query{
+				Protocol: database.PostgreSQL,
+				StreamID: streamID,
+				Seq:      seq,
+				Text:     text,
+			},
+		}
+	}
+	result := func(seq int, errorCode string, at time.Duration) akinet.ParsedNetworkTraffic {
+		return akinet.ParsedNetworkTraffic{
+			SrcIP:           server,
+			SrcPort:         5432,
+			DstIP:           client,
+			DstPort:         40000,
+			FinalPacketTime: start.Add(at),
+			Content: database.Result{
+				Protocol:  database.PostgreSQL,
+				StreamID:  streamID,
+				Seq:       seq,
+				ErrorCode: errorCode,
+			},
+		}
+	}
+
+	traffic := []akinet.ParsedNetworkTraffic{
+		query(1, selectDog, 0),
+		result(1, "", 10*time.Millisecond),
+		query(2, selectDog, 20*time.Millisecond),
+		result(2, "57014", 50*time.Millisecond),
+		query(3, "COMMIT", 60*time.Millisecond),
+		result(3, "", 61*time.Millisecond),
+		// No query was seen for this result.
+		result(9, "", 70*time.Millisecond),
+	}
+	for _, pnt := range traffic {
+		assert.NoError(t, col.Process(pnt))
+	}
+
+	assert.Equal(t, []DatabaseStatementWithStats{
+		{
+			DatabaseStatement{Protocol: database.PostgreSQL, ServerIP: "10.0.0.9", ServerPort: 5432, Text: selectDog},
+			DatabaseStatementStats{
+				Count:        2,
+				Errors:       1,
+				ErrorCodes:   map[string]int{"57014": 1},
+				TotalLatency: 40 * time.Millisecond,
+				MaxLatency:   30 * time.Millisecond,
+			},
+		},
+		{
+			DatabaseStatement{Protocol: database.PostgreSQL, ServerIP: "10.0.0.9", ServerPort: 5432, Text: "COMMIT"},
+			DatabaseStatementStats{
+				Count:        1,
+				TotalLatency: time.Millisecond,
+				MaxLatency:   time.Millisecond,
+			},
+		},
+	}, statements.Top(10))
+
+	expected := DatabaseCounts{Protocol: database.PostgreSQL, Port: 5432, Queries: 3, Results: 4, Errors: 1}
+	assert.Equal(t, []DatabaseCounts{expected}, counts.AllPorts())
+	assert.Equal(t, DatabaseCounts{Queries: 3, Results: 4, Errors: 1}, counts.Total())
+}
@@ -0,0 +1,114 @@
+package trace
+
+import (
+	"net"
+	"sync"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pcap/dns"
+)
+
+// Remembers the hostname that DNS resolved each address from, so that traffic
+// to the address can be named even when it carries no hostname itself.
+//
+// Imposes a hard limit on the number of addresses remembered; beyond that, an
+// arbitrary address is forgotten to make room. Record TTLs are ignored, since
+// connections routinely outlive them.
+type HostnameCache struct {
+	mutex sync.RWMutex
+	names map[string]string
+}
+
+func NewHostnameCache() *HostnameCache {
+	return &HostnameCache{
+		names: make(map[string]string),
+	}
+}
+
+// Records that name resolved to ip. Later resolutions replace earlier ones.
+func (c *HostnameCache) Add(ip net.IP, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := ip.String()
+	if _, ok := c.names[key]; !ok && len(c.names) >= maxKeys {
+		for k := range c.names {
+			delete(c.names, k)
+			break
+		}
+	}
+	c.names[key] = name
+}
+
+// Returns the hostname that last resolved to ip, if any.
+func (c *HostnameCache) Lookup(ip net.IP) (string, bool) {
+	if ip == nil {
+		return "", false
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	name, ok := c.names[ip.String()]
+	return name, ok
+}
+
+// Learns hostnames from DNS responses, and uses them to name the servers of
+// TLS handshakes that carry no hostname, e.g. because the client sent no SNI,
+// and of HTTP requests whose Host header is missing or an address. All
+// traffic is passed on to the wrapped collector.
+type DNSCollector struct {
+	Cache     *HostnameCache
+	Collector Collector
+}
+
+func (dc *DNSCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	switch c := t.Content.(type) {
+	case dns.Response:
+		if c.RCode == "NOERROR" && c.Name != "" {
+			for _, ip := range c.Addresses {
+				dc.Cache.Add(ip, c.Name)
+			}
+		}
+	case akinet.TLSClientHello:
+		if c.Hostname == nil {
+			if name, ok := dc.Cache.Lookup(t.DstIP); ok {
+				c.Hostname = &name
+				t.Content = c
+			}
+		}
+	case akinet.TLSServerHello:
+		if len(c.DNSNames) == 0 {
+			if name, ok := dc.Cache.Lookup(t.SrcIP); ok {
+				c.DNSNames = []string{name}
+				t.Content = c
+			}
+		}
+	case akinet.HTTPRequest:
+		if isAddressHost(c.Host) {
+			if name, ok := dc.Cache.Lookup(t.DstIP); ok {
+				if _, port, err := net.SplitHostPort(c.Host); err == nil {
+					name = net.JoinHostPort(name, port)
+				}
+				c.Host = name
+				t.Content = c
+			}
+		}
+	}
+	return dc.Collector.Process(t)
+}
+
+func (dc *DNSCollector) Close() error {
+	return dc.Collector.Close()
+}
+
+// Whether an HTTP Host header names no host: it is empty, or an IP address
+// with an optional port.
+func isAddressHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.ParseIP(host) != nil
+}
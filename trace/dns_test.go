@@ -0,0 +1,65 @@
+package trace
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pcap/dns"
+)
+
+// Records the traffic passed to it.
+type recordingCollector struct {
+	traffic []akinet.ParsedNetworkTraffic
+}
+
+func (rc *recordingCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	rc.traffic = append(rc.traffic, t)
+	return nil
+}
+
+func (rc *recordingCollector) Close() error {
+	return nil
+}
+
+func TestDNSCollector(t *testing.T) {
+	client := net.ParseIP("10.0.0.1")
+	resolved := net.ParseIP("93.184.216.34")
+	unresolved := net.ParseIP("93.184.216.99")
+
+	sink := &recordingCollector{}
+	col := &DNSCollector{
+		Cache:     NewHostnameCache(),
+		Collector: sink,
+	}
+
+	sni := "www.example.org"
+	traffic := []akinet.ParsedNetworkTraffic{
+		{
+			SrcIP:   net.ParseIP("10.0.0.53"),
+			SrcPort: 53,
+			DstIP:   client,
+			Content: dns.Response{Name: "api.example.com", Type: "A", RCode: "NOERROR", Addresses: []net.IP{resolved}},
+		},
+		{SrcIP: client, DstIP: resolved, DstPort: 443, Content: akinet.TLSClientHello{}},
+		{SrcIP: client, DstIP: resolved, DstPort: 443, Content: akinet.TLSClientHello{Hostname: &sni}},
+		{SrcIP: resolved, SrcPort: 443, DstIP: client, Content: akinet.TLSServerHello{}},
+		{SrcIP: client, DstIP: unresolved, DstPort: 443, Content: akinet.TLSClientHello{}},
+		{SrcIP: client, DstIP: resolved, DstPort: 8080, Content: akinet.HTTPRequest{Host: "93.184.216.34:8080"}},
+		{SrcIP: client, DstIP: resolved, DstPort: 80, Content: akinet.HTTPRequest{Host: "example.com"}},
+	}
+	for _, pnt := range traffic {
+		assert.NoError(t, col.Process(pnt))
+	}
+
+	resolvedName := "api.example.com"
+	assert.Equal(t, akinet.TLSClientHello{Hostname: &resolvedName}, sink.traffic[1].Content)
+	assert.Equal(t, akinet.TLSClientHello{Hostname: &sni}, sink.traffic[2].Content)
+	assert.Equal(t, akinet.TLSServerHello{DNSNames: []string{"api.example.com"}}, sink.traffic[3].Content)
+	assert.Equal(t, akinet.TLSClientHello{}, sink.traffic[4].Content)
+	assert.Equal(t, "api.example.com:8080", sink.traffic[5].Content.(akinet.HTTPRequest).Host)
+	assert.Equal(t, "example.com", sink.traffic[6].Content.(akinet.HTTPRequest).Host)
+}
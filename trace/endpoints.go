@@ -0,0 +1,296 @@
+package trace
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/go-utils/optionals"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pcap/http2"
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+const (
+	// Latencies are counted in buckets whose bounds grow by a factor of
+	// 2^(1/latencyBucketsPerDoubling), starting from a microsecond, so
+	// percentiles are within about 9% of the true value.
+	latencyBucketsPerDoubling = 8
+)
+
+// An endpoint of one of our services.
+type Endpoint struct {
+	Method string
+	Host   string
+
+	// The request path, with segments that look like identifiers replaced by
+	// "{id}".
+	Path string
+
+	// The GraphQL operation called, e.g. "query GetUser", or empty if the
+	// request isn't a GraphQL request. Every operation is sent to the same
+	// path, so this tells them apart.
+	Operation string
+}
+
+type EndpointStats struct {
+	// The number of requests whose response was seen.
+	Count int
+
+	// The number of responses by status code.
+	StatusCodes map[int]int
+
+	// The number of failed calls: responses with a 4xx or 5xx status code, or
+	// gRPC responses with a non-zero status.
+	Errors int
+
+	// Percentiles and maximum of the processing latency, over the calls whose
+	// latency could be measured.
+	LatencyP50 time.Duration
+	LatencyP90 time.Duration
+	LatencyP99 time.Duration
+	MaxLatency time.Duration
+}
+
+// Returns the share of calls that failed.
+func (s EndpointStats) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Count)
+}
+
+// Whether a call failed, judging by its response: a 4xx or 5xx status code,
+// or a non-zero gRPC status, which is sent with HTTP status 200.
+func responseFailed(c akinet.HTTPResponse) bool {
+	return c.StatusCode >= 400 || http2.GRPCFailed(c)
+}
+
+type EndpointWithStats struct {
+	Endpoint
+	EndpointStats
+}
+
+// Counts latencies in logarithmically sized buckets, so that percentiles can
+// be estimated in constant space.
+type latencyHistogram struct {
+	buckets map[int]int
+	count   int
+	max     time.Duration
+}
+
+func latencyBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	return int(math.Ceil(latencyBucketsPerDoubling * math.Log2(us)))
+}
+
+// Returns the upper bound of the latencies in bucket b.
+func latencyBucketBound(b int) time.Duration {
+	return time.Duration(math.Exp2(float64(b)/latencyBucketsPerDoubling) * float64(time.Microsecond))
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	if h.buckets == nil {
+		h.buckets = make(map[int]int)
+	}
+	h.buckets[latencyBucket(d)]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Returns the latency that fraction p of the latencies are at or below,
+// rounded up to the bound of its bucket, but no more than the maximum.
+func (h *latencyHistogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	buckets := make([]int, 0, len(h.buckets))
+	for b := range h.buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+
+	seen := 0
+	for _, b := range buckets {
+		seen += h.buckets[b]
+		if seen >= rank {
+			if bound := latencyBucketBound(b); bound < h.max {
+				return bound
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+type endpointStats struct {
+	count       int
+	errors      int
+	statusCodes map[int]int
+	latencies   latencyHistogram
+}
+
+// Aggregates the calls made to our services' endpoints: status codes, errors
+// and processing latency.
+//
+// Imposes a hard limit on the number of endpoints that are individually
+// tracked; further endpoints are dropped.
+type EndpointCounter struct {
+	mutex     sync.Mutex
+	endpoints map[Endpoint]*endpointStats
+}
+
+func NewEndpointCounter() *EndpointCounter {
+	return &EndpointCounter{
+		endpoints: make(map[Endpoint]*endpointStats),
+	}
+}
+
+// Records a response from e with the given status code, whether the call
+// failed, and the processing latency of the call, if it was measured.
+func (c *EndpointCounter) Add(e Endpoint, statusCode int, failed bool, latency optionals.Optional[time.Duration]) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats, ok := c.endpoints[e]
+	if !ok {
+		if len(c.endpoints) >= maxKeys {
+			return
+		}
+		stats = &endpointStats{
+			statusCodes: make(map[int]int),
+		}
+		c.endpoints[e] = stats
+	}
+
+	stats.count++
+	stats.statusCodes[statusCode]++
+	if failed {
+		stats.errors++
+	}
+	if l, ok := latency.Get(); ok {
+		stats.latencies.add(l)
+	}
+}
+
+// Returns all endpoints, most called first.
+func (c *EndpointCounter) All() []EndpointWithStats {
+	c.mutex.Lock()
+	result := make([]EndpointWithStats, 0, len(c.endpoints))
+	for e, stats := range c.endpoints {
+		statusCodes := make(map[int]int, len(stats.statusCodes))
+		for code, count := range stats.statusCodes {
+			statusCodes[code] = count
+		}
+		result = append(result, EndpointWithStats{e, EndpointStats{
+			Count:       stats.count,
+			StatusCodes: statusCodes,
+			Errors:      stats.errors,
+			LatencyP50:  stats.latencies.percentile(0.5),
+			LatencyP90:  stats.latencies.percentile(0.9),
+			LatencyP99:  stats.latencies.percentile(0.99),
+			MaxLatency:  stats.latencies.max,
+		}})
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Operation < b.Operation
+	})
+	return result
+}
+
+// Returns the endpoint that an HTTP request calls. If the request has no Host
+// header, the endpoint's host is the server's address. GraphQL operations are
+// separate endpoints.
+func httpEndpoint(t akinet.ParsedNetworkTraffic, req akinet.HTTPRequest) Endpoint {
+	e := Endpoint{
+		Method: req.Method,
+		Host:   req.Host,
+		Path:   "/",
+	}
+	if e.Host == "" {
+		e.Host = net.JoinHostPort(t.DstIP.String(), strconv.Itoa(t.DstPort))
+	}
+	if req.URL != nil {
+		e.Path = pathTemplate(req.URL.Path)
+	}
+	e.Operation = learn.GraphQLOperationName(req)
+	return e
+}
+
+type pendingEndpointCall struct {
+	endpoint   Endpoint
+	requestEnd time.Time
+}
+
+// Pairs the HTTP requests to our services with their responses to count
+// status codes and measure processing latency by endpoint. Outbound calls
+// are left to the DependencyCollector. All traffic is passed on to the
+// wrapped collector.
+type EndpointCollector struct {
+	// Used to skip outbound calls. May be nil.
+	Addrs *HostAddrs
+
+	Counter   *EndpointCounter
+	Collector Collector
+
+	calls pending.Calls[akid.WitnessID, pendingEndpointCall]
+}
+
+func (ec *EndpointCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	switch c := t.Content.(type) {
+	case akinet.HTTPRequest:
+		if !ec.Addrs.IsOutbound(t.SrcIP, t.DstIP) {
+			ec.calls.Add(learn.ToWitnessID(c.StreamID, c.Seq), t.ObservationTime, pendingEndpointCall{
+				endpoint:   httpEndpoint(t, c),
+				requestEnd: t.FinalPacketTime,
+			})
+		}
+	case akinet.HTTPResponse:
+		if call, ok := ec.calls.Take(learn.ToWitnessID(c.StreamID, c.Seq)); ok {
+			latency := optionals.None[time.Duration]()
+			if l, ok := processingLatency(call.requestEnd, t.ObservationTime); ok {
+				latency = optionals.Some(l)
+			}
+			ec.Counter.Add(call.endpoint, c.StatusCode, responseFailed(c), latency)
+		}
+	}
+	return ec.Collector.Process(t)
+}
+
+func (ec *EndpointCollector) Close() error {
+	return ec.Collector.Close()
+}
@@ -0,0 +1,126 @@
+package trace
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+func TestEndpointCollector(t *testing.T) {
+	local := net.ParseIP("10.0.0.1")
+	client := net.ParseIP("10.0.0.2")
+	remote := net.ParseIP("93.184.216.34")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sink := &recordingCollector{}
+	counter := NewEndpointCounter()
+	col := &EndpointCollector{
+		Addrs:     NewHostAddrs([]net.IP{local}),
+		Counter:   counter,
+		Collector: sink,
+	}
+
+	call := func(client, server net.IP, method, path string, status int, latency time.Duration) {
+		streamID := uuid.New()
+		assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			SrcIP:           client,
+			DstIP:           server,
+			DstPort:         8080,
+			Content:         akinet.HTTPRequest{StreamID: streamID, Method: method, Host: "orders.internal", URL: &url.URL{Path: path}},
+			FinalPacketTime: start,
+		}))
+		assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			SrcIP:           server,
+			SrcPort:         8080,
+			DstIP:           client,
+			Content:         akinet.HTTPResponse{StreamID: streamID, StatusCode: status},
+			ObservationTime: start.Add(latency),
+		}))
+	}
+	for i := 1; i <= 100; i++ {
+		status := 200
+		if i%10 == 0 {
+			status = 503
+		}
+		call(client, local, "GET", "/orders/"+uuid.NewString(), status, time.Duration(i)*time.Millisecond)
+	}
+	call(client, local, "POST", "/orders", 201, 5*time.Millisecond)
+
+	// Outbound calls aren't our endpoints.
+	call(local, remote, "GET", "/orders/1", 200, time.Millisecond)
+
+	assert.Len(t, sink.traffic, 204)
+	endpoints := counter.All()
+	require.Len(t, endpoints, 2)
+
+	get := endpoints[0]
+	assert.Equal(t, Endpoint{"GET", "orders.internal", "/orders/{id}", ""}, get.Endpoint)
+	assert.Equal(t, 100, get.Count)
+	assert.Equal(t, map[int]int{200: 90, 503: 10}, get.StatusCodes)
+	assert.Equal(t, 0.1, get.ErrorRate())
+	assert.InEpsilon(t, 50*time.Millisecond, get.LatencyP50, 0.1)
+	assert.InEpsilon(t, 90*time.Millisecond, get.LatencyP90, 0.1)
+	assert.InEpsilon(t, 99*time.Millisecond, get.LatencyP99, 0.1)
+	assert.Equal(t, 100*time.Millisecond, get.MaxLatency)
+
+	post := endpoints[1]
+	assert.Equal(t, Endpoint{"POST", "orders.internal", "/orders", ""}, post.Endpoint)
+	assert.Equal(t, 1, post.Count)
+	assert.Equal(t, 5*time.Millisecond, post.LatencyP99)
+}
+
+// GraphQL operations are all sent to the same path, but are separate
+// endpoints.
+func TestHTTPEndpointGraphQL(t *testing.T) {
+	graphQL := func(query string) akinet.HTTPRequest {
+		return akinet.HTTPRequest{
+			Method: "POST",
+			Host:   "api.internal",
+			URL:    &url.URL{Path: "/graphql"},
+			Header: http.Header{"Content-Type": {"application/json"}},
+			Body:   memview.New([]byte(`{"query": "` + query + `"}`)),
+		}
+	}
+
+	getDog := httpEndpoint(akinet.ParsedNetworkTraffic{}, graphQL("query GetDog { dog { name } }"))
+	bark := httpEndpoint(akinet.ParsedNetworkTraffic{}, graphQL("mutation Bark { bark }"))
+	assert.Equal(t, Endpoint{"POST", "api.internal", "/graphql", "query GetDog"}, getDog)
+	assert.Equal(t, Endpoint{"POST", "api.internal", "/graphql", "mutation Bark"}, bark)
+}
+
+func TestResponseFailed(t *testing.T) {
+	assert.False(t, responseFailed(akinet.HTTPResponse{StatusCode: 200}))
+	assert.True(t, responseFailed(akinet.HTTPResponse{StatusCode: 404}))
+
+	// gRPC failures are sent with HTTP status 200.
+	grpc := func(status string) akinet.HTTPResponse {
+		return akinet.HTTPResponse{StatusCode: 200, Header: http.Header{http.TrailerPrefix + "grpc-status": {status}}}
+	}
+	assert.False(t, responseFailed(grpc("0")))
+	assert.True(t, responseFailed(grpc("14")))
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	assert.Equal(t, time.Duration(0), h.percentile(0.5))
+
+	for _, d := range []time.Duration{0, time.Microsecond, time.Second, time.Hour} {
+		bound := latencyBucketBound(latencyBucket(d))
+		assert.GreaterOrEqual(t, bound, d)
+		assert.LessOrEqual(t, float64(bound), 1.1*float64(d)+float64(time.Microsecond))
+	}
+
+	h.add(-time.Second)
+	h.add(3 * time.Second)
+	assert.Equal(t, time.Microsecond, h.percentile(0.5))
+	assert.Equal(t, 3*time.Second, h.percentile(0.99))
+}
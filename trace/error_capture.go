@@ -0,0 +1,276 @@
+package trace
+
+import (
+	"sync"
+	"time"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pcap/http2"
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+const (
+	// Calls captured around the sample whose responses haven't come back
+	// through the sample within this long are forgotten, as in the
+	// BackendCollector's pair cache.
+	errorCaptureExpiration = pairCacheExpiration
+
+	// The window over which ErrorCaptureOptions.MaxPerMinute is counted.
+	errorCaptureWindow = time.Minute
+)
+
+// The calls that an ErrorCaptureCollector always captures, in addition to
+// those with a 5xx response, and limits on how many it captures.
+type ErrorCaptureOptions struct {
+	// 4xx status codes to always capture.
+	StatusCodes []int
+
+	// Calls whose processing latency exceeds this are always captured.
+	// Disabled if zero.
+	LatencyThreshold time.Duration
+
+	// The most calls captured around the sample in each minute of observation
+	// time. Unlimited if zero.
+	MaxPerMinute int
+
+	// If set, fewer calls are captured while the back end throttles uploads:
+	// none while it has asked us to wait, and a correspondingly smaller share
+	// of MaxPerMinute while the rate limit is reduced.
+	RateLimit *SharedRateLimit
+}
+
+// Captures failed HTTP calls that sampling or rate limiting would otherwise
+// drop. Sampling decides on requests before their responses are seen, so each
+// request that the sample doesn't pass on right away is copied and held until
+// its response arrives. If the call failed and the sample didn't include it,
+// the request and response are passed on around the sample, up to the
+// configured limits. Failed calls are those with a 5xx response, a 4xx
+// response in the configured set, or a processing latency over the configured
+// threshold. gRPC calls with a non-zero status count as 5xx responses.
+//
+// All traffic is passed to the sampled collector as usual.
+type ErrorCaptureCollector struct {
+	statusCodes      map[int]struct{}
+	latencyThreshold time.Duration
+	maxPerMinute     int
+	rateLimit        *SharedRateLimit
+
+	// Sampling and rate limiting, ending in a sampleTracker that passes on to
+	// collector.
+	sampled Collector
+
+	collector Collector
+
+	// Requests waiting for their responses, by pair key.
+	held pending.Calls[akid.WitnessID, akinet.ParsedNetworkTraffic]
+
+	// Requests that made it through the sample, by pair key.
+	passed pending.Calls[akid.WitnessID, struct{}]
+
+	// Guards the fields below, and the pairing of held, passed and forced,
+	// which the sampleTracker also uses. The sample may pass calls on from
+	// another goroutine, e.g. when a window ends.
+	mutex sync.Mutex
+
+	// Calls captured around the sample, by pair key. If the sample later
+	// passes them on anyway, e.g. from a reservoir, they are dropped.
+	forced map[akid.WitnessID]time.Time
+
+	lastExpiry time.Time
+
+	// The start of the current window, and the calls captured around the
+	// sample in it.
+	windowStart  time.Time
+	windowForced int
+}
+
+// Wraps collector so that failed calls are captured even if sample, which
+// adds sampling and rate limiting in front of a collector, would drop them.
+func NewErrorCaptureCollector(options ErrorCaptureOptions, collector Collector, sample func(Collector) Collector) *ErrorCaptureCollector {
+	ec := &ErrorCaptureCollector{
+		statusCodes:      make(map[int]struct{}, len(options.StatusCodes)),
+		latencyThreshold: options.LatencyThreshold,
+		maxPerMinute:     options.MaxPerMinute,
+		rateLimit:        options.RateLimit,
+		collector:        collector,
+		forced:           make(map[akid.WitnessID]time.Time),
+	}
+	for _, code := range options.StatusCodes {
+		ec.statusCodes[code] = struct{}{}
+	}
+	ec.sampled = sample(&sampleTracker{ec: ec, collector: collector})
+	return ec
+}
+
+func (ec *ErrorCaptureCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	now := t.ObservationTime
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	switch c := t.Content.(type) {
+	case akinet.HTTPRequest:
+		if err := ec.sampled.Process(t); err != nil {
+			return err
+		}
+		ec.holdUnlessPassed(learn.ToWitnessID(c.StreamID, c.Seq), t, c, now)
+		return nil
+
+	case akinet.HTTPResponse:
+		if err := ec.sampled.Process(t); err != nil {
+			return err
+		}
+
+		key := learn.ToWitnessID(c.StreamID, c.Seq)
+		request, force := ec.takeHeld(key, t, c, now)
+		if !force {
+			return nil
+		}
+		if err := ec.collector.Process(request); err != nil {
+			return err
+		}
+		return ec.collector.Process(t)
+
+	default:
+		return ec.sampled.Process(t)
+	}
+}
+
+// Holds a copy of a request that the sample didn't pass on, in case its
+// response shows that it failed. Requests that the sample passed on need no
+// copy, since their responses will be passed on too.
+func (ec *ErrorCaptureCollector) holdUnlessPassed(key akid.WitnessID, t akinet.ParsedNetworkTraffic, c akinet.HTTPRequest, now time.Time) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	ec.maybeExpireLocked(now)
+	if ec.passed.Has(key) {
+		return
+	}
+	ec.held.Add(key, t.ObservationTime, ownedHTTPRequest(t, c))
+}
+
+// Forgets the request with the given key, and returns it if its call should
+// be captured around the sample. If so, the call is recorded as captured
+// before the lock is released, so that the sample's copy is dropped even if
+// it is passed on right away from another goroutine.
+func (ec *ErrorCaptureCollector) takeHeld(key akid.WitnessID, response akinet.ParsedNetworkTraffic, c akinet.HTTPResponse, now time.Time) (akinet.ParsedNetworkTraffic, bool) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	_, passed := ec.passed.Take(key)
+	request, held := ec.held.Take(key)
+	if passed || !held || !ec.failed(request, response, c) || !ec.allowLocked(now) {
+		return akinet.ParsedNetworkTraffic{}, false
+	}
+	ec.forced[key] = now
+	return request, true
+}
+
+func (ec *ErrorCaptureCollector) failed(request, response akinet.ParsedNetworkTraffic, c akinet.HTTPResponse) bool {
+	if c.StatusCode >= 500 || http2.GRPCFailed(c) {
+		return true
+	}
+	if _, ok := ec.statusCodes[c.StatusCode]; ok {
+		return true
+	}
+	if ec.latencyThreshold > 0 {
+		if latency, ok := processingLatency(request.FinalPacketTime, response.ObservationTime); ok && latency > ec.latencyThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts a call captured around the sample, and returns whether it is within
+// the limits.
+func (ec *ErrorCaptureCollector) allowLocked(now time.Time) bool {
+	quota := float64(ec.maxPerMinute)
+	if ec.rateLimit != nil {
+		capacity := ec.rateLimit.UploadCapacity()
+		if capacity == 0 {
+			return false
+		}
+		quota *= capacity
+	}
+	if ec.maxPerMinute == 0 {
+		return true
+	}
+	if quota < 1 {
+		quota = 1
+	}
+
+	if now.Sub(ec.windowStart) >= errorCaptureWindow {
+		ec.windowStart = now
+		ec.windowForced = 0
+	}
+	if float64(ec.windowForced) >= quota {
+		return false
+	}
+	ec.windowForced++
+	return true
+}
+
+// Forgets calls captured around the sample whose responses never came back
+// through it.
+func (ec *ErrorCaptureCollector) maybeExpireLocked(now time.Time) {
+	if now.Sub(ec.lastExpiry) < errorCaptureExpiration {
+		return
+	}
+	ec.lastExpiry = now
+
+	cutoff := now.Add(-errorCaptureExpiration)
+	for key, seen := range ec.forced {
+		if seen.Before(cutoff) {
+			delete(ec.forced, key)
+		}
+	}
+}
+
+func (ec *ErrorCaptureCollector) Close() error {
+	return ec.sampled.Close()
+}
+
+// Sits at the end of the sample, noting which requests made it through, and
+// dropping calls that were already captured around the sample.
+type sampleTracker struct {
+	ec        *ErrorCaptureCollector
+	collector Collector
+}
+
+func (st *sampleTracker) Process(t akinet.ParsedNetworkTraffic) error {
+	if !st.track(t) {
+		return nil
+	}
+	return st.collector.Process(t)
+}
+
+// Returns whether t should be passed on.
+func (st *sampleTracker) track(t akinet.ParsedNetworkTraffic) bool {
+	ec := st.ec
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	switch c := t.Content.(type) {
+	case akinet.HTTPRequest:
+		key := learn.ToWitnessID(c.StreamID, c.Seq)
+		if _, ok := ec.forced[key]; ok {
+			return false
+		}
+		ec.passed.Add(key, t.ObservationTime, struct{}{})
+	case akinet.HTTPResponse:
+		key := learn.ToWitnessID(c.StreamID, c.Seq)
+		if _, ok := ec.forced[key]; ok {
+			delete(ec.forced, key)
+			return false
+		}
+	}
+	return true
+}
+
+func (st *sampleTracker) Close() error {
+	return st.collector.Close()
+}
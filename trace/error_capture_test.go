@@ -0,0 +1,105 @@
+package trace
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+func TestErrorCaptureCollector(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	options := ErrorCaptureOptions{
+		StatusCodes:      []int{429},
+		LatencyThreshold: time.Second,
+	}
+
+	call := func(col Collector, at time.Time, status int, latency time.Duration) uuid.UUID {
+		return errorCaptureCall(t, col, at, status, latency)
+	}
+
+	// A sample that drops everything.
+	sink := &recordingCollector{}
+	col := NewErrorCaptureCollector(options, sink, func(c Collector) Collector {
+		return NewSamplingCollector(0, c)
+	})
+	call(col, start, 200, time.Millisecond)
+	call(col, start, 400, time.Millisecond)
+	failed := call(col, start, 503, time.Millisecond)
+	throttled := call(col, start, 429, time.Millisecond)
+	slow := call(col, start, 200, 2*time.Second)
+	assert.Equal(t, []uuid.UUID{failed, throttled, slow}, pairedCalls(t, sink.traffic))
+
+	// A sample that keeps everything: nothing is captured twice.
+	sink = &recordingCollector{}
+	col = NewErrorCaptureCollector(options, sink, func(c Collector) Collector {
+		return NewSamplingCollector(1.0, c)
+	})
+	ok := call(col, start, 200, time.Millisecond)
+	failed = call(col, start, 503, time.Millisecond)
+	assert.Equal(t, []uuid.UUID{ok, failed}, pairedCalls(t, sink.traffic))
+	assert.Zero(t, col.held.Len(), "requests the sample passed on aren't copied")
+
+	// A sample that passes calls on later: a slow call that the sample holds
+	// is captured right away, and not again when the sample passes it on.
+	sink = &recordingCollector{}
+	col = NewErrorCaptureCollector(options, sink, func(c Collector) Collector {
+		return NewStratifiedSamplingCollector(StratifiedSamplingOptions{
+			MinPerEndpoint: 1,
+			ReservoirSize:  10,
+			Window:         time.Minute,
+		}, c)
+	})
+	first := call(col, start, 200, time.Millisecond)
+	held := call(col, start, 200, time.Millisecond)
+	slow = call(col, start, 200, 2*time.Second)
+	assert.Equal(t, []uuid.UUID{first, slow}, pairedCalls(t, sink.traffic))
+	require.NoError(t, col.Close())
+	assert.Equal(t, []uuid.UUID{first, slow, held}, pairedCalls(t, sink.traffic))
+}
+
+func TestErrorCaptureLimits(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	dropAll := func(c Collector) Collector {
+		return NewSamplingCollector(0, c)
+	}
+
+	// At most MaxPerMinute calls are captured around the sample each minute.
+	sink := &recordingCollector{}
+	col := NewErrorCaptureCollector(ErrorCaptureOptions{MaxPerMinute: 2}, sink, dropAll)
+	first := errorCaptureCall(t, col, start, 503, time.Millisecond)
+	second := errorCaptureCall(t, col, start.Add(time.Second), 500, time.Millisecond)
+	errorCaptureCall(t, col, start.Add(2*time.Second), 500, time.Millisecond)
+	later := errorCaptureCall(t, col, start.Add(time.Minute), 500, time.Millisecond)
+	assert.Equal(t, []uuid.UUID{first, second, later}, pairedCalls(t, sink.traffic))
+
+	// None are captured while the back end has asked us to wait.
+	rateLimit := NewRateLimit(100.0)
+	defer rateLimit.Stop()
+	rateLimit.UploadThrottled(time.Hour)
+
+	sink = &recordingCollector{}
+	col = NewErrorCaptureCollector(ErrorCaptureOptions{MaxPerMinute: 2, RateLimit: rateLimit}, sink, dropAll)
+	errorCaptureCall(t, col, start, 503, time.Millisecond)
+	assert.Empty(t, sink.traffic)
+}
+
+// Sends a call, and returns its stream ID.
+func errorCaptureCall(t *testing.T, col Collector, at time.Time, status int, latency time.Duration) uuid.UUID {
+	streamID := uuid.New()
+	require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+		Content:         akinet.HTTPRequest{StreamID: streamID, Method: "GET", Host: "api.internal", URL: &url.URL{Path: "/orders"}},
+		ObservationTime: at,
+		FinalPacketTime: at,
+	}))
+	require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+		Content:         akinet.HTTPResponse{StreamID: streamID, StatusCode: status},
+		ObservationTime: at.Add(latency),
+	}))
+	return streamID
+}
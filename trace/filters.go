@@ -2,77 +2,161 @@ package trace
 
 import (
 	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
 
 	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pending"
 	"github.com/akitasoftware/akita-libs/akid"
 	"github.com/akitasoftware/akita-libs/akinet"
 	"github.com/akitasoftware/akita-libs/trackers"
 )
 
-// Filters out HTTP paths.
-// TODO: compile the N regular expressions into one for efficiency.
-func NewHTTPPathFilterCollector(matchers []*regexp.Regexp, col Collector) Collector {
-	return &genericRequestFilter{
-		Collector: col,
-		filterFunc: func(r akinet.HTTPRequest) bool {
-			if r.URL != nil {
-				for _, m := range matchers {
-					if m.MatchString(r.URL.Path) {
-						return false
-					}
-				}
-			}
-			return true
-		},
+const (
+	// Rule prefixes for globs and literal prefixes. Rules without one of these
+	// are regular expressions.
+	globRulePrefix   = "glob:"
+	prefixRulePrefix = "prefix:"
+)
+
+// Rules for which HTTP requests are captured, by host and path. Each rule is a
+// regular expression, or, if it starts with "glob:" or "prefix:", a glob or a
+// literal prefix. In a glob, "*" and "?" match any characters other than "/",
+// and "**" matches any characters.
+type HTTPRequestFilterOptions struct {
+	// Requests matching any of these are dropped.
+	HostExclusions []string
+	PathExclusions []string
+
+	// If non-empty, only requests matching one of these are captured.
+	HostAllowlist []string
+	PathAllowlist []string
+}
+
+// Decides which HTTP requests are captured. The rules of each kind are
+// compiled into a single regular expression, so that each request is matched
+// once per kind, however many rules there are.
+//
+// A filter is safe to share between collectors.
+type HTTPRequestFilter struct {
+	hostExclusions *regexp.Regexp
+	pathExclusions *regexp.Regexp
+	hostAllowlist  *regexp.Regexp
+	pathAllowlist  *regexp.Regexp
+}
+
+// Returns nil if options has no rules.
+func NewHTTPRequestFilter(options HTTPRequestFilterOptions) (*HTTPRequestFilter, error) {
+	var f HTTPRequestFilter
+	for _, rules := range []struct {
+		rules  []string
+		name   string
+		target **regexp.Regexp
+	}{
+		{options.HostExclusions, "host exclusion", &f.hostExclusions},
+		{options.PathExclusions, "path exclusion", &f.pathExclusions},
+		{options.HostAllowlist, "host filter", &f.hostAllowlist},
+		{options.PathAllowlist, "path filter", &f.pathAllowlist},
+	} {
+		r, err := compileRules(rules.rules, rules.name)
+		if err != nil {
+			return nil, err
+		}
+		*rules.target = r
+	}
+
+	if f == (HTTPRequestFilter{}) {
+		return nil, nil
 	}
+	return &f, nil
 }
 
-// Filter out matching HTTP hosts
-func NewHTTPHostFilterCollector(matchers []*regexp.Regexp, col Collector) Collector {
-	return &genericRequestFilter{
-		Collector: col,
-		filterFunc: func(r akinet.HTTPRequest) bool {
-			for _, m := range matchers {
-				if m.MatchString(r.Host) {
-					return false
-				}
-			}
-			return true
-		},
+// Returns whether r should be captured.
+func (f *HTTPRequestFilter) Allows(r akinet.HTTPRequest) bool {
+	path, hasPath := "", r.URL != nil
+	if hasPath {
+		path = r.URL.Path
 	}
+
+	if f.hostExclusions != nil && f.hostExclusions.MatchString(r.Host) {
+		return false
+	}
+	if f.pathExclusions != nil && hasPath && f.pathExclusions.MatchString(path) {
+		return false
+	}
+	if f.hostAllowlist != nil && !f.hostAllowlist.MatchString(r.Host) {
+		return false
+	}
+	if f.pathAllowlist != nil && !(hasPath && f.pathAllowlist.MatchString(path)) {
+		return false
+	}
+	return true
 }
 
-// Allows only matching paths
-// TODO: compile the N regular expressions into one for efficiency.
-func NewHTTPPathAllowlistCollector(matchers []*regexp.Regexp, col Collector) Collector {
+// Drops HTTP requests that f doesn't allow, along with their responses.
+func (f *HTTPRequestFilter) NewCollector(col Collector) Collector {
 	return &genericRequestFilter{
-		Collector: col,
-		filterFunc: func(r akinet.HTTPRequest) bool {
-			if r.URL != nil {
-				for _, m := range matchers {
-					if m.MatchString(r.URL.Path) {
-						return true
-					}
-				}
+		Collector:  col,
+		filterFunc: f.Allows,
+	}
+}
+
+// Compiles rules into a single regular expression, or nil if there are none.
+func compileRules(rules []string, name string) (*regexp.Regexp, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	alternatives := make([]string, len(rules))
+	for i, rule := range rules {
+		var expr string
+		switch {
+		case strings.HasPrefix(rule, globRulePrefix):
+			expr = globToRegexp(strings.TrimPrefix(rule, globRulePrefix))
+		case strings.HasPrefix(rule, prefixRulePrefix):
+			expr = "^" + regexp.QuoteMeta(strings.TrimPrefix(rule, prefixRulePrefix))
+		default:
+			// Compile each regular expression separately, so that errors name the
+			// offending rule.
+			if _, err := regexp.Compile(rule); err != nil {
+				return nil, errors.Wrapf(err, "failed to compile %s %q", name, rule)
 			}
-			return false
-		},
+			expr = rule
+		}
+
+		// The group keeps flags such as (?i) from applying to other rules.
+		alternatives[i] = "(?:" + expr + ")"
+	}
+
+	r, err := regexp.Compile(strings.Join(alternatives, "|"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compile %s rules", name)
 	}
+	return r, nil
 }
 
-// Allows only matching hosts
-func NewHTTPHostAllowlistCollector(matchers []*regexp.Regexp, col Collector) Collector {
-	return &genericRequestFilter{
-		Collector: col,
-		filterFunc: func(r akinet.HTTPRequest) bool {
-			for _, m := range matchers {
-				if m.MatchString(r.Host) {
-					return true
-				}
+// Converts a glob into an anchored regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
 			}
-			return false
-		},
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
 	}
+	b.WriteString("$")
+	return b.String()
 }
 
 // Filters out third-party trackers.
@@ -97,12 +181,15 @@ type genericRequestFilter struct {
 	filterFunc func(akinet.HTTPRequest) bool
 
 	// Records witness IDs of filtered requests so we can filter out the
-	// corresponding responses.
+	// corresponding responses. IDs are forgotten once their response is seen,
+	// or as described in pending.Calls: when they expire, or, if too many
+	// responses are outstanding, oldest first, so that the newest filtered
+	// requests are always recorded.
 	// NOTE: we're assuming that we always see the request before the
 	// corresponding response, which should be generally true, with the exception
 	// of observing a response without request due to packet capture starting
 	// mid-connection.
-	filteredIDs map[akid.WitnessID]struct{}
+	filteredIDs pending.Calls[akid.WitnessID, struct{}]
 }
 
 func (fc *genericRequestFilter) Process(t akinet.ParsedNetworkTraffic) error {
@@ -112,13 +199,10 @@ func (fc *genericRequestFilter) Process(t akinet.ParsedNetworkTraffic) error {
 		if fc.filterFunc != nil && !fc.filterFunc(c) {
 			include = false
 
-			if fc.filteredIDs == nil {
-				fc.filteredIDs = map[akid.WitnessID]struct{}{}
-			}
-			fc.filteredIDs[learn.ToWitnessID(c.StreamID, c.Seq)] = struct{}{}
+			fc.filteredIDs.Add(learn.ToWitnessID(c.StreamID, c.Seq), t.ObservationTime, struct{}{})
 		}
 	case akinet.HTTPResponse:
-		if _, ok := fc.filteredIDs[learn.ToWitnessID(c.StreamID, c.Seq)]; ok {
+		if _, ok := fc.filteredIDs.Take(learn.ToWitnessID(c.StreamID, c.Seq)); ok {
 			include = false
 		}
 	}
@@ -0,0 +1,124 @@
+package trace
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+func TestHTTPRequestFilter(t *testing.T) {
+	f, err := NewHTTPRequestFilter(HTTPRequestFilterOptions{
+		HostExclusions: []string{`(?i)^INTERNAL\.`, "glob:*.health.example.com"},
+		PathExclusions: []string{"^/metrics$", "prefix:/debug/", "glob:/static/**.js"},
+		HostAllowlist:  []string{"example\\.com$"},
+		PathAllowlist:  []string{"glob:/v?/*", "prefix:/static/", "prefix:/debug/"},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, f)
+
+	request := func(host, path string) akinet.HTTPRequest {
+		return akinet.HTTPRequest{Host: host, URL: &url.URL{Path: path}}
+	}
+	testCases := []struct {
+		host, path string
+		expected   bool
+	}{
+		{"api.example.com", "/v1/users", true},
+		{"api.example.com", "/v1/users/1", false},
+		{"api.example.com", "/v10/users", false},
+		{"internal.example.com", "/v1/users", false},
+		{"a.b.health.example.com", "/v1/users", false},
+		{"api.example.org", "/v1/users", false},
+		{"api.example.com", "/metrics", false},
+		{"api.example.com", "/debug/pprof", false},
+		{"api.example.com", "/static/js/app.js", false},
+		{"api.example.com", "/static/css/app.css", true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, f.Allows(request(tc.host, tc.path)), "%s%s", tc.host, tc.path)
+	}
+
+	// Requests without a URL match no path rules.
+	assert.False(t, f.Allows(akinet.HTTPRequest{Host: "api.example.com"}))
+
+	f, err = NewHTTPRequestFilter(HTTPRequestFilterOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	_, err = NewHTTPRequestFilter(HTTPRequestFilterOptions{PathExclusions: []string{"prefix:(", "("}})
+	assert.ErrorContains(t, err, `path exclusion "("`)
+}
+
+func TestHTTPRequestFilterCollector(t *testing.T) {
+	f, err := NewHTTPRequestFilter(HTTPRequestFilterOptions{PathExclusions: []string{"prefix:/health"}})
+	require.NoError(t, err)
+
+	sink := &recordingCollector{}
+	col := f.NewCollector(sink).(*genericRequestFilter)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	call := func(path string, requestTime, responseTime time.Time) {
+		streamID := uuid.New()
+		assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			Content:         akinet.HTTPRequest{StreamID: streamID, URL: &url.URL{Path: path}},
+			ObservationTime: requestTime,
+		}))
+		if !responseTime.IsZero() {
+			assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+				Content:         akinet.HTTPResponse{StreamID: streamID, StatusCode: 200},
+				ObservationTime: responseTime,
+			}))
+		}
+	}
+
+	call("/health", start, start.Add(time.Millisecond))
+	call("/users", start, start.Add(time.Millisecond))
+	assert.Len(t, sink.traffic, 2)
+	assert.Zero(t, col.filteredIDs.Len(), "IDs are forgotten once their responses are seen")
+
+	// Requests whose responses are never seen are forgotten after a while.
+	call("/health", start, time.Time{})
+	assert.Equal(t, 1, col.filteredIDs.Len())
+	call("/health", start.Add(2*pending.Expiration), time.Time{})
+	assert.Equal(t, 1, col.filteredIDs.Len())
+}
+
+func TestHTTPRequestFilterCollectorWhenFull(t *testing.T) {
+	f, err := NewHTTPRequestFilter(HTTPRequestFilterOptions{PathExclusions: []string{"prefix:/health"}})
+	require.NoError(t, err)
+
+	sink := &recordingCollector{}
+	col := f.NewCollector(sink).(*genericRequestFilter)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	request := func() uuid.UUID {
+		streamID := uuid.New()
+		assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			Content:         akinet.HTTPRequest{StreamID: streamID, URL: &url.URL{Path: "/health"}},
+			ObservationTime: start,
+		}))
+		return streamID
+	}
+
+	// Fill the filtered IDs with requests whose responses are outstanding. A
+	// further filtered request is still recorded, so its response is dropped.
+	for i := 0; i < pending.MaxCalls; i++ {
+		request()
+	}
+	streamID := request()
+	assert.Equal(t, pending.MaxCalls, col.filteredIDs.Len())
+
+	assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+		Content:         akinet.HTTPResponse{StreamID: streamID, StatusCode: 200},
+		ObservationTime: start,
+	}))
+	assert.Empty(t, sink.traffic)
+}
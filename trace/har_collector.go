@@ -1,95 +1,390 @@
 package trace
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/google/martian/v3/har"
-	"github.com/pkg/errors"
 
 	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/redact"
 	"github.com/akitasoftware/akita-cli/version"
 	"github.com/akitasoftware/akita-libs/akid"
 	"github.com/akitasoftware/akita-libs/akinet"
 	"github.com/akitasoftware/akita-libs/tags"
 )
 
+const (
+	// How often completed HAR entries are written out to disk.
+	harFlushInterval = 5 * time.Second
+)
+
+// Limits at which the HAR collector closes the current file and starts a new
+// one. A zero value disables the corresponding limit. If all limits are
+// disabled, a single file is written.
+type HARRotationOptions struct {
+	MaxEntries    int
+	MaxSize_bytes int64
+	MaxAge        time.Duration
+}
+
+func (o HARRotationOptions) enabled() bool {
+	return o.MaxEntries > 0 || o.MaxSize_bytes > 0 || o.MaxAge > 0
+}
+
+// Writes completed requests and responses to HAR files in outDir. Entries are
+// streamed to disk periodically rather than buffered until Close, and files
+// are rotated according to the given HARRotationOptions.
+//
+// Requests and responses are paired by witness ID, as in BackendCollector.
+// Halves that remain unpaired for longer than pairCacheExpiration, measured in
+// capture time, are written out as orphaned entries.
 type HARCollector struct {
-	logger        *har.Logger
 	interfaceName string
 	outDir        string
+	rotation      HARRotationOptions
 
 	tags map[tags.Key]string
+
+	// Applied to each request and response before it is written. May be nil.
+	redactor *redact.Redactor
+
+	// Channel controlling periodic flushes, and the goroutine doing them.
+	flushDone chan struct{}
+	flushWG   sync.WaitGroup
+
+	// Protects pairCache and completed.
+	pairMutex sync.Mutex
+
+	// Un-paired requests and responses, by witness ID.
+	pairCache map[akid.WitnessID]*partialHAREntry
+
+	// Unpaired halves expire by capture time, which differs from the wall
+	// clock when replaying pcap files.
+	clock captureClock
+
+	// Entries ready to be written out.
+	completed []*harEntry
+
+	// Protects the fields below.
+	mutex sync.Mutex
+
+	// The file currently being written, if any. Files are created lazily so
+	// that we don't leave empty files behind.
+	current *harFileWriter
+
+	// Number of files created so far.
+	numFiles int
+}
+
+// One half of a HAR entry, waiting for its pair.
+type partialHAREntry struct {
+	id              akid.WitnessID
+	observationTime time.Time
+
+	request      *har.Request
+	requestStart time.Time
+	requestEnd   time.Time
+
+	response      *har.Response
+	responseStart time.Time
+	responseEnd   time.Time
 }
 
-func NewHARCollector(interfaceName, outDir string, tags map[tags.Key]string) *HARCollector {
-	return &HARCollector{
-		logger:        har.NewLogger(),
+func NewHARCollector(interfaceName, outDir string, tags map[tags.Key]string, rotation HARRotationOptions, redactor *redact.Redactor) *HARCollector {
+	h := &HARCollector{
 		interfaceName: interfaceName,
 		outDir:        outDir,
+		rotation:      rotation,
 		tags:          tags,
+		redactor:      redactor,
+		flushDone:     make(chan struct{}),
+		pairCache:     make(map[akid.WitnessID]*partialHAREntry),
 	}
+	h.flushWG.Add(1)
+	go h.periodicFlush()
+	return h
 }
 
 func (h *HARCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	partial := &partialHAREntry{
+		observationTime: t.ObservationTime,
+	}
+
 	switch c := t.Content.(type) {
 	case akinet.HTTPRequest:
-		id := learn.ToWitnessID(c.StreamID, c.Seq)
-		h.logger.RecordRequestWithTimestamps(akid.String(id), c.ToStdRequest(),
-			&har.MessageTimestamps{
-				StartTime: t.ObservationTime,
-				EndTime:   t.FinalPacketTime,
-			},
-		)
+		req, err := har.NewRequest(c.ToStdRequest(), true)
+		if err != nil {
+			printer.Debugf("Failed to convert HTTP request to HAR, skipping: %v\n", err)
+			return nil
+		}
+		h.redactor.RedactHARRequest(req)
+		partial.id = learn.ToWitnessID(c.StreamID, c.Seq)
+		partial.request = req
+		partial.requestStart = t.ObservationTime
+		partial.requestEnd = t.FinalPacketTime
 	case akinet.HTTPResponse:
-		id := learn.ToWitnessID(c.StreamID, c.Seq)
-		h.logger.RecordResponseWithTimestamps(akid.String(id), c.ToStdResponse(),
-			&har.MessageTimestamps{
-				StartTime: t.ObservationTime,
-				EndTime:   t.FinalPacketTime,
-			},
-		)
+		resp, err := har.NewResponse(c.ToStdResponse(), true)
+		if err != nil {
+			printer.Debugf("Failed to convert HTTP response to HAR, skipping: %v\n", err)
+			return nil
+		}
+		h.redactor.RedactHARResponse(resp)
+		partial.id = learn.ToWitnessID(c.StreamID, c.Seq)
+		partial.response = resp
+		partial.responseStart = t.ObservationTime
+		partial.responseEnd = t.FinalPacketTime
+	default:
+		return nil
+	}
+
+	h.clock.observe(t.ObservationTime)
+
+	h.pairMutex.Lock()
+	defer h.pairMutex.Unlock()
+
+	if pair, ok := h.pairCache[partial.id]; ok {
+		delete(h.pairCache, partial.id)
+		pair.merge(partial)
+		h.completed = append(h.completed, pair.toEntry())
+	} else {
+		h.pairCache[partial.id] = partial
 	}
 	return nil
 }
 
-// TODO: output HAR files periodically instead of buffering everything in
-// memory.
 func (h *HARCollector) Close() error {
-	harContent := h.logger.ExportAndReset()
+	// Wait for any periodic flush in progress, so that it can't open a new
+	// file after the last one is closed.
+	close(h.flushDone)
+	h.flushWG.Wait()
 
-	// Record AkitaExtension
-	harContent.AkitaExt = har.AkitaExtension{
-		Outbound: false,
-		Tags:     h.tags,
+	// Anything still unpaired at this point will never be paired.
+	h.expirePairCache(time.Now())
+
+	if err := h.flush(time.Now()); err != nil {
+		return err
 	}
 
-	if log := harContent.Log; log != nil {
-		if len(log.Entries) == 0 {
-			// No need to write an empty file.
-			return nil
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.closeCurrentFile()
+}
+
+// Moves requests and responses first observed before cutoffTime out of the
+// pair cache and queues them to be written as orphans.
+func (h *HARCollector) expirePairCache(cutoffTime time.Time) {
+	h.pairMutex.Lock()
+	defer h.pairMutex.Unlock()
+
+	for id, partial := range h.pairCache {
+		if partial.observationTime.Before(cutoffTime) {
+			h.completed = append(h.completed, partial.toEntry())
+			delete(h.pairCache, id)
 		}
+	}
+}
+
+func (h *HARCollector) takeCompleted() []*harEntry {
+	h.pairMutex.Lock()
+	defer h.pairMutex.Unlock()
+
+	result := h.completed
+	h.completed = nil
+	return result
+}
+
+func (h *HARCollector) periodicFlush() {
+	defer h.flushWG.Done()
 
-		// Customize the creator info.
-		log.Creator = &har.Creator{
-			Name:    "Akita SuperLearn (https://akitasoftware.com)",
-			Version: version.CLIDisplayString(),
+	ticker := time.NewTicker(harFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			h.expirePairCache(h.clock.now().Add(-1 * pairCacheExpiration))
+			if err := h.flush(now); err != nil {
+				printer.Warningf("Failed to write HAR entries: %v\n", err)
+			}
+		case <-h.flushDone:
+			return
 		}
-	} else {
-		// No need to write an empty file.
-		return nil
 	}
+}
+
+// Writes out all completed and orphaned entries, rotating to a new file as
+// needed.
+func (h *HARCollector) flush(now time.Time) error {
+	entries := h.takeCompleted()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
-	harBytes, err := json.Marshal(harContent)
+	// Rotate on age even if there's nothing new to write, so that files
+	// don't stay open indefinitely during quiet periods.
+	if h.current != nil && h.shouldRotate(now) {
+		if err := h.closeCurrentFile(); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if h.current != nil && h.shouldRotate(now) {
+			if err := h.closeCurrentFile(); err != nil {
+				return err
+			}
+		}
+
+		if h.current == nil {
+			if err := h.openNewFile(now); err != nil {
+				return err
+			}
+		}
+
+		if err := h.current.writeEntry(e); err != nil {
+			return err
+		}
+	}
+
+	if h.current != nil {
+		return h.current.flush()
+	}
+	return nil
+}
+
+// Should be called with h.mutex held.
+func (h *HARCollector) shouldRotate(now time.Time) bool {
+	if !h.rotation.enabled() {
+		return false
+	}
+
+	c := h.current
+	if h.rotation.MaxEntries > 0 && c.numEntries >= h.rotation.MaxEntries {
+		return true
+	}
+	if h.rotation.MaxSize_bytes > 0 && c.size_bytes >= h.rotation.MaxSize_bytes {
+		return true
+	}
+	if h.rotation.MaxAge > 0 && now.Sub(c.openedAt) >= h.rotation.MaxAge {
+		return true
+	}
+	return false
+}
+
+// Should be called with h.mutex held.
+func (h *HARCollector) openNewFile(now time.Time) error {
+	// Without rotation, keep the historical file name.
+	fileName := fmt.Sprintf("akita_%s.har", h.interfaceName)
+	if h.rotation.enabled() {
+		fileName = fmt.Sprintf("akita_%s_%04d_%s.har", h.interfaceName, h.numFiles, now.UTC().Format("20060102T150405Z"))
+	}
+
+	creator := &har.Creator{
+		Name:    "Akita SuperLearn (https://akitasoftware.com)",
+		Version: version.CLIDisplayString(),
+	}
+	akitaExt := har.AkitaExtension{
+		Outbound: false,
+		Tags:     h.tags,
+	}
+
+	hw, err := newHARFileWriter(path.Join(h.outDir, fileName), creator, akitaExt, now)
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal HAR to JSON")
+		return err
+	}
+	h.current = hw
+	h.numFiles += 1
+	return nil
+}
+
+// Should be called with h.mutex held.
+func (h *HARCollector) closeCurrentFile() error {
+	if h.current == nil {
+		return nil
 	}
 
-	outPath := path.Join(h.outDir, fmt.Sprintf("akita_%s.har", h.interfaceName))
-	if err := ioutil.WriteFile(outPath, harBytes, 0644); err != nil {
-		return errors.Wrap(err, "failed to write HAR file")
+	hw := h.current
+	h.current = nil
+	if err := hw.close(); err != nil {
+		return err
 	}
+	printer.Debugf("Wrote %d HAR entries to %s\n", hw.numEntries, hw.path)
 	return nil
 }
+
+// Fills in whichever half of the entry is missing from other.
+func (p *partialHAREntry) merge(other *partialHAREntry) {
+	if p.request == nil {
+		p.request = other.request
+		p.requestStart = other.requestStart
+		p.requestEnd = other.requestEnd
+	}
+	if p.response == nil {
+		p.response = other.response
+		p.responseStart = other.responseStart
+		p.responseEnd = other.responseEnd
+	}
+}
+
+func (p *partialHAREntry) toEntry() *harEntry {
+	e := &harEntry{
+		Entry: &har.Entry{
+			ID:       akid.String(p.id),
+			Request:  p.request,
+			Response: p.response,
+			Cache:    &har.Cache{},
+		},
+		Timings: &harTimings{},
+	}
+
+	switch {
+	case p.request == nil:
+		e.Orphaned = true
+		e.Comment = "No matching request was observed."
+		e.Request = &har.Request{
+			Cookies:     []har.Cookie{},
+			Headers:     []har.Header{},
+			QueryString: []har.QueryString{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+		e.StartedDateTime = p.responseStart
+		e.Timings.Receive = millisBetween(p.responseStart, p.responseEnd)
+	case p.response == nil:
+		e.Orphaned = true
+		e.Comment = "No matching response was observed."
+		e.Response = &har.Response{
+			Cookies:     []har.Cookie{},
+			Headers:     []har.Header{},
+			Content:     &har.Content{MimeType: "x-unknown"},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+		e.StartedDateTime = p.requestStart
+		e.Timings.Send = millisBetween(p.requestStart, p.requestEnd)
+	default:
+		e.StartedDateTime = p.requestStart
+		e.Timings.Send = millisBetween(p.requestStart, p.requestEnd)
+
+		// As in BackendCollector, processing latency is the time from the last
+		// packet of the request to the first packet of the response.
+		e.Timings.Wait = millisBetween(p.requestEnd, p.responseStart)
+		e.Timings.Receive = millisBetween(p.responseStart, p.responseEnd)
+	}
+
+	e.Time = e.Timings.Send + e.Timings.Wait + e.Timings.Receive
+	return e
+}
+
+// HAR timings are non-negative durations in milliseconds. Missing timestamps
+// are treated as a zero duration.
+func millisBetween(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return float64(end.Sub(start).Microseconds()) / 1000.0
+}
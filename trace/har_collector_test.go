@@ -0,0 +1,227 @@
+package trace
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+)
+
+func testHARRequest(streamID uuid.UUID, seq int, start, end time.Time) akinet.ParsedNetworkTraffic {
+	return akinet.ParsedNetworkTraffic{
+		ObservationTime: start,
+		FinalPacketTime: end,
+		Content: akinet.HTTPRequest{
+			StreamID:   streamID,
+			Seq:        seq,
+			Method:     "GET",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			URL: &url.URL{
+				Path: "/v1/doggos",
+			},
+			Host: "example.com",
+		},
+	}
+}
+
+func testHARResponse(streamID uuid.UUID, seq int, start, end time.Time) akinet.ParsedNetworkTraffic {
+	return akinet.ParsedNetworkTraffic{
+		ObservationTime: start,
+		FinalPacketTime: end,
+		Content: akinet.HTTPResponse{
+			StreamID:   streamID,
+			Seq:        seq,
+			StatusCode: 200,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: map[string][]string{
+				"Content-Type": {"application/json"},
+			},
+			Body: memview.New([]byte(`{"name": "prince"}`)),
+		},
+	}
+}
+
+func recordTestEntry(t *testing.T, h *HARCollector, seq int) {
+	streamID := uuid.New()
+	now := time.Now()
+	assert.NoError(t, h.Process(testHARRequest(streamID, seq, now, now)))
+	assert.NoError(t, h.Process(testHARResponse(streamID, seq, now, now)))
+}
+
+// Entries are decoded generically so that Akita-specific annotations are
+// visible.
+type testHAR struct {
+	Log struct {
+		Entries []map[string]interface{} `json:"entries"`
+	} `json:"log"`
+}
+
+// Reads the HAR files in dir, keyed by file name.
+func readHARFiles(t *testing.T, dir string) map[string]*testHAR {
+	files, err := filepath.Glob(filepath.Join(dir, "*.har"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(map[string]*testHAR, len(files))
+	for _, f := range files {
+		bs, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h testHAR
+		if err := json.Unmarshal(bs, &h); err != nil {
+			t.Fatalf("%s is not valid JSON: %v", f, err)
+		}
+		result[filepath.Base(f)] = &h
+	}
+	return result
+}
+
+func TestHARCollectorSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHARCollector("lo", dir, nil, HARRotationOptions{}, nil)
+
+	recordTestEntry(t, h, 1)
+	assert.NoError(t, h.flush(time.Now()))
+	recordTestEntry(t, h, 2)
+	assert.NoError(t, h.Close())
+
+	hars := readHARFiles(t, dir)
+	if assert.Contains(t, hars, "akita_lo.har") {
+		assert.Len(t, hars["akita_lo.har"].Log.Entries, 2)
+	}
+}
+
+func TestHARCollectorReplacesExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	for run := 1; run <= 2; run++ {
+		h := NewHARCollector("lo", dir, nil, HARRotationOptions{}, nil)
+		recordTestEntry(t, h, run)
+		assert.NoError(t, h.Close())
+	}
+
+	hars := readHARFiles(t, dir)
+	if assert.Contains(t, hars, "akita_lo.har") {
+		assert.Len(t, hars["akita_lo.har"].Log.Entries, 1)
+	}
+}
+
+func TestHARCollectorRotateByEntries(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHARCollector("lo", dir, nil, HARRotationOptions{MaxEntries: 2}, nil)
+
+	for seq := 1; seq <= 5; seq++ {
+		recordTestEntry(t, h, seq)
+	}
+	assert.NoError(t, h.Close())
+
+	hars := readHARFiles(t, dir)
+	assert.Len(t, hars, 3)
+
+	total := 0
+	for _, h := range hars {
+		assert.LessOrEqual(t, len(h.Log.Entries), 2)
+		total += len(h.Log.Entries)
+	}
+	assert.Equal(t, 5, total)
+}
+
+func TestHARCollectorRotateByAge(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHARCollector("lo", dir, nil, HARRotationOptions{MaxAge: time.Minute}, nil)
+
+	start := time.Now()
+	recordTestEntry(t, h, 1)
+	assert.NoError(t, h.flush(start))
+	recordTestEntry(t, h, 2)
+	assert.NoError(t, h.flush(start.Add(2*time.Minute)))
+	assert.NoError(t, h.Close())
+
+	assert.Len(t, readHARFiles(t, dir), 2)
+}
+
+func TestHARCollectorPairing(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHARCollector("lo", dir, nil, HARRotationOptions{}, nil)
+
+	streamID := uuid.New()
+	start := time.Now()
+
+	// Response arrives before the request.
+	assert.NoError(t, h.Process(testHARResponse(streamID, 1, start.Add(250*time.Millisecond), start.Add(300*time.Millisecond))))
+	assert.NoError(t, h.Process(testHARRequest(streamID, 1, start, start.Add(10*time.Millisecond))))
+
+	// Request with no response.
+	assert.NoError(t, h.Process(testHARRequest(streamID, 2, start, start)))
+	assert.NoError(t, h.Close())
+
+	hars := readHARFiles(t, dir)
+	if !assert.Contains(t, hars, "akita_lo.har") {
+		return
+	}
+	entries := hars["akita_lo.har"].Log.Entries
+	if !assert.Len(t, entries, 2) {
+		return
+	}
+
+	paired, orphan := entries[0], entries[1]
+	if _, ok := paired["_orphaned"]; ok {
+		paired, orphan = orphan, paired
+	}
+
+	timings := paired["timings"].(map[string]interface{})
+	assert.Equal(t, 10.0, timings["send"])
+	assert.Equal(t, 240.0, timings["wait"])
+	assert.Equal(t, 50.0, timings["receive"])
+	assert.NotContains(t, paired, "_orphaned")
+
+	assert.Equal(t, true, orphan["_orphaned"])
+	assert.Equal(t, 0.0, orphan["response"].(map[string]interface{})["status"])
+}
+
+// Requests from a replayed capture are paired with their responses, however
+// long ago they were captured.
+func TestHARCollectorReplayedTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHARCollector("lo", dir, nil, HARRotationOptions{}, nil)
+
+	streamID := uuid.New()
+	captured := time.Date(2020, 4, 17, 3, 45, 6, 0, time.UTC)
+
+	assert.NoError(t, h.Process(testHARRequest(streamID, 1, captured, captured)))
+	assert.NoError(t, h.Process(testHARRequest(streamID, 2, captured, captured)))
+	h.expirePairCache(h.clock.now().Add(-1 * pairCacheExpiration))
+	assert.Len(t, h.pairCache, 2, "requests captured years ago are still awaiting their responses")
+
+	// The response to the first request arrives, and the capture moves on past
+	// the expiry of the second.
+	assert.NoError(t, h.Process(testHARResponse(streamID, 1, captured.Add(time.Second), captured.Add(time.Second))))
+	assert.NoError(t, h.Process(testHARRequest(streamID, 3, captured.Add(2*pairCacheExpiration), captured.Add(2*pairCacheExpiration))))
+	h.expirePairCache(h.clock.now().Add(-1 * pairCacheExpiration))
+	assert.Len(t, h.pairCache, 1)
+	assert.NoError(t, h.Close())
+
+	hars := readHARFiles(t, dir)
+	if !assert.Contains(t, hars, "akita_lo.har") {
+		return
+	}
+	orphans := 0
+	for _, e := range hars["akita_lo.har"].Log.Entries {
+		if _, ok := e["_orphaned"]; ok {
+			orphans++
+		}
+	}
+	assert.Equal(t, 2, orphans)
+	assert.Len(t, hars["akita_lo.har"].Log.Entries, 3)
+}
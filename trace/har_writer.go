@@ -0,0 +1,151 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/google/martian/v3/har"
+	"github.com/pkg/errors"
+)
+
+// A HAR entry with Akita-specific annotations.
+type harEntry struct {
+	*har.Entry
+
+	// These shadow the corresponding fields in har.Entry, so that timings are
+	// recorded with sub-millisecond precision.
+	Time    float64     `json:"time"`
+	Timings *harTimings `json:"timings"`
+
+	// Free-form comment, as allowed by the HAR spec.
+	Comment string `json:"comment,omitempty"`
+
+	// Set when the request or response could not be paired before the pairing
+	// timeout. The missing half is filled in with placeholder values.
+	Orphaned bool `json:"_orphaned,omitempty"`
+}
+
+// Durations in milliseconds.
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Writes a HAR file incrementally, one entry at a time, so that entries don't
+// have to be buffered in memory until the capture ends. The file is only valid
+// JSON once close has been called.
+type harFileWriter struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+
+	akitaExt har.AkitaExtension
+
+	openedAt   time.Time
+	numEntries int
+	size_bytes int64
+}
+
+// Creates the file at path, replacing any file already there, e.g. from an
+// earlier run into the same directory.
+func newHARFileWriter(path string, creator *har.Creator, akitaExt har.AkitaExtension, now time.Time) (*harFileWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create HAR file %s", path)
+	}
+
+	hw := &harFileWriter{
+		path:     path,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		akitaExt: akitaExt,
+		openedAt: now,
+	}
+
+	creatorBytes, err := json.Marshal(creator)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to marshal HAR creator to JSON")
+	}
+
+	preamble := []byte(`{"log":{"version":"1.2","creator":`)
+	preamble = append(preamble, creatorBytes...)
+	preamble = append(preamble, []byte(`,"entries":[`)...)
+	if err := hw.writeBytes(preamble); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return hw, nil
+}
+
+func (hw *harFileWriter) write(s string) error {
+	return hw.writeBytes([]byte(s))
+}
+
+func (hw *harFileWriter) writeBytes(bs []byte) error {
+	n, err := hw.w.Write(bs)
+	hw.size_bytes += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write HAR file %s", hw.path)
+	}
+	return nil
+}
+
+func (hw *harFileWriter) writeEntry(e *harEntry) error {
+	entryBytes, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal HAR entry to JSON")
+	}
+
+	if hw.numEntries > 0 {
+		if err := hw.write(","); err != nil {
+			return err
+		}
+	}
+	if err := hw.write("\n"); err != nil {
+		return err
+	}
+	if err := hw.writeBytes(entryBytes); err != nil {
+		return err
+	}
+	hw.numEntries += 1
+	return nil
+}
+
+// Pushes buffered entries out to the file.
+func (hw *harFileWriter) flush() error {
+	if err := hw.w.Flush(); err != nil {
+		return errors.Wrapf(err, "failed to write HAR file %s", hw.path)
+	}
+	return nil
+}
+
+// Writes the end of the HAR document and closes the file.
+func (hw *harFileWriter) close() error {
+	err := hw.writeTrailer()
+	if closeErr := hw.f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "failed to close HAR file %s", hw.path)
+	}
+	return err
+}
+
+func (hw *harFileWriter) writeTrailer() error {
+	extBytes, err := json.Marshal(hw.akitaExt)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal HAR extension to JSON")
+	}
+
+	if err := hw.write("\n]},\"akita_ext\":"); err != nil {
+		return err
+	}
+	if err := hw.writeBytes(extBytes); err != nil {
+		return err
+	}
+	if err := hw.write("}\n"); err != nil {
+		return err
+	}
+	return hw.flush()
+}
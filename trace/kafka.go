@@ -0,0 +1,150 @@
+package trace
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pcap/kafka"
+)
+
+// Whether a client writes to or reads from a Kafka topic.
+type KafkaRole string
+
+const (
+	KafkaProducer KafkaRole = "produce"
+	KafkaConsumer KafkaRole = "consume"
+)
+
+// A client's use of a Kafka topic.
+type KafkaTopicEdge struct {
+	// The client ID that the client sent in its requests, which may be empty.
+	ClientID string
+	ClientIP string
+
+	Topic string
+	Role  KafkaRole
+}
+
+type KafkaTopicCounts struct {
+	// The number of Produce requests or Fetch responses that carried records
+	// for the topic.
+	Messages int
+
+	Records     int
+	RecordBytes int64
+}
+
+func (c *KafkaTopicCounts) Add(other KafkaTopicCounts) {
+	c.Messages += other.Messages
+	c.Records += other.Records
+	c.RecordBytes += other.RecordBytes
+}
+
+type KafkaTopicEdgeCounts struct {
+	KafkaTopicEdge
+	KafkaTopicCounts
+}
+
+// Counts Kafka records produced and consumed, by client and topic.
+//
+// Imposes a hard limit on the number of edges that are individually tracked;
+// traffic on further edges is dropped.
+type KafkaTopicCounter struct {
+	mutex sync.Mutex
+	edges map[KafkaTopicEdge]*KafkaTopicCounts
+}
+
+func NewKafkaTopicCounter() *KafkaTopicCounter {
+	return &KafkaTopicCounter{
+		edges: make(map[KafkaTopicEdge]*KafkaTopicCounts),
+	}
+}
+
+func (c *KafkaTopicCounter) Update(edge KafkaTopicEdge, delta KafkaTopicCounts) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counts, ok := c.edges[edge]
+	if !ok {
+		if len(c.edges) >= maxKeys {
+			return
+		}
+		counts = &KafkaTopicCounts{}
+		c.edges[edge] = counts
+	}
+	counts.Add(delta)
+}
+
+// Returns up to n edges with the most record bytes, largest first.
+func (c *KafkaTopicCounter) Top(n int) []KafkaTopicEdgeCounts {
+	c.mutex.Lock()
+	result := make([]KafkaTopicEdgeCounts, 0, len(c.edges))
+	for edge, counts := range c.edges {
+		result = append(result, KafkaTopicEdgeCounts{edge, *counts})
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RecordBytes != result[j].RecordBytes {
+			return result[i].RecordBytes > result[j].RecordBytes
+		}
+		return result[i].Records > result[j].Records
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// Counts the records in Kafka Produce requests and Fetch responses, to show
+// which clients produce to and consume from which topics. All traffic is
+// passed on to the wrapped collector.
+type KafkaTopicCollector struct {
+	Counter   *KafkaTopicCounter
+	Collector Collector
+}
+
+func (kc *KafkaTopicCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	switch c := t.Content.(type) {
+	case kafka.Request:
+		if c.APIKey == kafka.Produce {
+			kc.update(c.ClientID, t.SrcIP.String(), KafkaProducer, c.Partitions)
+		}
+	case kafka.Response:
+		if c.APIKey == kafka.Fetch {
+			kc.update(c.ClientID, t.DstIP.String(), KafkaConsumer, c.Partitions)
+		}
+	}
+	return kc.Collector.Process(t)
+}
+
+func (kc *KafkaTopicCollector) update(clientID, clientIP string, role KafkaRole, partitions []kafka.PartitionStats) {
+	byTopic := map[string]KafkaTopicCounts{}
+	for _, p := range partitions {
+		counts := byTopic[p.Topic]
+		counts.Records += p.RecordCount
+		counts.RecordBytes += int64(p.RecordBytes)
+		byTopic[p.Topic] = counts
+	}
+
+	for topic, counts := range byTopic {
+		// Fetch responses list every partition the consumer asked about, even
+		// those with nothing new.
+		if counts.Records == 0 {
+			continue
+		}
+		counts.Messages = 1
+		kc.Counter.Update(KafkaTopicEdge{
+			ClientID: clientID,
+			ClientIP: clientIP,
+			Topic:    topic,
+			Role:     role,
+		}, counts)
+	}
+}
+
+func (kc *KafkaTopicCollector) Close() error {
+	return kc.Collector.Close()
+}
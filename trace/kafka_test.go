@@ -0,0 +1,76 @@
+package trace
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pcap/kafka"
+)
+
+func TestKafkaTopicCollector(t *testing.T) {
+	counter := NewKafkaTopicCounter()
+	col := &KafkaTopicCollector{
+		Counter:   counter,
+		Collector: NewDummyCollector(),
+	}
+
+	producer := net.ParseIP("10.0.0.1")
+	consumer := net.ParseIP("10.0.0.2")
+	broker := net.ParseIP("10.0.0.9")
+
+	traffic := []akinet.ParsedNetworkTraffic{
+		{
+			SrcIP: producer,
+			DstIP: broker,
+			Content: kafka.Request{
+				APIKey:   kafka.Produce,
+				ClientID: "billing",
+				Partitions: []kafka.PartitionStats{
+					{Topic: "invoices", Partition: 0, RecordCount: 3, RecordBytes: 300},
+					{Topic: "invoices", Partition: 1, RecordCount: 1, RecordBytes: 100},
+				},
+			},
+		},
+		{
+			SrcIP: broker,
+			DstIP: consumer,
+			Content: kafka.Response{
+				APIKey:   kafka.Fetch,
+				ClientID: "mailer",
+				Partitions: []kafka.PartitionStats{
+					{Topic: "invoices", Partition: 0, RecordCount: 2, RecordBytes: 200},
+					// Nothing new on this topic.
+					{Topic: "refunds", Partition: 0},
+				},
+			},
+		},
+		{
+			// Fetch requests carry no records.
+			SrcIP: consumer,
+			DstIP: broker,
+			Content: kafka.Request{
+				APIKey:     kafka.Fetch,
+				ClientID:   "mailer",
+				Partitions: []kafka.PartitionStats{{Topic: "invoices", Partition: 0}},
+			},
+		},
+	}
+	for _, pnt := range traffic {
+		assert.NoError(t, col.Process(pnt))
+	}
+
+	assert.Equal(t, []KafkaTopicEdgeCounts{
+		{
+			KafkaTopicEdge{ClientID: "billing", ClientIP: "10.0.0.1", Topic: "invoices", Role: KafkaProducer},
+			KafkaTopicCounts{Messages: 1, Records: 4, RecordBytes: 400},
+		},
+		{
+			KafkaTopicEdge{ClientID: "mailer", ClientIP: "10.0.0.2", Topic: "invoices", Role: KafkaConsumer},
+			KafkaTopicCounts{Messages: 1, Records: 2, RecordBytes: 200},
+		},
+	}, counter.Top(10))
+}
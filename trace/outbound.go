@@ -0,0 +1,273 @@
+package trace
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+const (
+	// Maximum length of a path template, as kept in the dependency inventory
+	// and the endpoint statistics.
+	maxPathTemplateLength = 256
+)
+
+// The addresses of the host that the agent runs on. These tell the calls our
+// services make to other services apart from the calls they serve.
+type HostAddrs struct {
+	ips map[string]struct{}
+}
+
+func NewHostAddrs(ips []net.IP) *HostAddrs {
+	h := &HostAddrs{
+		ips: make(map[string]struct{}, len(ips)),
+	}
+	for _, ip := range ips {
+		h.ips[ip.String()] = struct{}{}
+	}
+	return h
+}
+
+// Whether ip is an address of this host. Always false for a nil HostAddrs.
+func (h *HostAddrs) Contains(ip net.IP) bool {
+	if h == nil || ip == nil {
+		return false
+	}
+	_, ok := h.ips[ip.String()]
+	return ok
+}
+
+// Whether the exchange between client and server is a call from this host to
+// another host. Exchanges in which neither end is local, e.g. traffic between
+// other hosts seen in promiscuous mode, are treated as inbound.
+func (h *HostAddrs) IsOutbound(client, server net.IP) bool {
+	return h.Contains(client) && !h.Contains(server)
+}
+
+// Returns the client and server addresses of HTTP traffic, and false for
+// anything else.
+func httpEndpoints(t akinet.ParsedNetworkTraffic) (client, server net.IP, ok bool) {
+	switch t.Content.(type) {
+	case akinet.HTTPRequest:
+		return t.SrcIP, t.DstIP, true
+	case akinet.HTTPResponse:
+		return t.DstIP, t.SrcIP, true
+	}
+	return nil, nil, false
+}
+
+// Passes on only the HTTP requests and responses of outbound calls, dropping
+// everything else. Used for traffic that is captured only to find the calls
+// our services make.
+type OutboundFilterCollector struct {
+	Addrs     *HostAddrs
+	Collector Collector
+}
+
+func (oc *OutboundFilterCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	if client, server, ok := httpEndpoints(t); ok && oc.Addrs.IsOutbound(client, server) {
+		return oc.Collector.Process(t)
+	}
+	return nil
+}
+
+func (oc *OutboundFilterCollector) Close() error {
+	return oc.Collector.Close()
+}
+
+// An endpoint of another service that our services call.
+type Dependency struct {
+	Host   string
+	Method string
+
+	// The request path, with segments that look like identifiers replaced by
+	// "{id}".
+	Path string
+}
+
+type DependencyStats struct {
+	// The number of requests made.
+	Calls int
+
+	// The number of responses with a 4xx or 5xx status code.
+	Errors int
+}
+
+type DependencyWithStats struct {
+	Dependency
+	DependencyStats
+}
+
+// Builds an inventory of the endpoints of other services that our services
+// call.
+//
+// Imposes a hard limit on the number of endpoints that are individually
+// tracked; further endpoints are dropped.
+type DependencyCounter struct {
+	mutex        sync.Mutex
+	dependencies map[Dependency]*DependencyStats
+}
+
+func NewDependencyCounter() *DependencyCounter {
+	return &DependencyCounter{
+		dependencies: make(map[Dependency]*DependencyStats),
+	}
+}
+
+func (c *DependencyCounter) stats(d Dependency) *DependencyStats {
+	stats, ok := c.dependencies[d]
+	if !ok {
+		if len(c.dependencies) >= maxKeys {
+			return nil
+		}
+		stats = &DependencyStats{}
+		c.dependencies[d] = stats
+	}
+	return stats
+}
+
+// Records a request to d.
+func (c *DependencyCounter) AddCall(d Dependency) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if stats := c.stats(d); stats != nil {
+		stats.Calls++
+	}
+}
+
+// Records a response from d, and whether the call failed.
+func (c *DependencyCounter) AddResponse(d Dependency, failed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if stats := c.stats(d); stats != nil && failed {
+		stats.Errors++
+	}
+}
+
+// Returns all endpoints, ordered by host, path and method.
+func (c *DependencyCounter) All() []DependencyWithStats {
+	c.mutex.Lock()
+	result := make([]DependencyWithStats, 0, len(c.dependencies))
+	for d, stats := range c.dependencies {
+		result = append(result, DependencyWithStats{d, *stats})
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Dependency, result[j].Dependency
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Method < b.Method
+	})
+	return result
+}
+
+// Records the outbound HTTP calls our services make, pairing each request with
+// its response to count errors. All traffic is passed on to the wrapped
+// collector.
+type DependencyCollector struct {
+	Addrs     *HostAddrs
+	Counter   *DependencyCounter
+	Collector Collector
+
+	calls pending.Calls[akid.WitnessID, Dependency]
+}
+
+func (dc *DependencyCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	switch c := t.Content.(type) {
+	case akinet.HTTPRequest:
+		if dc.Addrs.IsOutbound(t.SrcIP, t.DstIP) {
+			d := Dependency{
+				Host:   c.Host,
+				Method: c.Method,
+				Path:   "/",
+			}
+			if d.Host == "" {
+				d.Host = net.JoinHostPort(t.DstIP.String(), strconv.Itoa(t.DstPort))
+			}
+			if c.URL != nil {
+				d.Path = pathTemplate(c.URL.Path)
+			}
+			dc.Counter.AddCall(d)
+			dc.calls.Add(learn.ToWitnessID(c.StreamID, c.Seq), t.ObservationTime, d)
+		}
+	case akinet.HTTPResponse:
+		if d, ok := dc.calls.Take(learn.ToWitnessID(c.StreamID, c.Seq)); ok {
+			dc.Counter.AddResponse(d, responseFailed(c))
+		}
+	}
+	return dc.Collector.Process(t)
+}
+
+func (dc *DependencyCollector) Close() error {
+	return dc.Collector.Close()
+}
+
+// Replaces the segments of path that look like identifiers with "{id}", so
+// that calls to the same endpoint are counted together.
+func pathTemplate(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if LooksLikeID(seg) {
+			segments[i] = "{id}"
+		}
+	}
+	path = strings.Join(segments, "/")
+	if len(path) > maxPathTemplateLength {
+		path = path[:maxPathTemplateLength]
+	}
+	return path
+}
+
+// Whether a path segment looks like an identifier rather than a fixed part of
+// the path: a number, a hex string or UUID, a long token with a digit, or a
+// prefixed token like "cus_NffrFeUfNV2Hib". Shared by everything that turns
+// paths into templates, so that a path gets the same template everywhere.
+func LooksLikeID(seg string) bool {
+	if seg == "" {
+		return false
+	}
+
+	digits, hex, upper := 0, 0, 0
+	for _, r := range seg {
+		switch {
+		case '0' <= r && r <= '9':
+			digits++
+			hex++
+		case 'a' <= r && r <= 'f', 'A' <= r && r <= 'F', r == '-':
+			hex++
+		}
+		if 'A' <= r && r <= 'Z' {
+			upper++
+		}
+	}
+	switch {
+	case digits == len(seg):
+		return true
+	case digits > 0 && hex == len(seg) && len(seg) >= 16:
+		return true
+	case digits > 0 && len(seg) >= 20:
+		return true
+	}
+
+	if i := strings.IndexByte(seg, '_'); i > 0 {
+		token := seg[i+1:]
+		return len(token) >= 10 && !strings.ContainsAny(token, "_.") && (digits > 0 || upper > 0)
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package trace
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+)
+
+func TestDependencyCollector(t *testing.T) {
+	local := net.ParseIP("10.0.0.1")
+	peer := net.ParseIP("10.0.0.2")
+	stripe := net.ParseIP("54.187.174.169")
+	addrs := NewHostAddrs([]net.IP{local})
+
+	sink := &recordingCollector{}
+	counter := NewDependencyCounter()
+	col := &DependencyCollector{
+		Addrs:     addrs,
+		Counter:   counter,
+		Collector: sink,
+	}
+
+	call := func(client, server net.IP, host, path string, status int) {
+		streamID := uuid.New()
+		assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			SrcIP:   client,
+			DstIP:   server,
+			DstPort: 443,
+			Content: akinet.HTTPRequest{StreamID: streamID, Method: "POST", Host: host, URL: &url.URL{Path: path}},
+		}))
+		assert.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			SrcIP:   server,
+			SrcPort: 443,
+			DstIP:   client,
+			Content: akinet.HTTPResponse{StreamID: streamID, StatusCode: status},
+		}))
+	}
+	call(local, stripe, "api.stripe.com", "/v1/customers/cus_NffrFeUfNV2Hib", 200)
+	call(local, stripe, "api.stripe.com", "/v1/customers/cus_9s6XKzkNRiz8i3", 402)
+	call(local, stripe, "api.stripe.com", "/v1/charges", 200)
+	call(local, stripe, "", "/health", 200)
+
+	// Calls to this host, and between other hosts, aren't dependencies.
+	call(peer, local, "service.internal", "/v1/orders", 200)
+	call(peer, stripe, "api.stripe.com", "/v1/charges", 200)
+
+	assert.Len(t, sink.traffic, 12)
+	assert.Equal(t, []DependencyWithStats{
+		{Dependency{"54.187.174.169:443", "POST", "/health"}, DependencyStats{Calls: 1}},
+		{Dependency{"api.stripe.com", "POST", "/v1/charges"}, DependencyStats{Calls: 1}},
+		{Dependency{"api.stripe.com", "POST", "/v1/customers/{id}"}, DependencyStats{Calls: 2, Errors: 1}},
+	}, counter.All())
+}
+
+func TestOutboundFilterCollector(t *testing.T) {
+	local := net.ParseIP("10.0.0.1")
+	remote := net.ParseIP("93.184.216.34")
+
+	sink := &recordingCollector{}
+	col := &OutboundFilterCollector{
+		Addrs:     NewHostAddrs([]net.IP{local}),
+		Collector: sink,
+	}
+
+	outboundRequest := akinet.ParsedNetworkTraffic{SrcIP: local, DstIP: remote, Content: akinet.HTTPRequest{}}
+	outboundResponse := akinet.ParsedNetworkTraffic{SrcIP: remote, DstIP: local, Content: akinet.HTTPResponse{}}
+	traffic := []akinet.ParsedNetworkTraffic{
+		outboundRequest,
+		outboundResponse,
+		{SrcIP: remote, DstIP: local, Content: akinet.HTTPRequest{}},
+		{SrcIP: local, DstIP: remote, Content: akinet.HTTPResponse{}},
+		{SrcIP: local, DstIP: remote, Content: akinet.DroppedBytes(10)},
+	}
+	for _, pnt := range traffic {
+		assert.NoError(t, col.Process(pnt))
+	}
+	assert.Equal(t, []akinet.ParsedNetworkTraffic{outboundRequest, outboundResponse}, sink.traffic)
+
+	// Without host addresses, nothing is outbound.
+	var none *HostAddrs
+	assert.False(t, none.IsOutbound(local, remote))
+}
+
+func TestPathTemplate(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"", "/"},
+		{"/v1/charges", "/v1/charges"},
+		{"/v2/list_objects", "/v2/list_objects"},
+		{"/users/123/orders", "/users/{id}/orders"},
+		{"/objects/9f86d081884c7d659a2feaa0c55ad015", "/objects/{id}"},
+		{"/v1/payment_intents/pi_3MtwBwLkdIwHu7ix28a3tqPa/confirm", "/v1/payment_intents/{id}/confirm"},
+		{"/2010-04-01/Accounts/AC3f5e2d1c0b9a8f7e6d5c4b3a2f1e0d9c/Messages.json", "/2010-04-01/Accounts/{id}/Messages.json"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, pathTemplate(test.path), test.path)
+	}
+}
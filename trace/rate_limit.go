@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/telemetry"
 	"github.com/akitasoftware/akita-libs/akinet"
 	"github.com/spf13/viper"
 )
@@ -24,6 +25,26 @@ const (
 	RateLimitExponentialAlpha = "rate-limit-exponential-alpha"
 )
 
+const (
+	// When the back end throttles an upload, the effective rate is multiplied
+	// by this factor, but is never reduced below minRateFraction of the
+	// configured rate.
+	throttleRateFactor = 0.5
+	minRateFraction    = 0.01
+
+	// Throttled uploads this soon after the rate was reduced don't reduce it
+	// further, since they were likely captured at the old rate.
+	throttleCooldown = time.Minute
+
+	// While uploads succeed, the effective rate recovers by this fraction of
+	// the configured rate at most once per recoveryInterval.
+	recoveryRateFraction = 0.1
+	recoveryInterval     = time.Minute
+
+	// The longest pause in sampling that the back end can request.
+	maxRetryAfter = 10 * time.Minute
+)
+
 func init() {
 	viper.SetDefault(RateLimitEpochTime, 5*time.Minute)
 	viper.SetDefault(RateLimitMaxDuration, 10*time.Minute)
@@ -42,10 +63,21 @@ type SharedRateLimit struct {
 	epochTicker   *time.Ticker
 	intervalTimer *time.Timer
 
-	// Witnesses per minute (configured value) and per epoch (derived value)
+	// Witnesses per minute (effective value) and per epoch (derived value).
+	// The effective rate starts at the configured rate, is reduced while the
+	// back end throttles uploads, and recovers once uploads succeed.
 	WitnessesPerMinute float64
 	WitnessesPerEpoch  int
 
+	configuredWitnessesPerMinute float64
+
+	// When the effective rate was last changed.
+	lastRateChange time.Time
+
+	// Sampling is paused until this time, as requested by the back end when
+	// throttling uploads.
+	pausedUntil time.Time
+
 	// Current estimate of time taken to capture WitnessesPerEpoch
 	EstimatedSampleInterval time.Duration
 	FirstEstimate           bool
@@ -59,6 +91,52 @@ type SharedRateLimit struct {
 	lock sync.Mutex
 }
 
+// A snapshot of the state of a SharedRateLimit.
+type RateLimitStats struct {
+	// The configured rate, and the effective rate, which is lower while the
+	// back end throttles uploads.
+	ConfiguredWitnessesPerMinute float64
+	WitnessesPerMinute           float64
+	WitnessesPerEpoch            int
+
+	// The current estimate of the time taken to capture WitnessesPerEpoch, or
+	// zero before the first estimate.
+	EstimatedSampleInterval time.Duration
+
+	// Whether witnesses are being sampled, and how many have been sampled in
+	// the current interval.
+	SampleIntervalActive bool
+	SampleIntervalCount  int
+}
+
+func (r *SharedRateLimit) Stats() RateLimitStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats := RateLimitStats{
+		ConfiguredWitnessesPerMinute: r.configuredWitnessesPerMinute,
+		WitnessesPerMinute:           r.WitnessesPerMinute,
+		WitnessesPerEpoch:            r.WitnessesPerEpoch,
+		SampleIntervalActive:         r.SampleIntervalActive,
+		SampleIntervalCount:          r.SampleIntervalCount,
+	}
+	if !r.FirstEstimate {
+		stats.EstimatedSampleInterval = r.EstimatedSampleInterval
+	}
+	return stats
+}
+
+// Returns the share of the configured rate that may be captured while the
+// back end throttles uploads: zero while it has asked us to wait, and the
+// effective rate as a fraction of the configured rate otherwise.
+func (r *SharedRateLimit) UploadCapacity() float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Now().Before(r.pausedUntil) || r.configuredWitnessesPerMinute <= 0 {
+		return 0
+	}
+	return r.WitnessesPerMinute / r.configuredWitnessesPerMinute
+}
+
 func (r *SharedRateLimit) startInterval(start time.Time) {
 	// If we're in the current interval, just reset and keeping going.
 	// We don't get an updated interval that way, but that's OK.
@@ -165,7 +243,7 @@ func (r *SharedRateLimit) startNewEpoch(epochStart time.Time) {
 func (r *SharedRateLimit) AllowHTTPRequest() bool {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	if !r.SampleIntervalActive {
+	if !r.SampleIntervalActive || time.Now().Before(r.pausedUntil) {
 		return false
 	}
 
@@ -284,17 +362,88 @@ func (r *rateLimitCollector) expireRequests(threshold time.Time) {
 	printer.Debugf("Expired %v old requests\n", expired)
 }
 
-func NewRateLimit(witnessesPerMinute float64) *SharedRateLimit {
+// Called when the back end throttles an upload. Reduces the effective rate
+// and, if the back end gave a Retry-After, pauses sampling until then.
+func (r *SharedRateLimit) UploadThrottled(retryAfter time.Duration) {
+	now := time.Now()
+
+	r.lock.Lock()
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+	if until := now.Add(retryAfter); until.After(r.pausedUntil) {
+		r.pausedUntil = until
+	}
+
+	minRate := minRateFraction * r.configuredWitnessesPerMinute
+	if now.Sub(r.lastRateChange) < throttleCooldown || r.WitnessesPerMinute <= minRate {
+		r.lock.Unlock()
+		return
+	}
+	newRate := throttleRateFactor * r.WitnessesPerMinute
+	if newRate < minRate {
+		newRate = minRate
+	}
+	r.setRateLocked(newRate, now)
+	configured := r.configuredWitnessesPerMinute
+	r.lock.Unlock()
+
+	printer.Warningf("Witness uploads are being throttled by Postman; reducing the rate limit to %.0f witnesses per minute\n", newRate)
+	telemetry.RateLimitAdjusted("throttled", configured, newRate)
+}
+
+// Called when an upload succeeds. Gradually restores the effective rate to
+// the configured rate.
+func (r *SharedRateLimit) UploadSucceeded() {
+	now := time.Now()
+
+	r.lock.Lock()
+	if r.WitnessesPerMinute >= r.configuredWitnessesPerMinute || now.Sub(r.lastRateChange) < recoveryInterval {
+		r.lock.Unlock()
+		return
+	}
+	newRate := r.WitnessesPerMinute + recoveryRateFraction*r.configuredWitnessesPerMinute
+	if newRate > r.configuredWitnessesPerMinute {
+		newRate = r.configuredWitnessesPerMinute
+	}
+	r.setRateLocked(newRate, now)
+	configured := r.configuredWitnessesPerMinute
+	r.lock.Unlock()
+
+	printer.Debugf("Raising the rate limit to %.0f witnesses per minute\n", newRate)
+	telemetry.RateLimitAdjusted("recovered", configured, newRate)
+}
+
+// Sets the effective rate; should be called with r.lock already held.
+func (r *SharedRateLimit) setRateLocked(witnessesPerMinute float64, now time.Time) {
+	r.WitnessesPerMinute = witnessesPerMinute
+	r.WitnessesPerEpoch = witnessesPerEpoch(witnessesPerMinute)
+	r.lastRateChange = now
+
+	// End the current interval if it has already captured the new quota.
+	if r.SampleIntervalActive && r.SampleIntervalCount >= r.WitnessesPerEpoch {
+		r.endInterval(now)
+	}
+}
+
+func witnessesPerEpoch(witnessesPerMinute float64) int {
 	witnessLimit := witnessesPerMinute * viper.GetDuration(RateLimitEpochTime).Minutes()
 	if witnessLimit < 1 {
+		return 1
+	}
+	return int(witnessLimit)
+}
+
+func NewRateLimit(witnessesPerMinute float64) *SharedRateLimit {
+	if witnessesPerMinute*viper.GetDuration(RateLimitEpochTime).Minutes() < 1 {
 		printer.Warningln("Witnesses per minute rate is too low; rounding up to 1 per 5 minutes.")
-		witnessLimit = 1
 	}
 	r := &SharedRateLimit{
-		WitnessesPerMinute: witnessesPerMinute,
-		WitnessesPerEpoch:  int(witnessLimit),
-		FirstEstimate:      true,
-		done:               make(chan struct{}),
+		WitnessesPerMinute:           witnessesPerMinute,
+		WitnessesPerEpoch:            witnessesPerEpoch(witnessesPerMinute),
+		configuredWitnessesPerMinute: witnessesPerMinute,
+		FirstEstimate:                true,
+		done:                         make(chan struct{}),
 	}
 
 	// Start the first epoch.
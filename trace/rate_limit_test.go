@@ -108,3 +108,55 @@ func TestRateLimit_FirstSample(t *testing.T) {
 		t.Errorf("Expected empty child list after close.")
 	}
 }
+
+func TestRateLimit_Throttled(t *testing.T) {
+	rl := NewRateLimit(100.0)
+	defer rl.Stop()
+
+	// Pretend the last change to the rate was long ago.
+	backdate := func() {
+		rl.lock.Lock()
+		defer rl.lock.Unlock()
+		rl.lastRateChange = time.Now().Add(-time.Hour)
+	}
+
+	rl.UploadThrottled(0)
+	if s := rl.Stats(); s.WitnessesPerMinute != 50 || s.ConfiguredWitnessesPerMinute != 100 {
+		t.Errorf("Expected rate of 50 of 100 after throttling, got %v of %v", s.WitnessesPerMinute, s.ConfiguredWitnessesPerMinute)
+	}
+
+	// Throttling right after a reduction doesn't reduce the rate further.
+	rl.UploadThrottled(0)
+	if s := rl.Stats(); s.WitnessesPerMinute != 50 {
+		t.Errorf("Expected rate of 50 during cooldown, got %v", s.WitnessesPerMinute)
+	}
+
+	// Sampling pauses for the Retry-After.
+	backdate()
+	for !rl.IntervalStarted() {
+		time.Sleep(1 * time.Millisecond)
+	}
+	rl.UploadThrottled(time.Hour)
+	if s := rl.Stats(); s.WitnessesPerMinute != 25 {
+		t.Errorf("Expected rate of 25 after throttling again, got %v", s.WitnessesPerMinute)
+	}
+	if rl.AllowHTTPRequest() {
+		t.Errorf("Expected sampling to pause until Retry-After")
+	}
+
+	// The rate recovers gradually once uploads succeed.
+	rl.UploadSucceeded()
+	if s := rl.Stats(); s.WitnessesPerMinute != 25 {
+		t.Errorf("Expected rate to stay at 25 right after a change, got %v", s.WitnessesPerMinute)
+	}
+	for _, expected := range []float64{35, 45, 55, 65, 75, 85, 95, 100, 100} {
+		backdate()
+		rl.UploadSucceeded()
+		if s := rl.Stats(); s.WitnessesPerMinute != expected {
+			t.Errorf("Expected rate to recover to %v, got %v", expected, s.WitnessesPerMinute)
+		}
+	}
+	if s := rl.Stats(); s.WitnessesPerEpoch != 500 {
+		t.Errorf("Expected 500 witnesses per epoch once recovered, got %v", s.WitnessesPerEpoch)
+	}
+}
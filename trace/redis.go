@@ -0,0 +1,236 @@
+package trace
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pcap/redis"
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+const (
+	// Maximum number of key patterns and keys tracked for each command.
+	maxRedisKeysPerCommand = 1000
+)
+
+// A Redis command, as issued to a server.
+type RedisCommand struct {
+	// The server's address, so that the same command sent to different
+	// servers is kept apart.
+	ServerIP   string
+	ServerPort int
+
+	Name string
+}
+
+type RedisCommandStats struct {
+	// The number of commands whose reply was seen.
+	Count int
+
+	// The number of error replies, in total and by error prefix.
+	Errors        int
+	ErrorPrefixes map[string]int
+
+	// The number of null replies, which for reads are cache misses.
+	Misses int
+
+	// The number of replies of each type.
+	ReplyTypes map[redis.ReplyType]int
+
+	// Time from the last packet of the command to the last packet of its
+	// reply.
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+
+	// The number of commands by key pattern, and by key hash, for commands
+	// that take a key. Keys beyond the first maxRedisKeysPerCommand aren't
+	// tracked.
+	KeyPatterns map[string]int
+	KeyHashes   map[string]int
+}
+
+func (s RedisCommandStats) MeanLatency() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.Count)
+}
+
+// Returns the share of replies that weren't null.
+func (s RedisCommandStats) HitRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Count-s.Misses) / float64(s.Count)
+}
+
+// Returns the number of times the most used key was used.
+func (s RedisCommandStats) HottestKeyCount() int {
+	hottest := 0
+	for _, count := range s.KeyHashes {
+		if count > hottest {
+			hottest = count
+		}
+	}
+	return hottest
+}
+
+type RedisCommandWithStats struct {
+	RedisCommand
+	RedisCommandStats
+}
+
+// Aggregates Redis commands and their replies.
+//
+// Imposes a hard limit on the number of commands that are individually
+// tracked; further commands are dropped.
+type RedisCommandCounter struct {
+	mutex    sync.Mutex
+	commands map[RedisCommand]*RedisCommandStats
+}
+
+func NewRedisCommandCounter() *RedisCommandCounter {
+	return &RedisCommandCounter{
+		commands: make(map[RedisCommand]*RedisCommandStats),
+	}
+}
+
+// Records one command and its reply.
+func (c *RedisCommandCounter) Add(command RedisCommand, keyPattern, keyHash string, reply redis.Reply, latency time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats, ok := c.commands[command]
+	if !ok {
+		if len(c.commands) >= maxKeys {
+			return
+		}
+		stats = &RedisCommandStats{
+			ReplyTypes: make(map[redis.ReplyType]int),
+		}
+		c.commands[command] = stats
+	}
+
+	stats.Count++
+	stats.ReplyTypes[reply.Type]++
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+	switch reply.Type {
+	case redis.Error:
+		stats.Errors++
+		if reply.ErrorPrefix != "" {
+			if stats.ErrorPrefixes == nil {
+				stats.ErrorPrefixes = make(map[string]int)
+			}
+			stats.ErrorPrefixes[reply.ErrorPrefix]++
+		}
+	case redis.Null:
+		stats.Misses++
+	}
+	if keyPattern != "" {
+		if stats.KeyPatterns == nil {
+			stats.KeyPatterns = make(map[string]int)
+			stats.KeyHashes = make(map[string]int)
+		}
+		incrementBounded(stats.KeyPatterns, keyPattern)
+		incrementBounded(stats.KeyHashes, keyHash)
+	}
+}
+
+func incrementBounded(counts map[string]int, key string) {
+	if _, ok := counts[key]; ok || len(counts) < maxRedisKeysPerCommand {
+		counts[key]++
+	}
+}
+
+// Returns up to n commands that took the most time in total, slowest first.
+func (c *RedisCommandCounter) Top(n int) []RedisCommandWithStats {
+	c.mutex.Lock()
+	result := make([]RedisCommandWithStats, 0, len(c.commands))
+	for command, stats := range c.commands {
+		s := *stats
+		s.ErrorPrefixes = copyCounts(stats.ErrorPrefixes)
+		s.KeyPatterns = copyCounts(stats.KeyPatterns)
+		s.KeyHashes = copyCounts(stats.KeyHashes)
+		s.ReplyTypes = make(map[redis.ReplyType]int, len(stats.ReplyTypes))
+		for t, count := range stats.ReplyTypes {
+			s.ReplyTypes[t] = count
+		}
+		result = append(result, RedisCommandWithStats{command, s})
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalLatency != result[j].TotalLatency {
+			return result[i].TotalLatency > result[j].TotalLatency
+		}
+		return result[i].Count > result[j].Count
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	if counts == nil {
+		return nil
+	}
+	result := make(map[string]int, len(counts))
+	for k, v := range counts {
+		result[k] = v
+	}
+	return result
+}
+
+type pendingRedisCommand struct {
+	command    RedisCommand
+	keyPattern string
+	keyHash    string
+	sent       time.Time
+}
+
+// Pairs Redis commands with their replies to measure latency and count misses
+// and errors by command. All traffic is passed on to the wrapped collector.
+type RedisCommandCollector struct {
+	Counter   *RedisCommandCounter
+	Collector Collector
+
+	commands pending.Calls[akid.WitnessID, pendingRedisCommand]
+}
+
+func (rc *RedisCommandCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	switch c := t.Content.(type) {
+	case redis.Command:
+		rc.commands.Add(learn.ToWitnessID(c.StreamID, c.Seq), t.ObservationTime, pendingRedisCommand{
+			command: RedisCommand{
+				ServerIP:   t.DstIP.String(),
+				ServerPort: t.DstPort,
+				Name:       c.Name,
+			},
+			keyPattern: c.KeyPattern,
+			keyHash:    c.KeyHash,
+			sent:       t.FinalPacketTime,
+		})
+	case redis.Reply:
+		if cmd, ok := rc.commands.Take(learn.ToWitnessID(c.StreamID, c.Seq)); ok {
+			latency := t.FinalPacketTime.Sub(cmd.sent)
+			if cmd.sent.IsZero() || latency < 0 {
+				latency = 0
+			}
+			rc.Counter.Add(cmd.command, cmd.keyPattern, cmd.keyHash, c, latency)
+		}
+	}
+	return rc.Collector.Process(t)
+}
+
+func (rc *RedisCommandCollector) Close() error {
+	return rc.Collector.Close()
+}
@@ -0,0 +1,107 @@
+package trace
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+
+	"github.com/akitasoftware/akita-cli/pcap/redis"
+)
+
+func TestRedisCommandCollector(t *testing.T) {
+	commands := NewRedisCommandCounter()
+	col := &RedisCommandCollector{
+		Counter:   commands,
+		Collector: NewDummyCollector(),
+	}
+
+	client := net.ParseIP("10.0.0.1")
+	server := net.ParseIP("10.0.0.6")
+	streamID := uuid.New()
+	start := time.Unix(1700000000, 0)
+
+	command := func(seq int, name, keyPattern, keyHash string, at time.Duration) akinet.ParsedNetworkTraffic {
+		return akinet.ParsedNetworkTraffic{
+			SrcIP:           client,
+			SrcPort:         40000,
+			DstIP:           server,
+			DstPort:         6379,
+			FinalPacketTime: start.Add(at),
+			Content: redis.Command{
+				StreamID:   streamID,
+				Seq:        seq,
+				Name:       name,
+				KeyPattern: keyPattern,
+				KeyHash:    keyHash,
+			},
+		}
+	}
+	reply := func(seq int, replyType redis.ReplyType, errorPrefix string, at time.Duration) akinet.ParsedNetworkTraffic {
+		return akinet.ParsedNetworkTraffic{
+			SrcIP:           server,
+			SrcPort:         6379,
+			DstIP:           client,
+			DstPort:         40000,
+			FinalPacketTime: start.Add(at),
+			Content: redis.Reply{
+				StreamID:    streamID,
+				Seq:         seq,
+				Type:        replyType,
+				ErrorPrefix: errorPrefix,
+			},
+		}
+	}
+
+	traffic := []akinet.ParsedNetworkTraffic{
+		command(1, "GET", "user:*", "a1", 0),
+		reply(1, redis.BulkString, "", time.Millisecond),
+		command(2, "GET", "user:*", "a1", 2*time.Millisecond),
+		reply(2, redis.BulkString, "", 3*time.Millisecond),
+		command(3, "GET", "user:*", "b2", 4*time.Millisecond),
+		reply(3, redis.Null, "", 7*time.Millisecond),
+		command(4, "SET", "user:*", "b2", 8*time.Millisecond),
+		reply(4, redis.Error, "OOM", 20*time.Millisecond),
+		// No command was seen for this reply.
+		reply(9, redis.SimpleString, "", 30*time.Millisecond),
+	}
+	for _, pnt := range traffic {
+		assert.NoError(t, col.Process(pnt))
+	}
+
+	assert.Equal(t, []RedisCommandWithStats{
+		{
+			RedisCommand{ServerIP: "10.0.0.6", ServerPort: 6379, Name: "SET"},
+			RedisCommandStats{
+				Count:         1,
+				Errors:        1,
+				ErrorPrefixes: map[string]int{"OOM": 1},
+				ReplyTypes:    map[redis.ReplyType]int{redis.Error: 1},
+				TotalLatency:  12 * time.Millisecond,
+				MaxLatency:    12 * time.Millisecond,
+				KeyPatterns:   map[string]int{"user:*": 1},
+				KeyHashes:     map[string]int{"b2": 1},
+			},
+		},
+		{
+			RedisCommand{ServerIP: "10.0.0.6", ServerPort: 6379, Name: "GET"},
+			RedisCommandStats{
+				Count:        3,
+				Misses:       1,
+				ReplyTypes:   map[redis.ReplyType]int{redis.BulkString: 2, redis.Null: 1},
+				TotalLatency: 5 * time.Millisecond,
+				MaxLatency:   3 * time.Millisecond,
+				KeyPatterns:  map[string]int{"user:*": 3},
+				KeyHashes:    map[string]int{"a1": 2, "b2": 1},
+			},
+		},
+	}, commands.Top(10))
+
+	get := commands.Top(10)[1]
+	assert.InDelta(t, 2.0/3.0, get.HitRate(), 1e-9)
+	assert.Equal(t, 2, get.HottestKeyCount())
+}
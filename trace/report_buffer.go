@@ -3,6 +3,7 @@ package trace
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/akitasoftware/akita-cli/printer"
@@ -85,22 +86,63 @@ func (buf *reportBuffer) Flush() error {
 	// Ensure the buffer is empty when we return.
 	defer buf.UploadReportsRequest.Clear()
 
+	lrn := buf.collector.getLearnSession()
+
+	// While earlier batches are waiting in the spool, spool this one too, so
+	// that batches are uploaded in order.
+	spool := buf.collector.spool
+	if spool != nil && spool.Pending() {
+		if err := spool.Add(lrn, &buf.UploadReportsRequest); err != nil {
+			printer.Warningf("Failed to spool witnesses for upload to Postman: %v\n", err)
+		}
+		return nil
+	}
+
 	// Upload to the back end.
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	err := buf.collector.learnClient.AsyncReportsUpload(ctx, buf.collector.getLearnSession(), &buf.UploadReportsRequest)
+	atomic.AddUint64(&buf.collector.uploads, 1)
+	atomic.AddUint64(&buf.collector.uploadedBytes, uint64(buf.UploadReportsRequest.SizeInBytes()))
+	err := buf.collector.learnClient.AsyncReportsUpload(ctx, lrn, &buf.UploadReportsRequest)
 	if err != nil {
+		atomic.AddUint64(&buf.collector.failedUploads, 1)
+		atomic.StoreInt64(&buf.collector.lastFailedUpload, time.Now().UnixNano())
+
 		switch e := err.(type) {
 		case rest.HTTPError:
 			if e.StatusCode == http.StatusTooManyRequests {
-				// XXX Not all commands that call into this code have a --rate-limit
-				// option.
-				err = errors.Wrap(err, "your witness uploads are being throttled. Postman Insights will generate partial results. Try reducing the --rate-limit value to avoid this.")
+				atomic.AddUint64(&buf.collector.throttledUploads, 1)
+
+				if rateLimit := buf.collector.rateLimit; rateLimit != nil {
+					// Capture fewer witnesses until the back end catches up.
+					rateLimit.UploadThrottled(e.RetryAfter)
+					err = errors.Wrap(err, "your witness uploads are being throttled. Postman Insights will generate partial results while it captures fewer witnesses")
+				} else {
+					// XXX Not all commands that call into this code have a --rate-limit
+					// option.
+					err = errors.Wrap(err, "your witness uploads are being throttled. Postman Insights will generate partial results. Try reducing the --rate-limit value to avoid this.")
+				}
 			}
 		}
 
+		// Keep the batch to upload once the back end can be reached again, or
+		// has caught up.
+		if spool != nil && shouldSpool(err) {
+			spoolErr := spool.Add(lrn, &buf.UploadReportsRequest)
+			if spoolErr == nil {
+				printer.Debugf("Failed to upload to Postman, spooled witnesses to retry later: %v\n", err)
+				return nil
+			}
+			printer.Warningf("Failed to spool witnesses for upload to Postman: %v\n", spoolErr)
+		}
+
 		printer.Warningf("Failed to upload to Postman: %v\n", err)
+	} else {
+		atomic.StoreInt64(&buf.collector.lastUpload, time.Now().UnixNano())
+		if rateLimit := buf.collector.rateLimit; rateLimit != nil {
+			rateLimit.UploadSucceeded()
+		}
 	}
 	printer.Debugf("Uploaded %d witnesses, %d TCP connection reports, and %d TLS handshake reports\n", len(buf.Witnesses), len(buf.TCPConnections), len(buf.TLSHandshakes))
 
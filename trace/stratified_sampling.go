@@ -0,0 +1,294 @@
+package trace
+
+import (
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/akitasoftware/akita-libs/akid"
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+
+	"github.com/akitasoftware/akita-cli/learn"
+	"github.com/akitasoftware/akita-cli/pending"
+	"github.com/akitasoftware/akita-cli/printer"
+)
+
+const (
+	// Maximum number of endpoints whose calls are counted in each window.
+	// Calls to endpoints beyond these are sampled as if the endpoint's quota
+	// were used up.
+	maxSampledEndpoints = 10000
+
+	// How often to check whether the current window has ended, when traffic
+	// is quiet.
+	maxWindowCheckInterval = time.Second
+)
+
+// Limits for a StratifiedSamplingCollector. Calls are sampled in fixed windows
+// of time.
+type StratifiedSamplingOptions struct {
+	// The number of calls to each endpoint that are kept in each window.
+	MinPerEndpoint int
+
+	// The number of other calls, across all endpoints, kept in each window.
+	// These are chosen uniformly at random.
+	ReservoirSize int
+
+	Window time.Duration
+}
+
+// A call held in the reservoir until the end of the window.
+type sampledCall struct {
+	request  akinet.ParsedNetworkTraffic
+	response akinet.ParsedNetworkTraffic
+
+	// The order in which the call was offered to the reservoir.
+	index int
+}
+
+// Samples HTTP calls by endpoint, so that busy endpoints don't crowd rare
+// ones out of the trace. In each window, the collector keeps:
+//   - the first MinPerEndpoint calls to each endpoint;
+//   - every failed call: those with a 4xx or 5xx response, or gRPC calls with
+//     a non-zero status; and
+//   - a reservoir of ReservoirSize calls chosen at random from the rest.
+//
+// Requests and their responses are kept or dropped together. Since whether to
+// keep a call can depend on its response, requests beyond their endpoint's
+// quota are copied and held until their response arrives, and calls in the
+// reservoir are only passed on when the window ends. All other traffic is
+// passed on as is. Requests whose responses are never seen are forgotten as
+// described in pending.Calls.
+//
+// Windows are measured by observation time, and end when traffic from the
+// next window is processed, when a window's worth of time passes without
+// traffic, or when the collector is closed. Calls may therefore be passed on
+// from a goroutine other than the one calling Process.
+type StratifiedSamplingCollector struct {
+	options   StratifiedSamplingOptions
+	collector Collector
+
+	// Tells the time while traffic is quiet.
+	clock captureClock
+
+	// Requests that were kept, so their responses should be too, by pair key.
+	kept pending.Calls[akid.WitnessID, struct{}]
+
+	// Requests beyond their endpoint's quota, by pair key.
+	held pending.Calls[akid.WitnessID, akinet.ParsedNetworkTraffic]
+
+	// Guards the fields below, and is held while passing traffic on, so that
+	// the end of a window isn't interleaved with other traffic.
+	mutex sync.Mutex
+
+	windowStart time.Time
+
+	// Calls to each endpoint in the current window.
+	endpointCalls map[Endpoint]int
+
+	reservoir []sampledCall
+
+	// The number of calls offered to the reservoir in the current window.
+	reservoirOffered int
+
+	rand *rand.Rand
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewStratifiedSamplingCollector(options StratifiedSamplingOptions, collector Collector) *StratifiedSamplingCollector {
+	sc := &StratifiedSamplingCollector{
+		options:       options,
+		collector:     collector,
+		endpointCalls: make(map[Endpoint]int),
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:          make(chan struct{}),
+	}
+	sc.wg.Add(1)
+	go sc.endQuietWindows()
+	return sc
+}
+
+func (sc *StratifiedSamplingCollector) Process(t akinet.ParsedNetworkTraffic) error {
+	sc.clock.observe(t.ObservationTime)
+	now := t.ObservationTime
+	if now.IsZero() {
+		now = sc.clock.now()
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if err := sc.maybeEndWindow(now); err != nil {
+		return err
+	}
+
+	switch c := t.Content.(type) {
+	case akinet.HTTPRequest:
+		key := learn.ToWitnessID(c.StreamID, c.Seq)
+		if sc.withinQuota(httpEndpoint(t, c)) {
+			sc.kept.Add(key, t.ObservationTime, struct{}{})
+			return sc.collector.Process(t)
+		}
+		sc.held.Add(key, t.ObservationTime, ownedHTTPRequest(t, c))
+		return nil
+
+	case akinet.HTTPResponse:
+		key := learn.ToWitnessID(c.StreamID, c.Seq)
+		if _, ok := sc.kept.Take(key); ok {
+			return sc.collector.Process(t)
+		}
+		request, ok := sc.held.Take(key)
+		if !ok {
+			return nil
+		}
+
+		if responseFailed(c) {
+			if err := sc.collector.Process(request); err != nil {
+				return err
+			}
+			return sc.collector.Process(t)
+		}
+		sc.offer(request, t, c)
+		return nil
+
+	default:
+		return sc.collector.Process(t)
+	}
+}
+
+// Counts a call to e, and returns whether it is within e's quota for the
+// current window.
+func (sc *StratifiedSamplingCollector) withinQuota(e Endpoint) bool {
+	count, ok := sc.endpointCalls[e]
+	if !ok && len(sc.endpointCalls) >= maxSampledEndpoints {
+		return false
+	}
+	sc.endpointCalls[e] = count + 1
+	return count < sc.options.MinPerEndpoint
+}
+
+// Offers a call to the reservoir, using reservoir sampling so that every call
+// offered in a window is equally likely to be kept.
+func (sc *StratifiedSamplingCollector) offer(request, response akinet.ParsedNetworkTraffic, c akinet.HTTPResponse) {
+	sc.reservoirOffered++
+	slot := len(sc.reservoir)
+	if slot >= sc.options.ReservoirSize {
+		slot = sc.rand.Intn(sc.reservoirOffered)
+		if slot >= sc.options.ReservoirSize {
+			return
+		}
+	}
+
+	call := sampledCall{
+		request:  request,
+		response: ownedHTTPResponse(response, c),
+		index:    sc.reservoirOffered,
+	}
+	if slot == len(sc.reservoir) {
+		sc.reservoir = append(sc.reservoir, call)
+	} else {
+		sc.reservoir[slot] = call
+	}
+}
+
+func (sc *StratifiedSamplingCollector) maybeEndWindow(now time.Time) error {
+	if sc.windowStart.IsZero() {
+		sc.windowStart = now
+		return nil
+	}
+	if now.Sub(sc.windowStart) < sc.options.Window {
+		return nil
+	}
+
+	err := sc.flushReservoir()
+
+	sc.windowStart = now
+	sc.endpointCalls = make(map[Endpoint]int)
+	sc.reservoirOffered = 0
+	return err
+}
+
+// Ends windows while traffic is quiet, so that the calls in the reservoir
+// aren't held indefinitely.
+func (sc *StratifiedSamplingCollector) endQuietWindows() {
+	defer sc.wg.Done()
+
+	interval := sc.options.Window
+	if interval > maxWindowCheckInterval {
+		interval = maxWindowCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sc.mutex.Lock()
+			err := sc.maybeEndWindow(sc.clock.now())
+			sc.mutex.Unlock()
+			if err != nil {
+				printer.Warningf("Failed to pass on sampled calls: %v\n", err)
+			}
+		case <-sc.done:
+			return
+		}
+	}
+}
+
+// Passes on the calls in the reservoir, in the order they were offered.
+func (sc *StratifiedSamplingCollector) flushReservoir() error {
+	sort.Slice(sc.reservoir, func(i, j int) bool {
+		return sc.reservoir[i].index < sc.reservoir[j].index
+	})
+	calls := sc.reservoir
+	sc.reservoir = nil
+
+	for _, call := range calls {
+		if err := sc.collector.Process(call.request); err != nil {
+			return err
+		}
+		if err := sc.collector.Process(call.response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *StratifiedSamplingCollector) Close() error {
+	close(sc.done)
+	sc.wg.Wait()
+
+	sc.mutex.Lock()
+	err := sc.flushReservoir()
+	sc.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return sc.collector.Close()
+}
+
+// Returns a copy of t whose body doesn't refer to pooled buffers, which are
+// released once Process returns.
+func ownedHTTPRequest(t akinet.ParsedNetworkTraffic, c akinet.HTTPRequest) akinet.ParsedNetworkTraffic {
+	c.Body = ownedMemView(c.Body)
+	t.Content = c
+	return t
+}
+
+func ownedHTTPResponse(t akinet.ParsedNetworkTraffic, c akinet.HTTPResponse) akinet.ParsedNetworkTraffic {
+	c.Body = ownedMemView(c.Body)
+	t.Content = c
+	return t
+}
+
+func ownedMemView(mv memview.MemView) memview.MemView {
+	if mv.Len() == 0 {
+		return memview.MemView{}
+	}
+	b, _ := io.ReadAll(mv.CreateReader())
+	return memview.New(b)
+}
@@ -0,0 +1,174 @@
+package trace
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-libs/akinet"
+	"github.com/akitasoftware/akita-libs/memview"
+
+	"github.com/akitasoftware/akita-cli/pending"
+)
+
+func TestStratifiedSamplingCollector(t *testing.T) {
+	client := net.ParseIP("10.0.0.2")
+	server := net.ParseIP("10.0.0.1")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sink := &recordingCollector{}
+	col := NewStratifiedSamplingCollector(StratifiedSamplingOptions{
+		MinPerEndpoint: 2,
+		ReservoirSize:  3,
+		Window:         time.Minute,
+	}, sink)
+
+	// Sends a call, and returns its stream ID.
+	call := func(at time.Time, path string, status int) uuid.UUID {
+		streamID := uuid.New()
+		require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			SrcIP:           client,
+			DstIP:           server,
+			DstPort:         8080,
+			Content:         akinet.HTTPRequest{StreamID: streamID, Method: "GET", Host: "api.internal", URL: &url.URL{Path: path}, Body: memview.New([]byte("request"))},
+			ObservationTime: at,
+		}))
+		require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			SrcIP:           server,
+			SrcPort:         8080,
+			DstIP:           client,
+			Content:         akinet.HTTPResponse{StreamID: streamID, StatusCode: status, Body: memview.New([]byte("response"))},
+			ObservationTime: at,
+		}))
+		return streamID
+	}
+
+	// A busy health check, a rare endpoint, and a failing call to the health
+	// check.
+	for i := 0; i < 1000; i++ {
+		call(start.Add(time.Duration(i)*time.Millisecond), "/health", 200)
+	}
+	rare := call(start.Add(time.Second), "/orders/1234", 200)
+	failed := call(start.Add(2*time.Second), "/health", 503)
+
+	// Quota calls and errors are passed on right away; the reservoir waits for
+	// the end of the window.
+	calls := pairedCalls(t, sink.traffic)
+	assert.Len(t, calls, 4)
+	assert.Contains(t, calls, rare)
+	assert.Contains(t, calls, failed)
+
+	// Traffic from the next window ends this one.
+	call(start.Add(time.Minute+time.Second), "/health", 200)
+	calls = pairedCalls(t, sink.traffic)
+	assert.Len(t, calls, 8)
+
+	// Requests and responses held past Process own their bodies.
+	for _, traffic := range sink.traffic[8:14] {
+		switch c := traffic.Content.(type) {
+		case akinet.HTTPRequest:
+			assertBody(t, "request", c.Body)
+		case akinet.HTTPResponse:
+			assertBody(t, "response", c.Body)
+		}
+	}
+
+	// Closing flushes the reservoir of the last window.
+	call(start.Add(time.Minute+2*time.Second), "/health", 200)
+	call(start.Add(time.Minute+3*time.Second), "/health", 200)
+	assert.Len(t, pairedCalls(t, sink.traffic), 9)
+	require.NoError(t, col.Close())
+	assert.Len(t, pairedCalls(t, sink.traffic), 10)
+}
+
+func TestStratifiedSamplingEndsQuietWindows(t *testing.T) {
+	sink := &recordingCollector{}
+	col := NewStratifiedSamplingCollector(StratifiedSamplingOptions{
+		ReservoirSize: 1,
+		Window:        10 * time.Millisecond,
+	}, sink)
+	defer col.Close()
+
+	streamID := uuid.New()
+	now := time.Now()
+	require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+		Content:         akinet.HTTPRequest{StreamID: streamID, Method: "GET", URL: &url.URL{Path: "/"}},
+		ObservationTime: now,
+	}))
+	require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+		Content:         akinet.HTTPResponse{StreamID: streamID, StatusCode: 200},
+		ObservationTime: now,
+	}))
+
+	// The reservoir is passed on without waiting for more traffic.
+	assert.Eventually(t, func() bool {
+		col.mutex.Lock()
+		defer col.mutex.Unlock()
+		return len(sink.traffic) == 2
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestStratifiedSamplingEvictsHeldRequests(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink := &recordingCollector{}
+	col := NewStratifiedSamplingCollector(StratifiedSamplingOptions{
+		Window: time.Hour,
+	}, sink)
+	defer col.Close()
+
+	request := func(streamID uuid.UUID) {
+		require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			Content:         akinet.HTTPRequest{StreamID: streamID, Method: "GET", URL: &url.URL{Path: "/"}},
+			ObservationTime: start,
+		}))
+	}
+	response := func(streamID uuid.UUID) {
+		require.NoError(t, col.Process(akinet.ParsedNetworkTraffic{
+			Content:         akinet.HTTPResponse{StreamID: streamID, StatusCode: 500},
+			ObservationTime: start,
+		}))
+	}
+
+	// Fill the held requests, then hold one more: the oldest is forgotten to
+	// make room, rather than the newest.
+	oldest := uuid.New()
+	request(oldest)
+	for i := 1; i < pending.MaxCalls; i++ {
+		request(uuid.New())
+	}
+	newest := uuid.New()
+	request(newest)
+	assert.Equal(t, pending.MaxCalls, col.held.Len())
+
+	response(oldest)
+	response(newest)
+	assert.Equal(t, []uuid.UUID{newest}, pairedCalls(t, sink.traffic))
+}
+
+// Returns the stream IDs of the calls in traffic, checking that each request
+// is directly followed by its response.
+func pairedCalls(t *testing.T, traffic []akinet.ParsedNetworkTraffic) []uuid.UUID {
+	require.Equal(t, 0, len(traffic)%2)
+	var result []uuid.UUID
+	for i := 0; i < len(traffic); i += 2 {
+		req, ok := traffic[i].Content.(akinet.HTTPRequest)
+		require.True(t, ok)
+		resp, ok := traffic[i+1].Content.(akinet.HTTPResponse)
+		require.True(t, ok)
+		require.Equal(t, req.StreamID, resp.StreamID)
+		result = append(result, req.StreamID)
+	}
+	return result
+}
+
+func assertBody(t *testing.T, expected string, body memview.MemView) {
+	b, err := io.ReadAll(body.CreateReader())
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(b))
+}
@@ -0,0 +1,432 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/akitasoftware/akita-cli/printer"
+	"github.com/akitasoftware/akita-cli/rest"
+	"github.com/akitasoftware/akita-libs/akid"
+	kgxapi "github.com/akitasoftware/akita-libs/api_schema"
+)
+
+const (
+	// Spooled batches are written to files with this extension. Files are
+	// first written under a temporary name, so that a partial write is never
+	// replayed.
+	spoolFileExt    = ".batch"
+	spoolTmpFileExt = ".tmp"
+)
+
+// Bounds on the delay between attempts to replay a spooled batch. Variables
+// so that tests can shorten them.
+var (
+	spoolMinBackoff = 5 * time.Second
+	spoolMaxBackoff = 5 * time.Minute
+)
+
+// Options for an UploadSpool. A zero limit disables the corresponding limit.
+type UploadSpoolOptions struct {
+	// The total size of the spooled batches. Once reached, the oldest batches
+	// are dropped to make room for new ones.
+	MaxSize_bytes int64
+
+	// Batches spooled for longer than this are dropped.
+	MaxAge time.Duration
+
+	// If set, told when replayed batches are throttled or uploaded, so that
+	// fewer witnesses are captured until the back end catches up.
+	RateLimit *SharedRateLimit
+}
+
+// Statistics about the batches an UploadSpool is holding and replaying.
+type UploadSpoolStats struct {
+	// Batches on disk, waiting to be replayed, and their total size.
+	Batches int
+	Bytes   int64
+
+	// Batches that were replayed successfully, and that were dropped because
+	// of the spool's limits or because the back end rejected them.
+	Replayed uint64
+	Dropped  uint64
+}
+
+type spooledBatchFile struct {
+	path    string
+	size    int64
+	spooled time.Time
+}
+
+// The contents of a spooled batch file.
+type spooledBatch struct {
+	LearnSessionID akid.LearnSessionID          `json:"learn_session_id"`
+	Request        *kgxapi.UploadReportsRequest `json:"request"`
+}
+
+// Keeps batches of reports that failed to upload because the back end was
+// unreachable or throttling uploads, and replays them in order, with backoff,
+// once it can be reached again. Batches are kept in a directory on disk, so
+// they survive restarts of the agent.
+//
+// An UploadSpool may be shared by several BackendCollectors; each batch is
+// replayed to the learn session it was originally destined for.
+type UploadSpool struct {
+	// Updated atomically. These come first to keep them 64-bit aligned on
+	// 32-bit platforms.
+	replayed uint64
+	dropped  uint64
+
+	dir         string
+	options     UploadSpoolOptions
+	learnClient rest.LearnClient
+
+	mutex sync.Mutex
+
+	// Spooled batches, oldest first, and their total size.
+	files     []spooledBatchFile
+	size      int64
+	nextIndex uint64
+
+	// Signals the replay loop that a batch was spooled.
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Opens the spool in dir, creating the directory if needed. Batches spooled by
+// an earlier run are replayed along with new ones.
+func NewUploadSpool(dir string, options UploadSpoolOptions, lc rest.LearnClient) (*UploadSpool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create upload spool directory %s", dir)
+	}
+
+	s := &UploadSpool{
+		dir:         dir,
+		options:     options,
+		learnClient: lc,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if len(s.files) > 0 {
+		printer.Infof("Found %d witness batches spooled by an earlier run; uploading them once Postman can be reached\n", len(s.files))
+		s.wake <- struct{}{}
+	}
+
+	s.wg.Add(1)
+	go s.replayLoop()
+	return s, nil
+}
+
+// Reads the batches already in the spool directory.
+func (s *UploadSpool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read upload spool directory %s", s.dir)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, spoolTmpFileExt):
+			// Left over from an interrupted write.
+			_ = os.Remove(filepath.Join(s.dir, name))
+		case strings.HasSuffix(name, spoolFileExt):
+			spooled, index, ok := parseSpoolFileName(name)
+			if !ok {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			s.files = append(s.files, spooledBatchFile{
+				path:    filepath.Join(s.dir, name),
+				size:    info.Size(),
+				spooled: spooled,
+			})
+			s.size += info.Size()
+			if index >= s.nextIndex {
+				s.nextIndex = index + 1
+			}
+		}
+	}
+
+	// File names sort in the order the batches were spooled.
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].path < s.files[j].path
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.enforceLimitsLocked(time.Now())
+	return nil
+}
+
+// Spool file names are the spool time and a sequence number, both zero-padded
+// so that names sort in the order the batches were spooled.
+func spoolFileName(spooled time.Time, index uint64) string {
+	return fmt.Sprintf("%020d-%020d%s", spooled.UnixNano(), index, spoolFileExt)
+}
+
+func parseSpoolFileName(name string) (time.Time, uint64, bool) {
+	parts := strings.Split(strings.TrimSuffix(name, spoolFileExt), "-")
+	if len(parts) != 2 {
+		return time.Time{}, 0, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	index, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return time.Unix(0, nanos), index, true
+}
+
+// Writes a batch to the spool, to be uploaded to the given learn session once
+// the back end can be reached.
+func (s *UploadSpool) Add(lrn akid.LearnSessionID, req *kgxapi.UploadReportsRequest) error {
+	data, err := json.Marshal(spooledBatch{
+		LearnSessionID: lrn,
+		Request:        req,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode batch for upload spool")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.options.MaxSize_bytes > 0 && int64(len(data)) > s.options.MaxSize_bytes {
+		atomic.AddUint64(&s.dropped, 1)
+		return errors.Errorf("batch of %d bytes is larger than the upload spool", len(data))
+	}
+
+	now := time.Now()
+	path := filepath.Join(s.dir, spoolFileName(now, s.nextIndex))
+	s.nextIndex++
+	if err := writeFileAtomically(path, data); err != nil {
+		return errors.Wrap(err, "failed to write batch to upload spool")
+	}
+	s.files = append(s.files, spooledBatchFile{
+		path:    path,
+		size:    int64(len(data)),
+		spooled: now,
+	})
+	s.size += int64(len(data))
+	s.enforceLimitsLocked(now)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	tmp := path + spoolTmpFileExt
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Drops the oldest batches until the spool is within its limits.
+func (s *UploadSpool) enforceLimitsLocked(now time.Time) {
+	for len(s.files) > 0 {
+		oldest := s.files[0]
+		tooOld := s.options.MaxAge > 0 && now.Sub(oldest.spooled) > s.options.MaxAge
+		tooBig := s.options.MaxSize_bytes > 0 && s.size > s.options.MaxSize_bytes
+		if !tooOld && !tooBig {
+			return
+		}
+		if tooOld {
+			printer.Warningf("Dropping witnesses that couldn't be uploaded to Postman within %v\n", s.options.MaxAge)
+		} else {
+			printer.Warningf("Upload spool is full; dropping the oldest witnesses that couldn't be uploaded to Postman\n")
+		}
+		s.removeOldestLocked()
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *UploadSpool) removeOldestLocked() {
+	oldest := s.files[0]
+	if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+		printer.Debugf("Failed to remove %s from upload spool: %v\n", oldest.path, err)
+	}
+	s.files = s.files[1:]
+	s.size -= oldest.size
+}
+
+// Whether any batches are waiting to be replayed. While there are, new batches
+// should be spooled rather than uploaded, so that batches are uploaded in
+// order.
+func (s *UploadSpool) Pending() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.files) > 0
+}
+
+func (s *UploadSpool) Stats() UploadSpoolStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return UploadSpoolStats{
+		Batches:  len(s.files),
+		Bytes:    s.size,
+		Replayed: atomic.LoadUint64(&s.replayed),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+	}
+}
+
+// Stops replaying batches. Batches that haven't been replayed are left on
+// disk for the next run.
+func (s *UploadSpool) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *UploadSpool) replayLoop() {
+	defer s.wg.Done()
+
+	backoff := spoolMinBackoff
+	for {
+		// Wait until there is something to replay.
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+
+		for s.Pending() {
+			err := s.replayOldest()
+			if err == nil {
+				backoff = spoolMinBackoff
+				continue
+			}
+
+			// Wait at least as long as the back end asked, if it is throttling
+			// uploads.
+			wait := backoff
+			if retryAfter, ok := throttledRetryAfter(err); ok && retryAfter > wait {
+				wait = retryAfter
+			}
+			printer.Debugf("Failed to upload spooled witnesses to Postman, retrying in %v: %v\n", wait, err)
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			backoff *= 2
+			if backoff > spoolMaxBackoff {
+				backoff = spoolMaxBackoff
+			}
+		}
+	}
+}
+
+// Uploads the oldest spooled batch, removing it from the spool unless the
+// upload should be retried. Returns an error only if it should be.
+func (s *UploadSpool) replayOldest() error {
+	s.mutex.Lock()
+	s.enforceLimitsLocked(time.Now())
+	if len(s.files) == 0 {
+		s.mutex.Unlock()
+		return nil
+	}
+	oldest := s.files[0]
+	s.mutex.Unlock()
+
+	var batch spooledBatch
+	data, err := os.ReadFile(oldest.path)
+	if err == nil {
+		err = json.Unmarshal(data, &batch)
+	}
+	if err != nil || batch.Request == nil {
+		printer.Warningf("Dropping unreadable batch %s from upload spool: %v\n", oldest.path, err)
+		s.removeIfOldest(oldest)
+		atomic.AddUint64(&s.dropped, 1)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = s.learnClient.AsyncReportsUpload(ctx, batch.LearnSessionID, batch.Request)
+	if rateLimit := s.options.RateLimit; rateLimit != nil {
+		if retryAfter, throttled := throttledRetryAfter(err); throttled {
+			rateLimit.UploadThrottled(retryAfter)
+		} else if err == nil {
+			rateLimit.UploadSucceeded()
+		}
+	}
+	if err != nil && shouldSpool(err) {
+		return err
+	}
+
+	if err != nil {
+		printer.Warningf("Dropping spooled witnesses rejected by Postman: %v\n", err)
+		atomic.AddUint64(&s.dropped, 1)
+	} else {
+		printer.Debugf("Uploaded %d spooled witnesses\n", len(batch.Request.Witnesses))
+		atomic.AddUint64(&s.replayed, 1)
+	}
+	s.removeIfOldest(oldest)
+	return nil
+}
+
+// Removes f from the spool, unless it was already dropped to enforce the
+// spool's limits while it was being replayed.
+func (s *UploadSpool) removeIfOldest(f spooledBatchFile) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.files) > 0 && s.files[0].path == f.path {
+		s.removeOldestLocked()
+	}
+}
+
+// Whether a failed upload was caused by the back end being unreachable.
+func isBackendUnreachable(err error) bool {
+	var httpErr rest.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// If a failed upload was throttled by the back end, returns how long the back
+// end asked us to wait before trying again, which may be zero.
+func throttledRetryAfter(err error) (time.Duration, bool) {
+	var httpErr rest.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+		return httpErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// Whether a batch that failed to upload should be spooled, or kept in the
+// spool, to be uploaded later: either the back end is unreachable or it is
+// throttling uploads. Other failures mean the back end rejected the batch.
+func shouldSpool(err error) bool {
+	_, throttled := throttledRetryAfter(err)
+	return throttled || isBackendUnreachable(err)
+}
@@ -0,0 +1,209 @@
+package trace
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/akitasoftware/akita-cli/rest"
+	mockrest "github.com/akitasoftware/akita-cli/rest/mock"
+	"github.com/akitasoftware/akita-libs/akid"
+	kgxapi "github.com/akitasoftware/akita-libs/api_schema"
+)
+
+// A back end that can be taken down and brought back up.
+type flakyBackend struct {
+	mutex     sync.Mutex
+	reachable bool
+	status    int
+	uploaded  []string
+}
+
+func (b *flakyBackend) setReachable(reachable bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reachable = reachable
+}
+
+func (b *flakyBackend) upload(_ context.Context, lrn akid.LearnSessionID, req *kgxapi.UploadReportsRequest) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.reachable {
+		return errors.New("connection refused")
+	}
+	if b.status != 0 {
+		return rest.HTTPError{StatusCode: b.status}
+	}
+	if lrn != fakeLrn {
+		return errors.Errorf("unexpected learn session %s", akid.String(lrn))
+	}
+	for _, w := range req.Witnesses {
+		b.uploaded = append(b.uploaded, w.WitnessProto)
+	}
+	return nil
+}
+
+func (b *flakyBackend) getUploaded() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.uploaded...)
+}
+
+func newFlakyBackend(t *testing.T) (*flakyBackend, rest.LearnClient) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	backend := &flakyBackend{}
+	mockClient := mockrest.NewMockLearnClient(ctrl)
+	mockClient.EXPECT().
+		AsyncReportsUpload(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(backend.upload).
+		AnyTimes()
+	return backend, mockClient
+}
+
+func shortenSpoolBackoff(t *testing.T) {
+	minBackoff, maxBackoff := spoolMinBackoff, spoolMaxBackoff
+	spoolMinBackoff, spoolMaxBackoff = time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		spoolMinBackoff, spoolMaxBackoff = minBackoff, maxBackoff
+	})
+}
+
+func batchOf(witnesses ...string) *kgxapi.UploadReportsRequest {
+	req := &kgxapi.UploadReportsRequest{}
+	for _, w := range witnesses {
+		req.AddWitnessReport(&kgxapi.WitnessReport{WitnessProto: w})
+	}
+	return req
+}
+
+func TestUploadSpoolReplaysInOrder(t *testing.T) {
+	shortenSpoolBackoff(t)
+	backend, client := newFlakyBackend(t)
+	dir := t.TempDir()
+
+	spool, err := NewUploadSpool(dir, UploadSpoolOptions{}, client)
+	require.NoError(t, err)
+	require.NoError(t, spool.Add(fakeLrn, batchOf("a", "b")))
+	require.NoError(t, spool.Add(fakeLrn, batchOf("c")))
+	assert.True(t, spool.Pending())
+	spool.Close()
+
+	// Batches survive a restart, and are replayed in order once the back end
+	// is reachable.
+	spool, err = NewUploadSpool(dir, UploadSpoolOptions{}, client)
+	require.NoError(t, err)
+	defer spool.Close()
+	require.NoError(t, spool.Add(fakeLrn, batchOf("d")))
+	assert.Equal(t, 3, spool.Stats().Batches)
+
+	backend.setReachable(true)
+	assert.Eventually(t, func() bool { return !spool.Pending() }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, backend.getUploaded())
+	assert.Equal(t, uint64(3), spool.Stats().Replayed)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestUploadSpoolLimits(t *testing.T) {
+	shortenSpoolBackoff(t)
+	backend, client := newFlakyBackend(t)
+	batchSize := func(req *kgxapi.UploadReportsRequest) int64 {
+		dir := t.TempDir()
+		spool, err := NewUploadSpool(dir, UploadSpoolOptions{}, client)
+		require.NoError(t, err)
+		defer spool.Close()
+		require.NoError(t, spool.Add(fakeLrn, req))
+		return spool.Stats().Bytes
+	}(batchOf("x"))
+
+	// Room for two batches: the oldest is dropped to make room for a third.
+	spool, err := NewUploadSpool(t.TempDir(), UploadSpoolOptions{MaxSize_bytes: 2 * batchSize}, client)
+	require.NoError(t, err)
+	defer spool.Close()
+	require.NoError(t, spool.Add(fakeLrn, batchOf("1")))
+	require.NoError(t, spool.Add(fakeLrn, batchOf("2")))
+	require.NoError(t, spool.Add(fakeLrn, batchOf("3")))
+	assert.Error(t, spool.Add(fakeLrn, batchOf(strings.Repeat("x", int(2*batchSize)))))
+
+	stats := spool.Stats()
+	assert.Equal(t, 2, stats.Batches)
+	assert.Equal(t, uint64(2), stats.Dropped)
+
+	// Batches rejected by the back end are dropped rather than retried.
+	backend.mutex.Lock()
+	backend.reachable = true
+	backend.status = 400
+	backend.mutex.Unlock()
+	assert.Eventually(t, func() bool { return !spool.Pending() }, 5*time.Second, time.Millisecond)
+	assert.Empty(t, backend.getUploaded())
+	assert.Equal(t, uint64(4), spool.Stats().Dropped)
+}
+
+func TestUploadSpoolMaxAge(t *testing.T) {
+	_, client := newFlakyBackend(t)
+	dir := t.TempDir()
+
+	spool, err := NewUploadSpool(dir, UploadSpoolOptions{}, client)
+	require.NoError(t, err)
+	require.NoError(t, spool.Add(fakeLrn, batchOf("old")))
+	spool.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	spool, err = NewUploadSpool(dir, UploadSpoolOptions{MaxAge: 5 * time.Millisecond}, client)
+	require.NoError(t, err)
+	defer spool.Close()
+	assert.False(t, spool.Pending())
+	assert.Equal(t, uint64(1), spool.Stats().Dropped)
+}
+
+func TestUploadSpoolThrottled(t *testing.T) {
+	shortenSpoolBackoff(t)
+	backend, client := newFlakyBackend(t)
+	backend.reachable = true
+	backend.status = 429
+
+	rateLimit := NewRateLimit(100.0)
+	defer rateLimit.Stop()
+
+	spool, err := NewUploadSpool(t.TempDir(), UploadSpoolOptions{RateLimit: rateLimit}, client)
+	require.NoError(t, err)
+	defer spool.Close()
+	require.NoError(t, spool.Add(fakeLrn, batchOf("a")))
+
+	// Throttled replays slow down capture, and the batch is kept.
+	assert.Eventually(t, func() bool {
+		return rateLimit.Stats().WitnessesPerMinute < 100
+	}, 5*time.Second, time.Millisecond)
+	assert.True(t, spool.Pending())
+
+	backend.mutex.Lock()
+	backend.status = 0
+	backend.mutex.Unlock()
+	assert.Eventually(t, func() bool { return !spool.Pending() }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"a"}, backend.getUploaded())
+}
+
+func TestShouldSpool(t *testing.T) {
+	assert.True(t, shouldSpool(errors.New("connection refused")))
+	assert.True(t, shouldSpool(errors.Wrap(rest.HTTPError{StatusCode: 503}, "upload")))
+	assert.True(t, shouldSpool(errors.Wrap(rest.HTTPError{StatusCode: 429}, "upload")))
+	assert.False(t, shouldSpool(rest.HTTPError{StatusCode: 400}))
+
+	retryAfter, throttled := throttledRetryAfter(rest.HTTPError{StatusCode: 429, RetryAfter: time.Minute})
+	assert.True(t, throttled)
+	assert.Equal(t, time.Minute, retryAfter)
+	_, throttled = throttledRetryAfter(rest.HTTPError{StatusCode: 503})
+	assert.False(t, throttled)
+}
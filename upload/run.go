@@ -135,6 +135,11 @@ func uploadTraces(learnClient rest.LearnClient, args Args, serviceID akid.Servic
 		optionals.Some(apispec.DefaultMaxWitnessSize_bytes),
 		inboundCount,
 		args.Plugins,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 	defer inboundCollector.Close()
 